@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/disgoorg/snowflake/v2"
+)
+
+// An auditEntry is a role change the bot made or tried to make.
+type auditEntry struct {
+	Time    time.Time    `json:"time"`
+	GuildID snowflake.ID `json:"guild_id"`
+	UserID  snowflake.ID `json:"user_id"`
+	RoleID  snowflake.ID `json:"role_id"`
+	Role    string       `json:"role"` // The name it had then.
+	Add     bool         `json:"add"`
+	Trigger string       `json:"trigger"` // Of the sync, like triggerEvent.
+	Run     string       `json:"run"`
+	Error   string       `json:"error,omitempty"` // Empty if it was made.
+}
+
+// triggerCommand is the trigger of the role changes members ask for with a
+// command, like /calls notify.
+const triggerCommand = "command"
+
+// maxAuditRetention is the longest DISCORD_AUDIT_RETENTION, which bounds
+// the file /voice why reads.
+const maxAuditRetention = 90 * 24 * time.Hour
+
+// auditPruneInterval is the least time between dropping expired entries.
+const auditPruneInterval = time.Hour
+
+// auditTrail appends role changes to a JSONL file, dropping those older than
+// its retention. A nil trail records nothing.
+type auditTrail struct {
+	clock     clock
+	path      string
+	retention time.Duration
+
+	mu     sync.Mutex
+	f      *os.File
+	pruned time.Time
+}
+
+func newAuditTrail(
+	c clock, path string, retention time.Duration,
+) (*auditTrail, error) {
+	t := &auditTrail{clock: c, path: path, retention: retention}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.pruneLocked(c.Now()); err != nil {
+		if t.f != nil {
+			t.f.Close()
+		}
+		return nil, err
+	}
+	return t, nil
+}
+
+// record appends e, timestamped now.
+func (t *auditTrail) record(e auditEntry) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.clock.Now()
+	e.Time = now.UTC()
+	if now.Sub(t.pruned) >= auditPruneInterval {
+		if err := t.pruneLocked(now); err != nil {
+			slog.Error("failed to prune audit trail", "error", err)
+		}
+	}
+	if t.f == nil {
+		return
+	}
+	if err := json.NewEncoder(t.f).Encode(e); err != nil {
+		slog.Error("failed to record role change", "error", err)
+	}
+}
+
+// pruneLocked rewrites the file without entries expired by now and reopens
+// it. The file is reopened even if that fails, so that entries are still
+// appended.
+func (t *auditTrail) pruneLocked(now time.Time) error {
+	t.pruned = now
+	err := t.dropExpired(now)
+	f, oerr := os.OpenFile(t.path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0o600)
+	if oerr == nil {
+		oerr = endLine(f)
+		if oerr != nil {
+			f.Close()
+		}
+	}
+	if oerr != nil {
+		return errors.Join(err,
+			fmt.Errorf("could not open audit trail: %w", oerr))
+	}
+	if t.f != nil {
+		t.f.Close()
+	}
+	t.f = f
+	return err
+}
+
+// dropExpired rewrites the file without the entries older than the
+// retention.
+func (t *auditTrail) dropExpired(now time.Time) error {
+	all, err := loadAudit(t.path)
+	if err != nil {
+		return err
+	}
+	cutoff := now.Add(-t.retention)
+	kept := all[:0]
+	for _, e := range all {
+		if e.Time.After(cutoff) {
+			kept = append(kept, e)
+		}
+	}
+	if len(kept) == len(all) {
+		return nil
+	}
+	return saveAudit(t.path, kept)
+}
+
+// appendAudit appends e, timestamped now, to the audit trail at path. It is
+// for processes that record too little to keep an auditTrail open, like the
+// interactions endpoint.
+func appendAudit(c clock, path string, e auditEntry) error {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return fmt.Errorf("could not open audit trail: %w", err)
+	}
+	e.Time = c.Now().UTC()
+	err = endLine(f)
+	if err == nil {
+		err = json.NewEncoder(f).Encode(e)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("could not record role change: %w", err)
+	}
+	return nil
+}
+
+// endLine ends a partial last line in f, so that what is appended next
+// starts on its own line.
+func endLine(f *os.File) error {
+	fi, err := f.Stat()
+	if err != nil || fi.Size() == 0 {
+		return err
+	}
+	last := make([]byte, 1)
+	if _, err := f.ReadAt(last, fi.Size()-1); err != nil {
+		return err
+	}
+	if last[0] == '\n' {
+		return nil
+	}
+	_, err = f.Write([]byte{'\n'})
+	return err
+}
+
+func (t *auditTrail) close() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.f == nil {
+		return
+	}
+	if err := t.f.Close(); err != nil {
+		slog.Error("failed to close audit trail", "error", err)
+	}
+	t.f = nil
+}
+
+// loadAudit reads the entries of the audit trail at path, oldest first.
+func loadAudit(path string) ([]auditEntry, error) {
+	var entries []auditEntry
+	err := scanAudit(path, func(e auditEntry) {
+		entries = append(entries, e)
+	})
+	return entries, err
+}
+
+// scanAudit calls fn with each entry of the audit trail at path, oldest
+// first. A missing file holds none. Lines that don't decode are logged and
+// skipped: a crash mid-append leaves a partial line, which may be followed by
+// more entries.
+func scanAudit(path string, fn func(auditEntry)) error {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("could not read audit trail: %w", err)
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		var e auditEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			slog.Warn("skipping bad audit trail line",
+				"path", path, "line", line, "error", err)
+			continue
+		}
+		fn(e)
+	}
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("could not read audit trail: %w", err)
+	}
+	return nil
+}
+
+func saveAudit(path string, entries []auditEntry) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".audit-*")
+	if err != nil {
+		return fmt.Errorf("could not save audit trail: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, e := range entries {
+		if err = enc.Encode(e); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("could not save audit trail: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("could not save audit trail: %w", err)
+	}
+	return nil
+}
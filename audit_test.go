@@ -0,0 +1,335 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/disgoorg/snowflake/v2"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestAuditTrailRetention(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	clk := &fakeClock{now: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}
+	trail, err := newAuditTrail(clk, path, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trail.record(auditEntry{GuildID: 1, UserID: 10, RoleID: 2, Add: true})
+	clk.now = clk.now.Add(12 * time.Hour)
+	trail.record(auditEntry{GuildID: 1, UserID: 10, RoleID: 2, Error: "403"})
+	clk.now = clk.now.Add(13 * time.Hour)
+	trail.record(auditEntry{GuildID: 1, UserID: 11, RoleID: 2, Add: true})
+	trail.close()
+
+	got, err := loadAudit(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	want := []auditEntry{{
+		Time:    start.Add(12 * time.Hour),
+		GuildID: 1, UserID: 10, RoleID: 2, Error: "403",
+	}, {
+		Time:    start.Add(25 * time.Hour),
+		GuildID: 1, UserID: 11, RoleID: 2, Add: true,
+	}}
+	if !cmp.Equal(got, want) {
+		t.Errorf("audit trail -want +got\n%s", cmp.Diff(want, got))
+	}
+}
+
+func TestAuditTrailPartialLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	// A crash cut the second entry short, and a restart appended a third.
+	lines := []string{
+		`{"time":"2025-01-01T00:00:00Z","guild_id":"1","user_id":"10"}`,
+		`{"time":"2025-01-01T00:01:00Z","gui`,
+		`{"time":"2025-01-01T00:02:00Z","guild_id":"1","user_id":"11"}`,
+		`{"time":"2025-01-01T00:03:00Z","guild_id":"1","us`,
+	}
+	err := os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clk := &fakeClock{now: time.Date(2025, 1, 1, 0, 4, 0, 0, time.UTC)}
+	trail, err := newAuditTrail(clk, path, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trail.record(auditEntry{GuildID: 1, UserID: 12})
+	trail.close()
+
+	got, err := loadAudit(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	want := []auditEntry{
+		{Time: start, GuildID: 1, UserID: 10},
+		{Time: start.Add(2 * time.Minute), GuildID: 1, UserID: 11},
+		{Time: start.Add(4 * time.Minute), GuildID: 1, UserID: 12},
+	}
+	if !cmp.Equal(got, want) {
+		t.Errorf("audit trail -want +got\n%s", cmp.Diff(want, got))
+	}
+}
+
+func TestAuditTrailPruneFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	clk := &fakeClock{now: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}
+	trail, err := newAuditTrail(clk, path, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer trail.close()
+	// A line too long to read makes the next prune fail.
+	long := strings.Repeat("x", 1<<20) + "\n"
+	if err := os.WriteFile(path, []byte(long), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	clk.now = clk.now.Add(auditPruneInterval)
+	trail.record(auditEntry{GuildID: 1, UserID: 10})
+	trail.record(auditEntry{GuildID: 1, UserID: 11})
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []auditEntry
+	for line := range strings.Lines(strings.TrimPrefix(string(data), long)) {
+		var e auditEntry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("%v: %q", err, line)
+		}
+		got = append(got, e)
+	}
+	want := []auditEntry{
+		{Time: clk.now, GuildID: 1, UserID: 10},
+		{Time: clk.now, GuildID: 1, UserID: 11},
+	}
+	if !cmp.Equal(got, want) {
+		t.Errorf("appended -want +got\n%s", cmp.Diff(want, got))
+	}
+}
+
+func TestAuditTrailNil(t *testing.T) {
+	var trail *auditTrail
+	trail.record(auditEntry{GuildID: 1})
+	trail.close()
+}
+
+func TestVoiceSyncAudit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	clk := &fakeClock{now: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}
+	trail, err := newAuditTrail(clk, path, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	run := newSyncRun(testRun.log, 0, triggerEvent)
+	f := newFakeVoice(set[snowflake.ID]{11: {}}, set[snowflake.ID]{10: {}})
+	s := f.voiceSync(nil)
+	s.audit = trail
+	if err := s.syncGuild(t.Context(), run, 0); err != nil {
+		t.Fatal(err)
+	}
+	f = newFakeVoice(nil, set[snowflake.ID]{12: {}})
+	f.toggleErr = errors.New("boom")
+	s = f.voiceSync(nil)
+	s.audit = trail
+	if err := s.syncGuild(t.Context(), run, 0); err == nil {
+		t.Fatal("syncGuild() succeeded, want error")
+	}
+	trail.close()
+
+	got, err := loadAudit(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := auditEntry{
+		Time:    clk.now,
+		RoleID:  1,
+		Role:    voiceRole,
+		Trigger: triggerEvent,
+		Run:     run.id,
+	}
+	want := []auditEntry{entry, entry, entry}
+	want[0].UserID = 11
+	want[1].UserID, want[1].Add = 10, true
+	want[2].UserID, want[2].Add, want[2].Error = 12, true, "boom"
+	if !cmp.Equal(got, want) {
+		t.Errorf("audit trail -want +got\n%s", cmp.Diff(want, got))
+	}
+}
+
+func TestInteractionsVoiceWhy(t *testing.T) {
+	const slash = `{"id":"1","application_id":"1000","type":2,"token":"t",` +
+		`"version":1,"guild_id":"1","channel_id":"3",` +
+		`"member":{"user":{"id":"20","username":"mod"},"roles":[],` +
+		`"permissions":"268435456"},` +
+		`"data":{"id":"52","name":"voice","type":1,` +
+		`"options":[{"name":"why","type":1,"options":[` +
+		`{"name":"user","type":6,"value":"10"},` +
+		`{"name":"role","type":8,"value":"2"}]}],` +
+		`"resolved":{` +
+		`"users":{"10":{"id":"10","username":"alice"}},` +
+		`"members":{"10":{"roles":["2"]}},` +
+		`"roles":{"2":{"id":"2","name":"voice"}}}}}`
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	var entries []auditEntry
+	for i := range 7 {
+		entries = append(entries, auditEntry{
+			Time:    time.Unix(int64(i), 0),
+			GuildID: 1, UserID: 10, RoleID: 2,
+			Add: i%2 == 0, Trigger: triggerEvent,
+		})
+	}
+	entries = append(entries,
+		auditEntry{Time: time.Unix(10, 0), GuildID: 1, UserID: 11, RoleID: 2},
+		auditEntry{Time: time.Unix(11, 0), GuildID: 4, UserID: 10, RoleID: 2},
+	)
+	if err := saveAudit(path, entries); err != nil {
+		t.Fatal(err)
+	}
+	f := newFakeDiscord(t, 1)
+	url, key := testInteractions(t, f,
+		map[string]string{"DISCORD_AUDIT_FILE": path})
+
+	status, body := postInteraction(t, url, key, slash)
+	if status != http.StatusOK {
+		t.Fatalf("status %d: %s", status, body)
+	}
+	var resp struct {
+		Data struct {
+			Content string `json:"content"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal([]byte(body), &resp); err != nil {
+		t.Fatalf("%v: %s", err, body)
+	}
+	want := "<@10> has <@&2>. Latest changes by the bot:\n" +
+		"- <t:6:R> added (event sync)\n" +
+		"- <t:5:R> removed (event sync)\n" +
+		"- <t:4:R> added (event sync)\n" +
+		"- <t:3:R> removed (event sync)\n" +
+		"- <t:2:R> added (event sync)"
+	if resp.Data.Content != want {
+		t.Errorf("content %q, want %q", resp.Data.Content, want)
+	}
+}
+
+type formatWhyTest struct {
+	desc    string
+	has     bool
+	entries []auditEntry
+	want    string
+}
+
+var formatWhyTests = []formatWhyTest{{
+	desc: "no changes",
+	want: "<@10> does not have <@&2>. " +
+		"The bot has no changes to it on record.",
+}, {
+	desc: "newest first",
+	has:  true,
+	entries: []auditEntry{
+		{Time: time.Unix(100, 0), Add: true, Trigger: triggerEvent},
+		{Time: time.Unix(200, 0), Trigger: triggerGrace, Error: "403"},
+		{Time: time.Unix(300, 0), Add: true, Trigger: triggerManual},
+	},
+	want: "<@10> has <@&2>. Latest changes by the bot:\n" +
+		"- <t:300:R> added (manual sync)\n" +
+		"- <t:200:R> removed (grace sync), failed: 403\n" +
+		"- <t:100:R> added (event sync)",
+}, {
+	desc: "command",
+	has:  true,
+	entries: []auditEntry{
+		{Time: time.Unix(100, 0), Add: true, Trigger: triggerCommand},
+	},
+	want: "<@10> has <@&2>. Latest changes by the bot:\n" +
+		"- <t:100:R> added (their own command)",
+}, {
+	desc: "limited",
+	entries: []auditEntry{
+		{Time: time.Unix(1, 0), Trigger: triggerTicker},
+		{Time: time.Unix(2, 0), Trigger: triggerTicker},
+		{Time: time.Unix(3, 0), Trigger: triggerTicker},
+		{Time: time.Unix(4, 0), Trigger: triggerTicker},
+		{Time: time.Unix(5, 0), Trigger: triggerTicker},
+		{Time: time.Unix(6, 0), Trigger: triggerTicker},
+	},
+	want: "<@10> does not have <@&2>. Latest changes by the bot:\n" +
+		"- <t:6:R> removed (ticker sync)\n" +
+		"- <t:5:R> removed (ticker sync)\n" +
+		"- <t:4:R> removed (ticker sync)\n" +
+		"- <t:3:R> removed (ticker sync)\n" +
+		"- <t:2:R> removed (ticker sync)",
+}}
+
+func TestFormatWhy(t *testing.T) {
+	for _, tt := range formatWhyTests {
+		t.Run(tt.desc, func(t *testing.T) {
+			got := formatWhy(10, 2, tt.has, tt.entries)
+			if got != tt.want {
+				t.Errorf("formatWhy() -want +got\n%s",
+					cmp.Diff(tt.want, got))
+			}
+		})
+	}
+}
+
+func TestCLIAuditExport(t *testing.T) {
+	const (
+		guildID   snowflake.ID = 1
+		roleID    snowflake.ID = 2
+		channelID snowflake.ID = 3
+		alice     snowflake.ID = 10 // Holds the voice role, not in a call.
+	)
+	f := newFakeDiscord(t, guildID)
+	f.addVoiceChannel(channelID, "General")
+	f.addRole(roleID, voiceRole)
+	f.addMember(alice, "alice", roleID)
+	env := map[string]string{
+		"DISCORD_AUDIT_FILE": filepath.Join(t.TempDir(), "audit.jsonl"),
+	}
+
+	c, _ := testCLI(f, env)
+	if err := c.run(t.Context(), []string{"sync", "-guild", "1"}); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	c, out := testCLI(nil, env)
+	err := c.run(t.Context(), []string{"audit", "export", "-guild", "1"})
+	if err != nil {
+		t.Fatalf("audit export: %v", err)
+	}
+	rows, err := csv.NewReader(out).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range rows[1:] {
+		row[0], row[7] = "", "" // The time and run ID vary.
+	}
+	want := [][]string{
+		{"time", "guild_id", "user_id", "role_id", "role",
+			"action", "trigger", "run", "outcome"},
+		{"", "1", "10", "2", "voice", "remove", "manual", "", "ok"},
+	}
+	if !cmp.Equal(rows, want) {
+		t.Errorf("audit export -want +got\n%s", cmp.Diff(want, rows))
+	}
+
+	c, _ = testCLI(nil, nil)
+	err = c.run(t.Context(), []string{"audit", "export"})
+	if want := "DISCORD_AUDIT_FILE is not set"; err == nil ||
+		err.Error() != want {
+		t.Errorf("audit export = %v, want %q", err, want)
+	}
+}
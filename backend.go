@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	disgobot "github.com/disgoorg/disgo/bot"
+	"github.com/disgoorg/disgo/discord"
+	"github.com/disgoorg/disgo/rest"
+	"github.com/disgoorg/snowflake/v2"
+)
+
+// discordBackend serves voiceSync from the Discord API and the gateway cache.
+type discordBackend struct{ bot disgobot.Client }
+
+func (d discordBackend) FindRole(
+	gid snowflake.ID, name string,
+) (discord.Role, error) {
+	roles, err := d.GuildRoles(gid)
+	if err != nil {
+		return discord.Role{}, err
+	}
+	return roleNamed(roles, name)
+}
+
+func (d discordBackend) GuildRoles(gid snowflake.ID) ([]discord.Role, error) {
+	roles, err := d.bot.Rest().GetRoles(gid)
+	if err != nil {
+		return nil, fmt.Errorf("could not get roles: %w", err)
+	}
+	return roles, nil
+}
+
+func (d discordBackend) SetMemberRole(
+	ctx context.Context, gid, uid, rid snowflake.ID, enable bool,
+) error {
+	if enable {
+		return d.bot.Rest().AddMemberRole(gid, uid, rid, rest.WithCtx(ctx))
+	}
+	return d.bot.Rest().RemoveMemberRole(gid, uid, rid, rest.WithCtx(ctx))
+}
+
+// RequestMembers requests every member of gid through the gateway, for
+// listeners and middleware to see. It returns once all chunks have arrived.
+func (d discordBackend) RequestMembers(
+	ctx context.Context, gid snowflake.ID,
+) error {
+	chunkCtx, cancel := context.WithTimeout(
+		ctx, 30*time.Second,
+	)
+	defer cancel()
+	// Nothing is collected here: a large guild would double its memory.
+	_, err := d.bot.MemberChunkingManager().RequestMembersWithFilterCtx(
+		chunkCtx, gid,
+		func(discord.Member) bool { return false },
+	)
+	if err != nil {
+		return fmt.Errorf("could not request members: %w", err)
+	}
+	return nil
+}
+
+func (d discordBackend) CallMembers(
+	gid snowflake.ID, match func(callState) bool,
+) set[snowflake.ID] {
+	s := newSet[snowflake.ID]()
+	d.bot.Caches().ChannelsForEach(func(channel discord.GuildChannel) {
+		if channel.GuildID() != gid {
+			return
+		}
+		ac, ok := channel.(discord.GuildAudioChannel)
+		if !ok {
+			return
+		}
+		_, stage := ac.(discord.GuildStageVoiceChannel)
+		for _, m := range d.bot.Caches().AudioChannelMembers(ac) {
+			if match != nil {
+				vs, _ := d.bot.Caches().VoiceState(gid, m.User.ID)
+				if !match(callState{vs, stage}) {
+					continue
+				}
+			}
+			s.Add(m.User.ID)
+		}
+	})
+	return s
+}
+
+func (d discordBackend) MemberVoiceState(
+	gid, uid snowflake.ID, match func(callState) bool, role discord.Role,
+) (inCall, hasRole, ok bool) {
+	member, ok := d.bot.Caches().Member(gid, uid)
+	if !ok {
+		return false, false, false
+	}
+	hasRole = slices.Contains(member.RoleIDs, role.ID)
+	vs, inCall := d.bot.Caches().VoiceState(gid, uid)
+	if !inCall || vs.ChannelID == nil {
+		return false, hasRole, true
+	}
+	if match == nil {
+		return true, hasRole, true
+	}
+	ch, _ := d.bot.Caches().Channel(*vs.ChannelID)
+	_, stage := ch.(discord.GuildStageVoiceChannel)
+	return match(callState{vs, stage}), hasRole, true
+}
+
+func (d discordBackend) MemberName(gid, uid snowflake.ID) string {
+	if m, ok := d.bot.Caches().Member(gid, uid); ok {
+		return m.User.Username
+	}
+	return "<unknown>"
+}
+
+// RoleMembers returns the cached members of gid holding role. It stands in
+// for a roleIndex without the server members intent, when the cache only
+// has the members the bot has seen in a call.
+func (d discordBackend) RoleMembers(
+	_ context.Context, gid snowflake.ID, role discord.Role,
+) (set[snowflake.ID], error) {
+	s := newSet[snowflake.ID]()
+	d.bot.Caches().MembersForEach(gid, func(m discord.Member) {
+		if slices.Contains(m.RoleIDs, role.ID) {
+			s.Add(m.User.ID)
+		}
+	})
+	return s, nil
+}
+
+// cacheMutator records the role changes it makes in the member cache, for
+// when Discord sends no GUILD_MEMBER_UPDATE to do so.
+type cacheMutator struct{ discordBackend }
+
+func (c cacheMutator) SetMemberRole(
+	ctx context.Context, gid, uid, rid snowflake.ID, enable bool,
+) error {
+	err := c.discordBackend.SetMemberRole(ctx, gid, uid, rid, enable)
+	if err != nil {
+		return err
+	}
+	m, ok := c.bot.Caches().Member(gid, uid)
+	if !ok {
+		return nil
+	}
+	m.RoleIDs = slices.DeleteFunc(slices.Clone(m.RoleIDs),
+		func(id snowflake.ID) bool { return id == rid })
+	if enable {
+		m.RoleIDs = append(m.RoleIDs, rid)
+	}
+	c.bot.Caches().AddMember(m)
+	return nil
+}
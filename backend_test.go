@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/disgoorg/disgo/cache"
+	"github.com/disgoorg/disgo/discord"
+	"github.com/disgoorg/snowflake/v2"
+	"github.com/google/go-cmp/cmp"
+)
+
+type findRolesTest struct {
+	desc        string
+	roleName    string
+	roles       []discord.Role
+	getRolesErr error
+	guildID     snowflake.ID
+	wantErr     error
+	wantRole    discord.Role
+}
+
+var findRolesTests = []findRolesTest{{
+	desc:        "GetRoles() error",
+	roleName:    "voice",
+	roles:       nil,
+	getRolesErr: errors.New("boom"),
+	guildID:     42,
+	wantErr:     errors.New("could not get roles: boom"),
+	wantRole:    discord.Role{},
+}, {
+	desc:        "no roles",
+	roleName:    "voice",
+	roles:       []discord.Role{},
+	getRolesErr: nil,
+	guildID:     42,
+	wantErr:     errors.New(`could not find role "voice"`),
+	wantRole:    discord.Role{},
+}, {
+	desc:        "role not found",
+	roleName:    "voice",
+	roles:       []discord.Role{{Name: "notvoice"}, {}},
+	getRolesErr: nil,
+	guildID:     42,
+	wantErr:     errors.New(`could not find role "voice"`),
+	wantRole:    discord.Role{},
+}, {
+	desc:        "role found",
+	roleName:    "voice",
+	roles:       []discord.Role{{Name: "notvoice"}, {Name: "voice"}},
+	getRolesErr: nil,
+	guildID:     42,
+	wantErr:     nil,
+	wantRole:    discord.Role{Name: "voice"},
+}}
+
+func TestDiscordBackendFindRole(t *testing.T) {
+	for _, tt := range findRolesTests {
+		t.Run(tt.desc, func(t *testing.T) {
+			c := mockClient(t)
+			c.Rest().(*clientRest)._GetRoles_Return(tt.roles, tt.getRolesErr)
+
+			role, err := discordBackend{c}.FindRole(tt.guildID, tt.roleName)
+
+			gotErr, wantErr := fmt.Sprintf("%v", err),
+				fmt.Sprintf("%v", tt.wantErr)
+			if gotErr != wantErr {
+				t.Errorf("%s(%T, %v, %v): %v, want %v",
+					funcname(t, discordBackend.FindRole), c, tt.guildID, tt.roleName,
+					err, tt.wantErr)
+				return
+			}
+			if got, want := role, tt.wantRole; !cmp.Equal(got, want) {
+				t.Errorf("%s(%T, %v, %v) -want +got\n%s",
+					funcname(t, discordBackend.FindRole), c, tt.guildID, tt.roleName,
+					cmp.Diff(want, got),
+				)
+			}
+		})
+	}
+}
+
+var benchGuildSizes = flag.String("guildsizes", "1000,10000,100000",
+	"comma-separated member counts of benchmark guilds")
+
+// guildSizes parses -guildsizes.
+func guildSizes(b *testing.B) []int {
+	b.Helper()
+	var sizes []int
+	for s := range strings.SplitSeq(*benchGuildSizes, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || n < 1 {
+			b.Fatalf("bad -guildsizes: %q", *benchGuildSizes)
+		}
+		sizes = append(sizes, n)
+	}
+	return sizes
+}
+
+const (
+	benchGuildID    snowflake.ID = 1
+	benchRoleID     snowflake.ID = 2
+	benchChannelID  snowflake.ID = 100 // First of benchChannels.
+	benchChannels                = 20
+	benchCallEveryN              = 100 // One member in this many is in a call.
+)
+
+// benchMember returns a member of the benchmark guild. Members in a call
+// already hold the voice role, so that syncs are steady-state.
+func benchMember(i int) (m discord.Member, channel *snowflake.ID) {
+	uid := snowflake.ID(10_000 + i)
+	m = discord.Member{
+		GuildID: benchGuildID,
+		User:    discord.User{ID: uid, Username: "member" + uid.String()},
+	}
+	if i%benchCallEveryN == 0 {
+		m.RoleIDs = []snowflake.ID{benchRoleID}
+		channel = ptr(benchChannelID + snowflake.ID(i%benchChannels))
+	}
+	return m, channel
+}
+
+func benchFakeDiscord(b *testing.B, members int) *fakeDiscord {
+	b.Helper()
+	f := newFakeDiscord(b, benchGuildID)
+	for i := range benchChannels {
+		f.addVoiceChannel(benchChannelID+snowflake.ID(i), "voice")
+	}
+	f.addRole(benchRoleID, voiceRole)
+	for i := range members {
+		m, channel := benchMember(i)
+		f.addMember(m.User.ID, m.User.Username, m.RoleIDs...)
+		if channel != nil {
+			f.setVoice(m.User.ID, channel)
+		}
+	}
+	return f
+}
+
+func quietLogs(b *testing.B) {
+	b.Helper()
+	orig := slog.Default()
+	b.Cleanup(func() { slog.SetDefault(orig) })
+	slog.SetDefault(slog.New(slog.DiscardHandler))
+}
+
+// BenchmarkSyncGuild measures a full sync of a guild served by fakeDiscord.
+// Role holders come either from the role index, as in production, or from a
+// member request on every sync; members are either all cached or only those
+// in voice. Besides time and allocations per sync it reports REST calls and
+// member requests per sync, the members left in the cache and the live heap.
+func BenchmarkSyncGuild(b *testing.B) {
+	quietLogs(b)
+	for _, n := range guildSizes(b) {
+		for _, holders := range []string{"index", "chunk"} {
+			for _, members := range []string{"all", "voice"} {
+				name := fmt.Sprintf("members=%d/holders=%s/cache=%s",
+					n, holders, members)
+				b.Run(name, func(b *testing.B) {
+					benchSyncGuild(b, n, holders == "chunk", members == "voice")
+				})
+			}
+		}
+	}
+}
+
+func benchSyncGuild(b *testing.B, members int, rechunk, lean bool) {
+	f := benchFakeDiscord(b, members)
+	var l *leanMemberCache
+	if lean {
+		l = &leanMemberCache{roles: []string{voiceRole}}
+	}
+	index := newRoleIndex(systemClock{}, 0)
+	backend := discordBackend{f.connect(l, index.middleware())}
+	var requests int
+	index.request = func(ctx context.Context, gid snowflake.ID) error {
+		requests++
+		return backend.RequestMembers(ctx, gid)
+	}
+	s := &voiceSync{
+		role:    voiceCallRole,
+		roles:   backend,
+		mutator: backend,
+		holders: index,
+		members: backend,
+		clock:   systemClock{},
+	}
+	f.requests.Store(0)
+	b.ReportAllocs()
+	for b.Loop() {
+		if rechunk {
+			index.invalidate(benchGuildID)
+		}
+		err := s.syncGuild(b.Context(), testRun, benchGuildID)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(f.requests.Load())/float64(b.N), "rest-calls/op")
+	b.ReportMetric(float64(requests)/float64(b.N), "member-requests/op")
+	b.ReportMetric(float64(
+		backend.bot.Caches().MembersLen(benchGuildID),
+	), "cached-members")
+	runtime.GC()
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	b.ReportMetric(float64(ms.HeapAlloc)/(1<<20), "heap-MiB")
+}
+
+// BenchmarkCallMembers measures the scan of cached voice channels and voice
+// states behind every sync.
+func BenchmarkCallMembers(b *testing.B) {
+	for _, n := range guildSizes(b) {
+		b.Run(fmt.Sprintf("members=%d", n), func(b *testing.B) {
+			caches := cache.New(cache.WithCaches(cache.FlagChannels |
+				cache.FlagMembers | cache.FlagVoiceStates))
+			for i := range benchChannels {
+				var ch discord.UnmarshalChannel
+				err := json.Unmarshal(fmt.Appendf(nil,
+					`{"id":"%d","type":%d,"guild_id":"%d"}`,
+					benchChannelID+snowflake.ID(i),
+					discord.ChannelTypeGuildVoice, benchGuildID,
+				), &ch)
+				if err != nil {
+					b.Fatal(err)
+				}
+				caches.AddChannel(ch.Channel.(discord.GuildChannel))
+			}
+			for i := range n {
+				m, channel := benchMember(i)
+				caches.AddMember(m)
+				if channel != nil {
+					caches.AddVoiceState(discord.VoiceState{
+						GuildID:   benchGuildID,
+						UserID:    m.User.ID,
+						ChannelID: channel,
+					})
+				}
+			}
+			c := mockClient(nil)
+			c._Caches_Return(caches)
+			backend := discordBackend{c}
+			want := (n + benchCallEveryN - 1) / benchCallEveryN
+			b.ReportAllocs()
+			for b.Loop() {
+				if got := len(backend.CallMembers(benchGuildID, nil)); got != want {
+					b.Fatalf("CallMembers() = %d members, want %d", got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	disgobot "github.com/disgoorg/disgo/bot"
+	"github.com/disgoorg/disgo/discord"
+	"github.com/disgoorg/disgo/gateway"
+	"github.com/disgoorg/snowflake/v2"
+)
+
+// callsRole is the role members take to be pinged when a call starts.
+const callsRole = "calls"
+
+// callAnnouncer posts about calls.
+type callAnnouncer interface {
+	// AnnounceCall says that a call started in channel cid. It returns the
+	// ID of the message, or zero if there is nowhere to post in gid.
+	AnnounceCall(gid, cid snowflake.ID, start time.Time) (snowflake.ID, error)
+	// AnnounceCallEnded edits message mid to say that the call ended.
+	AnnounceCallEnded(gid, cid, mid snowflake.ID, d time.Duration) error
+}
+
+// callNotifier announces calls in voice channels. A call starts when someone
+// joins an empty channel and ends when the last member leaves.
+//
+// A call is announced once it has lasted minDuration, so short calls are not
+// announced at all, and the announcement is edited to say how long the call
+// took when it ends. A channel is not announced again until cooldown has
+// passed since its last announced call ended. Calls already in progress when
+// the bot connects are not announced.
+//
+// The notifier is fed by gateway middleware, so that it sees voice states in
+// gateway order even with async listeners. Discord is only called from
+// timers, so that the gateway never waits on it.
+type callNotifier struct {
+	clock       clock
+	minDuration time.Duration
+	cooldown    time.Duration
+
+	// Set before the gateway opens. Without an announcer, calls are tracked
+	// but never announced.
+	announcer callAnnouncer
+	enabled   func(gid snowflake.ID) bool
+	leading   func() bool
+	log       *slog.Logger
+
+	mu       sync.Mutex
+	channels map[guildMember]snowflake.ID // The channel each member is in.
+	calls    map[snowflake.ID]*call       // By channel.
+	quiet    map[snowflake.ID]time.Time   // When cooldowns end, by channel.
+	stopped  bool
+	inflight sync.WaitGroup
+}
+
+type call struct {
+	guildID, channelID snowflake.ID
+	start, end         time.Time
+	members            int
+	timer              stopper      // Until the call is announced.
+	message            snowflake.ID // Zero until announced.
+}
+
+func newCallNotifier(
+	c clock, minDuration, cooldown time.Duration,
+) *callNotifier {
+	return &callNotifier{
+		clock:       c,
+		minDuration: minDuration,
+		cooldown:    cooldown,
+		enabled:     func(snowflake.ID) bool { return true },
+		leading:     func() bool { return true },
+		log:         slog.Default(),
+		channels:    make(map[guildMember]snowflake.ID),
+		calls:       make(map[snowflake.ID]*call),
+		quiet:       make(map[snowflake.ID]time.Time),
+	}
+}
+
+func (n *callNotifier) middleware() gatewayMiddleware {
+	return func(
+		_ disgobot.Client, next gateway.EventHandlerFunc,
+	) gateway.EventHandlerFunc {
+		return func(
+			t gateway.EventType, seq int, shardID int, e gateway.EventData,
+		) {
+			n.handle(e)
+			next(t, seq, shardID, e)
+		}
+	}
+}
+
+func (n *callNotifier) handle(e gateway.EventData) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	switch e := e.(type) {
+	case gateway.EventGuildCreate:
+		n.resetLocked(e.ID, e.VoiceStates)
+	case gateway.EventGuildDelete:
+		if !e.Unavailable {
+			n.resetLocked(e.ID, nil)
+		}
+	case gateway.EventVoiceStateUpdate:
+		n.moveLocked(guildMember{e.GuildID, e.UserID}, e.ChannelID, true)
+	}
+}
+
+// resetLocked replaces what is known about the calls in gid with states,
+// as after a reconnect. Calls that ended in the meantime end now, and calls
+// that started are not announced.
+func (n *callNotifier) resetLocked(
+	gid snowflake.ID, states []discord.VoiceState,
+) {
+	for k := range n.channels {
+		if k.guildID == gid {
+			n.moveLocked(k, nil, false)
+		}
+	}
+	for _, vs := range states {
+		n.moveLocked(guildMember{gid, vs.UserID}, vs.ChannelID, false)
+	}
+	for _, c := range n.calls {
+		if c.guildID == gid && c.members == 0 {
+			n.endLocked(c)
+		}
+	}
+}
+
+// moveLocked records that a member is now in channel to, or in no channel
+// if to is nil. If live is false, calls are left open when they empty and
+// new calls are not announced.
+func (n *callNotifier) moveLocked(
+	k guildMember, to *snowflake.ID, live bool,
+) {
+	if from, ok := n.channels[k]; ok {
+		if to != nil && *to == from {
+			return
+		}
+		delete(n.channels, k)
+		if c := n.calls[from]; c != nil {
+			c.members--
+			if c.members == 0 && live {
+				n.endLocked(c)
+			}
+		}
+	}
+	if to == nil {
+		return
+	}
+	n.channels[k] = *to
+	if c := n.calls[*to]; c != nil {
+		c.members++
+		return
+	}
+	c := &call{
+		guildID:   k.guildID,
+		channelID: *to,
+		start:     n.clock.Now(),
+		members:   1,
+	}
+	n.calls[*to] = c
+	if live && n.announcer != nil && n.enabled(k.guildID) &&
+		!n.clock.Now().Before(n.quiet[*to]) {
+		c.timer = n.clock.AfterFunc(n.minDuration, func() { n.announce(c) })
+	}
+}
+
+// endLocked ends c, editing its announcement if it has one.
+func (n *callNotifier) endLocked(c *call) {
+	delete(n.calls, c.channelID)
+	c.end = n.clock.Now()
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	if c.message == 0 {
+		return
+	}
+	n.quiet[c.channelID] = c.end.Add(n.cooldown)
+	n.clock.AfterFunc(0, func() { n.announceEnded(c) })
+}
+
+// announce posts that c started, unless it has ended since.
+func (n *callNotifier) announce(c *call) {
+	n.mu.Lock()
+	if n.calls[c.channelID] != c || c.timer == nil || !n.begin() {
+		n.mu.Unlock()
+		return
+	}
+	c.timer = nil
+	n.mu.Unlock()
+	defer n.inflight.Done()
+	if !n.leading() {
+		return
+	}
+	mid, err := n.announcer.AnnounceCall(c.guildID, c.channelID, c.start)
+	if err != nil {
+		n.log.Error("failed to announce call",
+			"channel", c.channelID, "error", err)
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	c.message = mid
+	if !c.end.IsZero() && mid != 0 {
+		// The call ended while it was being announced.
+		n.quiet[c.channelID] = c.end.Add(n.cooldown)
+		n.clock.AfterFunc(0, func() { n.announceEnded(c) })
+	}
+}
+
+// announceEnded edits the announcement of c to say that it ended.
+func (n *callNotifier) announceEnded(c *call) {
+	n.mu.Lock()
+	ok := n.begin()
+	n.mu.Unlock()
+	if !ok {
+		return
+	}
+	defer n.inflight.Done()
+	err := n.announcer.AnnounceCallEnded(
+		c.guildID, c.channelID, c.message, c.end.Sub(c.start),
+	)
+	if err != nil {
+		n.log.Error("failed to announce call ended",
+			"channel", c.channelID, "error", err)
+	}
+}
+
+// begin reports whether Discord may be called, counting the call in flight
+// if so. n.mu must be held.
+func (n *callNotifier) begin() bool {
+	if n.stopped {
+		return false
+	}
+	n.inflight.Add(1)
+	return true
+}
+
+// stop cancels pending announcements and waits for those being posted.
+func (n *callNotifier) stop() {
+	n.mu.Lock()
+	n.stopped = true
+	for _, c := range n.calls {
+		if c.timer != nil {
+			c.timer.Stop()
+		}
+	}
+	n.mu.Unlock()
+	n.inflight.Wait()
+}
+
+// formatCallDuration formats d to the minute, like "1h12m".
+func formatCallDuration(d time.Duration) string {
+	d = d.Round(time.Minute)
+	h, m := int(d/time.Hour), int(d%time.Hour/time.Minute)
+	if h == 0 {
+		return fmt.Sprintf("%dm", m)
+	}
+	return fmt.Sprintf("%dh%dm", h, m)
+}
+
+// discordAnnouncer posts call announcements to the first of channels in the
+// guild of the call, pinging the calls role if the guild has one.
+type discordAnnouncer struct {
+	bot      disgobot.Client
+	channels []snowflake.ID
+}
+
+func (a discordAnnouncer) AnnounceCall(
+	gid, cid snowflake.ID, start time.Time,
+) (snowflake.ID, error) {
+	tc, ok := a.textChannel(gid)
+	if !ok {
+		return 0, nil
+	}
+	msg := discord.MessageCreate{
+		Content: fmt.Sprintf("📞 Call started in %s %s.",
+			discord.ChannelMention(cid),
+			discord.TimestampStyleRelative.FormatTime(start)),
+		AllowedMentions: &discord.AllowedMentions{},
+	}
+	a.bot.Caches().RolesForEach(gid, func(r discord.Role) {
+		if r.Name == callsRole {
+			msg.Content = discord.RoleMention(r.ID) + " " + msg.Content
+			msg.AllowedMentions.Roles = []snowflake.ID{r.ID}
+		}
+	})
+	m, err := a.bot.Rest().CreateMessage(tc, msg)
+	if err != nil {
+		return 0, fmt.Errorf("could not post message: %w", err)
+	}
+	return m.ID, nil
+}
+
+func (a discordAnnouncer) AnnounceCallEnded(
+	gid, cid, mid snowflake.ID, d time.Duration,
+) error {
+	tc, ok := a.textChannel(gid)
+	if !ok {
+		return nil
+	}
+	content := fmt.Sprintf("📞 Call in %s ended after %s.",
+		discord.ChannelMention(cid), formatCallDuration(d))
+	_, err := a.bot.Rest().UpdateMessage(tc, mid, discord.MessageUpdate{
+		Content:         &content,
+		AllowedMentions: &discord.AllowedMentions{},
+	})
+	if err != nil {
+		return fmt.Errorf("could not edit message: %w", err)
+	}
+	return nil
+}
+
+func (a discordAnnouncer) textChannel(gid snowflake.ID) (snowflake.ID, bool) {
+	for _, id := range a.channels {
+		if ch, ok := a.bot.Caches().Channel(id); ok && ch.GuildID() == gid {
+			return id, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	disgobot "github.com/disgoorg/disgo/bot"
+	"github.com/disgoorg/disgo/discord"
+	"github.com/disgoorg/disgo/gateway"
+	"github.com/disgoorg/disgo/rest"
+	"github.com/disgoorg/snowflake/v2"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+// fakeAnnouncer records announcements as strings.
+type fakeAnnouncer struct {
+	got        []string
+	onAnnounce func() // Called while announcing a call start.
+}
+
+func (a *fakeAnnouncer) AnnounceCall(
+	gid, cid snowflake.ID, start time.Time,
+) (snowflake.ID, error) {
+	if a.onAnnounce != nil {
+		a.onAnnounce()
+	}
+	a.got = append(a.got, fmt.Sprintf("started %d at %s",
+		cid, start.Format(time.TimeOnly)))
+	return snowflake.ID(len(a.got)), nil
+}
+
+func (a *fakeAnnouncer) AnnounceCallEnded(
+	gid, cid, mid snowflake.ID, d time.Duration,
+) error {
+	a.got = append(a.got, fmt.Sprintf("message %d: %d ended after %s",
+		mid, cid, formatCallDuration(d)))
+	return nil
+}
+
+// fakeNotifier returns a callNotifier on a fakeClock that announces calls
+// lasting a minute, with a 15 minute cooldown.
+func fakeNotifier() (*callNotifier, *fakeClock, *fakeAnnouncer) {
+	clk := &fakeClock{now: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	a := new(fakeAnnouncer)
+	n := newCallNotifier(clk, time.Minute, 15*time.Minute)
+	n.announcer = a
+	return n, clk, a
+}
+
+// fire runs the timers of clk that have not been stopped or run.
+func fire(clk *fakeClock) {
+	for i := 0; i < len(clk.timers); i++ {
+		if t := clk.timers[i]; !t.stopped {
+			t.stopped = true
+			t.f()
+		}
+	}
+}
+
+func voiceState(uid snowflake.ID, cid *snowflake.ID) gateway.EventData {
+	return gateway.EventVoiceStateUpdate{VoiceState: discord.VoiceState{
+		GuildID: 1, UserID: uid, ChannelID: cid,
+	}}
+}
+
+func TestCallNotifierAnnounces(t *testing.T) {
+	n, clk, a := fakeNotifier()
+
+	n.handle(voiceState(10, ptr[snowflake.ID](5)))
+	clk.now = clk.now.Add(time.Minute)
+	n.handle(voiceState(11, ptr[snowflake.ID](5)))
+	if len(clk.timers) != 1 || clk.timers[0].d != time.Minute {
+		t.Fatalf("timers = %v, want one for a minute", clk.timers)
+	}
+	fire(clk)
+	clk.now = clk.now.Add(71 * time.Minute)
+	n.handle(voiceState(10, nil))
+	fire(clk)
+	if len(a.got) != 1 {
+		t.Fatalf("call ended with a member left: %q", a.got)
+	}
+	n.handle(voiceState(11, nil))
+	fire(clk)
+
+	want := []string{
+		"started 5 at 12:00:00",
+		"message 1: 5 ended after 1h12m",
+	}
+	if !cmp.Equal(a.got, want) {
+		t.Errorf("announcements -want +got\n%s", cmp.Diff(want, a.got))
+	}
+}
+
+func TestCallNotifierShortCall(t *testing.T) {
+	n, clk, a := fakeNotifier()
+
+	n.handle(voiceState(10, ptr[snowflake.ID](5)))
+	clk.now = clk.now.Add(30 * time.Second)
+	n.handle(voiceState(10, nil))
+	if !clk.timers[0].stopped {
+		t.Errorf("announcement of a short call was not cancelled")
+	}
+	fire(clk)
+	if len(a.got) != 0 {
+		t.Errorf("short call announced: %q", a.got)
+	}
+}
+
+func TestCallNotifierCooldown(t *testing.T) {
+	n, clk, a := fakeNotifier()
+
+	n.handle(voiceState(10, ptr[snowflake.ID](5)))
+	fire(clk)
+	n.handle(voiceState(10, nil))
+	fire(clk)
+	clk.now = clk.now.Add(10 * time.Minute)
+	n.handle(voiceState(10, ptr[snowflake.ID](5)))
+	n.handle(voiceState(11, ptr[snowflake.ID](6)))
+	fire(clk)
+	n.handle(voiceState(10, nil))
+	clk.now = clk.now.Add(5 * time.Minute)
+	n.handle(voiceState(10, ptr[snowflake.ID](5)))
+	fire(clk)
+
+	want := []string{
+		"started 5 at 12:00:00",
+		"message 1: 5 ended after 0m",
+		// Channel 5 is cooling down until 12:15, but 6 is not.
+		"started 6 at 12:10:00",
+		"started 5 at 12:15:00",
+	}
+	if !cmp.Equal(a.got, want) {
+		t.Errorf("announcements -want +got\n%s", cmp.Diff(want, a.got))
+	}
+}
+
+func TestCallNotifierMove(t *testing.T) {
+	n, clk, a := fakeNotifier()
+
+	n.handle(voiceState(10, ptr[snowflake.ID](5)))
+	fire(clk)
+	clk.now = clk.now.Add(5 * time.Minute)
+	n.handle(voiceState(10, ptr[snowflake.ID](6)))
+	fire(clk)
+
+	want := []string{
+		"started 5 at 12:00:00",
+		"message 1: 5 ended after 5m",
+		"started 6 at 12:05:00",
+	}
+	if !cmp.Equal(a.got, want) {
+		t.Errorf("announcements -want +got\n%s", cmp.Diff(want, a.got))
+	}
+}
+
+func TestCallNotifierReconnect(t *testing.T) {
+	n, clk, a := fakeNotifier()
+
+	n.handle(voiceState(10, ptr[snowflake.ID](5)))
+	fire(clk)
+	clk.now = clk.now.Add(20 * time.Minute)
+	// While the bot was away, 10 left and 11 started a call in 6.
+	var e gateway.EventGuildCreate
+	e.ID = 1
+	e.VoiceStates = []discord.VoiceState{
+		{UserID: 11, ChannelID: ptr[snowflake.ID](6)},
+	}
+	n.handle(e)
+	fire(clk)
+	n.handle(voiceState(12, ptr[snowflake.ID](6)))
+	fire(clk)
+
+	want := []string{
+		"started 5 at 12:00:00",
+		"message 1: 5 ended after 20m",
+	}
+	if !cmp.Equal(a.got, want) {
+		t.Errorf("announcements -want +got\n%s", cmp.Diff(want, a.got))
+	}
+}
+
+func TestCallNotifierEndedWhileAnnouncing(t *testing.T) {
+	n, clk, a := fakeNotifier()
+	a.onAnnounce = func() {
+		clk.now = clk.now.Add(2 * time.Minute)
+		n.handle(voiceState(10, nil))
+	}
+
+	n.handle(voiceState(10, ptr[snowflake.ID](5)))
+	fire(clk)
+
+	want := []string{
+		"started 5 at 12:00:00",
+		"message 1: 5 ended after 2m",
+	}
+	if !cmp.Equal(a.got, want) {
+		t.Errorf("announcements -want +got\n%s", cmp.Diff(want, a.got))
+	}
+}
+
+func TestCallNotifierSkips(t *testing.T) {
+	tests := []struct {
+		desc  string
+		setup func(n *callNotifier)
+	}{{
+		desc: "disabled guild",
+		setup: func(n *callNotifier) {
+			n.enabled = func(snowflake.ID) bool { return false }
+		},
+	}, {
+		desc: "standby",
+		setup: func(n *callNotifier) {
+			n.leading = func() bool { return false }
+		},
+	}, {
+		desc:  "stopped",
+		setup: func(n *callNotifier) { n.stop() },
+	}}
+	for _, tt := range tests {
+		n, clk, a := fakeNotifier()
+		tt.setup(n)
+		n.handle(voiceState(10, ptr[snowflake.ID](5)))
+		n.handle(voiceState(11, ptr[snowflake.ID](6)))
+		clk.now = clk.now.Add(time.Hour)
+		fire(clk)
+		n.handle(voiceState(10, nil))
+		n.handle(voiceState(11, nil))
+		fire(clk)
+		if len(a.got) != 0 {
+			t.Errorf("%s: announced %q", tt.desc, a.got)
+		}
+	}
+}
+
+func TestFormatCallDuration(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{20 * time.Second, "0m"},
+		{45 * time.Minute, "45m"},
+		{time.Hour + 12*time.Minute + 29*time.Second, "1h12m"},
+		{3 * time.Hour, "3h0m"},
+	}
+	for _, tt := range tests {
+		if got := formatCallDuration(tt.d); got != tt.want {
+			t.Errorf("%s(%v) = %q, want %q",
+				funcname(t, formatCallDuration), tt.d, got, tt.want)
+		}
+	}
+}
+
+func TestRunAnnouncesCalls(t *testing.T) {
+	const (
+		voiceID snowflake.ID = 3
+		textID  snowflake.ID = 4
+		pingID  snowflake.ID = 7
+		alice   snowflake.ID = 10
+	)
+	f := newFakeDiscord(t, 1)
+	f.addVoiceChannel(voiceID, "General")
+	f.addTextChannel(textID, "general")
+	f.addRole(2, voiceRole)
+	f.addRole(pingID, callsRole)
+	f.addMember(alice, "alice")
+
+	t.Cleanup(setDefaultHandler(f.logger().Handler()))
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan error, 1)
+	go func() {
+		done <- run(ctx, &config{
+			token:         fakeToken,
+			leader:        leaderConfig{ttl: 15 * time.Second},
+			callsChannels: []snowflake.ID{textID},
+		}, http.NewServeMux(), disgobot.WithRestClientConfigOpts(
+			rest.WithURL(f.srv.URL),
+		))
+	}()
+	f.waitIdentified()
+	f.setVoice(alice, ptr(voiceID))
+	f.waitMessages(func(msgs []fakeChatMessage) bool {
+		return len(msgs) == 1
+	})
+	f.setVoice(alice, nil)
+	f.waitMessages(func(msgs []fakeChatMessage) bool {
+		return strings.Contains(msgs[0].Content, "ended")
+	})
+	f.quiesce()
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("run(): %v", err)
+	}
+
+	f.mu.Lock()
+	got := f.messages
+	f.mu.Unlock()
+	want := []fakeChatMessage{{
+		ChannelID: textID,
+		Content:   "📞 Call in <#3> ended after 0m.",
+		Pings:     []snowflake.ID{pingID},
+	}}
+	if !cmp.Equal(got, want) {
+		t.Errorf("messages -want +got\n%s", cmp.Diff(want, got))
+	}
+}
+
+func TestInteractionsCallsNotify(t *testing.T) {
+	const slash = `{"id":"1","application_id":"1000","type":2,"token":"t",` +
+		`"version":1,"guild_id":"1","channel_id":"3",` +
+		`"app_permissions":"268435456",` +
+		`"member":{"user":{"id":"10","username":"alice"},"roles":[%s],` +
+		`"permissions":"0"},` +
+		`"data":{"id":"51","name":"calls","type":1,` +
+		`"options":[{"name":"notify","type":1}]}}`
+	tests := []struct {
+		desc     string
+		role     bool // Whether the guild has the calls role.
+		roles    string
+		want     string
+		wantMuts []roleMutation
+	}{{
+		desc: "opt in",
+		role: true,
+		want: "🔔 You will be pinged when a call starts.",
+		wantMuts: []roleMutation{
+			{Add: true, GuildID: 1, UserID: 10, RoleID: 7},
+		},
+	}, {
+		desc:  "opt out",
+		role:  true,
+		roles: `"7"`,
+		want:  "🔕 You will no longer be pinged when a call starts.",
+		wantMuts: []roleMutation{
+			{Add: false, GuildID: 1, UserID: 10, RoleID: 7},
+		},
+	}, {
+		desc: "no role",
+		want: `❌ Pings are not available: could not find role "calls".`,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			f := newFakeDiscord(t, 1)
+			if tt.role {
+				f.addRole(7, callsRole)
+			}
+			f.addMember(10, "alice")
+			audit := filepath.Join(t.TempDir(), "audit.jsonl")
+			url, key := testInteractions(t, f,
+				map[string]string{"DISCORD_AUDIT_FILE": audit})
+
+			status, body := postInteraction(t, url, key,
+				fmt.Sprintf(slash, tt.roles))
+			if status != http.StatusOK {
+				t.Fatalf("status %d: %s", status, body)
+			}
+			var resp struct {
+				Data struct {
+					Content string `json:"content"`
+				} `json:"data"`
+			}
+			if err := json.Unmarshal([]byte(body), &resp); err != nil {
+				t.Fatalf("%v: %s", err, body)
+			}
+			if resp.Data.Content != tt.want {
+				t.Errorf("content %q, want %q", resp.Data.Content, tt.want)
+			}
+			f.mu.Lock()
+			muts := f.mutations
+			f.mu.Unlock()
+			if !cmp.Equal(muts, tt.wantMuts) {
+				t.Errorf("mutations -want +got\n%s",
+					cmp.Diff(tt.wantMuts, muts))
+			}
+			entries, err := loadAudit(audit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var wantAudit []auditEntry
+			for _, m := range tt.wantMuts {
+				wantAudit = append(wantAudit, auditEntry{
+					GuildID: m.GuildID,
+					UserID:  m.UserID,
+					RoleID:  m.RoleID,
+					Role:    callsRole,
+					Add:     m.Add,
+					Trigger: triggerCommand,
+					Run:     "1",
+				})
+			}
+			ignoreTime := cmpopts.IgnoreFields(auditEntry{}, "Time")
+			if !cmp.Equal(entries, wantAudit, ignoreTime) {
+				t.Errorf("audit trail -want +got\n%s",
+					cmp.Diff(wantAudit, entries, ignoreTime))
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+
+	disgobot "github.com/disgoorg/disgo/bot"
+	"github.com/disgoorg/disgo/cache"
+	"github.com/disgoorg/disgo/discord"
+	"github.com/disgoorg/disgo/gateway"
+)
+
+// callsModule announces calls in a text channel.
+type callsModule struct {
+	cfg      *config
+	notifier *callNotifier
+}
+
+func newCallsModule(cfg *config) module {
+	return &callsModule{
+		cfg: cfg,
+		notifier: newCallNotifier(systemClock{},
+			cfg.callsMinDuration, cfg.callsCooldown),
+	}
+}
+
+func (*callsModule) Name() string { return "calls" }
+
+func (*callsModule) Intents() gateway.Intents {
+	return gateway.IntentGuildVoiceStates
+}
+
+func (*callsModule) Caches() cache.Flags {
+	return cache.FlagChannels | cache.FlagRoles
+}
+
+func (m *callsModule) Middleware() gatewayMiddleware {
+	return m.notifier.middleware()
+}
+
+func (m *callsModule) Start(_ context.Context, env moduleEnv) error {
+	if len(m.cfg.callsChannels) == 0 {
+		return nil
+	}
+	m.notifier.announcer = discordAnnouncer{env.bot, m.cfg.callsChannels}
+	m.notifier.enabled = env.enabled
+	m.notifier.leading = env.leading
+	m.notifier.log = env.log
+	return nil
+}
+
+func (*callsModule) Listeners() []disgobot.EventListener { return nil }
+
+func (m *callsModule) Stop() { m.notifier.stop() }
+
+func (m *callsModule) Commands() []command {
+	return []command{{
+		create: discord.SlashCommandCreate{
+			Name:        "calls",
+			Description: "Call announcements",
+			Contexts: []discord.InteractionContextType{
+				discord.InteractionContextTypeGuild,
+			},
+			Options: []discord.ApplicationCommandOption{
+				discord.ApplicationCommandOptionSubCommand{
+					Name:        "notify",
+					Description: "Turn pings for new calls on or off",
+				},
+			},
+		},
+		paths: map[string]commandHandler{
+			"/calls/notify": callsNotify.command(m.cfg),
+		},
+	}}
+}
+
+// callsNotify toggles the calls role, so that members choose whether calls
+// ping them.
+var callsNotify = selfRole{
+	module:      "calls",
+	name:        callsRole,
+	unavailable: "❌ Pings are not available: ",
+	on:          "🔔 You will be pinged when a call starts.",
+	off:         "🔕 You will no longer be pinged when a call starts.",
+}
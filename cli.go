@@ -0,0 +1,514 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	disgobot "github.com/disgoorg/disgo/bot"
+	"github.com/disgoorg/disgo/discord"
+	"github.com/disgoorg/disgo/rest"
+	"github.com/disgoorg/snowflake/v2"
+)
+
+// cli runs the bot daemon and the operator commands that sit alongside it.
+// Every command that talks to Discord builds its client with newBot, so it
+// sees Discord the way run does.
+type cli struct {
+	getenv         func(string) string
+	stdout, stderr io.Writer
+	mux            *http.ServeMux       // Served by run.
+	addr           string               // Where run serves mux, if set.
+	opts           []disgobot.ConfigOpt // Applied to every client.
+}
+
+type cliCommand struct {
+	name string // Including any parent, like "roles list".
+	args string
+	help string
+	run  func(c *cli, ctx context.Context, args []string) error
+}
+
+var cliCommands = []cliCommand{{
+	name: "run",
+	help: "connect to Discord and sync roles until interrupted (default)",
+	run:  (*cli).runBot,
+}, {
+	name: "sync",
+	args: "-guild ID [-dry-run]",
+	help: "sync the members of one guild who hold a call role now, " +
+		"ignoring grace periods",
+	run: (*cli).sync,
+}, {
+	name: "roles list",
+	args: "-guild ID",
+	help: "list the roles of a guild",
+	run:  (*cli).rolesList,
+}, {
+	name: "commands register",
+	args: "[-guild ID]",
+	help: "register slash commands globally, or in one guild",
+	run:  (*cli).commandsRegister,
+}, {
+	name: "config validate",
+	help: "check the configuration in the environment",
+	run:  (*cli).configValidate,
+}, {
+	name: "doctor",
+	args: "[-guild ID]",
+	help: "check the bot's access to Discord and its guilds",
+	run:  (*cli).doctor,
+}, {
+	name: "interactions",
+	help: "serve the interactions endpoint without connecting to the gateway",
+	run:  (*cli).interactions,
+}, {
+	name: "replay",
+	args: "FILE",
+	help: "replay a gateway recording and print the role changes",
+	run:  (*cli).replay,
+}, {
+	name: "webhooks log",
+	help: "list pending and recent webhook deliveries",
+	run:  (*cli).webhooksLog,
+}, {
+	name: "webhooks replay",
+	args: "ID",
+	help: "send a webhook delivery again",
+	run:  (*cli).webhooksReplay,
+}, {
+	name: "audit export",
+	args: "[-guild ID]",
+	help: "print the audit trail of role changes as CSV",
+	run:  (*cli).auditExport,
+}}
+
+var errUsage = errors.New("bad usage")
+
+// run runs the command named by args, as given on the command line.
+func (c *cli) run(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return c.runBot(ctx, nil)
+	}
+	for _, cmd := range cliCommands {
+		name := strings.Fields(cmd.name)
+		if len(args) >= len(name) && slices.Equal(args[:len(name)], name) {
+			return cmd.run(c, ctx, args[len(name):])
+		}
+	}
+	c.usage()
+	return fmt.Errorf("%w: unknown command %q", errUsage, args[0])
+}
+
+func (c *cli) usage() {
+	fmt.Fprintln(c.stderr, "usage: discord [command]")
+	fmt.Fprintln(c.stderr)
+	tw := tabwriter.NewWriter(c.stderr, 0, 0, 2, ' ', 0)
+	for _, cmd := range cliCommands {
+		fmt.Fprintf(tw, "  %s %s\t%s\n", cmd.name, cmd.args, cmd.help)
+	}
+	tw.Flush()
+}
+
+// flags returns a flag set for the named command. guild, if not nil, is set
+// from -guild.
+func (c *cli) flags(name string, guild *snowflake.ID) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(c.stderr)
+	if guild != nil {
+		fs.Func("guild", "guild `ID`", func(s string) (err error) {
+			*guild, err = snowflake.Parse(s)
+			return err
+		})
+	}
+	return fs
+}
+
+// parse parses args, which take no positional arguments. If guild is not
+// nil, -guild is required.
+func parse(fs *flag.FlagSet, args []string, guild *snowflake.ID) error {
+	if err := fs.Parse(args); err != nil {
+		return fmt.Errorf("%w: %w", errUsage, err)
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("%w: unexpected argument %q", errUsage, fs.Arg(0))
+	}
+	if guild != nil && *guild == 0 {
+		return fmt.Errorf("%w: -guild is required", errUsage)
+	}
+	return nil
+}
+
+// config loads the configuration and the modules it enables.
+func (c *cli) config() (*config, []enabledModule, error) {
+	cfg, err := loadConfig(c.getenv)
+	if err != nil {
+		return nil, nil, err
+	}
+	mods, err := enabledModules(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cfg, mods, nil
+}
+
+// client builds a client for commands that only use the REST API.
+func (c *cli) client() (*config, []enabledModule, disgobot.Client, error) {
+	cfg, mods, err := c.config()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	bot, err := newBot(cfg, mods, nil, c.opts...)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return cfg, mods, bot, nil
+}
+
+func (c *cli) runBot(ctx context.Context, args []string) error {
+	if err := parse(c.flags("run", nil), args, nil); err != nil {
+		return err
+	}
+	cfg, err := loadConfig(c.getenv)
+	if err != nil {
+		return err
+	}
+	if c.addr != "" {
+		// Only the daemon serves pprof and readiness, so that operator
+		// commands can run beside it.
+		go func() {
+			slog.Error(http.ListenAndServe(c.addr, c.mux).Error())
+		}()
+	}
+	return run(ctx, cfg, c.mux, c.opts...)
+}
+
+func (c *cli) sync(ctx context.Context, args []string) error {
+	var gid snowflake.ID
+	fs := c.flags("sync", &gid)
+	dryRun := fs.Bool("dry-run", false,
+		"print the role changes as JSONL instead of making them")
+	if err := parse(fs, args, &gid); err != nil {
+		return err
+	}
+	cfg, _, bot, err := c.client()
+	if err != nil {
+		return err
+	}
+	defer bot.Close(context.Background())
+	if err := loadGuild(bot, gid); err != nil {
+		return err
+	}
+
+	backend := discordBackend{bot}
+	voice := voiceSync{
+		roles:   backend,
+		mutator: backend,
+		holders: backend,
+		members: backend,
+		clock:   systemClock{},
+	}
+	if *dryRun {
+		voice.mutator = changeLog{systemClock{}, json.NewEncoder(c.stdout)}
+	} else if cfg.auditFile != "" {
+		voice.audit, err = newAuditTrail(systemClock{},
+			cfg.auditFile, cfg.auditRetention)
+		if err != nil {
+			return err
+		}
+		defer voice.audit.close()
+	}
+	run := newSyncRun(moduleLogger("voice"), gid, triggerManual)
+	return newCallSyncs(voice).syncGuild(ctx, run, gid)
+}
+
+// Codes of the JSON errors Discord answers for a guild the bot is not in.
+const (
+	unknownGuild  rest.JSONErrorCode = 10004
+	missingAccess rest.JSONErrorCode = 50001
+)
+
+// loadGuild fills the caches of bot with gid, its roles, channels and members
+// and their voice states, from the REST API rather than a gateway session.
+// Discord can't list the voice states of a guild over REST, and asking for
+// every member's would take a request each, so only members holding a call
+// role are asked for theirs. Members in a call without one are not seen in
+// it: a sync takes call roles from those who left, but gives none out.
+func loadGuild(bot disgobot.Client, gid snowflake.ID) error {
+	r, caches := bot.Rest(), bot.Caches()
+	guild, err := r.GetGuild(gid, false)
+	var restErr rest.Error
+	if errors.As(err, &restErr) &&
+		(restErr.Code == unknownGuild || restErr.Code == missingAccess) {
+		return fmt.Errorf("bot is not in guild %s", gid)
+	} else if err != nil {
+		return fmt.Errorf("could not get guild: %w", err)
+	}
+	caches.AddGuild(guild.Guild)
+	callRoleIDs := newSet[snowflake.ID]()
+	for _, role := range guild.Roles {
+		role.GuildID = gid
+		caches.AddRole(role)
+		if slices.Contains(callRoleNames(), role.Name) {
+			callRoleIDs.Add(role.ID)
+		}
+	}
+	channels, err := r.GetGuildChannels(gid)
+	if err != nil {
+		return fmt.Errorf("could not get channels: %w", err)
+	}
+	for _, ch := range channels {
+		caches.AddChannel(ch)
+	}
+	const pageSize = 1000 // The most Discord lists at once.
+	var members []discord.Member
+	for after := snowflake.ID(0); ; {
+		page, err := r.GetMembers(gid, pageSize, after)
+		if err != nil {
+			return fmt.Errorf("could not list members: %w", err)
+		}
+		members = append(members, page...)
+		if len(page) < pageSize {
+			break
+		}
+		after = page[len(page)-1].User.ID
+	}
+	// Voice states go first, so that a lean member cache keeps those in a
+	// call.
+	for _, m := range members {
+		if !slices.ContainsFunc(m.RoleIDs, func(id snowflake.ID) bool {
+			_, ok := callRoleIDs[id]
+			return ok
+		}) {
+			continue
+		}
+		vs, err := r.GetUserVoiceState(gid, m.User.ID)
+		if errors.As(err, &restErr) && restErr.Code == unknownVoiceState {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("could not get voice state: %w", err)
+		}
+		vs.GuildID = gid
+		caches.AddVoiceState(*vs)
+	}
+	for _, m := range members {
+		caches.AddMember(m)
+	}
+	return nil
+}
+
+func (c *cli) rolesList(_ context.Context, args []string) error {
+	var gid snowflake.ID
+	if err := parse(c.flags("roles list", &gid), args, &gid); err != nil {
+		return err
+	}
+	_, _, bot, err := c.client()
+	if err != nil {
+		return err
+	}
+	defer bot.Close(context.Background())
+	roles, err := bot.Rest().GetRoles(gid)
+	if err != nil {
+		return fmt.Errorf("could not get roles: %w", err)
+	}
+	slices.SortFunc(roles, func(a, b discord.Role) int {
+		return cmp.Or(
+			cmp.Compare(b.Position, a.Position), cmp.Compare(a.ID, b.ID),
+		)
+	})
+	tw := tabwriter.NewWriter(c.stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tPOSITION\tSYNCED")
+	for _, r := range roles {
+		synced := ""
+		if slices.Contains(callRoleNames(), r.Name) {
+			synced = "yes"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\n", r.ID, r.Name, r.Position, synced)
+	}
+	return tw.Flush()
+}
+
+func (c *cli) commandsRegister(_ context.Context, args []string) error {
+	var gid snowflake.ID
+	fs := c.flags("commands register", &gid)
+	if err := parse(fs, args, nil); err != nil {
+		return err
+	}
+	_, mods, bot, err := c.client()
+	if err != nil {
+		return err
+	}
+	defer bot.Close(context.Background())
+	creates := commandCreates(mods)
+	var registered []discord.ApplicationCommand
+	if gid == 0 {
+		registered, err = bot.Rest().SetGlobalCommands(
+			bot.ApplicationID(), creates)
+	} else {
+		registered, err = bot.Rest().SetGuildCommands(
+			bot.ApplicationID(), gid, creates)
+	}
+	if err != nil {
+		return fmt.Errorf("could not register commands: %w", err)
+	}
+	for _, cmd := range registered {
+		fmt.Fprintf(c.stdout, "registered /%s\n", cmd.Name())
+	}
+	return nil
+}
+
+func (c *cli) configValidate(_ context.Context, args []string) error {
+	if err := parse(c.flags("config validate", nil), args, nil); err != nil {
+		return err
+	}
+	if _, _, err := c.config(); err != nil {
+		return err
+	}
+	fmt.Fprintln(c.stdout, "config ok")
+	return nil
+}
+
+func (c *cli) replay(ctx context.Context, args []string) error {
+	fs := c.flags("replay", nil)
+	if err := fs.Parse(args); err != nil {
+		return fmt.Errorf("%w: %w", errUsage, err)
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("%w: replay takes one recording", errUsage)
+	}
+	return replayFile(ctx, c.getenv, fs.Arg(0), c.stdout)
+}
+
+// webhookState loads the webhook queue saved by the bot.
+func (c *cli) webhookState() (*config, webhookState, error) {
+	cfg, _, err := c.config()
+	if err != nil {
+		return nil, webhookState{}, err
+	}
+	if cfg.webhooks.file == "" {
+		return nil, webhookState{},
+			fmt.Errorf("DISCORD_WEBHOOK_FILE is not set")
+	}
+	st, err := loadWebhookState(cfg.webhooks.file)
+	return cfg, st, err
+}
+
+func (c *cli) webhooksLog(_ context.Context, args []string) error {
+	if err := parse(c.flags("webhooks log", nil), args, nil); err != nil {
+		return err
+	}
+	_, st, err := c.webhookState()
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(c.stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tTYPE\tURL\tATTEMPTS\tRESULT")
+	for _, r := range st.Log {
+		result := "delivered"
+		if r.Error != "" {
+			result = "failed: " + r.Error
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\n",
+			r.ID, r.Type, r.URL, r.Attempts, result)
+	}
+	for _, d := range st.Pending {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\tpending until %s\n",
+			d.ID, d.Type, d.URL, d.Attempts, d.Next.Format(time.RFC3339))
+	}
+	return tw.Flush()
+}
+
+func (c *cli) webhooksReplay(_ context.Context, args []string) error {
+	fs := c.flags("webhooks replay", nil)
+	if err := fs.Parse(args); err != nil {
+		return fmt.Errorf("%w: %w", errUsage, err)
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("%w: webhooks replay takes one delivery ID",
+			errUsage)
+	}
+	id := fs.Arg(0)
+	cfg, st, err := c.webhookState()
+	if err != nil {
+		return err
+	}
+	var found []webhookDelivery
+	for _, r := range st.Log {
+		if r.ID == id {
+			found = append(found, r.webhookDelivery)
+		}
+	}
+	for _, d := range st.Pending {
+		if d.ID == id {
+			found = append(found, *d)
+		}
+	}
+	if len(found) == 0 {
+		return fmt.Errorf("no webhook delivery %q", id)
+	}
+	sender := webhookSender{http.DefaultClient, cfg.webhooks.secret}
+	var errs []error
+	for _, d := range found {
+		status, err := sender.send(&d)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", d.URL, err))
+			continue
+		}
+		fmt.Fprintf(c.stdout, "replayed %s to %s: %d\n", id, d.URL, status)
+	}
+	return errors.Join(errs...)
+}
+
+func (c *cli) auditExport(_ context.Context, args []string) error {
+	var gid snowflake.ID
+	fs := c.flags("audit export", &gid)
+	if err := parse(fs, args, nil); err != nil {
+		return err
+	}
+	cfg, _, err := c.config()
+	if err != nil {
+		return err
+	}
+	if cfg.auditFile == "" {
+		return fmt.Errorf("DISCORD_AUDIT_FILE is not set")
+	}
+	entries, err := loadAudit(cfg.auditFile)
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(c.stdout)
+	w.Write([]string{
+		"time", "guild_id", "user_id", "role_id", "role",
+		"action", "trigger", "run", "outcome",
+	})
+	for _, e := range entries {
+		if gid != 0 && e.GuildID != gid {
+			continue
+		}
+		action, outcome := "remove", "ok"
+		if e.Add {
+			action = "add"
+		}
+		if e.Error != "" {
+			outcome = "failed: " + e.Error
+		}
+		w.Write([]string{
+			e.Time.Format(time.RFC3339), e.GuildID.String(),
+			e.UserID.String(), e.RoleID.String(), e.Role,
+			action, e.Trigger, e.Run, outcome,
+		})
+	}
+	w.Flush()
+	return w.Error()
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+
+	disgobot "github.com/disgoorg/disgo/bot"
+	"github.com/disgoorg/disgo/discord"
+	"github.com/disgoorg/disgo/rest"
+	"github.com/disgoorg/snowflake/v2"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+// testCLI returns a cli whose clients talk to f, and the buffer it writes its
+// output to.
+func testCLI(f *fakeDiscord, env map[string]string) (*cli, *bytes.Buffer) {
+	out := new(bytes.Buffer)
+	c := &cli{
+		getenv: func(k string) string {
+			if v, ok := env[k]; ok {
+				return v
+			}
+			if k == "DISCORD_TOKEN" {
+				return fakeToken
+			}
+			return ""
+		},
+		stdout: out,
+		stderr: new(bytes.Buffer),
+	}
+	if f != nil {
+		c.opts = []disgobot.ConfigOpt{
+			disgobot.WithRestClientConfigOpts(rest.WithURL(f.srv.URL)),
+		}
+	}
+	return c, out
+}
+
+func TestCLIUsage(t *testing.T) {
+	tests := []struct {
+		desc string
+		args []string
+	}{
+		{"unknown command", []string{"frobnicate"}},
+		{"unknown subcommand", []string{"roles", "delete"}},
+		{"missing guild", []string{"roles", "list"}},
+		{"bad guild", []string{"sync", "-guild", "lesiw"}},
+		{"extra argument", []string{"doctor", "now"}},
+		{"missing recording", []string{"replay"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			t.Parallel()
+			c, _ := testCLI(nil, nil)
+			if err := c.run(t.Context(), tt.args); !errors.Is(err, errUsage) {
+				t.Errorf("run(%q) = %v, want %v", tt.args, err, errUsage)
+			}
+		})
+	}
+}
+
+func TestCLIConfigValidate(t *testing.T) {
+	c, out := testCLI(nil, nil)
+	err := c.run(t.Context(), []string{"config", "validate"})
+	if err != nil {
+		t.Fatalf("config validate: %v", err)
+	}
+	if got, want := out.String(), "config ok\n"; got != want {
+		t.Errorf("config validate printed %q, want %q", got, want)
+	}
+
+	c, _ = testCLI(nil, map[string]string{"DISCORD_MEMBER_CACHE": "some"})
+	err = c.run(t.Context(), []string{"config", "validate"})
+	if err == nil || !strings.Contains(err.Error(), "DISCORD_MEMBER_CACHE") {
+		t.Errorf("config validate = %v, want DISCORD_MEMBER_CACHE error", err)
+	}
+}
+
+func TestCLIRolesList(t *testing.T) {
+	f := newFakeDiscord(t, 1)
+	f.addRole(2, voiceRole)
+	f.addBotRole(3, "bot")
+	c, out := testCLI(f, nil)
+	err := c.run(t.Context(), []string{"roles", "list", "-guild", "1"})
+	if err != nil {
+		t.Fatalf("roles list: %v", err)
+	}
+	want := "" +
+		"ID  NAME   POSITION  SYNCED\n" +
+		"3   bot    2         \n" +
+		"2   voice  1         yes\n"
+	if got := out.String(); got != want {
+		t.Errorf("roles list -want +got\n%s", cmp.Diff(want, got))
+	}
+}
+
+func TestCLISync(t *testing.T) {
+	const (
+		guildID   snowflake.ID = 1
+		roleID    snowflake.ID = 2
+		channelID snowflake.ID = 3
+		alice     snowflake.ID = 10 // In a call, without the voice role.
+		bob       snowflake.ID = 11 // Holds the voice role.
+		carol     snowflake.ID = 12 // Both.
+	)
+	f := newFakeDiscord(t, guildID)
+	f.addVoiceChannel(channelID, "General")
+	f.addRole(roleID, voiceRole)
+	f.addMember(alice, "alice")
+	f.addMember(bob, "bob", roleID)
+	f.addMember(carol, "carol", roleID)
+	f.setVoice(alice, ptr(channelID))
+	f.setVoice(carol, ptr(channelID))
+
+	// Only members holding a call role are asked for their voice state, so
+	// Alice is not given one.
+	c, out := testCLI(f, nil)
+	err := c.run(t.Context(), []string{"sync", "-guild", "1", "-dry-run"})
+	if err != nil {
+		t.Fatalf("sync -dry-run: %v", err)
+	}
+	var got []roleChange
+	for dec := json.NewDecoder(out); dec.More(); {
+		var rc roleChange
+		if err := dec.Decode(&rc); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, rc)
+	}
+	want := []roleChange{
+		{GuildID: guildID, UserID: bob, RoleID: roleID, Add: false},
+	}
+	opt := cmpopts.IgnoreFields(roleChange{}, "Time")
+	if !cmp.Equal(got, want, opt) {
+		t.Errorf("sync -dry-run -want +got\n%s", cmp.Diff(want, got, opt))
+	}
+	f.mu.Lock()
+	if len(f.mutations) > 0 {
+		t.Errorf("sync -dry-run made role changes: %v", f.mutations)
+	}
+	f.mu.Unlock()
+
+	c, _ = testCLI(f, nil)
+	if err := c.run(t.Context(), []string{"sync", "-guild", "1"}); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	wantMutations := []roleMutation{
+		{Add: false, GuildID: guildID, UserID: bob, RoleID: roleID},
+	}
+	if got := f.waitMutations(1); !cmp.Equal(got, wantMutations) {
+		t.Errorf("sync -want +got\n%s", cmp.Diff(wantMutations, got))
+	}
+	select {
+	case <-f.identified:
+		t.Errorf("sync identified on the gateway")
+	default:
+	}
+}
+
+func TestCLISyncPages(t *testing.T) {
+	const (
+		roleID    snowflake.ID = 2
+		channelID snowflake.ID = 3
+		carol     snowflake.ID = 5000 // Holds the voice role, on page two.
+	)
+	f := newFakeDiscord(t, 1)
+	f.addVoiceChannel(channelID, "General")
+	f.addRole(roleID, voiceRole)
+	for i := range 1000 {
+		id := snowflake.ID(1000 + i)
+		f.addMember(id, "member"+strconv.Itoa(i))
+		f.setVoice(id, ptr(channelID))
+	}
+	f.addMember(carol, "carol", roleID)
+
+	c, out := testCLI(f, nil)
+	err := c.run(t.Context(), []string{"sync", "-guild", "1", "-dry-run"})
+	if err != nil {
+		t.Fatalf("sync -dry-run: %v", err)
+	}
+	var rc roleChange
+	if err := json.Unmarshal(out.Bytes(), &rc); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	want := roleChange{GuildID: 1, UserID: carol, RoleID: roleID}
+	opt := cmpopts.IgnoreFields(roleChange{}, "Time")
+	if !cmp.Equal(rc, want, opt) {
+		t.Errorf("sync -dry-run -want +got\n%s", cmp.Diff(want, rc, opt))
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if got, want := f.voiceGets, []snowflake.ID{carol}; !cmp.Equal(got, want) {
+		t.Errorf("asked for the voice states of %v, want %v", got, want)
+	}
+}
+
+func TestCLISyncUnknownGuild(t *testing.T) {
+	f := newFakeDiscord(t, 1)
+	c, _ := testCLI(f, nil)
+	err := c.run(t.Context(), []string{"sync", "-guild", "2"})
+	if got, want := err, "bot is not in guild 2"; got == nil ||
+		got.Error() != want {
+		t.Errorf("sync = %v, want %q", got, want)
+	}
+}
+
+func TestCLICommandsRegister(t *testing.T) {
+	f := newFakeDiscord(t, 1)
+	for _, args := range [][]string{
+		{"commands", "register"},
+		{"commands", "register", "-guild", "1"},
+	} {
+		c, out := testCLI(f, nil)
+		if err := c.run(t.Context(), args); err != nil {
+			t.Fatalf("run(%q): %v", args, err)
+		}
+		got, want := out.String(), "registered /voice\nregistered /calls\n"+
+			"registered /stage\nregistered /presence\n"
+		if got != want {
+			t.Errorf("run(%q) printed %q, want %q", args, got, want)
+		}
+	}
+	want := []string{
+		"/applications/1000/commands",
+		"/applications/1000/guilds/1/commands",
+	}
+	if got := f.commandPuts; !cmp.Equal(got, want) {
+		t.Errorf("command registrations -want +got\n%s", cmp.Diff(want, got))
+	}
+}
+
+func TestCLIDoctor(t *testing.T) {
+	tests := []struct {
+		desc  string
+		setup func(f *fakeDiscord)
+		fail  string
+	}{{
+		desc:  "healthy",
+		setup: func(*fakeDiscord) {},
+	}, {
+		desc: "no members intent",
+		setup: func(f *fakeDiscord) {
+			f.appFlags = 0
+		},
+		fail: "FAIL  application: server members intent is not enabled",
+	}, {
+		desc: "no manage roles",
+		setup: func(f *fakeDiscord) {
+			f.permissions = discord.PermissionViewChannel
+		},
+		fail: "FAIL  guild 1 (lesiw): missing Manage Roles permission",
+	}, {
+		desc: "voice role above bot",
+		setup: func(f *fakeDiscord) {
+			f.roles[0], f.roles[1] = f.roles[1], f.roles[0]
+			f.roles[0].Position, f.roles[1].Position = 1, 2
+		},
+		fail: `FAIL  guild 1 (lesiw): role "voice" is not below ` +
+			"the bot's highest role",
+	}, {
+		desc: "no voice role",
+		setup: func(f *fakeDiscord) {
+			f.roles = f.roles[1:]
+		},
+		fail: `FAIL  guild 1 (lesiw): no "voice" role`,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			t.Parallel()
+			f := newFakeDiscord(t, 1)
+			f.addRole(2, voiceRole)
+			f.addBotRole(3, "bot")
+			tt.setup(f)
+			c, out := testCLI(f, nil)
+			err := c.run(t.Context(), []string{"doctor"})
+			if tt.fail == "" {
+				if err != nil {
+					t.Errorf("doctor: %v\n%s", err, out)
+				}
+				return
+			}
+			if err == nil {
+				t.Errorf("doctor succeeded, want failure\n%s", out)
+			}
+			if !strings.Contains(out.String(), tt.fail) {
+				t.Errorf("doctor output lacks %q:\n%s", tt.fail, out)
+			}
+		})
+	}
+}
+
+func TestBotGuilds(t *testing.T) {
+	var all []discord.OAuth2Guild
+	for id := range snowflake.ID(450) {
+		all = append(all, discord.OAuth2Guild{ID: id + 1})
+	}
+	c := mockClient(t)
+	c.Rest().(*clientRest)._GetCurrentUserGuilds_Do(func(
+		_ string, _, after snowflake.ID, limit int, _ bool,
+		_ ...rest.RequestOpt,
+	) ([]discord.OAuth2Guild, error) {
+		i := int(after)
+		return all[i:min(i+limit, len(all))], nil
+	})
+
+	got, err := botGuilds(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cmp.Equal(got, all) {
+		t.Errorf("%s() -want +got\n%s", funcname(t, botGuilds),
+			cmp.Diff(all, got))
+	}
+	var afters []snowflake.ID
+	for _, call := range c.Rest().(*clientRest)._GetCurrentUserGuilds_Calls() {
+		afters = append(afters, call.After)
+	}
+	if want := []snowflake.ID{0, 200, 400}; !cmp.Equal(afters, want) {
+		t.Errorf("pages after %v, want %v", afters, want)
+	}
+}
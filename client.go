@@ -0,0 +1,38 @@
+package main
+
+import (
+	"runtime"
+
+	"github.com/disgoorg/disgo"
+	disgobot "github.com/disgoorg/disgo/bot"
+	"github.com/disgoorg/disgo/gateway"
+	"github.com/disgoorg/disgo/handlers"
+)
+
+// A gatewayMiddleware sees every gateway event before disgo updates its
+// caches and dispatches it to listeners.
+type gatewayMiddleware func(
+	c disgobot.Client, next gateway.EventHandlerFunc,
+) gateway.EventHandlerFunc
+
+// newClient is disgo.New with gateway middleware.
+func newClient(
+	token string, mw []gatewayMiddleware, opts ...disgobot.ConfigOpt,
+) (disgobot.Client, error) {
+	cfg := disgobot.DefaultConfig(
+		handlers.GetGatewayHandlers(),
+		handlers.GetHTTPServerHandler(),
+	)
+	cfg.Apply(opts)
+	return disgobot.BuildClient(token, cfg,
+		func(c disgobot.Client) gateway.EventHandlerFunc {
+			h := handlers.DefaultGatewayEventHandlerFunc(c)
+			for i := len(mw) - 1; i >= 0; i-- {
+				h = mw[i](c, h)
+			}
+			return h
+		},
+		handlers.DefaultHTTPServerEventHandlerFunc,
+		runtime.GOOS, disgo.Name, disgo.GitHub, disgo.Version,
+	)
+}
@@ -0,0 +1,537 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/disgoorg/disgo/webhook"
+	"github.com/disgoorg/snowflake/v2"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+type config struct {
+	token        string
+	shards       shardConfig
+	leader       leaderConfig
+	interactions interactionsConfig
+
+	sessionFile   string // Empty disables session persistence.
+	sessionMaxAge time.Duration
+
+	voiceLeaveGrace time.Duration
+	voiceMinInCall  time.Duration
+
+	roleIndexMaxAge time.Duration // Zero never re-requests members.
+
+	callsChannels    []snowflake.ID // Text channels to announce calls in.
+	callsMinDuration time.Duration
+	callsCooldown    time.Duration
+
+	stageChannels []snowflake.ID // Stage channels to summarize and queue in.
+
+	namesChannels []snowflake.ID // Voice channels to show occupancy in.
+	namesStats    []snowflake.ID // Channels to show guild-wide stats in.
+	namesInterval time.Duration  // The least time between renames.
+
+	presence presenceConfig
+	webhooks webhookConfig
+	ops      opsConfig
+	log      logConfig
+	trace    traceConfig
+
+	recordFile string // Empty disables gateway event recording.
+
+	auditFile      string        // Empty keeps no audit trail of role changes.
+	auditRetention time.Duration // At most maxAuditRetention.
+
+	// leanMembers caches only members in a call or holding a managed role.
+	leanMembers bool
+
+	// modules maps the names of enabled modules to the guilds they are on
+	// in, or nil for every guild. A nil map enables every module.
+	modules map[string][]snowflake.ID
+}
+
+type leaderConfig struct {
+	lock string // Empty means this is the only replica.
+	id   string
+	ttl  time.Duration
+}
+
+type interactionsConfig struct {
+	addr      string // Empty receives interactions over the gateway.
+	publicKey string // The application's hex-encoded Ed25519 key.
+}
+
+type presenceConfig struct {
+	addr    string   // Empty disables the presence API.
+	origins []string // Allowed CORS origins. Nil allows any.
+}
+
+type webhookConfig struct {
+	urls   []string // Empty sends no webhooks.
+	secret string   // Signs deliveries.
+	file   string   // Empty keeps the queue and log in memory.
+}
+
+type opsConfig struct {
+	channel snowflake.ID // Zero unless posting with the bot.
+	webhook string       // Empty unless posting through a Discord webhook.
+	level   slog.Level   // Of the records to mirror.
+}
+
+func (oc opsConfig) enabled() bool {
+	return oc.channel != 0 || oc.webhook != ""
+}
+
+type logConfig struct {
+	format  string                // "text" or "json".
+	level   slog.Level            // Of the records to write.
+	modules map[string]slog.Level // Overrides level for these modules.
+}
+
+type traceConfig struct {
+	endpoint string // OTLP/HTTP traces URL. Empty drops spans.
+	// exporter, if set, is used instead of the endpoint. For tests.
+	exporter sdktrace.SpanExporter
+}
+
+type shardConfig struct {
+	enabled bool
+	count   int   // Zero lets Discord pick the shard count.
+	ids     []int // Nil runs every shard.
+}
+
+func loadConfig(getenv func(string) string) (*config, error) {
+	cfg := new(config)
+	if cfg.token = getenv("DISCORD_TOKEN"); cfg.token == "" {
+		return nil, fmt.Errorf("bad DISCORD_TOKEN")
+	}
+	var err error
+	cfg.shards, err = parseShardConfig(
+		getenv("DISCORD_SHARDS"), getenv("DISCORD_SHARD_IDS"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	cfg.interactions, err = parseInteractionsConfig(
+		getenv("DISCORD_INTERACTIONS_ADDR"), getenv("DISCORD_PUBLIC_KEY"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	cfg.modules, err = parseModules(getenv("DISCORD_MODULES"))
+	if err != nil {
+		return nil, err
+	}
+	cfg.callsChannels, err = parseIDs(
+		"DISCORD_CALLS_CHANNELS", getenv("DISCORD_CALLS_CHANNELS"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	cfg.stageChannels, err = parseIDs(
+		"DISCORD_STAGE_CHANNELS", getenv("DISCORD_STAGE_CHANNELS"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	cfg.namesChannels, err = parseIDs(
+		"DISCORD_NAMES_CHANNELS", getenv("DISCORD_NAMES_CHANNELS"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	cfg.namesStats, err = parseIDs(
+		"DISCORD_NAMES_STATS", getenv("DISCORD_NAMES_STATS"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	cfg.presence, err = parsePresenceConfig(
+		getenv("DISCORD_PRESENCE_ADDR"), getenv("DISCORD_PRESENCE_ORIGINS"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	cfg.webhooks, err = parseWebhookConfig(
+		getenv("DISCORD_WEBHOOK_URLS"),
+		getenv("DISCORD_WEBHOOK_SECRET"),
+		getenv("DISCORD_WEBHOOK_FILE"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	cfg.ops, err = parseOpsConfig(
+		getenv("DISCORD_OPS_CHANNEL"),
+		getenv("DISCORD_OPS_WEBHOOK"),
+		getenv("DISCORD_OPS_LEVEL"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	cfg.log, err = parseLogConfig(
+		getenv("DISCORD_LOG_FORMAT"),
+		getenv("DISCORD_LOG_LEVEL"),
+		getenv("DISCORD_LOG_LEVELS"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	cfg.trace, err = parseTraceConfig(getenv("DISCORD_TRACE_ENDPOINT"))
+	if err != nil {
+		return nil, err
+	}
+	cfg.sessionFile = getenv("DISCORD_SESSION_FILE")
+	cfg.recordFile = getenv("DISCORD_RECORD_FILE")
+	cfg.auditFile = getenv("DISCORD_AUDIT_FILE")
+	switch mc := getenv("DISCORD_MEMBER_CACHE"); mc {
+	case "", "all":
+	case "voice":
+		cfg.leanMembers = true
+	default:
+		return nil, fmt.Errorf("bad DISCORD_MEMBER_CACHE: %q", mc)
+	}
+	for _, d := range []struct {
+		dst  *time.Duration
+		name string
+		def  time.Duration
+	}{
+		{&cfg.sessionMaxAge, "DISCORD_SESSION_MAX_AGE", 2 * time.Minute},
+		{&cfg.voiceLeaveGrace, "DISCORD_VOICE_LEAVE_GRACE", 30 * time.Second},
+		{&cfg.voiceMinInCall, "DISCORD_VOICE_MIN_IN_CALL", 0},
+		{&cfg.roleIndexMaxAge, "DISCORD_ROLE_INDEX_MAX_AGE", time.Hour},
+		{&cfg.callsMinDuration, "DISCORD_CALLS_MIN_DURATION", time.Minute},
+		{&cfg.callsCooldown, "DISCORD_CALLS_COOLDOWN", 15 * time.Minute},
+		{&cfg.namesInterval, "DISCORD_NAMES_INTERVAL", 5 * time.Minute},
+		{&cfg.auditRetention, "DISCORD_AUDIT_RETENTION", 30 * 24 * time.Hour},
+	} {
+		if *d.dst, err = parseDuration(getenv, d.name, d.def); err != nil {
+			return nil, err
+		}
+	}
+	// Discord lets a channel be renamed only twice in ten minutes.
+	if cfg.namesInterval < 5*time.Minute {
+		return nil, fmt.Errorf("bad DISCORD_NAMES_INTERVAL: %q",
+			getenv("DISCORD_NAMES_INTERVAL"))
+	}
+	// Entries must expire, since /voice why reads the whole file.
+	if r := cfg.auditRetention; r == 0 || r > maxAuditRetention {
+		return nil, fmt.Errorf("bad DISCORD_AUDIT_RETENTION: %q",
+			getenv("DISCORD_AUDIT_RETENTION"))
+	}
+	cfg.leader, err = parseLeaderConfig(
+		getenv("DISCORD_LEADER_LOCK"),
+		getenv("DISCORD_LEADER_ID"),
+		getenv("DISCORD_LEADER_TTL"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// maxShards bounds DISCORD_SHARDS and DISCORD_SHARD_IDS, so that a typo in
+// a range can't exhaust memory. A shard holds up to 2500 guilds, so no bot
+// comes near it.
+const maxShards = 1 << 16
+
+// parseShardConfig parses DISCORD_SHARDS and DISCORD_SHARD_IDS.
+//
+// An empty count runs a single gateway connection without the shard manager.
+// "auto" uses the shard count recommended by Discord, and a number fixes it.
+// ids is a comma-separated list of shard IDs or inclusive ranges like "0-3",
+// which lets several processes split the shards between them.
+func parseShardConfig(count, ids string) (shardConfig, error) {
+	var sc shardConfig
+	switch count {
+	case "":
+		if ids != "" {
+			return sc, fmt.Errorf(
+				"DISCORD_SHARD_IDS set without DISCORD_SHARDS")
+		}
+		return sc, nil
+	case "auto":
+		sc.enabled = true
+	default:
+		n, err := strconv.Atoi(count)
+		if err != nil || n < 1 || n > maxShards {
+			return sc, fmt.Errorf("bad DISCORD_SHARDS: %q", count)
+		}
+		sc.enabled, sc.count = true, n
+	}
+	if ids == "" {
+		return sc, nil
+	}
+	seen := newSet[int]()
+	for part := range strings.SplitSeq(ids, ",") {
+		lo, hi, err := parseShardRange(strings.TrimSpace(part))
+		if err != nil {
+			return sc, fmt.Errorf("bad DISCORD_SHARD_IDS: %w", err)
+		}
+		if sc.count > 0 && hi >= sc.count {
+			return sc, fmt.Errorf("bad DISCORD_SHARD_IDS: "+
+				"shard %d out of range for %d shards", hi, sc.count)
+		}
+		if hi >= maxShards {
+			return sc, fmt.Errorf("bad DISCORD_SHARD_IDS: "+
+				"shard %d out of range for at most %d shards", hi, maxShards)
+		}
+		for id := lo; id <= hi; id++ {
+			if _, ok := seen[id]; ok {
+				continue
+			}
+			seen.Add(id)
+			sc.ids = append(sc.ids, id)
+		}
+	}
+	return sc, nil
+}
+
+// parseInteractionsConfig parses DISCORD_INTERACTIONS_ADDR and
+// DISCORD_PUBLIC_KEY. Discord signs the interactions it sends to an endpoint
+// with the application's key, which is shown in the developer portal.
+func parseInteractionsConfig(addr, key string) (interactionsConfig, error) {
+	ic := interactionsConfig{addr: addr, publicKey: key}
+	if addr == "" {
+		return ic, nil
+	}
+	if key == "" {
+		return ic, fmt.Errorf(
+			"DISCORD_INTERACTIONS_ADDR set without DISCORD_PUBLIC_KEY")
+	}
+	if k, err := hex.DecodeString(key); err != nil ||
+		len(k) != ed25519.PublicKeySize {
+		return ic, fmt.Errorf("bad DISCORD_PUBLIC_KEY: %q", key)
+	}
+	return ic, nil
+}
+
+// parsePresenceConfig parses DISCORD_PRESENCE_ADDR and
+// DISCORD_PRESENCE_ORIGINS, a comma-separated list of origins like
+// "https://lesiw.chat" that browsers may read the API from.
+func parsePresenceConfig(addr, origins string) (presenceConfig, error) {
+	pc := presenceConfig{addr: addr}
+	if origins == "" {
+		return pc, nil
+	}
+	if addr == "" {
+		return pc, fmt.Errorf(
+			"DISCORD_PRESENCE_ORIGINS set without DISCORD_PRESENCE_ADDR")
+	}
+	for part := range strings.SplitSeq(origins, ",") {
+		o := strings.TrimSpace(part)
+		u, err := url.Parse(o)
+		if err != nil || u.Scheme == "" || u.Host == "" ||
+			u.String() != u.Scheme+"://"+u.Host {
+			return pc, fmt.Errorf("bad DISCORD_PRESENCE_ORIGINS: %q", o)
+		}
+		pc.origins = append(pc.origins, o)
+	}
+	return pc, nil
+}
+
+// parseWebhookConfig parses DISCORD_WEBHOOK_URLS, a comma-separated list of
+// URLs to deliver webhooks to, DISCORD_WEBHOOK_SECRET and
+// DISCORD_WEBHOOK_FILE.
+func parseWebhookConfig(urls, secret, file string) (webhookConfig, error) {
+	wc := webhookConfig{secret: secret, file: file}
+	if urls == "" {
+		return wc, nil
+	}
+	for part := range strings.SplitSeq(urls, ",") {
+		s := strings.TrimSpace(part)
+		u, err := url.Parse(s)
+		if err != nil || u.Host == "" ||
+			(u.Scheme != "http" && u.Scheme != "https") {
+			return wc, fmt.Errorf("bad DISCORD_WEBHOOK_URLS: %q", s)
+		}
+		wc.urls = append(wc.urls, s)
+	}
+	if secret == "" {
+		return wc, fmt.Errorf(
+			"DISCORD_WEBHOOK_URLS set without DISCORD_WEBHOOK_SECRET")
+	}
+	return wc, nil
+}
+
+// parseOpsConfig parses DISCORD_OPS_CHANNEL, DISCORD_OPS_WEBHOOK and
+// DISCORD_OPS_LEVEL. Records are mirrored to a channel with the bot or
+// through a webhook URL, not both, from the warning level by default.
+func parseOpsConfig(channel, hook, level string) (opsConfig, error) {
+	oc := opsConfig{webhook: hook, level: slog.LevelWarn}
+	if channel != "" && hook != "" {
+		return oc, fmt.Errorf(
+			"DISCORD_OPS_CHANNEL and DISCORD_OPS_WEBHOOK are both set")
+	}
+	if channel != "" {
+		cid, err := snowflake.Parse(channel)
+		if err != nil {
+			return oc, fmt.Errorf("bad DISCORD_OPS_CHANNEL: %q", channel)
+		}
+		oc.channel = cid
+	}
+	if hook != "" {
+		if _, err := webhook.NewWithURL(hook); err != nil {
+			// The URL holds the webhook's token, so it is not repeated.
+			return oc, fmt.Errorf("bad DISCORD_OPS_WEBHOOK: not a webhook URL")
+		}
+	}
+	if level != "" {
+		if err := oc.level.UnmarshalText([]byte(level)); err != nil {
+			return oc, fmt.Errorf("bad DISCORD_OPS_LEVEL: %q", level)
+		}
+	}
+	return oc, nil
+}
+
+// parseLogConfig parses DISCORD_LOG_FORMAT, DISCORD_LOG_LEVEL and
+// DISCORD_LOG_LEVELS. Logs are text from the info level by default. levels is
+// a comma-separated list of module levels, like "voice=debug,names=warn".
+func parseLogConfig(format, level, levels string) (logConfig, error) {
+	lc := logConfig{format: format, level: slog.LevelInfo}
+	switch format {
+	case "":
+		lc.format = "text"
+	case "text", "json":
+	default:
+		return lc, fmt.Errorf("bad DISCORD_LOG_FORMAT: %q", format)
+	}
+	if level != "" {
+		if err := lc.level.UnmarshalText([]byte(level)); err != nil {
+			return lc, fmt.Errorf("bad DISCORD_LOG_LEVEL: %q", level)
+		}
+	}
+	if levels == "" {
+		return lc, nil
+	}
+	lc.modules = make(map[string]slog.Level)
+	for part := range strings.SplitSeq(levels, ",") {
+		name, text, ok := strings.Cut(strings.TrimSpace(part), "=")
+		var l slog.Level
+		if !ok || name == "" || l.UnmarshalText([]byte(text)) != nil {
+			return lc, fmt.Errorf("bad DISCORD_LOG_LEVELS: %q", part)
+		}
+		lc.modules[name] = l
+	}
+	return lc, nil
+}
+
+// parseTraceConfig parses DISCORD_TRACE_ENDPOINT, the URL of an OTLP/HTTP
+// traces endpoint like "http://localhost:4318/v1/traces".
+func parseTraceConfig(endpoint string) (traceConfig, error) {
+	tc := traceConfig{endpoint: endpoint}
+	if endpoint == "" {
+		return tc, nil
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") ||
+		u.Host == "" {
+		return tc, fmt.Errorf("bad DISCORD_TRACE_ENDPOINT: %q", endpoint)
+	}
+	return tc, nil
+}
+
+// parseModules parses DISCORD_MODULES, a comma-separated list of modules to
+// enable. A module may be followed by the guilds it is on in, like
+// "voice:123:456"; otherwise it is on in every guild. Empty enables every
+// module everywhere.
+func parseModules(s string) (map[string][]snowflake.ID, error) {
+	if s == "" {
+		return nil, nil
+	}
+	mods := make(map[string][]snowflake.ID)
+	for part := range strings.SplitSeq(s, ",") {
+		name, guilds, _ := strings.Cut(strings.TrimSpace(part), ":")
+		if name == "" {
+			return nil, fmt.Errorf("bad DISCORD_MODULES: %q", s)
+		}
+		if _, ok := mods[name]; ok {
+			return nil, fmt.Errorf(
+				"bad DISCORD_MODULES: module %q listed twice", name)
+		}
+		mods[name] = nil
+		if guilds == "" {
+			continue
+		}
+		for g := range strings.SplitSeq(guilds, ":") {
+			gid, err := snowflake.Parse(g)
+			if err != nil {
+				return nil, fmt.Errorf("bad DISCORD_MODULES: bad guild %q", g)
+			}
+			mods[name] = append(mods[name], gid)
+		}
+	}
+	return mods, nil
+}
+
+// parseIDs parses a comma-separated list of snowflakes from the variable
+// name.
+func parseIDs(name, s string) ([]snowflake.ID, error) {
+	var ids []snowflake.ID
+	if s == "" {
+		return ids, nil
+	}
+	for part := range strings.SplitSeq(s, ",") {
+		id, err := snowflake.Parse(strings.TrimSpace(part))
+		if err != nil {
+			return nil, fmt.Errorf("bad %s: %q", name, part)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func parseLeaderConfig(lock, id, ttl string) (leaderConfig, error) {
+	lc := leaderConfig{lock: lock, id: id, ttl: 15 * time.Second}
+	if lc.id == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return lc, fmt.Errorf("could not get hostname: %w", err)
+		}
+		lc.id = fmt.Sprintf("%s-%d", host, os.Getpid())
+	}
+	if ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil || d < 3*time.Second {
+			return lc, fmt.Errorf("bad DISCORD_LEADER_TTL: %q", ttl)
+		}
+		lc.ttl = d
+	}
+	return lc, nil
+}
+
+func parseDuration(
+	getenv func(string) string, name string, def time.Duration,
+) (time.Duration, error) {
+	v := getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("bad %s: %q", name, v)
+	}
+	return d, nil
+}
+
+func parseShardRange(s string) (lo, hi int, err error) {
+	a, b, isRange := strings.Cut(s, "-")
+	if lo, err = strconv.Atoi(a); err != nil || lo < 0 {
+		return 0, 0, fmt.Errorf("bad shard ID %q", s)
+	}
+	if !isRange {
+		return lo, lo, nil
+	}
+	if hi, err = strconv.Atoi(b); err != nil || hi < lo {
+		return 0, 0, fmt.Errorf("bad shard range %q", s)
+	}
+	return lo, hi, nil
+}
@@ -0,0 +1,535 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/disgoorg/snowflake/v2"
+	"github.com/google/go-cmp/cmp"
+)
+
+type parseShardConfigTest struct {
+	desc    string
+	count   string
+	ids     string
+	want    shardConfig
+	wantErr error
+}
+
+var parseShardConfigTests = []parseShardConfigTest{{
+	desc: "unsharded",
+}, {
+	desc:    "ids without count",
+	ids:     "0",
+	wantErr: fmt.Errorf("DISCORD_SHARD_IDS set without DISCORD_SHARDS"),
+}, {
+	desc:  "auto",
+	count: "auto",
+	want:  shardConfig{enabled: true},
+}, {
+	desc:  "fixed count",
+	count: "4",
+	want:  shardConfig{enabled: true, count: 4},
+}, {
+	desc:    "bad count",
+	count:   "zero",
+	wantErr: fmt.Errorf(`bad DISCORD_SHARDS: "zero"`),
+}, {
+	desc:    "zero count",
+	count:   "0",
+	wantErr: fmt.Errorf(`bad DISCORD_SHARDS: "0"`),
+}, {
+	desc:  "id list and range",
+	count: "8",
+	ids:   "0-2, 5,1",
+	want:  shardConfig{enabled: true, count: 8, ids: []int{0, 1, 2, 5}},
+}, {
+	desc:  "auto with ids",
+	count: "auto",
+	ids:   "3",
+	want:  shardConfig{enabled: true, ids: []int{3}},
+}, {
+	desc:    "id out of range",
+	count:   "2",
+	ids:     "1-2",
+	wantErr: fmt.Errorf("bad DISCORD_SHARD_IDS: shard 2 out of range for 2 shards"),
+}, {
+	desc:  "huge range with auto",
+	count: "auto",
+	ids:   "0-4000000000",
+	wantErr: fmt.Errorf("bad DISCORD_SHARD_IDS: " +
+		"shard 4000000000 out of range for at most 65536 shards"),
+}, {
+	desc:    "too many shards",
+	count:   "65537",
+	wantErr: fmt.Errorf(`bad DISCORD_SHARDS: "65537"`),
+}, {
+	desc:    "backwards range",
+	count:   "4",
+	ids:     "3-1",
+	wantErr: fmt.Errorf(`bad DISCORD_SHARD_IDS: bad shard range "3-1"`),
+}, {
+	desc:    "negative id",
+	count:   "4",
+	ids:     "-1",
+	wantErr: fmt.Errorf(`bad DISCORD_SHARD_IDS: bad shard ID "-1"`),
+}}
+
+func TestParseShardConfig(t *testing.T) {
+	for _, tt := range parseShardConfigTests {
+		t.Run(tt.desc, func(t *testing.T) {
+			sc, err := parseShardConfig(tt.count, tt.ids)
+
+			gotErr, wantErr := fmt.Sprintf("%v", err),
+				fmt.Sprintf("%v", tt.wantErr)
+			if gotErr != wantErr {
+				t.Errorf("%s(%q, %q): %v, want %v",
+					funcname(t, parseShardConfig), tt.count, tt.ids,
+					err, tt.wantErr)
+				return
+			}
+			if err != nil {
+				return
+			}
+			opt := cmp.AllowUnexported(shardConfig{})
+			if got, want := sc, tt.want; !cmp.Equal(got, want, opt) {
+				t.Errorf("%s(%q, %q) -want +got\n%s",
+					funcname(t, parseShardConfig), tt.count, tt.ids,
+					cmp.Diff(want, got, opt))
+			}
+		})
+	}
+}
+
+func TestParseInteractionsConfig(t *testing.T) {
+	key := strings.Repeat("ab", 32)
+	tests := []struct {
+		desc      string
+		addr, key string
+		wantErr   error
+	}{{
+		desc: "gateway",
+	}, {
+		desc: "endpoint",
+		addr: ":8081",
+		key:  key,
+	}, {
+		desc: "key without endpoint",
+		key:  "ignored",
+	}, {
+		desc:    "endpoint without key",
+		addr:    ":8081",
+		wantErr: fmt.Errorf("DISCORD_INTERACTIONS_ADDR set without DISCORD_PUBLIC_KEY"),
+	}, {
+		desc:    "short key",
+		addr:    ":8081",
+		key:     "abcd",
+		wantErr: fmt.Errorf(`bad DISCORD_PUBLIC_KEY: "abcd"`),
+	}, {
+		desc:    "not hex",
+		addr:    ":8081",
+		key:     "not a key",
+		wantErr: fmt.Errorf(`bad DISCORD_PUBLIC_KEY: "not a key"`),
+	}}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			_, err := parseInteractionsConfig(tt.addr, tt.key)
+			gotErr, wantErr := fmt.Sprintf("%v", err),
+				fmt.Sprintf("%v", tt.wantErr)
+			if gotErr != wantErr {
+				t.Errorf("%s(%q, %q): %v, want %v",
+					funcname(t, parseInteractionsConfig), tt.addr, tt.key,
+					err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseModules(t *testing.T) {
+	tests := []struct {
+		desc    string
+		s       string
+		want    map[string][]snowflake.ID
+		wantErr error
+	}{{
+		desc: "unset",
+	}, {
+		desc: "every guild",
+		s:    "voice",
+		want: map[string][]snowflake.ID{"voice": nil},
+	}, {
+		desc: "some guilds",
+		s:    "voice:1:2, stage",
+		want: map[string][]snowflake.ID{"voice": {1, 2}, "stage": nil},
+	}, {
+		desc:    "bad guild",
+		s:       "voice:one",
+		wantErr: fmt.Errorf(`bad DISCORD_MODULES: bad guild "one"`),
+	}, {
+		desc:    "empty name",
+		s:       "voice,",
+		wantErr: fmt.Errorf(`bad DISCORD_MODULES: "voice,"`),
+	}, {
+		desc:    "twice",
+		s:       "voice:1,voice:2",
+		wantErr: fmt.Errorf(`bad DISCORD_MODULES: module "voice" listed twice`),
+	}}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			got, err := parseModules(tt.s)
+
+			gotErr, wantErr := fmt.Sprintf("%v", err),
+				fmt.Sprintf("%v", tt.wantErr)
+			if gotErr != wantErr {
+				t.Fatalf("%s(%q): %v, want %v",
+					funcname(t, parseModules), tt.s, err, tt.wantErr)
+			}
+			if !cmp.Equal(got, tt.want) {
+				t.Errorf("%s(%q) -want +got\n%s",
+					funcname(t, parseModules), tt.s, cmp.Diff(tt.want, got))
+			}
+		})
+	}
+}
+
+func TestParsePresenceConfig(t *testing.T) {
+	tests := []struct {
+		desc    string
+		addr    string
+		origins string
+		want    presenceConfig
+		wantErr error
+	}{{
+		desc: "unset",
+	}, {
+		desc: "any origin",
+		addr: ":8082",
+		want: presenceConfig{addr: ":8082"},
+	}, {
+		desc:    "some origins",
+		addr:    ":8082",
+		origins: "https://lesiw.chat, http://localhost:3000",
+		want: presenceConfig{
+			addr:    ":8082",
+			origins: []string{"https://lesiw.chat", "http://localhost:3000"},
+		},
+	}, {
+		desc:    "origins without addr",
+		origins: "https://lesiw.chat",
+		wantErr: fmt.Errorf(
+			"DISCORD_PRESENCE_ORIGINS set without DISCORD_PRESENCE_ADDR"),
+	}, {
+		desc:    "origin with path",
+		addr:    ":8082",
+		origins: "https://lesiw.chat/voice",
+		wantErr: fmt.Errorf(
+			`bad DISCORD_PRESENCE_ORIGINS: "https://lesiw.chat/voice"`),
+	}, {
+		desc:    "host without scheme",
+		addr:    ":8082",
+		origins: "lesiw.chat",
+		wantErr: fmt.Errorf(`bad DISCORD_PRESENCE_ORIGINS: "lesiw.chat"`),
+	}}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			got, err := parsePresenceConfig(tt.addr, tt.origins)
+
+			gotErr, wantErr := fmt.Sprintf("%v", err),
+				fmt.Sprintf("%v", tt.wantErr)
+			if gotErr != wantErr {
+				t.Fatalf("%s(%q, %q): %v, want %v",
+					funcname(t, parsePresenceConfig), tt.addr, tt.origins,
+					err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if !cmp.Equal(got, tt.want, cmp.AllowUnexported(got)) {
+				t.Errorf("%s(%q, %q) -want +got\n%s",
+					funcname(t, parsePresenceConfig), tt.addr, tt.origins,
+					cmp.Diff(tt.want, got, cmp.AllowUnexported(got)))
+			}
+		})
+	}
+}
+
+func TestParseWebhookConfig(t *testing.T) {
+	tests := []struct {
+		desc    string
+		urls    string
+		secret  string
+		want    webhookConfig
+		wantErr error
+	}{{
+		desc: "unset",
+	}, {
+		desc:   "urls",
+		urls:   "https://example.com/hook, http://localhost:9000",
+		secret: "s3cret",
+		want: webhookConfig{
+			urls:   []string{"https://example.com/hook", "http://localhost:9000"},
+			secret: "s3cret",
+		},
+	}, {
+		desc: "no secret",
+		urls: "https://example.com/hook",
+		wantErr: fmt.Errorf(
+			"DISCORD_WEBHOOK_URLS set without DISCORD_WEBHOOK_SECRET"),
+	}, {
+		desc:    "bad scheme",
+		urls:    "ftp://example.com",
+		secret:  "s3cret",
+		wantErr: fmt.Errorf(`bad DISCORD_WEBHOOK_URLS: "ftp://example.com"`),
+	}, {
+		desc:    "relative",
+		urls:    "/hook",
+		secret:  "s3cret",
+		wantErr: fmt.Errorf(`bad DISCORD_WEBHOOK_URLS: "/hook"`),
+	}}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			got, err := parseWebhookConfig(tt.urls, tt.secret, "")
+
+			gotErr, wantErr := fmt.Sprintf("%v", err),
+				fmt.Sprintf("%v", tt.wantErr)
+			if gotErr != wantErr {
+				t.Fatalf("%s(%q, %q): %v, want %v",
+					funcname(t, parseWebhookConfig), tt.urls, tt.secret,
+					err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if !cmp.Equal(got, tt.want, cmp.AllowUnexported(got)) {
+				t.Errorf("%s(%q, %q) -want +got\n%s",
+					funcname(t, parseWebhookConfig), tt.urls, tt.secret,
+					cmp.Diff(tt.want, got, cmp.AllowUnexported(got)))
+			}
+		})
+	}
+}
+
+func TestParseOpsConfig(t *testing.T) {
+	const hook = "https://discord.com/api/webhooks/123/token"
+	tests := []struct {
+		desc    string
+		channel string
+		hook    string
+		level   string
+		want    opsConfig
+		wantErr error
+	}{{
+		desc: "unset",
+		want: opsConfig{level: slog.LevelWarn},
+	}, {
+		desc:    "channel",
+		channel: "5",
+		level:   "error",
+		want:    opsConfig{channel: 5, level: slog.LevelError},
+	}, {
+		desc: "webhook",
+		hook: hook,
+		want: opsConfig{webhook: hook, level: slog.LevelWarn},
+	}, {
+		desc:    "both",
+		channel: "5",
+		hook:    hook,
+		wantErr: fmt.Errorf(
+			"DISCORD_OPS_CHANNEL and DISCORD_OPS_WEBHOOK are both set"),
+	}, {
+		desc:    "bad webhook",
+		hook:    "https://discord.com/api/webhooks/123",
+		wantErr: fmt.Errorf("bad DISCORD_OPS_WEBHOOK: not a webhook URL"),
+	}, {
+		desc:    "bad level",
+		channel: "5",
+		level:   "loud",
+		wantErr: fmt.Errorf(`bad DISCORD_OPS_LEVEL: "loud"`),
+	}}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			got, err := parseOpsConfig(tt.channel, tt.hook, tt.level)
+
+			gotErr, wantErr := fmt.Sprintf("%v", err),
+				fmt.Sprintf("%v", tt.wantErr)
+			if gotErr != wantErr {
+				t.Fatalf("%s(%q, %q, %q): %v, want %v",
+					funcname(t, parseOpsConfig), tt.channel, tt.hook,
+					tt.level, err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if !cmp.Equal(got, tt.want, cmp.AllowUnexported(got)) {
+				t.Errorf("%s(%q, %q, %q) -want +got\n%s",
+					funcname(t, parseOpsConfig), tt.channel, tt.hook,
+					tt.level, cmp.Diff(tt.want, got, cmp.AllowUnexported(got)))
+			}
+		})
+	}
+}
+
+func TestParseLogConfig(t *testing.T) {
+	tests := []struct {
+		desc    string
+		format  string
+		level   string
+		levels  string
+		want    logConfig
+		wantErr error
+	}{{
+		desc: "unset",
+		want: logConfig{format: "text", level: slog.LevelInfo},
+	}, {
+		desc:   "json",
+		format: "json",
+		level:  "warn",
+		levels: "voice=debug, names=error",
+		want: logConfig{
+			format: "json",
+			level:  slog.LevelWarn,
+			modules: map[string]slog.Level{
+				"voice": slog.LevelDebug,
+				"names": slog.LevelError,
+			},
+		},
+	}, {
+		desc:    "bad format",
+		format:  "xml",
+		wantErr: fmt.Errorf(`bad DISCORD_LOG_FORMAT: "xml"`),
+	}, {
+		desc:    "bad level",
+		level:   "loud",
+		wantErr: fmt.Errorf(`bad DISCORD_LOG_LEVEL: "loud"`),
+	}, {
+		desc:    "bad module level",
+		levels:  "voice=debug,names",
+		wantErr: fmt.Errorf(`bad DISCORD_LOG_LEVELS: "names"`),
+	}}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			got, err := parseLogConfig(tt.format, tt.level, tt.levels)
+
+			gotErr, wantErr := fmt.Sprintf("%v", err),
+				fmt.Sprintf("%v", tt.wantErr)
+			if gotErr != wantErr {
+				t.Fatalf("%s(%q, %q, %q): %v, want %v",
+					funcname(t, parseLogConfig), tt.format, tt.level,
+					tt.levels, err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if !cmp.Equal(got, tt.want, cmp.AllowUnexported(got)) {
+				t.Errorf("%s(%q, %q, %q) -want +got\n%s",
+					funcname(t, parseLogConfig), tt.format, tt.level,
+					tt.levels, cmp.Diff(tt.want, got, cmp.AllowUnexported(got)))
+			}
+		})
+	}
+}
+
+func TestParseTraceConfig(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		wantErr  error
+	}{
+		{endpoint: ""},
+		{endpoint: "http://localhost:4318/v1/traces"},
+		{endpoint: "https://otlp.example.com/v1/traces"},
+		{
+			endpoint: "localhost:4318",
+			wantErr:  fmt.Errorf(`bad DISCORD_TRACE_ENDPOINT: "localhost:4318"`),
+		},
+		{
+			endpoint: "grpc://localhost:4317",
+			wantErr: fmt.Errorf(
+				`bad DISCORD_TRACE_ENDPOINT: "grpc://localhost:4317"`),
+		},
+	}
+	for _, tt := range tests {
+		got, err := parseTraceConfig(tt.endpoint)
+		gotErr, wantErr := fmt.Sprintf("%v", err),
+			fmt.Sprintf("%v", tt.wantErr)
+		if gotErr != wantErr {
+			t.Errorf("%s(%q): %v, want %v",
+				funcname(t, parseTraceConfig), tt.endpoint, err, tt.wantErr)
+		} else if err == nil && got.endpoint != tt.endpoint {
+			t.Errorf("%s(%q).endpoint = %q",
+				funcname(t, parseTraceConfig), tt.endpoint, got.endpoint)
+		}
+	}
+}
+
+func TestLoadConfigDurations(t *testing.T) {
+	tests := []struct {
+		desc    string
+		env     map[string]string
+		wantErr error
+	}{{
+		desc: "defaults",
+	}, {
+		desc: "shortest names interval",
+		env:  map[string]string{"DISCORD_NAMES_INTERVAL": "5m"},
+	}, {
+		desc:    "names interval too short",
+		env:     map[string]string{"DISCORD_NAMES_INTERVAL": "4m59s"},
+		wantErr: fmt.Errorf(`bad DISCORD_NAMES_INTERVAL: "4m59s"`),
+	}, {
+		desc: "longest audit retention",
+		env:  map[string]string{"DISCORD_AUDIT_RETENTION": "2160h"},
+	}, {
+		desc:    "audit retention too long",
+		env:     map[string]string{"DISCORD_AUDIT_RETENTION": "2161h"},
+		wantErr: fmt.Errorf(`bad DISCORD_AUDIT_RETENTION: "2161h"`),
+	}, {
+		desc:    "audit retention forever",
+		env:     map[string]string{"DISCORD_AUDIT_RETENTION": "0"},
+		wantErr: fmt.Errorf(`bad DISCORD_AUDIT_RETENTION: "0"`),
+	}}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			_, err := loadConfig(func(k string) string {
+				if k == "DISCORD_TOKEN" {
+					return fakeToken
+				}
+				return tt.env[k]
+			})
+			gotErr, wantErr := fmt.Sprintf("%v", err),
+				fmt.Sprintf("%v", tt.wantErr)
+			if gotErr != wantErr {
+				t.Errorf("%s(%v): %v, want %v",
+					funcname(t, loadConfig), tt.env, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseIDs(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    []snowflake.ID
+		wantErr error
+	}{
+		{s: ""},
+		{s: "1, 2", want: []snowflake.ID{1, 2}},
+		{
+			s:       "1,two,3",
+			wantErr: fmt.Errorf(`bad DISCORD_CALLS_CHANNELS: "two"`),
+		},
+	}
+	for _, tt := range tests {
+		got, err := parseIDs("DISCORD_CALLS_CHANNELS", tt.s)
+		gotErr, wantErr := fmt.Sprintf("%v", err),
+			fmt.Sprintf("%v", tt.wantErr)
+		if gotErr != wantErr {
+			t.Errorf("%s(%q): %v, want %v",
+				funcname(t, parseIDs), tt.s, err, tt.wantErr)
+		} else if !cmp.Equal(got, tt.want) {
+			t.Errorf("%s(%q) -want +got\n%s",
+				funcname(t, parseIDs), tt.s, cmp.Diff(tt.want, got))
+		}
+	}
+}
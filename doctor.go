@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+
+	disgobot "github.com/disgoorg/disgo/bot"
+	"github.com/disgoorg/disgo/discord"
+	"github.com/disgoorg/snowflake/v2"
+)
+
+// doctor checks the things the bot needs from Discord that its configuration
+// cannot: the privileged members intent, gateway sessions left for the day,
+// and, in each guild, a voice role the bot is allowed to assign.
+func (c *cli) doctor(_ context.Context, args []string) error {
+	var gid snowflake.ID
+	if err := parse(c.flags("doctor", &gid), args, nil); err != nil {
+		return err
+	}
+	cfg, mods, bot, err := c.client()
+	if err != nil {
+		fmt.Fprintf(c.stdout, "FAIL  config: %v\n", err)
+		return err
+	}
+	defer bot.Close(context.Background())
+	d := &checkup{w: c.stdout}
+	d.check("config", func() (string, error) { return "ok", nil })
+	d.check("application", func() (string, error) {
+		return checkApplication(bot, mods)
+	})
+	d.check("gateway", func() (string, error) {
+		return checkGateway(bot, cfg.shards)
+	})
+	guilds, err := botGuilds(bot)
+	d.check("guilds", func() (string, error) {
+		if err != nil {
+			return "", fmt.Errorf("could not get guilds: %w", err)
+		}
+		if gid == 0 {
+			return fmt.Sprintf("in %d guilds", len(guilds)), nil
+		}
+		if !slices.ContainsFunc(guilds, func(g discord.OAuth2Guild) bool {
+			return g.ID == gid
+		}) {
+			return "", fmt.Errorf("bot is not in guild %s", gid)
+		}
+		return "ok", nil
+	})
+	for _, g := range guilds {
+		if gid != 0 && g.ID != gid {
+			continue
+		}
+		d.check(fmt.Sprintf("guild %s (%s)", g.ID, g.Name),
+			func() (string, error) {
+				return checkGuild(bot, g.ID, g.Permissions)
+			})
+	}
+	if d.failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", d.failed, d.checks)
+	}
+	return nil
+}
+
+// checkup reports the result of each check as a line of w.
+type checkup struct {
+	w              io.Writer
+	checks, failed int
+}
+
+func (d *checkup) check(name string, f func() (string, error)) {
+	d.checks++
+	detail, err := f()
+	if err != nil {
+		d.failed++
+		fmt.Fprintf(d.w, "FAIL  %s: %v\n", name, err)
+		return
+	}
+	fmt.Fprintf(d.w, "ok    %s: %s\n", name, detail)
+}
+
+func checkApplication(
+	bot disgobot.Client, mods []enabledModule,
+) (string, error) {
+	app, err := bot.Rest().GetBotApplicationInfo()
+	if err != nil {
+		return "", fmt.Errorf("could not get application: %w", err)
+	}
+	intents, _ := gatewayNeeds(mods)
+	if denied := deniedIntents(app.Flags, intents); denied != 0 {
+		return "", fmt.Errorf("%s intent is not enabled "+
+			"in the developer portal", intentNames(denied))
+	}
+	return app.Name, nil
+}
+
+func checkGateway(bot disgobot.Client, sc shardConfig) (string, error) {
+	gw, err := bot.Rest().GetGatewayBot()
+	if err != nil {
+		return "", fmt.Errorf("could not get gateway: %w", err)
+	}
+	limit := gw.SessionStartLimit
+	if limit.Remaining == 0 {
+		return "", fmt.Errorf("no sessions left until reset in %dms",
+			limit.ResetAfter)
+	}
+	detail := fmt.Sprintf("%d of %d sessions left, %d shards recommended",
+		limit.Remaining, limit.Total, gw.Shards)
+	if sc.count > 0 && sc.count < gw.Shards {
+		detail += fmt.Sprintf(" (running %d)", sc.count)
+	}
+	return detail, nil
+}
+
+// checkGuild checks that the bot can assign the voice role in gid, given its
+// permissions there.
+func checkGuild(
+	bot disgobot.Client, gid snowflake.ID, perms discord.Permissions,
+) (string, error) {
+	if !perms.Has(discord.PermissionManageRoles) &&
+		!perms.Has(discord.PermissionAdministrator) {
+		return "", fmt.Errorf("missing Manage Roles permission")
+	}
+	roles, err := bot.Rest().GetRoles(gid)
+	if err != nil {
+		return "", fmt.Errorf("could not get roles: %w", err)
+	}
+	i := slices.IndexFunc(roles, func(r discord.Role) bool {
+		return r.Name == voiceRole
+	})
+	if i < 0 {
+		return "", fmt.Errorf("no %q role", voiceRole)
+	}
+	voice := roles[i]
+	// A bot user shares its application's ID, which is known before the
+	// gateway sends READY.
+	self, err := bot.Rest().GetMember(gid, bot.ApplicationID())
+	if err != nil {
+		return "", fmt.Errorf("could not get bot member: %w", err)
+	}
+	top := 0
+	for _, r := range roles {
+		if slices.Contains(self.RoleIDs, r.ID) {
+			top = max(top, r.Position)
+		}
+	}
+	if top <= voice.Position {
+		return "", fmt.Errorf("role %q is not below the bot's highest role",
+			voiceRole)
+	}
+	return fmt.Sprintf("can assign %q", voiceRole), nil
+}
+
+// botGuildsPage is the most guilds Discord lists at once.
+const botGuildsPage = 200
+
+// botGuilds lists every guild the bot is in, a page at a time.
+func botGuilds(bot disgobot.Client) ([]discord.OAuth2Guild, error) {
+	var guilds []discord.OAuth2Guild
+	for after := snowflake.ID(0); ; {
+		page, err := bot.Rest().GetCurrentUserGuilds("", 0, after,
+			botGuildsPage, false)
+		if err != nil {
+			return nil, err
+		}
+		guilds = append(guilds, page...)
+		if len(page) < botGuildsPage {
+			return guilds, nil
+		}
+		after = page[len(page)-1].ID
+	}
+}
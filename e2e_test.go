@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	disgobot "github.com/disgoorg/disgo/bot"
+	"github.com/disgoorg/disgo/rest"
+	"github.com/disgoorg/snowflake/v2"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRunEndToEnd(t *testing.T) {
+	const (
+		guildID   snowflake.ID = 1
+		roleID    snowflake.ID = 2
+		channelID snowflake.ID = 3
+		alice     snowflake.ID = 10
+		bob       snowflake.ID = 11
+		carol     snowflake.ID = 12
+	)
+	f := newFakeDiscord(t, guildID)
+	f.addVoiceChannel(channelID, "General")
+	f.addRole(roleID, "voice")
+	f.addMember(alice, "alice")
+	f.addMember(bob, "bob", roleID)
+	f.addMember(carol, "carol")
+	f.setVoice(alice, ptr(channelID))
+
+	recording := filepath.Join(t.TempDir(), "events.jsonl")
+	t.Cleanup(setDefaultHandler(f.logger().Handler()))
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan error, 1)
+	go func() {
+		done <- run(ctx, &config{
+			token:      fakeToken,
+			leader:     leaderConfig{ttl: 15 * time.Second},
+			recordFile: recording,
+		}, http.NewServeMux(), disgobot.WithRestClientConfigOpts(
+			rest.WithURL(f.srv.URL),
+		))
+	}()
+
+	want := []roleMutation{
+		{Add: false, GuildID: guildID, UserID: bob, RoleID: roleID},
+		{Add: true, GuildID: guildID, UserID: alice, RoleID: roleID},
+	}
+	if got := f.waitMutations(2); !cmp.Equal(got, want) {
+		t.Fatalf("initial sync -want +got\n%s", cmp.Diff(want, got))
+	}
+
+	f.setVoice(carol, ptr(channelID))
+	want = append(want,
+		roleMutation{Add: true, GuildID: guildID, UserID: carol, RoleID: roleID})
+	if got := f.waitMutations(3); !cmp.Equal(got, want) {
+		t.Fatalf("after join -want +got\n%s", cmp.Diff(want, got))
+	}
+
+	f.setVoice(alice, nil)
+	want = append(want,
+		roleMutation{Add: false, GuildID: guildID, UserID: alice, RoleID: roleID})
+	if got := f.waitMutations(4); !cmp.Equal(got, want) {
+		t.Fatalf("after leave -want +got\n%s", cmp.Diff(want, got))
+	}
+
+	f.quiesce()
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("run(): %v", err)
+		}
+	case <-time.After(15 * time.Second):
+		t.Fatal("run() did not return after cancel")
+	}
+
+	// Replaying the recording makes the same role changes.
+	rec, err := os.Open(recording)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rec.Close()
+	var out bytes.Buffer
+	if err := replay(t.Context(), new(config), rec, &out); err != nil {
+		t.Fatalf("replay(): %v", err)
+	}
+	var replayed []roleMutation
+	for dec := json.NewDecoder(&out); dec.More(); {
+		var m roleChange
+		if err := dec.Decode(&m); err != nil {
+			t.Fatal(err)
+		}
+		replayed = append(replayed, roleMutation{
+			Add: m.Add, GuildID: m.GuildID, UserID: m.UserID, RoleID: m.RoleID,
+		})
+	}
+	if !cmp.Equal(replayed, want) {
+		t.Errorf("replay -want +got\n%s", cmp.Diff(want, replayed))
+	}
+}
+
+func TestRunStreamingRoles(t *testing.T) {
+	const (
+		guildID   snowflake.ID = 1
+		voiceID   snowflake.ID = 2
+		channelID snowflake.ID = 3
+		liveID    snowflake.ID = 4
+		cameraID  snowflake.ID = 5
+		alice     snowflake.ID = 10
+		bob       snowflake.ID = 11
+	)
+	f := newFakeDiscord(t, guildID)
+	f.addVoiceChannel(channelID, "General")
+	f.addRole(voiceID, "voice")
+	f.addRole(liveID, "live")
+	f.addRole(cameraID, "camera")
+	f.addMember(alice, "alice")
+	f.addMember(bob, "bob", liveID)
+	f.setVoice(alice, ptr(channelID))
+	f.setStreaming(alice, true, false)
+	runFake(t, f)
+
+	want := []roleMutation{
+		{Add: true, GuildID: guildID, UserID: alice, RoleID: voiceID},
+		{Add: false, GuildID: guildID, UserID: bob, RoleID: liveID},
+		{Add: true, GuildID: guildID, UserID: alice, RoleID: liveID},
+	}
+	if got := f.waitMutations(3); !cmp.Equal(got, want) {
+		t.Fatalf("initial sync -want +got\n%s", cmp.Diff(want, got))
+	}
+
+	// A sync already under way may see the stream stop after the camera
+	// starts, so the order of the changes that follow is not fixed.
+	f.setStreaming(alice, false, true)
+	want = append(want,
+		roleMutation{Add: false, GuildID: guildID, UserID: alice, RoleID: liveID},
+		roleMutation{Add: true, GuildID: guildID, UserID: alice, RoleID: cameraID},
+	)
+	if got := f.waitMutations(5); !cmp.Equal(got, want, anyMutationOrder) {
+		t.Fatalf("after camera on -want +got\n%s",
+			cmp.Diff(want, got, anyMutationOrder))
+	}
+
+	f.setVoice(alice, nil)
+	want = append(want,
+		roleMutation{Add: false, GuildID: guildID, UserID: alice, RoleID: voiceID},
+		roleMutation{Add: false, GuildID: guildID, UserID: alice, RoleID: cameraID},
+	)
+	if got := f.waitMutations(7); !cmp.Equal(got, want, anyMutationOrder) {
+		t.Fatalf("after leave -want +got\n%s", cmp.Diff(want, got, anyMutationOrder))
+	}
+}
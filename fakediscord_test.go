@@ -0,0 +1,1015 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	disgobot "github.com/disgoorg/disgo/bot"
+	"github.com/disgoorg/disgo/discord"
+	"github.com/disgoorg/disgo/events"
+	"github.com/disgoorg/disgo/gateway"
+	"github.com/disgoorg/disgo/rest"
+	"github.com/disgoorg/snowflake/v2"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/gorilla/websocket"
+)
+
+const fakeBotID snowflake.ID = 1000
+
+var fakeToken = base64.RawStdEncoding.EncodeToString(
+	[]byte(fakeBotID.String()),
+) + ".fake.token"
+
+// fakeDiscord is an in-process Discord REST API and gateway serving a single
+// guild. The real disgo client can be pointed at it with rest.WithURL.
+type fakeDiscord struct {
+	t        testing.TB
+	srv      *httptest.Server
+	requests atomic.Int64 // REST requests served.
+
+	mu          sync.Mutex
+	guildID     snowflake.ID
+	channels    []json.RawMessage
+	stages      set[snowflake.ID] // Stage channels.
+	roles       []discord.Role
+	members     map[snowflake.ID]discord.Member
+	voiceStates map[snowflake.ID]discord.VoiceState
+	mutations   []roleMutation
+	changed     chan struct{}
+	voiceGets   []snowflake.ID // Users whose voice state was asked for.
+
+	botRoles    []snowflake.ID
+	permissions discord.Permissions      // The bot's, in the guild.
+	appFlags    discord.ApplicationFlags // Of the bot's application.
+	commandPuts []string                 // Paths commands were set at.
+	disallowed  gateway.Intents          // Closes the gateway with 4014.
+	closeCode   int                      // Closes the next IDENTIFY once.
+	intents     gateway.Intents          // Of the last IDENTIFY.
+	messages    []fakeChatMessage        // Posted by the bot, as edited.
+	renames     []fakeRename             // Of channels, by the bot.
+
+	identified   chan struct{} // Closed once the guild has been sent.
+	identifyOnce sync.Once
+	resumed      chan string // Receives the session ID of each RESUME.
+
+	connMu sync.Mutex
+	conn   *websocket.Conn
+	seq    int
+	hellos int  // Sent, one for each heartbeat goroutine started.
+	quiet  bool // Nothing more is sent, see quiesce.
+
+	clientSync *clientSync
+}
+
+type roleMutation struct {
+	Add             bool
+	GuildID, UserID snowflake.ID
+	RoleID          snowflake.ID
+}
+
+// anyMutationOrder compares role mutations regardless of order, for syncs
+// that race with the events they follow.
+var anyMutationOrder = cmpopts.SortSlices(func(a, b roleMutation) bool {
+	return a.UserID < b.UserID || a.UserID == b.UserID && a.RoleID < b.RoleID
+})
+
+type fakeChatMessage struct {
+	ChannelID snowflake.ID
+	Content   string
+	Pings     []snowflake.ID // Roles the message was allowed to ping.
+}
+
+type fakeRename struct {
+	ChannelID snowflake.ID
+	Name      string
+}
+
+// anyRenameOrder compares renames regardless of order, for channels renamed
+// from separate timers.
+var anyRenameOrder = cmpopts.SortSlices(func(a, b fakeRename) bool {
+	return a.ChannelID < b.ChannelID
+})
+
+type fakeMessage struct {
+	Op gateway.Opcode    `json:"op"`
+	S  int               `json:"s,omitempty"`
+	T  gateway.EventType `json:"t,omitempty"`
+	D  any               `json:"d"`
+}
+
+func newFakeDiscord(t testing.TB, guildID snowflake.ID) *fakeDiscord {
+	t.Helper()
+	f := &fakeDiscord{
+		t:           t,
+		guildID:     guildID,
+		members:     make(map[snowflake.ID]discord.Member),
+		voiceStates: make(map[snowflake.ID]discord.VoiceState),
+		stages:      newSet[snowflake.ID](),
+		changed:     make(chan struct{}, 1),
+		identified:  make(chan struct{}),
+		resumed:     make(chan string, 1),
+		clientSync: &clientSync{
+			changed: make(chan struct{}),
+			acked:   make(chan struct{}),
+			release: make(chan struct{}),
+		},
+		permissions: discord.PermissionManageRoles,
+		appFlags:    discord.ApplicationFlagGatewayGuildMembers,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /gateway", f.getGateway)
+	mux.HandleFunc("GET /gateway/bot", f.getGateway)
+	mux.HandleFunc("GET /oauth2/applications/@me", f.getApplication)
+	mux.HandleFunc("GET /users/@me/guilds", f.getGuilds)
+	mux.HandleFunc("PUT /applications/{aid}/commands", f.putCommands)
+	mux.HandleFunc("PUT /applications/{aid}/guilds/{gid}/commands",
+		f.putCommands)
+	mux.HandleFunc("GET /guilds/{gid}", f.getGuild)
+	mux.HandleFunc("GET /guilds/{gid}/channels", f.getChannels)
+	mux.HandleFunc("GET /guilds/{gid}/members", f.getMembers)
+	mux.HandleFunc("GET /guilds/{gid}/voice-states/{uid}", f.getVoiceState)
+	mux.HandleFunc("GET /guilds/{gid}/roles", f.getRoles)
+	mux.HandleFunc("GET /guilds/{gid}/members/{uid}", f.getMember)
+	mux.HandleFunc("PUT /guilds/{gid}/members/{uid}/roles/{rid}",
+		f.memberRole(true))
+	mux.HandleFunc("DELETE /guilds/{gid}/members/{uid}/roles/{rid}",
+		f.memberRole(false))
+	mux.HandleFunc("PATCH /guilds/{gid}/voice-states/{uid}",
+		f.patchVoiceState)
+	mux.HandleFunc("PATCH /channels/{cid}", f.patchChannel)
+	mux.HandleFunc("POST /channels/{cid}/messages", f.postMessage)
+	mux.HandleFunc("PATCH /channels/{cid}/messages/{mid}", f.patchMessage)
+	mux.HandleFunc("GET /ws", f.serveGateway)
+	f.srv = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/ws" {
+				f.requests.Add(1)
+			}
+			mux.ServeHTTP(w, r)
+		},
+	))
+	t.Cleanup(f.close)
+	return f
+}
+
+func (f *fakeDiscord) close() {
+	f.connMu.Lock()
+	if f.conn != nil {
+		f.conn.Close()
+	}
+	f.connMu.Unlock()
+	f.srv.Close()
+	close(f.clientSync.release)
+}
+
+func (f *fakeDiscord) addVoiceChannel(id snowflake.ID, name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.channels = append(f.channels, json.RawMessage(fmt.Sprintf(
+		`{"id":"%d","type":%d,"guild_id":"%d","name":%q}`,
+		id, discord.ChannelTypeGuildVoice, f.guildID, name,
+	)))
+}
+
+// addStageChannel adds a stage channel. Members join it in the audience.
+func (f *fakeDiscord) addStageChannel(id snowflake.ID, name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.channels = append(f.channels, json.RawMessage(fmt.Sprintf(
+		`{"id":"%d","type":%d,"guild_id":"%d","name":%q}`,
+		id, discord.ChannelTypeGuildStageVoice, f.guildID, name,
+	)))
+	f.stages.Add(id)
+}
+
+func (f *fakeDiscord) addTextChannel(id snowflake.ID, name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.channels = append(f.channels, json.RawMessage(fmt.Sprintf(
+		`{"id":"%d","type":%d,"guild_id":"%d","name":%q}`,
+		id, discord.ChannelTypeGuildText, f.guildID, name,
+	)))
+}
+
+// addRole adds a role ranked above those already added.
+func (f *fakeDiscord) addRole(id snowflake.ID, name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.roles = append(f.roles, discord.Role{
+		ID: id, GuildID: f.guildID, Name: name, Position: len(f.roles) + 1,
+	})
+}
+
+// addBotRole adds a role held by the bot.
+func (f *fakeDiscord) addBotRole(id snowflake.ID, name string) {
+	f.addRole(id, name)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.botRoles = append(f.botRoles, id)
+}
+
+func (f *fakeDiscord) addMember(
+	uid snowflake.ID, name string, roles ...snowflake.ID,
+) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.members[uid] = discord.Member{
+		GuildID: f.guildID,
+		User:    discord.User{ID: uid, Username: name},
+		RoleIDs: roles,
+	}
+}
+
+// setVoice puts a member into channel, or out of every call if channel is
+// nil. Once connected, the change is dispatched as VOICE_STATE_UPDATE.
+func (f *fakeDiscord) setVoice(uid snowflake.ID, channel *snowflake.ID) {
+	f.mu.Lock()
+	vs := discord.VoiceState{
+		GuildID:   f.guildID,
+		UserID:    uid,
+		ChannelID: channel,
+		SessionID: "voice-" + uid.String(),
+	}
+	if channel != nil {
+		_, vs.Suppress = f.stages[*channel]
+	}
+	if channel == nil {
+		delete(f.voiceStates, uid)
+	} else {
+		f.voiceStates[uid] = vs
+	}
+	member := f.members[uid]
+	f.mu.Unlock()
+	f.dispatch(gateway.EventTypeVoiceStateUpdate,
+		gateway.EventVoiceStateUpdate{VoiceState: vs, Member: member})
+}
+
+// setStreaming sets whether a member in a call is streaming their screen and
+// has their camera on.
+func (f *fakeDiscord) setStreaming(uid snowflake.ID, stream, video bool) {
+	f.updateVoice(uid, func(vs *discord.VoiceState) bool {
+		vs.SelfStream, vs.SelfVideo = stream, video
+		return true
+	})
+}
+
+// updateVoice changes the voice state of a member in a call with update,
+// and dispatches the change unless update returns false.
+func (f *fakeDiscord) updateVoice(
+	uid snowflake.ID, update func(*discord.VoiceState) bool,
+) bool {
+	f.mu.Lock()
+	vs, ok := f.voiceStates[uid]
+	if !ok || !update(&vs) {
+		f.mu.Unlock()
+		return false
+	}
+	f.voiceStates[uid] = vs
+	member := f.members[uid]
+	f.mu.Unlock()
+	f.dispatch(gateway.EventTypeVoiceStateUpdate,
+		gateway.EventVoiceStateUpdate{VoiceState: vs, Member: member})
+	return true
+}
+
+// waitIdentified waits until a client has identified and been sent the
+// guild, so that later events reach it as changes.
+func (f *fakeDiscord) waitIdentified() {
+	f.t.Helper()
+	select {
+	case <-f.identified:
+	case <-time.After(10 * time.Second):
+		f.t.Fatal("timed out waiting for the client to identify")
+	}
+}
+
+// waitMutations waits until at least n role mutations have been made and
+// returns them.
+func (f *fakeDiscord) waitMutations(n int) []roleMutation {
+	f.t.Helper()
+	timeout := time.After(10 * time.Second)
+	for {
+		f.mu.Lock()
+		got := slices.Clone(f.mutations)
+		f.mu.Unlock()
+		if len(got) >= n {
+			return got
+		}
+		select {
+		case <-f.changed:
+		case <-timeout:
+			f.t.Fatalf("timed out waiting for %d role mutations, got %v",
+				n, got)
+		}
+	}
+}
+
+// waitRenames waits until at least n channels have been renamed and returns
+// the renames.
+func (f *fakeDiscord) waitRenames(n int) []fakeRename {
+	f.t.Helper()
+	timeout := time.After(10 * time.Second)
+	for {
+		f.mu.Lock()
+		got := slices.Clone(f.renames)
+		f.mu.Unlock()
+		if len(got) >= n {
+			return got
+		}
+		select {
+		case <-f.changed:
+		case <-timeout:
+			f.t.Fatalf("timed out waiting for %d renames, got %v", n, got)
+		}
+	}
+}
+
+func (f *fakeDiscord) getGateway(w http.ResponseWriter, _ *http.Request) {
+	url := "ws" + strings.TrimPrefix(f.srv.URL, "http") + "/ws"
+	writeJSON(w, map[string]any{
+		"url":    url,
+		"shards": 1,
+		"session_start_limit": map[string]int{
+			"total": 1000, "remaining": 1000, "max_concurrency": 1,
+		},
+	})
+}
+
+func (f *fakeDiscord) getApplication(w http.ResponseWriter, _ *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	writeJSON(w, map[string]any{
+		"id": fakeBotID, "name": "lesiw", "flags": f.appFlags,
+	})
+}
+
+func (f *fakeDiscord) getGuilds(w http.ResponseWriter, _ *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	writeJSON(w, []map[string]any{{
+		"id": f.guildID, "name": "lesiw", "permissions": f.permissions,
+	}})
+}
+
+func (f *fakeDiscord) putCommands(w http.ResponseWriter, r *http.Request) {
+	var cmds []json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&cmds); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	f.commandPuts = append(f.commandPuts, r.URL.Path)
+	f.mu.Unlock()
+	writeJSON(w, cmds)
+}
+
+// postMessage posts a message. Its ID is its index in f.messages plus one.
+func (f *fakeDiscord) postMessage(w http.ResponseWriter, r *http.Request) {
+	cid, err := snowflake.Parse(r.PathValue("cid"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var msg discord.MessageCreate
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	m := fakeChatMessage{ChannelID: cid, Content: msg.Content}
+	if msg.AllowedMentions != nil {
+		m.Pings = msg.AllowedMentions.Roles
+	}
+	f.mu.Lock()
+	f.messages = append(f.messages, m)
+	id := len(f.messages)
+	f.mu.Unlock()
+	f.notify()
+	writeJSON(w, map[string]any{
+		"id": snowflake.ID(id), "channel_id": cid, "content": m.Content,
+		"timestamp": time.Now(),
+	})
+}
+
+// patchChannel renames a channel and tells the gateway about it.
+func (f *fakeDiscord) patchChannel(w http.ResponseWriter, r *http.Request) {
+	cid, err := snowflake.Parse(r.PathValue("cid"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var update struct {
+		Name *string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	i := slices.IndexFunc(f.channels, func(ch json.RawMessage) bool {
+		var c struct {
+			ID snowflake.ID `json:"id"`
+		}
+		return json.Unmarshal(ch, &c) == nil && c.ID == cid
+	})
+	if i < 0 {
+		f.mu.Unlock()
+		http.Error(w, `{"message":"Unknown Channel","code":10003}`,
+			http.StatusNotFound)
+		return
+	}
+	var ch map[string]any
+	if err := json.Unmarshal(f.channels[i], &ch); err != nil {
+		f.mu.Unlock()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if update.Name != nil {
+		ch["name"] = *update.Name
+		f.renames = append(f.renames, fakeRename{cid, *update.Name})
+	}
+	raw, _ := json.Marshal(ch)
+	f.channels[i] = raw
+	f.mu.Unlock()
+	f.dispatch(gateway.EventTypeChannelUpdate, json.RawMessage(raw))
+	f.notify()
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(raw)
+}
+
+func (f *fakeDiscord) patchMessage(w http.ResponseWriter, r *http.Request) {
+	mid, err := snowflake.Parse(r.PathValue("mid"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var msg discord.MessageUpdate
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	if mid == 0 || int(mid) > len(f.messages) {
+		f.mu.Unlock()
+		http.Error(w, `{"message":"Unknown Message","code":10008}`,
+			http.StatusNotFound)
+		return
+	}
+	m := &f.messages[mid-1]
+	if msg.Content != nil {
+		m.Content = *msg.Content
+	}
+	resp := map[string]any{
+		"id": mid, "channel_id": m.ChannelID, "content": m.Content,
+		"timestamp": time.Now(),
+	}
+	f.mu.Unlock()
+	f.notify()
+	writeJSON(w, resp)
+}
+
+// waitMessages waits until the messages posted by the bot satisfy ok.
+func (f *fakeDiscord) waitMessages(ok func([]fakeChatMessage) bool) {
+	f.t.Helper()
+	timeout := time.After(10 * time.Second)
+	for {
+		f.mu.Lock()
+		got := slices.Clone(f.messages)
+		f.mu.Unlock()
+		if ok(got) {
+			return
+		}
+		select {
+		case <-f.changed:
+		case <-timeout:
+			f.t.Fatalf("timed out waiting for messages, got %v", got)
+		}
+	}
+}
+
+// notify wakes up anything waiting on a change.
+func (f *fakeDiscord) notify() {
+	select {
+	case f.changed <- struct{}{}:
+	default:
+	}
+}
+
+// patchVoiceState invites a member on a stage to speak, or moves them to the
+// audience.
+func (f *fakeDiscord) patchVoiceState(w http.ResponseWriter, r *http.Request) {
+	uid, err := snowflake.Parse(r.PathValue("uid"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var update discord.UserVoiceStateUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ok := f.updateVoice(uid, func(vs *discord.VoiceState) bool {
+		if update.ChannelID == nil || *vs.ChannelID != *update.ChannelID {
+			return false
+		}
+		if update.Suppress != nil {
+			vs.Suppress = *update.Suppress
+		}
+		return true
+	})
+	if !ok {
+		http.Error(w, `{"message":"Unknown Voice State","code":10065}`,
+			http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (f *fakeDiscord) getMember(w http.ResponseWriter, r *http.Request) {
+	uid, err := snowflake.Parse(r.PathValue("uid"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	m, ok := f.members[uid]
+	if uid == fakeBotID {
+		m = discord.Member{
+			GuildID: f.guildID,
+			User:    discord.User{ID: fakeBotID, Username: "bot"},
+			RoleIDs: f.botRoles,
+		}
+	} else if !ok {
+		http.Error(w, `{"message":"Unknown Member","code":10007}`,
+			http.StatusNotFound)
+		return
+	}
+	writeJSON(w, m)
+}
+
+// inGuild reports whether r is for the fake's guild, answering it as
+// Discord does if not.
+func (f *fakeDiscord) inGuild(w http.ResponseWriter, r *http.Request) bool {
+	if r.PathValue("gid") != f.guildID.String() {
+		http.Error(w, `{"message":"Missing Access","code":50001}`,
+			http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func (f *fakeDiscord) getGuild(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.inGuild(w, r) {
+		return
+	}
+	writeJSON(w, map[string]any{
+		"id":       f.guildID,
+		"name":     "lesiw",
+		"owner_id": fakeBotID,
+		"roles":    f.roles,
+	})
+}
+
+func (f *fakeDiscord) getChannels(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.inGuild(w, r) {
+		return
+	}
+	writeJSON(w, f.channels)
+}
+
+// getMembers lists members by ID, a page at a time.
+func (f *fakeDiscord) getMembers(w http.ResponseWriter, r *http.Request) {
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	after, err := snowflake.Parse(r.URL.Query().Get("after"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.inGuild(w, r) {
+		return
+	}
+	ids := slices.Sorted(maps.Keys(f.members))
+	members := []discord.Member{}
+	for _, id := range ids {
+		if id > after && len(members) < limit {
+			members = append(members, f.members[id])
+		}
+	}
+	writeJSON(w, members)
+}
+
+func (f *fakeDiscord) getVoiceState(w http.ResponseWriter, r *http.Request) {
+	uid, err := snowflake.Parse(r.PathValue("uid"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.inGuild(w, r) {
+		return
+	}
+	f.voiceGets = append(f.voiceGets, uid)
+	vs, ok := f.voiceStates[uid]
+	if !ok {
+		http.Error(w, `{"message":"Unknown Voice State","code":10065}`,
+			http.StatusNotFound)
+		return
+	}
+	writeJSON(w, vs)
+}
+
+func (f *fakeDiscord) getRoles(w http.ResponseWriter, _ *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	writeJSON(w, f.roles)
+}
+
+func (f *fakeDiscord) memberRole(add bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var ids [3]snowflake.ID
+		for i, k := range []string{"gid", "uid", "rid"} {
+			id, err := snowflake.Parse(r.PathValue(k))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			ids[i] = id
+		}
+		f.mu.Lock()
+		m, ok := f.members[ids[1]]
+		if !ok {
+			f.mu.Unlock()
+			http.Error(w, `{"message":"Unknown Member","code":10007}`,
+				http.StatusNotFound)
+			return
+		}
+		m.RoleIDs = slices.DeleteFunc(slices.Clone(m.RoleIDs),
+			func(id snowflake.ID) bool { return id == ids[2] })
+		if add {
+			m.RoleIDs = append(m.RoleIDs, ids[2])
+		}
+		f.members[ids[1]] = m
+		f.mutations = append(f.mutations, roleMutation{
+			Add: add, GuildID: ids[0], UserID: ids[1], RoleID: ids[2],
+		})
+		memberEvents := f.intents.Has(gateway.IntentGuildMembers)
+		f.mu.Unlock()
+		// Dispatch first, so that tests waiting on a mutation see its
+		// GUILD_MEMBER_UPDATE ordered before whatever they do next.
+		if memberEvents {
+			f.dispatch(gateway.EventTypeGuildMemberUpdate, m)
+		}
+		f.notify()
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// fakeHeartbeat is how often clients of the fake gateway heartbeat. Only
+// the first heartbeat is ever due while a client runs: see clientSync.
+const fakeHeartbeat = 10 * time.Millisecond
+
+func (f *fakeDiscord) serveGateway(w http.ResponseWriter, r *http.Request) {
+	conn, err := new(websocket.Upgrader).Upgrade(w, r, nil)
+	if err != nil {
+		f.t.Errorf("could not upgrade gateway connection: %v", err)
+		return
+	}
+	f.connMu.Lock()
+	f.conn = conn
+	f.hellos++
+	f.connMu.Unlock()
+	f.send(fakeMessage{
+		Op: gateway.OpcodeHello,
+		D: map[string]int{
+			"heartbeat_interval": int(fakeHeartbeat / time.Millisecond),
+		},
+	})
+	for {
+		var msg struct {
+			Op gateway.Opcode  `json:"op"`
+			D  json.RawMessage `json:"d"`
+		}
+		if err := conn.ReadJSON(&msg); err != nil {
+			return
+		}
+		switch msg.Op {
+		case gateway.OpcodeHeartbeat:
+			f.send(fakeMessage{Op: gateway.OpcodeHeartbeatACK})
+		case gateway.OpcodeIdentify:
+			var d gateway.MessageDataIdentify
+			if err := json.Unmarshal(msg.D, &d); err != nil {
+				f.t.Errorf("bad identify: %v", err)
+				continue
+			}
+			f.mu.Lock()
+			code := f.closeCode
+			f.closeCode = 0
+			f.mu.Unlock()
+			text := "Closed."
+			if d.Intents&f.disallowed != 0 {
+				code = gateway.CloseEventCodeDisallowedIntent.Code
+				text = "Disallowed intent(s)."
+			}
+			if code != 0 {
+				if f.waitHeld() {
+					_ = conn.WriteMessage(websocket.CloseMessage,
+						websocket.FormatCloseMessage(code, text))
+				}
+				return
+			}
+			f.identify(d.Intents)
+		case gateway.OpcodeResume:
+			var d gateway.MessageDataResume
+			if err := json.Unmarshal(msg.D, &d); err != nil {
+				f.t.Errorf("bad resume: %v", err)
+				continue
+			}
+			select {
+			case f.resumed <- d.SessionID:
+			default:
+			}
+			f.dispatch(gateway.EventTypeResumed, nil)
+		case gateway.OpcodeRequestGuildMembers:
+			var d gateway.MessageDataRequestGuildMembers
+			if err := json.Unmarshal(msg.D, &d); err != nil {
+				f.t.Errorf("bad member request: %v", err)
+				continue
+			}
+			f.mu.Lock()
+			members := slices.Collect(maps.Values(f.members))
+			f.mu.Unlock()
+			// Discord sends at most 1000 members per chunk.
+			chunks := slices.Collect(slices.Chunk(members, 1000))
+			if len(chunks) == 0 {
+				chunks = [][]discord.Member{nil}
+			}
+			for i, chunk := range chunks {
+				f.dispatch(gateway.EventTypeGuildMembersChunk,
+					gateway.EventGuildMembersChunk{
+						GuildID:    d.GuildID,
+						Members:    chunk,
+						ChunkIndex: i,
+						ChunkCount: len(chunks),
+						Nonce:      d.Nonce,
+					})
+			}
+		}
+	}
+}
+
+// fakeLargeThreshold is the member count above which Discord only sends
+// members in voice with GUILD_CREATE.
+const fakeLargeThreshold = 250
+
+func (f *fakeDiscord) identify(intents gateway.Intents) {
+	f.mu.Lock()
+	f.intents = intents
+	members := slices.Collect(maps.Values(f.members))
+	large := len(members) > fakeLargeThreshold
+	// Without the server members intent, Discord sends the members in voice
+	// whatever the size of the guild.
+	if large || !intents.Has(gateway.IntentGuildMembers) {
+		members = members[:0]
+		for uid := range f.voiceStates {
+			members = append(members, f.members[uid])
+		}
+	}
+	guild := map[string]any{
+		"id":           f.guildID,
+		"name":         "lesiw",
+		"owner_id":     fakeBotID,
+		"unavailable":  false,
+		"large":        large,
+		"member_count": len(f.members),
+		"joined_at":    time.Now(),
+		"channels":     f.channels,
+		"roles":        f.roles,
+		"members":      members,
+		"voice_states": slices.Collect(maps.Values(f.voiceStates)),
+	}
+	f.mu.Unlock()
+	f.dispatch(gateway.EventTypeReady, map[string]any{
+		"v":                  gateway.Version,
+		"user":               map[string]any{"id": fakeBotID, "username": "bot"},
+		"guilds":             []map[string]any{{"id": f.guildID, "unavailable": true}},
+		"session_id":         "fake-session",
+		"resume_gateway_url": "ws" + strings.TrimPrefix(f.srv.URL, "http") + "/ws",
+		"application":        map[string]any{"id": fakeBotID},
+	})
+	f.dispatch(gateway.EventTypeGuildCreate, guild)
+	f.identifyOnce.Do(func() { close(f.identified) })
+}
+
+// dispatch sends an event if the gateway is connected.
+func (f *fakeDiscord) dispatch(t gateway.EventType, d any) {
+	f.connMu.Lock()
+	f.seq++
+	seq := f.seq
+	f.connMu.Unlock()
+	f.send(fakeMessage{Op: gateway.OpcodeDispatch, S: seq, T: t, D: d})
+}
+
+func (f *fakeDiscord) send(msg fakeMessage) {
+	f.connMu.Lock()
+	defer f.connMu.Unlock()
+	if f.conn == nil || f.quiet {
+		return
+	}
+	// Errors surface as a closed connection on the read side.
+	_ = f.conn.WriteJSON(msg)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// clientSync orders the test against disgo's gateway goroutines, which
+// v0.18.16 leaves racing each other and Close: the sequence and the cancel
+// func of the heartbeat goroutine are written without a lock. Every gateway
+// log record takes mu, ordering what its goroutine did before it ahead of
+// whoever takes mu next.
+//
+// Heartbeat goroutines are held at their first heartbeat until release is
+// closed, so that they read nothing more. See waitHeld and quiesce.
+type clientSync struct {
+	mu      sync.Mutex
+	held    int           // Heartbeat goroutines.
+	changed chan struct{} // Closed and replaced when held changes.
+	acked   chan struct{} // Closed once a HEARTBEAT_ACK has been read.
+	release chan struct{}
+}
+
+// clientSyncHandler is the slog.Handler of clientSync. It passes records on
+// to its slog.Handler.
+type clientSyncHandler struct {
+	slog.Handler
+	s *clientSync
+}
+
+// Enabled is true for every level, as what clientSync watches for is logged
+// at debug.
+func (h clientSyncHandler) Enabled(context.Context, slog.Level) bool {
+	h.s.mu.Lock()
+	defer h.s.mu.Unlock()
+	return true
+}
+
+func (h clientSyncHandler) Handle(ctx context.Context, r slog.Record) error {
+	switch r.Message {
+	case "sending heartbeat":
+		h.s.mu.Lock()
+		h.s.held++
+		close(h.s.changed)
+		h.s.changed = make(chan struct{})
+		h.s.mu.Unlock()
+		<-h.s.release
+		return nil
+	case "received gateway message":
+		r.Attrs(func(a slog.Attr) bool {
+			if a.Key == "data" &&
+				strings.Contains(a.Value.String(), `"op":11`) {
+				h.s.mu.Lock()
+				defer h.s.mu.Unlock()
+				select {
+				case <-h.s.acked:
+				default:
+					close(h.s.acked)
+				}
+			}
+			return true
+		})
+	}
+	if !h.Handler.Enabled(ctx, r.Level) {
+		return nil
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h clientSyncHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return clientSyncHandler{h.Handler.WithAttrs(attrs), h.s}
+}
+
+func (h clientSyncHandler) WithGroup(name string) slog.Handler {
+	return clientSyncHandler{h.Handler.WithGroup(name), h.s}
+}
+
+// logger returns a logger for clients of the fake gateway, which they must
+// use for quiesce to work.
+func (f *fakeDiscord) logger() *slog.Logger {
+	return slog.New(clientSyncHandler{slog.Default().Handler(), f.clientSync})
+}
+
+// waitHeld waits until a heartbeat goroutine is held for every HELLO the
+// fake gateway sent, after which Discord can close the connection without
+// racing them. It reports whether they were held in time.
+func (f *fakeDiscord) waitHeld() bool {
+	timeout := time.After(10 * time.Second)
+	for {
+		f.connMu.Lock()
+		hellos := f.hellos
+		f.connMu.Unlock()
+		f.clientSync.mu.Lock()
+		held, changed := f.clientSync.held, f.clientSync.changed
+		f.clientSync.mu.Unlock()
+		if held >= hellos {
+			return true
+		}
+		select {
+		case <-changed:
+		case <-timeout:
+			f.t.Errorf("timed out waiting for heartbeats: %d held for %d "+
+				"HELLOs", held, hellos)
+			return false
+		}
+	}
+}
+
+// quiesce stops the fake gateway sending and waits until the client has
+// read everything it was sent, after which it can be closed.
+func (f *fakeDiscord) quiesce() {
+	f.t.Helper()
+	if !f.waitHeld() {
+		return
+	}
+	f.connMu.Lock()
+	f.quiet = true
+	if f.conn != nil {
+		_ = f.conn.WriteJSON(fakeMessage{Op: gateway.OpcodeHeartbeatACK})
+	}
+	f.connMu.Unlock()
+	select {
+	case <-f.clientSync.acked:
+	case <-time.After(10 * time.Second):
+		f.t.Error("timed out waiting for the client to read a HEARTBEAT_ACK")
+	}
+}
+
+// connect opens a client on the fake gateway and waits for the guild to be
+// ready. lean may be nil to cache every member.
+func (f *fakeDiscord) connect(
+	lean *leanMemberCache, mw ...gatewayMiddleware,
+) disgobot.Client {
+	f.t.Helper()
+	var (
+		ready = make(chan struct{})
+		once  sync.Once
+	)
+	intents, caches := gatewayNeeds(
+		[]enabledModule{{module: new(voiceModule)}},
+	)
+	bot, err := newClient(fakeToken, mw,
+		gatewayOpts(shardConfig{}, gateway.WithIntents(intents)),
+		cacheOpt(caches, lean),
+		disgobot.WithRestClientConfigOpts(rest.WithURL(f.srv.URL)),
+		disgobot.WithEventListenerFunc(func(*events.GuildReady) {
+			once.Do(func() { close(ready) })
+		}),
+		disgobot.WithLogger(f.logger()),
+	)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	if lean != nil {
+		lean.bind(bot)
+	}
+	if err := bot.OpenGateway(f.t.Context()); err != nil {
+		f.t.Fatal(err)
+	}
+	f.t.Cleanup(func() {
+		f.quiesce()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		bot.Close(ctx)
+	})
+	select {
+	case <-ready:
+	case <-time.After(10 * time.Second):
+		f.t.Fatal("timed out waiting for guild")
+	}
+	return bot
+}
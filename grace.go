@@ -0,0 +1,131 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/disgoorg/snowflake/v2"
+)
+
+// voiceGrace delays voice role changes so that brief disconnects and
+// drive-by joins do not flap the role.
+//
+// A member who leaves keeps the role until leaveGrace has passed, and a
+// member who joins gets it once they have been in the call for minInCall.
+// Returning before the timer fires cancels it. Members with no pending timer,
+// such as those already in a call when the bot starts, are synced at once.
+type voiceGrace struct {
+	leaveGrace time.Duration
+	minInCall  time.Duration
+	trigger    func(gid snowflake.ID)
+	clock      clock
+
+	mu           sync.Mutex
+	pendingJoin  map[guildMember]stopper
+	pendingLeave map[guildMember]stopper
+}
+
+type guildMember struct {
+	guildID, userID snowflake.ID
+}
+
+func newVoiceGrace(
+	c clock, leaveGrace, minInCall time.Duration, trigger func(snowflake.ID),
+) *voiceGrace {
+	return &voiceGrace{
+		leaveGrace:   leaveGrace,
+		minInCall:    minInCall,
+		trigger:      trigger,
+		clock:        c,
+		pendingJoin:  make(map[guildMember]stopper),
+		pendingLeave: make(map[guildMember]stopper),
+	}
+}
+
+// joined records that a member joined a call.
+func (g *voiceGrace) joined(gid, uid snowflake.ID) {
+	if g == nil {
+		return
+	}
+	k := guildMember{gid, uid}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	cancelPending(g.pendingLeave, k)
+	if g.minInCall > 0 {
+		g.schedule(g.pendingJoin, k, g.minInCall)
+	}
+}
+
+// left records that a member left every call.
+func (g *voiceGrace) left(gid, uid snowflake.ID) {
+	if g == nil {
+		return
+	}
+	k := guildMember{gid, uid}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	cancelPending(g.pendingJoin, k)
+	if g.leaveGrace > 0 {
+		g.schedule(g.pendingLeave, k, g.leaveGrace)
+	}
+}
+
+// forget cancels any pending role change for a member.
+func (g *voiceGrace) forget(gid, uid snowflake.ID) {
+	if g == nil {
+		return
+	}
+	k := guildMember{gid, uid}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	cancelPending(g.pendingJoin, k)
+	cancelPending(g.pendingLeave, k)
+}
+
+// canAdd reports whether a member in a call may be given the role.
+func (g *voiceGrace) canAdd(gid, uid snowflake.ID) bool {
+	if g == nil {
+		return true
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	_, pending := g.pendingJoin[guildMember{gid, uid}]
+	return !pending
+}
+
+// canRemove reports whether a member out of a call may lose the role.
+func (g *voiceGrace) canRemove(gid, uid snowflake.ID) bool {
+	if g == nil {
+		return true
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	_, pending := g.pendingLeave[guildMember{gid, uid}]
+	return !pending
+}
+
+func (g *voiceGrace) schedule(
+	m map[guildMember]stopper, k guildMember, d time.Duration,
+) {
+	cancelPending(m, k)
+	var t stopper
+	t = g.clock.AfterFunc(d, func() {
+		g.mu.Lock()
+		current := m[k] == t
+		if current {
+			delete(m, k)
+		}
+		g.mu.Unlock()
+		if current {
+			g.trigger(k.guildID)
+		}
+	})
+	m[k] = t
+}
+
+func cancelPending(m map[guildMember]stopper, k guildMember) {
+	if t, ok := m[k]; ok {
+		t.Stop()
+		delete(m, k)
+	}
+}
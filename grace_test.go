@@ -0,0 +1,131 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/disgoorg/snowflake/v2"
+	"github.com/google/go-cmp/cmp"
+)
+
+type fakeTimer struct {
+	d       time.Duration
+	f       func()
+	stopped bool
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.stopped = true
+	return true
+}
+
+// fakeClock is a clock that stands still and whose timers only fire when
+// told to.
+type fakeClock struct {
+	now    time.Time
+	timers []*fakeTimer
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) stopper {
+	t := &fakeTimer{d: d, f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// fakeGrace returns a voiceGrace on a fakeClock.
+func fakeGrace(
+	leaveGrace, minInCall time.Duration,
+) (g *voiceGrace, timers *[]*fakeTimer, triggered *[]snowflake.ID) {
+	clk, triggered := new(fakeClock), new([]snowflake.ID)
+	g = newVoiceGrace(clk, leaveGrace, minInCall, func(gid snowflake.ID) {
+		*triggered = append(*triggered, gid)
+	})
+	return g, &clk.timers, triggered
+}
+
+// pendingGrace returns a voiceGrace in guild 0 with pending joins and leaves.
+func pendingGrace(joins, leaves []snowflake.ID) *voiceGrace {
+	g, _, _ := fakeGrace(time.Minute, time.Minute)
+	for _, uid := range leaves {
+		g.left(0, uid)
+	}
+	for _, uid := range joins {
+		g.joined(0, uid)
+	}
+	return g
+}
+
+func TestVoiceGraceLeave(t *testing.T) {
+	g, timers, triggered := fakeGrace(30*time.Second, 0)
+
+	g.joined(1, 2)
+	if len(*timers) != 0 {
+		t.Fatalf("joined() started a timer without a minimum time in call")
+	}
+	g.left(1, 2)
+	if g.canRemove(1, 2) {
+		t.Errorf("canRemove() = true within leave grace period")
+	}
+	(*timers)[0].f()
+	if !g.canRemove(1, 2) {
+		t.Errorf("canRemove() = false after leave grace period")
+	}
+	if got, want := *triggered, []snowflake.ID{1}; !cmp.Equal(got, want) {
+		t.Errorf("triggered -want +got\n%s", cmp.Diff(want, got))
+	}
+}
+
+func TestVoiceGraceReturn(t *testing.T) {
+	g, timers, triggered := fakeGrace(30*time.Second, 0)
+
+	g.left(1, 2)
+	g.joined(1, 2)
+	if !(*timers)[0].stopped {
+		t.Errorf("returning did not stop the leave timer")
+	}
+	(*timers)[0].f() // The timer fired anyway, racing the stop.
+	if len(*triggered) != 0 {
+		t.Errorf("cancelled timer triggered a sync")
+	}
+	if !g.canRemove(1, 2) || !g.canAdd(1, 2) {
+		t.Errorf("member still pending after returning")
+	}
+}
+
+func TestVoiceGraceMinInCall(t *testing.T) {
+	g, timers, triggered := fakeGrace(0, 10*time.Second)
+
+	g.joined(1, 2)
+	if g.canAdd(1, 2) {
+		t.Errorf("canAdd() = true before minimum time in call")
+	}
+	if got, want := (*timers)[0].d, 10*time.Second; got != want {
+		t.Errorf("timer duration = %v, want %v", got, want)
+	}
+	g.left(1, 2)
+	if !(*timers)[0].stopped {
+		t.Errorf("leaving did not stop the join timer")
+	}
+	if !g.canRemove(1, 2) {
+		t.Errorf("canRemove() = false without a leave grace period")
+	}
+	g.joined(1, 2)
+	(*timers)[1].f()
+	if !g.canAdd(1, 2) {
+		t.Errorf("canAdd() = false after minimum time in call")
+	}
+	if got, want := *triggered, []snowflake.ID{1}; !cmp.Equal(got, want) {
+		t.Errorf("triggered -want +got\n%s", cmp.Diff(want, got))
+	}
+}
+
+func TestVoiceGraceNil(t *testing.T) {
+	var g *voiceGrace
+	g.joined(1, 2)
+	g.left(1, 2)
+	if !g.canAdd(1, 2) || !g.canRemove(1, 2) {
+		t.Errorf("nil voiceGrace deferred a role change")
+	}
+}
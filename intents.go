@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	disgobot "github.com/disgoorg/disgo/bot"
+	"github.com/disgoorg/disgo/discord"
+	"github.com/disgoorg/disgo/gateway"
+	"github.com/disgoorg/disgo/sharding"
+	"github.com/gorilla/websocket"
+)
+
+// A privilegedIntent is only granted to applications that turn it on in the
+// developer portal. Discord closes the gateway with code 4014 on an IDENTIFY
+// that asks for one the application lacks.
+type privilegedIntent struct {
+	intent gateway.Intents
+	name   string
+	flags  discord.ApplicationFlags // Any of these grants the intent.
+}
+
+var privilegedIntents = []privilegedIntent{{
+	intent: gateway.IntentGuildMembers,
+	name:   "server members",
+	flags: discord.ApplicationFlagGatewayGuildMembers |
+		discord.ApplicationFlagGatewayGuildMemberLimited,
+}, {
+	intent: gateway.IntentGuildPresences,
+	name:   "presence",
+	flags: discord.ApplicationFlagGatewayPresence |
+		discord.ApplicationFlagGatewayPresenceLimited,
+}, {
+	intent: gateway.IntentMessageContent,
+	name:   "message content",
+	flags: discord.ApplicationFlagGatewayMessageContent |
+		discord.ApplicationFlagGatewayMessageContentLimited,
+}}
+
+// deniedIntents returns the privileged intents in want that flags do not
+// grant.
+func deniedIntents(
+	flags discord.ApplicationFlags, want gateway.Intents,
+) gateway.Intents {
+	var denied gateway.Intents
+	for _, p := range privilegedIntents {
+		if want.Has(p.intent) && flags&p.flags == 0 {
+			denied |= p.intent
+		}
+	}
+	return denied
+}
+
+// intentNames names the privileged intents in i, like "server members and
+// presence".
+func intentNames(i gateway.Intents) string {
+	var names []string
+	for _, p := range privilegedIntents {
+		if i.Has(p.intent) {
+			names = append(names, p.name)
+		}
+	}
+	switch len(names) {
+	case 0:
+		return "no privileged"
+	case 1:
+		return names[0]
+	}
+	return strings.Join(names[:len(names)-1], ", ") +
+		" and " + names[len(names)-1]
+}
+
+// A degradedModule can run without some of its intents, doing less.
+type degradedModule interface {
+	// Degraded describes what the module cannot do without missing.
+	Degraded(missing gateway.Intents) string
+}
+
+// grantIntents takes the privileged intents the application lacks away from
+// the modules that asked for them, so that Discord accepts the IDENTIFY,
+// and warns about what each of those modules can no longer do. A module
+// that cannot do without an intent is an error.
+func grantIntents(bot disgobot.Client, mods []enabledModule) error {
+	app, err := bot.Rest().GetBotApplicationInfo()
+	if err != nil {
+		return fmt.Errorf("could not get application: %w", err)
+	}
+	for i, m := range mods {
+		denied := deniedIntents(app.Flags, m.Intents())
+		if denied == 0 {
+			continue
+		}
+		d, ok := m.module.(degradedModule)
+		if !ok {
+			return fmt.Errorf("%s module needs the %s intent: "+
+				"turn it on in the developer portal",
+				m.Name(), intentNames(denied))
+		}
+		mods[i].missing = denied
+		slog.Warn("privileged intent not enabled in the developer portal",
+			"module", m.Name(), "intent", intentNames(denied),
+			"degraded", d.Degraded(denied))
+	}
+	return nil
+}
+
+// gatewayCreateOpt applies opts to the gateway or to every shard once its
+// ID and count are set, and calls fatal when Discord closes a connection
+// with a code that disgo does not reconnect after, like 4014 for disallowed
+// intents.
+//
+// Shards are created by a single create func, as the shard manager keeps
+// only the last one it is given. They report a close to their close
+// handler. disgo builds the unsharded gateway without one and only reports
+// the close in a log record, so that gateway logs through a handler that
+// watches for it.
+func gatewayCreateOpt(
+	sc shardConfig, fatal func(code int), opts ...gateway.ConfigOpt,
+) disgobot.ConfigOpt {
+	if sc.enabled {
+		return disgobot.WithShardManagerConfigOpts(
+			sharding.WithGatewayCreateFunc(shardGateway(fatal, opts...)),
+		)
+	}
+	return disgobot.WithGatewayConfigOpts(append(opts,
+		gateway.WithLogger(slog.New(
+			closeWatcher{slog.Default().Handler(), fatal},
+		)),
+	)...)
+}
+
+// shardGateway creates shards like gateway.New, applying opts after those
+// of the shard manager, and calls fatal when a shard is left closed.
+func shardGateway(
+	fatal func(code int), opts ...gateway.ConfigOpt,
+) gateway.CreateFunc {
+	return func(
+		token string, events gateway.EventHandlerFunc,
+		closed gateway.CloseHandlerFunc, shardOpts ...gateway.ConfigOpt,
+	) gateway.Gateway {
+		return gateway.New(token, events, watchClose(closed, fatal),
+			append(shardOpts, opts...)...)
+	}
+}
+
+// watchClose wraps the close handler of a shard to call fatal with the
+// close code of the connection, except 4011: Discord asks for more shards,
+// which is not a mistake in the config, and the shard manager is left to
+// handle it.
+func watchClose(
+	closed gateway.CloseHandlerFunc, fatal func(code int),
+) gateway.CloseHandlerFunc {
+	return func(g gateway.Gateway, err error) {
+		if closed != nil {
+			closed(g, err)
+		}
+		var ce *websocket.CloseError
+		if errors.As(err, &ce) &&
+			ce.Code != gateway.CloseEventCodeShardingRequired.Code {
+			fatal(ce.Code)
+		}
+	}
+}
+
+// closeWatcherMsg is the message of the record disgo logs when a gateway
+// connection is closed by Discord. TestCloseWatcherDisgo pins the disgo
+// version it was checked against.
+const closeWatcherMsg = "gateway close received"
+
+// closeWatcher passes records on to a slog.Handler, calling fatal with the
+// close code of connections that will not be reconnected.
+type closeWatcher struct {
+	slog.Handler
+	fatal func(code int)
+}
+
+func (w closeWatcher) Handle(ctx context.Context, r slog.Record) error {
+	if r.Message == closeWatcherMsg {
+		code, reconnect := 0, true
+		r.Attrs(func(a slog.Attr) bool {
+			switch a.Key {
+			case "code":
+				code = int(a.Value.Int64())
+			case "reconnect":
+				reconnect = a.Value.Bool()
+			}
+			return true
+		})
+		if !reconnect {
+			w.fatal(code)
+		}
+	}
+	return w.Handler.Handle(ctx, r)
+}
+
+func (w closeWatcher) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return closeWatcher{w.Handler.WithAttrs(attrs), w.fatal}
+}
+
+func (w closeWatcher) WithGroup(name string) slog.Handler {
+	return closeWatcher{w.Handler.WithGroup(name), w.fatal}
+}
+
+// gatewayClosed explains why Discord closed the gateway with code, having
+// been asked for intents.
+func gatewayClosed(code int, intents gateway.Intents) error {
+	c := gateway.CloseEventCodeByCode(code)
+	err := fmt.Errorf("gateway closed with code %d (%s)", code, c.Description)
+	if code == gateway.CloseEventCodeDisallowedIntent.Code {
+		var privileged gateway.Intents
+		for _, p := range privilegedIntents {
+			privileged |= p.intent
+		}
+		return fmt.Errorf("%w: turn on the %s intent in the developer portal",
+			err, intentNames(intents&privileged))
+	}
+	return err
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/disgoorg/disgo"
+	disgobot "github.com/disgoorg/disgo/bot"
+	"github.com/disgoorg/disgo/discord"
+	"github.com/disgoorg/disgo/gateway"
+	"github.com/disgoorg/disgo/rest"
+	"github.com/disgoorg/snowflake/v2"
+	"github.com/google/go-cmp/cmp"
+	"github.com/gorilla/websocket"
+)
+
+func TestDeniedIntents(t *testing.T) {
+	const want = gateway.IntentGuilds |
+		gateway.IntentGuildMembers |
+		gateway.IntentMessageContent
+	tests := []struct {
+		desc  string
+		flags discord.ApplicationFlags
+		want  gateway.Intents
+	}{{
+		desc: "none granted",
+		want: gateway.IntentGuildMembers | gateway.IntentMessageContent,
+	}, {
+		desc:  "members",
+		flags: discord.ApplicationFlagGatewayGuildMembers,
+		want:  gateway.IntentMessageContent,
+	}, {
+		desc: "limited",
+		flags: discord.ApplicationFlagGatewayGuildMemberLimited |
+			discord.ApplicationFlagGatewayMessageContentLimited,
+	}, {
+		desc:  "unrelated",
+		flags: discord.ApplicationFlagGatewayPresence,
+		want:  gateway.IntentGuildMembers | gateway.IntentMessageContent,
+	}}
+	for _, tt := range tests {
+		if got := deniedIntents(tt.flags, want); got != tt.want {
+			t.Errorf("%s: %s(%d, %d) = %d, want %d", tt.desc,
+				funcname(t, deniedIntents), tt.flags, want, got, tt.want)
+		}
+	}
+}
+
+func TestIntentNames(t *testing.T) {
+	tests := []struct {
+		intents gateway.Intents
+		want    string
+	}{
+		{gateway.IntentGuilds, "no privileged"},
+		{gateway.IntentGuildMembers, "server members"},
+		{gateway.IntentGuildMembers | gateway.IntentGuildPresences,
+			"server members and presence"},
+		{gateway.IntentsPrivileged,
+			"server members, presence and message content"},
+	}
+	for _, tt := range tests {
+		if got := intentNames(tt.intents); got != tt.want {
+			t.Errorf("%s(%d) = %q, want %q",
+				funcname(t, intentNames), tt.intents, got, tt.want)
+		}
+	}
+}
+
+func TestGatewayClosed(t *testing.T) {
+	tests := []struct {
+		code int
+		want string
+	}{{
+		code: 4014,
+		want: "gateway closed with code 4014 (Disallowed intent(s)): " +
+			"turn on the server members intent in the developer portal",
+	}, {
+		code: 4004,
+		want: "gateway closed with code 4004 (Authentication failed)",
+	}}
+	for _, tt := range tests {
+		err := gatewayClosed(tt.code,
+			gateway.IntentGuilds|gateway.IntentGuildMembers)
+		if got := err.Error(); got != tt.want {
+			t.Errorf("%s(%d) = %q, want %q",
+				funcname(t, gatewayClosed), tt.code, got, tt.want)
+		}
+	}
+}
+
+func TestGrantIntentsRequired(t *testing.T) {
+	f := newFakeDiscord(t, 1)
+	f.appFlags = 0
+	bot, err := newClient(fakeToken, nil,
+		disgobot.WithRestClientConfigOpts(rest.WithURL(f.srv.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mods := []enabledModule{{module: membersOnlyModule{}}}
+	err = grantIntents(bot, mods)
+	want := "members module needs the server members intent: " +
+		"turn it on in the developer portal"
+	if err == nil || err.Error() != want {
+		t.Errorf("%s(): %v, want %s", funcname(t, grantIntents), err, want)
+	}
+}
+
+// membersOnlyModule can't do without the server members intent.
+type membersOnlyModule struct{ module }
+
+func (membersOnlyModule) Name() string { return "members" }
+
+func (membersOnlyModule) Intents() gateway.Intents {
+	return gateway.IntentGuildMembers
+}
+
+// runFake runs the bot against f until the test ends, returning what run
+// returns.
+func runFake(t *testing.T, f *fakeDiscord) <-chan error {
+	t.Helper()
+	return runFakeConfig(t, f, &config{
+		token:  fakeToken,
+		leader: leaderConfig{ttl: 15 * time.Second},
+	})
+}
+
+// runFakeConfig is runFake with a config of the test's own.
+func runFakeConfig(t *testing.T, f *fakeDiscord, cfg *config) <-chan error {
+	t.Helper()
+	t.Cleanup(setDefaultHandler(f.logger().Handler()))
+	// Not t.Context, which is done before the gateway is quiesced.
+	ctx, cancel := context.WithCancel(context.Background())
+	done, stopped := make(chan error, 1), make(chan struct{})
+	t.Cleanup(func() {
+		select {
+		case <-stopped: // Discord closed the gateway.
+		default:
+			f.quiesce()
+		}
+		cancel()
+		select {
+		case <-stopped:
+		case <-time.After(10 * time.Second):
+			t.Error("run() did not return after its context was done")
+		}
+	})
+	go func() {
+		err := run(ctx, cfg, http.NewServeMux(), disgobot.WithRestClientConfigOpts(
+			rest.WithURL(f.srv.URL),
+		))
+		close(stopped)
+		done <- err
+	}()
+	return done
+}
+
+func TestRunWithoutMembersIntent(t *testing.T) {
+	const (
+		guildID   snowflake.ID = 1
+		roleID    snowflake.ID = 2
+		channelID snowflake.ID = 3
+		alice     snowflake.ID = 10
+		bob       snowflake.ID = 11
+		carol     snowflake.ID = 12
+	)
+	f := newFakeDiscord(t, guildID)
+	f.appFlags = 0
+	f.disallowed = gateway.IntentGuildMembers
+	f.addVoiceChannel(channelID, "General")
+	f.addRole(roleID, "voice")
+	f.addMember(alice, "alice")
+	f.addMember(bob, "bob", roleID)
+	f.addMember(carol, "carol")
+	f.setVoice(alice, ptr(channelID))
+	runFake(t, f)
+
+	// Bob is never seen in a call, so he keeps the role.
+	want := []roleMutation{
+		{Add: true, GuildID: guildID, UserID: alice, RoleID: roleID},
+	}
+	if got := f.waitMutations(1); !cmp.Equal(got, want) {
+		t.Fatalf("initial sync -want +got\n%s", cmp.Diff(want, got))
+	}
+
+	f.setVoice(carol, ptr(channelID))
+	want = append(want,
+		roleMutation{Add: true, GuildID: guildID, UserID: carol, RoleID: roleID})
+	if got := f.waitMutations(2); !cmp.Equal(got, want) {
+		t.Fatalf("after join -want +got\n%s", cmp.Diff(want, got))
+	}
+
+	f.setVoice(alice, nil)
+	want = append(want,
+		roleMutation{Add: false, GuildID: guildID, UserID: alice, RoleID: roleID})
+	if got := f.waitMutations(3); !cmp.Equal(got, want) {
+		t.Fatalf("after leave -want +got\n%s", cmp.Diff(want, got))
+	}
+}
+
+func TestRunDisallowedIntent(t *testing.T) {
+	tests := []struct {
+		desc   string
+		shards shardConfig
+	}{
+		{"unsharded", shardConfig{}},
+		{"sharded", shardConfig{enabled: true, count: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			f := newFakeDiscord(t, 1)
+			// The application info says the intent is on, but the gateway
+			// disagrees.
+			f.disallowed = gateway.IntentGuildMembers
+			select {
+			case err := <-runFakeConfig(t, f, &config{
+				token:  fakeToken,
+				shards: tt.shards,
+				leader: leaderConfig{ttl: 15 * time.Second},
+			}):
+				if err == nil || !strings.Contains(err.Error(), "code 4014") ||
+					!strings.Contains(err.Error(), "server members") {
+					t.Errorf("run(): %v, want disallowed server members intent",
+						err)
+				}
+			case <-time.After(15 * time.Second):
+				t.Fatal("run() did not return after the gateway closed")
+			}
+		})
+	}
+}
+
+// TestRunShardingRequired checks that a shard closed with 4011 is left to
+// the shard manager rather than stopping the bot. disgo v0.18.16 reconnects
+// after 4011 itself: TestWatchClose covers the close handler.
+func TestRunShardingRequired(t *testing.T) {
+	f := newFakeDiscord(t, 1)
+	f.closeCode = gateway.CloseEventCodeShardingRequired.Code
+	select {
+	case err := <-runFakeConfig(t, f, &config{
+		token:  fakeToken,
+		shards: shardConfig{enabled: true, count: 1},
+		leader: leaderConfig{ttl: 15 * time.Second},
+	}):
+		t.Errorf("run(): %v after 4011, want it to keep running", err)
+	case <-f.identified:
+	case <-time.After(10 * time.Second):
+		t.Fatal("shard did not identify again after 4011")
+	}
+}
+
+func TestWatchClose(t *testing.T) {
+	tests := []struct {
+		desc string
+		err  error
+		want int // Passed to fatal, or 0.
+	}{
+		{"disallowed intent", &websocket.CloseError{Code: 4014}, 4014},
+		{"sharding required", &websocket.CloseError{Code: 4011}, 0},
+		{"not a close", errors.New("boom"), 0},
+	}
+	for _, tt := range tests {
+		var closed bool
+		got := 0
+		watchClose(func(gateway.Gateway, error) { closed = true },
+			func(code int) { got = code })(nil, tt.err)
+		if !closed {
+			t.Errorf("%s: %s did not call the shard manager's close handler",
+				tt.desc, funcname(t, watchClose))
+		}
+		if got != tt.want {
+			t.Errorf("%s: %s called fatal with %d, want %d",
+				tt.desc, funcname(t, watchClose), got, tt.want)
+		}
+	}
+}
+
+// TestCloseWatcherDisgo fails when disgo is upgraded: check that its
+// unsharded gateway still logs closeWatcherMsg with the code and reconnect
+// attributes, or gained a close handler, then update the version here.
+func TestCloseWatcherDisgo(t *testing.T) {
+	if got, want := disgo.Version, "v0.18.16"; got != want {
+		t.Errorf("disgo %s, closeWatcher was checked against %s", got, want)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	disgobot "github.com/disgoorg/disgo/bot"
+	"github.com/disgoorg/disgo/httpserver"
+)
+
+// interactionsPath is where the interactions endpoint receives requests.
+const interactionsPath = "/interactions"
+
+// interactionsOpt receives slash commands and components on an HTTP endpoint
+// instead of the gateway. disgo checks the Ed25519 signature Discord puts on
+// every request, answering forgeries with 401 Unauthorized.
+func interactionsOpt(ic interactionsConfig) disgobot.ConfigOpt {
+	return disgobot.WithHTTPServerConfigOpts(ic.publicKey,
+		httpserver.WithAddress(ic.addr),
+		httpserver.WithURL(interactionsPath),
+	)
+}
+
+// interactions serves the interactions endpoint without connecting to the
+// gateway, so that it can be scaled and restarted apart from the daemon.
+func (c *cli) interactions(ctx context.Context, args []string) error {
+	if err := parse(c.flags("interactions", nil), args, nil); err != nil {
+		return err
+	}
+	cfg, mods, bot, err := c.client()
+	if err != nil {
+		return err
+	}
+	if cfg.interactions.addr == "" {
+		return fmt.Errorf("DISCORD_INTERACTIONS_ADDR is not set")
+	}
+	bot.AddEventListeners(commandListeners(mods)...)
+	if err := bot.OpenHTTPServer(); err != nil {
+		return fmt.Errorf("could not serve interactions: %w", err)
+	}
+	slog.Info("serving interactions",
+		"addr", cfg.interactions.addr, "path", interactionsPath)
+	<-ctx.Done()
+	closeCtx, cancel := context.WithTimeout(
+		context.Background(), 10*time.Second,
+	)
+	defer cancel()
+	bot.Close(closeCtx)
+	return nil
+}
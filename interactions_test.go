@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	disgobot "github.com/disgoorg/disgo/bot"
+	"github.com/disgoorg/disgo/discord"
+	"github.com/disgoorg/disgo/httpserver"
+	"github.com/disgoorg/disgo/rest"
+)
+
+// testInteractions serves the interactions endpoint of a bot talking to f,
+// configured by env, and returns the endpoint's URL and the key requests must
+// be signed with.
+func testInteractions(
+	t *testing.T, f *fakeDiscord, env map[string]string,
+) (url string, key ed25519.PrivateKey) {
+	t.Helper()
+	pub, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	env = maps.Clone(env)
+	if env == nil {
+		env = make(map[string]string)
+	}
+	env["DISCORD_INTERACTIONS_ADDR"] = "127.0.0.1:0"
+	env["DISCORD_PUBLIC_KEY"] = hex.EncodeToString(pub)
+	c, _ := testCLI(f, env)
+	c.opts = []disgobot.ConfigOpt{
+		disgobot.WithRestClientConfigOpts(rest.WithURL(f.srv.URL)),
+		disgobot.WithHTTPServerConfigOpts(hex.EncodeToString(pub),
+			httpserver.WithServeMux(mux)),
+	}
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan error, 1)
+	go func() { done <- c.run(ctx, []string{"interactions"}) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("interactions: %v", err)
+		}
+	})
+	url = srv.URL + interactionsPath
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if _, pattern := mux.Handler(
+			httptest.NewRequest("POST", interactionsPath, nil),
+		); pattern != "" {
+			return url, key
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for interactions endpoint")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// postInteraction posts body to url, signed with key if it is not nil.
+func postInteraction(
+	t *testing.T, url string, key ed25519.PrivateKey, body string,
+) (status int, resp string) {
+	t.Helper()
+	req, err := http.NewRequest("POST", url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != nil {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		sig := ed25519.Sign(key, []byte(ts+body))
+		req.Header.Set("X-Signature-Timestamp", ts)
+		req.Header.Set("X-Signature-Ed25519", hex.EncodeToString(sig))
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode, string(b)
+}
+
+const pingInteraction = `{"id":"1","application_id":"1000","type":1,` +
+	`"token":"t","version":1}`
+
+func TestInteractionsSignature(t *testing.T) {
+	url, key := testInteractions(t, newFakeDiscord(t, 1), nil)
+	_, forger, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		desc string
+		key  ed25519.PrivateKey
+		want int
+	}{
+		{"signed", key, http.StatusOK},
+		{"unsigned", nil, http.StatusUnauthorized},
+		{"forged", forger, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		status, body := postInteraction(t, url, tt.key, pingInteraction)
+		if status != tt.want {
+			t.Errorf("%s ping: status %d, want %d", tt.desc, status, tt.want)
+		}
+		if status == http.StatusOK && strings.TrimSpace(body) != `{"type":1}` {
+			t.Errorf("%s ping: got %s, want pong", tt.desc, body)
+		}
+	}
+}
+
+func TestInteractionsVoiceCheck(t *testing.T) {
+	const (
+		slash = `{"id":"1","application_id":"1000","type":2,"token":"t",` +
+			`"version":1,"guild_id":"1","channel_id":"3",` +
+			`"app_permissions":"%d",` +
+			`"member":{"user":{"id":"10","username":"mod"},"roles":[],` +
+			`"permissions":"268435456"},` +
+			`"data":{"id":"50","name":"voice","type":1,` +
+			`"options":[{"name":"check","type":1}]}}`
+		button = `{"id":"2","application_id":"1000","type":3,"token":"t",` +
+			`"version":1,"guild_id":"1","channel_id":"3",` +
+			`"app_permissions":"%d",` +
+			`"member":{"user":{"id":"10","username":"mod"},"roles":[],` +
+			`"permissions":"268435456"},` +
+			`"message":{"id":"60","channel_id":"3","content":"",` +
+			`"timestamp":"2024-01-01T00:00:00Z"},` +
+			`"data":{"custom_id":"voice/check","component_type":2}}`
+	)
+	f := newFakeDiscord(t, 1)
+	f.addRole(2, voiceRole)
+	f.addBotRole(3, "bot")
+	url, key := testInteractions(t, f, nil)
+
+	tests := []struct {
+		desc     string
+		body     string
+		perms    discord.Permissions
+		wantType discord.InteractionResponseType
+		want     string
+	}{{
+		desc:     "command",
+		body:     slash,
+		perms:    discord.PermissionManageRoles,
+		wantType: discord.InteractionResponseTypeCreateMessage,
+		want:     `✅ Voice roles are working: the bot can assign "voice".`,
+	}, {
+		desc:     "command without permission",
+		body:     slash,
+		perms:    discord.PermissionViewChannel,
+		wantType: discord.InteractionResponseTypeCreateMessage,
+		want: "❌ Voice roles are not working: " +
+			"missing Manage Roles permission.",
+	}, {
+		desc:     "button",
+		body:     button,
+		perms:    discord.PermissionManageRoles,
+		wantType: discord.InteractionResponseTypeUpdateMessage,
+		want:     `✅ Voice roles are working: the bot can assign "voice".`,
+	}}
+	for _, tt := range tests {
+		status, body := postInteraction(t, url, key,
+			strings.Replace(tt.body, "%d",
+				strconv.FormatInt(int64(tt.perms), 10), 1))
+		if status != http.StatusOK {
+			t.Errorf("%s: status %d: %s", tt.desc, status, body)
+			continue
+		}
+		var resp struct {
+			Type discord.InteractionResponseType `json:"type"`
+			Data struct {
+				Content string               `json:"content"`
+				Flags   discord.MessageFlags `json:"flags"`
+			} `json:"data"`
+		}
+		if err := json.Unmarshal([]byte(body), &resp); err != nil {
+			t.Fatalf("%s: %v: %s", tt.desc, err, body)
+		}
+		if resp.Type != tt.wantType {
+			t.Errorf("%s: response type %d, want %d",
+				tt.desc, resp.Type, tt.wantType)
+		}
+		if resp.Data.Content != tt.want {
+			t.Errorf("%s: content %q, want %q",
+				tt.desc, resp.Data.Content, tt.want)
+		}
+		if tt.wantType == discord.InteractionResponseTypeCreateMessage &&
+			!resp.Data.Flags.Has(discord.MessageFlagEphemeral) {
+			t.Errorf("%s: response is not ephemeral", tt.desc)
+		}
+	}
+}
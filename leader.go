@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// A leaderLock grants leadership to at most one replica at a time.
+// Leadership is a lease: holders must renew it before ttl elapses.
+type leaderLock interface {
+	// TryAcquire takes or renews the lock, reporting whether it is held.
+	TryAcquire(ctx context.Context) (bool, error)
+	// Release gives up the lock if it is held.
+	Release(ctx context.Context) error
+}
+
+func newLeaderLock(spec, id string, ttl time.Duration) (leaderLock, error) {
+	switch {
+	case spec == "":
+		return soloLock{}, nil
+	case strings.HasPrefix(spec, "file:"):
+		return &fileLock{
+			path: strings.TrimPrefix(spec, "file:"),
+			id:   id,
+			ttl:  ttl,
+		}, nil
+	case strings.HasPrefix(spec, "http://"),
+		strings.HasPrefix(spec, "https://"):
+		return &httpLease{
+			url:    spec,
+			id:     id,
+			ttl:    ttl,
+			client: &http.Client{Timeout: ttl / 3},
+		}, nil
+	default:
+		return nil, fmt.Errorf("bad DISCORD_LEADER_LOCK: %q", spec)
+	}
+}
+
+// soloLock is always held. It is used when only one replica runs.
+type soloLock struct{}
+
+func (soloLock) TryAcquire(context.Context) (bool, error) { return true, nil }
+func (soloLock) Release(context.Context) error            { return nil }
+
+// fileLock is a leaderLock for replicas sharing a filesystem. The lock file
+// holds the holder's ID, or nothing if the lock is free, and its modification
+// time is the last renewal. Replicas flock the file while they read and write
+// it, so only one of them can take a stale lock.
+type fileLock struct {
+	path string
+	id   string
+	ttl  time.Duration
+}
+
+func (l *fileLock) TryAcquire(context.Context) (held bool, err error) {
+	err = l.locked(func(f *os.File, holder string) error {
+		switch {
+		case holder == l.id, holder == "":
+		default:
+			fi, err := f.Stat()
+			if err != nil {
+				return fmt.Errorf("could not stat lock file: %w", err)
+			}
+			if time.Since(fi.ModTime()) < l.ttl {
+				return nil
+			}
+			slog.Warn("breaking stale leader lock", "holder", holder)
+		}
+		// Writing the ID renews the lock, even if it is already there.
+		if err := f.Truncate(0); err != nil {
+			return fmt.Errorf("could not write lock file: %w", err)
+		}
+		if _, err := f.WriteAt([]byte(l.id), 0); err != nil {
+			return fmt.Errorf("could not write lock file: %w", err)
+		}
+		held = true
+		return nil
+	})
+	return held, err
+}
+
+func (l *fileLock) Release(context.Context) error {
+	return l.locked(func(f *os.File, holder string) error {
+		if holder != l.id {
+			return nil
+		}
+		if err := f.Truncate(0); err != nil {
+			return fmt.Errorf("could not release lock file: %w", err)
+		}
+		return nil
+	})
+}
+
+// locked calls fn with the lock file and its holder while holding an
+// exclusive lock on it.
+func (l *fileLock) locked(fn func(f *os.File, holder string) error) error {
+	f, err := os.OpenFile(l.path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("could not open lock file: %w", err)
+	}
+	defer f.Close()
+	if err := lockFile(f); err != nil {
+		return fmt.Errorf("could not lock lock file: %w", err)
+	}
+	defer unlockFile(f)
+	holder, err := io.ReadAll(f)
+	if err != nil {
+		return fmt.Errorf("could not read lock file: %w", err)
+	}
+	return fn(f, string(holder))
+}
+
+// httpLease is a leaderLock backed by a key-value lease service.
+//
+// PUT to url with a leaseRequest acquires or renews the lease, answering
+// 200 OK if it is held by the caller and 409 Conflict if it is held by
+// someone else. DELETE with a leaseRequest releases it.
+type httpLease struct {
+	url    string
+	id     string
+	ttl    time.Duration
+	client *http.Client
+}
+
+type leaseRequest struct {
+	Holder string `json:"holder"`
+	TTLMS  int64  `json:"ttl_ms"`
+}
+
+func (l *httpLease) TryAcquire(ctx context.Context) (bool, error) {
+	status, err := l.do(ctx, http.MethodPut)
+	if err != nil {
+		return false, err
+	}
+	switch status {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusConflict:
+		return false, nil
+	default:
+		return false, fmt.Errorf("could not acquire lease: status %d", status)
+	}
+}
+
+func (l *httpLease) Release(ctx context.Context) error {
+	status, err := l.do(ctx, http.MethodDelete)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK && status != http.StatusConflict {
+		return fmt.Errorf("could not release lease: status %d", status)
+	}
+	return nil
+}
+
+func (l *httpLease) do(ctx context.Context, method string) (int, error) {
+	body, err := json.Marshal(leaseRequest{
+		Holder: l.id,
+		TTLMS:  l.ttl.Milliseconds(),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("could not encode lease request: %w", err)
+	}
+	req, err := http.NewRequestWithContext(
+		ctx, method, l.url, bytes.NewReader(body),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("could not build lease request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("lease request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// elector periodically renews a leaderLock and tracks whether this replica
+// is the leader.
+type elector struct {
+	lock     leaderLock
+	interval time.Duration
+	onChange func(leading bool)
+
+	isLeader atomic.Bool
+}
+
+func newElector(
+	lock leaderLock, ttl time.Duration, onChange func(bool),
+) *elector {
+	return &elector{lock: lock, interval: ttl / 3, onChange: onChange}
+}
+
+// leading reports whether this replica may mutate roles.
+func (e *elector) leading() bool {
+	return e.isLeader.Load()
+}
+
+// run campaigns for leadership until ctx is done, then releases the lock.
+func (e *elector) run(ctx context.Context) {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	for {
+		e.campaign(ctx)
+		select {
+		case <-ctx.Done():
+			e.set(false)
+			rctx, cancel := context.WithTimeout(
+				context.Background(), e.interval,
+			)
+			defer cancel()
+			if err := e.lock.Release(rctx); err != nil {
+				slog.Error("failed to release leader lock", "error", err)
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (e *elector) campaign(ctx context.Context) {
+	ok, err := e.lock.TryAcquire(ctx)
+	if err != nil {
+		// Without a confirmed renewal the lease may lapse, so step down.
+		slog.Error("failed to acquire leader lock", "error", err)
+		ok = false
+	}
+	e.set(ok)
+}
+
+func (e *elector) set(leading bool) {
+	if e.isLeader.Swap(leading) == leading {
+		return
+	}
+	if leading {
+		slog.Info("became leader")
+	} else {
+		slog.Info("became standby")
+	}
+	if e.onChange != nil {
+		e.onChange(leading)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestFileLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leader.lock")
+	a := &fileLock{path: path, id: "a", ttl: time.Minute}
+	b := &fileLock{path: path, id: "b", ttl: time.Minute}
+
+	mustAcquire(t, a, true)
+	mustAcquire(t, b, false)
+	mustAcquire(t, a, true) // Renewal.
+
+	if err := b.Release(t.Context()); err != nil {
+		t.Fatalf("b.Release(): %v", err)
+	}
+	mustAcquire(t, b, false) // b does not hold the lock, so it is not freed.
+
+	if err := a.Release(t.Context()); err != nil {
+		t.Fatalf("a.Release(): %v", err)
+	}
+	mustAcquire(t, b, true)
+	mustAcquire(t, a, false)
+}
+
+func TestFileLockStale(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leader.lock")
+	a := &fileLock{path: path, id: "a", ttl: time.Minute}
+	b := &fileLock{path: path, id: "b", ttl: time.Minute}
+
+	mustAcquire(t, a, true)
+	stale := time.Now().Add(-2 * time.Minute)
+	if err := os.Chtimes(path, stale, stale); err != nil {
+		t.Fatal(err)
+	}
+	mustAcquire(t, b, true)
+	mustAcquire(t, a, false)
+}
+
+func TestFileLockStaleRace(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leader.lock")
+	ids := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	for range 200 {
+		if err := os.WriteFile(path, []byte("old"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		stale := time.Now().Add(-2 * time.Minute)
+		if err := os.Chtimes(path, stale, stale); err != nil {
+			t.Fatal(err)
+		}
+		var (
+			wg      sync.WaitGroup
+			mu      sync.Mutex
+			winners []string
+			start   = make(chan struct{})
+		)
+		for _, id := range ids {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				l := &fileLock{path: path, id: id, ttl: time.Minute}
+				ok, err := l.TryAcquire(t.Context())
+				if err != nil {
+					t.Errorf("%s.TryAcquire(): %v", id, err)
+				}
+				if ok {
+					mu.Lock()
+					winners = append(winners, id)
+					mu.Unlock()
+				}
+			}()
+		}
+		close(start)
+		wg.Wait()
+		if len(winners) != 1 {
+			t.Fatalf("stale lock taken by %v, want one replica", winners)
+		}
+		holder, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(holder) != winners[0] {
+			t.Fatalf("lock file holds %q, want %q", holder, winners[0])
+		}
+	}
+}
+
+// leaseServer is an in-memory implementation of the httpLease protocol.
+type leaseServer struct {
+	mu      sync.Mutex
+	now     func() time.Time
+	holder  string
+	expires time.Time
+}
+
+func (s *leaseServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req leaseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	free := s.holder == "" || now.After(s.expires)
+	switch r.Method {
+	case http.MethodPut:
+		if !free && s.holder != req.Holder {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		s.holder = req.Holder
+		s.expires = now.Add(time.Duration(req.TTLMS) * time.Millisecond)
+	case http.MethodDelete:
+		if !free && s.holder != req.Holder {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		s.holder = ""
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestHTTPLease(t *testing.T) {
+	now := time.Now()
+	srv := httptest.NewServer(&leaseServer{now: func() time.Time { return now }})
+	defer srv.Close()
+	a, err := newLeaderLock(srv.URL+"/leader", "a", 15*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := newLeaderLock(srv.URL+"/leader", "b", 15*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mustAcquire(t, a, true)
+	mustAcquire(t, b, false)
+
+	now = now.Add(20 * time.Second) // a's lease lapses.
+	mustAcquire(t, b, true)
+	mustAcquire(t, a, false)
+
+	if err := b.Release(t.Context()); err != nil {
+		t.Fatalf("b.Release(): %v", err)
+	}
+	mustAcquire(t, a, true)
+}
+
+type fakeLock struct {
+	held bool
+	err  error
+}
+
+func (l *fakeLock) TryAcquire(context.Context) (bool, error) {
+	return l.held, l.err
+}
+
+func (l *fakeLock) Release(context.Context) error {
+	l.held = false
+	return nil
+}
+
+func TestElector(t *testing.T) {
+	lock := new(fakeLock)
+	var changes []bool
+	e := newElector(lock, 3*time.Second, func(leading bool) {
+		changes = append(changes, leading)
+	})
+
+	e.campaign(t.Context())
+	if e.leading() {
+		t.Errorf("leading() = true before acquiring lock")
+	}
+	lock.held = true
+	e.campaign(t.Context())
+	e.campaign(t.Context())
+	if !e.leading() {
+		t.Errorf("leading() = false after acquiring lock")
+	}
+	lock.err = errors.New("boom")
+	e.campaign(t.Context())
+	if e.leading() {
+		t.Errorf("leading() = true after failed renewal")
+	}
+	if got, want := changes, []bool{true, false}; !cmp.Equal(got, want) {
+		t.Errorf("onChange calls -want +got\n%s", cmp.Diff(want, got))
+	}
+}
+
+func mustAcquire(t *testing.T, l leaderLock, want bool) {
+	t.Helper()
+	got, err := l.TryAcquire(t.Context())
+	if err != nil {
+		t.Fatalf("TryAcquire(): %v", err)
+	}
+	if got != want {
+		t.Fatalf("TryAcquire() = %t, want %t", got, want)
+	}
+}
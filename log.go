@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"io"
+	"log/slog"
+
+	"github.com/disgoorg/disgo/discord"
+	"github.com/disgoorg/snowflake/v2"
+)
+
+// logModuleKey is the attribute naming the module a logger logs for.
+const logModuleKey = "module"
+
+// Reasons a voice role sync runs, logged as its trigger.
+const (
+	triggerStart  = "start"  // The guild became available.
+	triggerEvent  = "event"  // A member joined, left or changed in a call.
+	triggerGrace  = "grace"  // A grace period ended.
+	triggerTicker = "ticker" // The periodic resync.
+	triggerLeader = "leader" // This replica became the leader.
+	triggerManual = "manual" // The sync command.
+)
+
+// newLogHandler returns a handler writing records to w in the format of lc,
+// at the level of the module they are logged for.
+func newLogHandler(w io.Writer, lc logConfig) slog.Handler {
+	lowest := lc.level
+	for _, l := range lc.modules {
+		lowest = min(lowest, l)
+	}
+	opts := &slog.HandlerOptions{Level: lowest}
+	var h slog.Handler
+	if lc.format == "json" {
+		h = slog.NewJSONHandler(w, opts)
+	} else {
+		h = slog.NewTextHandler(w, opts)
+	}
+	return &moduleLevelHandler{next: h, level: lc.level, modules: lc.modules}
+}
+
+// moduleLevelHandler drops records below the level of their module, as set
+// on a logger with With(logModuleKey, name), or below level if it has none.
+type moduleLevelHandler struct {
+	next    slog.Handler
+	level   slog.Level
+	modules map[string]slog.Level // Nil inside groups.
+}
+
+func (h *moduleLevelHandler) Enabled(ctx context.Context, l slog.Level) bool {
+	return l >= h.level && h.next.Enabled(ctx, l)
+}
+
+func (h *moduleLevelHandler) Handle(ctx context.Context, r slog.Record) error {
+	return h.next.Handle(ctx, r)
+}
+
+func (h *moduleLevelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	c := *h
+	c.next = h.next.WithAttrs(attrs)
+	for _, a := range attrs {
+		if a.Key != logModuleKey {
+			continue
+		}
+		if l, ok := h.modules[a.Value.String()]; ok {
+			c.level = l
+		}
+	}
+	return &c
+}
+
+func (h *moduleLevelHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	c := *h
+	c.next = h.next.WithGroup(name)
+	c.modules = nil // A module attribute in a group names no module.
+	return &c
+}
+
+// moduleLogger returns the logger for the named module.
+func moduleLogger(name string) *slog.Logger {
+	return slog.With(logModuleKey, name)
+}
+
+// A syncRun is one run of a voice role sync. Its ID and trigger tie
+// together what the run logs and the role changes it makes.
+type syncRun struct {
+	id      string
+	trigger string       // Like triggerEvent.
+	log     *slog.Logger // With the guild, ID and trigger.
+
+	gid   snowflake.ID
+	roles []discord.Role // Of gid, once listed by findRole.
+}
+
+// newSyncRun starts a run of a sync of gid, logging to log.
+func newSyncRun(log *slog.Logger, gid snowflake.ID, trigger string) *syncRun {
+	id := rand.Text()
+	return &syncRun{
+		id:      id,
+		trigger: trigger,
+		log:     log.With("guild", gid, "run", id, "trigger", trigger),
+		gid:     gid,
+	}
+}
+
+// findRole finds the named role of gid with f. If f is a roleLister, the
+// roles of the guild of r are only listed the first time.
+func (r *syncRun) findRole(
+	f roleFinder, gid snowflake.ID, name string,
+) (discord.Role, error) {
+	l, ok := f.(roleLister)
+	if !ok || gid != r.gid {
+		return f.FindRole(gid, name)
+	}
+	if r.roles == nil {
+		roles, err := l.GuildRoles(gid)
+		if err != nil {
+			return discord.Role{}, err
+		}
+		r.roles = append(make([]discord.Role, 0, len(roles)), roles...)
+	}
+	return roleNamed(r.roles, name)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestLogHandlerModuleLevels(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(newLogHandler(&buf, logConfig{
+		format: "json",
+		level:  slog.LevelInfo,
+		modules: map[string]slog.Level{
+			"voice": slog.LevelDebug,
+			"names": slog.LevelWarn,
+		},
+	}))
+	logger.Debug("bot debug")
+	logger.Info("bot info")
+	voice := logger.With(logModuleKey, "voice")
+	voice.Debug("voice debug")
+	names := logger.With(logModuleKey, "names")
+	names.Info("names info")
+	names.Warn("names warn")
+	// A module attribute in a group is not the module of the logger.
+	logger.WithGroup("g").With(logModuleKey, "voice").Debug("group debug")
+
+	var got []string
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var line struct{ Msg string }
+		if err := dec.Decode(&line); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, line.Msg)
+	}
+	want := []string{"bot info", "voice debug", "names warn"}
+	if !cmp.Equal(got, want) {
+		t.Errorf("logged -want +got\n%s", cmp.Diff(want, got))
+	}
+}
+
+func TestSyncRunLog(t *testing.T) {
+	var buf bytes.Buffer
+	base := slog.New(newLogHandler(&buf, logConfig{format: "json"})).
+		With(logModuleKey, "voice")
+	a := newSyncRun(base, 1, triggerTicker).log
+	b := newSyncRun(base, 1, triggerEvent).log
+	a.Info("synced voice roles")
+	b.Info("synced voice roles")
+
+	type line struct {
+		Module  string
+		Guild   string
+		Run     string
+		Trigger string
+	}
+	var lines []line
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var l line
+		if err := dec.Decode(&l); err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, l)
+	}
+	if len(lines) != 2 {
+		t.Fatalf("logged %d lines, want 2", len(lines))
+	}
+	for i, trigger := range []string{triggerTicker, triggerEvent} {
+		l := lines[i]
+		if l.Module != "voice" || l.Guild != "1" || l.Trigger != trigger ||
+			l.Run == "" {
+			t.Errorf("line %d = %+v, want voice, guild 1, a run and %s",
+				i, l, trigger)
+		}
+	}
+	if lines[0].Run == lines[1].Run {
+		t.Errorf("runs share the ID %q", lines[0].Run)
+	}
+}
@@ -3,278 +3,385 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"os/signal"
 	"slices"
-	"strings"
+	"syscall"
 	"time"
 
-	"github.com/disgoorg/disgo"
 	disgobot "github.com/disgoorg/disgo/bot"
-	"github.com/disgoorg/disgo/cache"
-	"github.com/disgoorg/disgo/discord"
 	"github.com/disgoorg/disgo/events"
 	"github.com/disgoorg/disgo/gateway"
+	"github.com/disgoorg/disgo/webhook"
 	"github.com/disgoorg/snowflake/v2"
+	"go.opentelemetry.io/otel/trace"
 	_ "golang.org/x/crypto/x509roots/fallback"
 )
 
-var t testingDetector
-
 //go:generate go run lesiw.io/moxie@latest client
 type client struct{ disgobot.Client }
 
 func main() {
-	go func() {
-		slog.Error(http.ListenAndServe("localhost:8080", nil).Error())
-	}()
-	if err := run(); err != nil {
+	// Bad settings are reported when the command loads its config.
+	if lc, err := parseLogConfig(
+		os.Getenv("DISCORD_LOG_FORMAT"),
+		os.Getenv("DISCORD_LOG_LEVEL"),
+		os.Getenv("DISCORD_LOG_LEVELS"),
+	); err == nil {
+		slog.SetDefault(slog.New(newLogHandler(os.Stderr, lc)))
+	}
+	ctx, stop := signal.NotifyContext(context.Background(),
+		os.Interrupt, syscall.SIGTERM)
+	err := (&cli{
+		getenv: os.Getenv,
+		stdout: os.Stdout,
+		stderr: os.Stderr,
+		mux:    http.DefaultServeMux,
+		addr:   "localhost:8080",
+	}).run(ctx, os.Args[1:])
+	stop()
+	if errors.Is(err, errUsage) {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	} else if err != nil {
 		slog.Error(err.Error())
 		os.Exit(1)
 	}
 }
 
-func run() error {
-	tok := os.Getenv("DISCORD_TOKEN")
-	if tok == "" {
-		return fmt.Errorf("bad DISCORD_TOKEN")
-	}
-	bot, err := disgo.New(tok,
-		disgobot.WithGatewayConfigOpts(
-			gateway.WithIntents(
-				gateway.IntentGuilds,
-				gateway.IntentGuildMembers,
-				gateway.IntentGuildMessages,
-				gateway.IntentGuildVoiceStates,
-				gateway.IntentGuildMessageReactions,
-			),
-		),
-		disgobot.WithCacheConfigOpts(
-			cache.WithCaches(cache.FlagGuilds|
-				cache.FlagChannels|
-				cache.FlagMembers|
-				cache.FlagVoiceStates|
-				cache.FlagRoles,
-			),
-		),
-		disgobot.WithEventManagerConfigOpts(
-			disgobot.WithAsyncEventsEnabled(),
-		),
+// run connects to Discord and syncs roles until ctx is done.
+func run(
+	ctx context.Context, cfg *config, mux *http.ServeMux,
+	extra ...disgobot.ConfigOpt,
+) error {
+	var (
+		sessions *sessionStore
+		mw       []gatewayMiddleware
+		opts     []disgobot.ConfigOpt
+		gwOpts   []gateway.ConfigOpt // Applied once the shard is set.
+		ops      *opsMirror
 	)
-	if err != nil {
-		return fmt.Errorf("could not set up bot: %w", err)
+	if cfg.ops.enabled() {
+		// Installed first, so that every logger made from here on mirrors.
+		h := slog.Default().Handler()
+		ops = newOpsMirror(systemClock{}, h)
+		restore := setDefaultHandler(newOpsHandler(h, cfg.ops.level, ops))
+		defer func() {
+			restore()
+			ops.stop()
+		}()
+		if cfg.ops.webhook != "" {
+			client, err := webhook.NewWithURL(cfg.ops.webhook)
+			if err != nil {
+				return fmt.Errorf("could not set up ops webhook: %w", err)
+			}
+			ops.setPoster(opsWebhookPoster{client})
+		}
 	}
-
-	ctx := context.Background()
-	updateRole := make(chan struct{})
-
-	bot = &client{bot}
-	bot.AddEventListeners(
-		disgobot.NewListenerFunc(func(*events.Ready) {
-			slog.Info("received ready event from gateway")
-		}),
-		disgobot.NewListenerFunc(func(e *events.GuildReady) {
-			go func() {
-				for range updateRole {
-					err := syncVoiceRoles(ctx, bot, e.GuildID)
-					if err != nil {
-						slog.Error("failed to sync voice roles", "error", err)
-					}
-				}
-			}()
-		}),
-		disgobot.NewListenerFunc(func(e *events.GuildVoiceJoin) {
-			updateRole <- struct{}{}
-		}),
-		disgobot.NewListenerFunc(func(e *events.GuildVoiceLeave) {
-			updateRole <- struct{}{}
-		}))
-	go func() {
-		ticker := time.NewTicker(time.Minute)
-		for range ticker.C {
-			updateRole <- struct{}{}
+	if cfg.recordFile != "" {
+		rec, err := newRecorder(cfg.recordFile, systemClock{})
+		if err != nil {
+			return err
 		}
-	}()
-	if err := bot.OpenGateway(ctx); err != nil {
-		return fmt.Errorf("could not connect to gateway: %w", err)
+		defer rec.close()
+		mw = append(mw, rec.middleware())
 	}
-	select {}
-}
-
-var testHookFindRoleByName func(
-	disgobot.Client, snowflake.ID, string,
-) (discord.Role, error)
-
-func findRoleByName(
-	c disgobot.Client, gid snowflake.ID, name string,
-) (discord.Role, error) {
-	if h := testHookFindRoleByName; t.Testing() && h != nil {
-		return h(c, gid, name)
+	if cfg.sessionFile != "" {
+		sessions = newSessionStore(cfg.sessionFile, cfg.sessionMaxAge)
+		if err := sessions.load(); err != nil {
+			slog.Error("failed to load gateway session", "error", err)
+		}
+		mw = append(mw, sessions.middleware())
+		gwOpts = append(gwOpts, sessions.gatewayOpt())
 	}
-	roles, err := c.Rest().GetRoles(gid)
+	mods, err := enabledModules(cfg)
 	if err != nil {
-		return discord.Role{}, fmt.Errorf("could not get roles: %w", err)
+		return err
 	}
-	for _, r := range roles {
-		if r.Name == name {
-			return r, nil
+	tp, shutdownTraces, err := newTracerProvider(ctx, cfg.trace)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(
+			context.Background(), 10*time.Second,
+		)
+		defer cancel()
+		if err := shutdownTraces(ctx); err != nil {
+			slog.Error("failed to export traces", "error", err)
 		}
+	}()
+	probe, err := newClient(cfg.token, nil, extra...)
+	if err != nil {
+		return fmt.Errorf("could not set up bot: %w", err)
 	}
-	return discord.Role{}, fmt.Errorf("could not find role %q", name)
-}
-
-var testHookToggleRole func(
-	disgobot.Client, bool, snowflake.ID, snowflake.ID, snowflake.ID,
-) error
-
-func toggleRole(
-	bot disgobot.Client, state bool,
-	guildID, userID, roleID snowflake.ID,
-) error {
-	if h := testHookToggleRole; t.Testing() && h != nil {
-		return h(bot, state, guildID, userID, roleID)
+	err = grantIntents(probe, mods)
+	probe.Close(ctx)
+	if err != nil {
+		return err
 	}
-	fn := bot.Rest().RemoveMemberRole
-	if state {
-		fn = bot.Rest().AddMemberRole
+	for _, m := range mods {
+		if m, ok := m.module.(middlewareModule); ok {
+			mw = append(mw, m.Middleware())
+		}
 	}
-	var roleName, userName string
-	if role, ok := bot.Caches().Role(guildID, roleID); ok {
-		roleName = role.Name
-	} else {
-		roleName = "<unknown>"
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	closed := make(chan int, 1)
+	opts = append(opts, gatewayCreateOpt(cfg.shards, func(code int) {
+		select {
+		case closed <- code:
+			cancel()
+		default:
+		}
+	}, gwOpts...))
+	bot, err := newBot(cfg, mods, mw, append(opts, extra...)...)
+	if err != nil {
+		return err
 	}
-	if user, ok := bot.Caches().Member(guildID, userID); ok {
-		userName = user.User.Username
-	} else {
-		userName = "<unknown>"
+	if ops != nil && cfg.ops.channel != 0 {
+		ops.setPoster(opsChannelPoster{bot, cfg.ops.channel})
 	}
-	if err := fn(guildID, userID, roleID); err != nil {
-		return fmt.Errorf("failed to toggle role %q (enable=%t): %w",
-			roleName, state, err)
+	if sessions != nil {
+		if err := sessions.restore(bot.Caches()); err != nil {
+			slog.Error("failed to restore gateway session", "error", err)
+		}
 	}
-	slog.Info("role toggle",
-		"role", roleName,
-		"user", userName,
-		"enable", state,
-	)
-	return nil
-}
 
-func syncVoiceRoles(
-	ctx context.Context,
-	bot disgobot.Client, gid snowflake.ID,
-) error {
-	slog.Info("syncVoiceRoles event")
-	role, err := findRoleByName(bot, gid, "voice")
-	if err != nil {
-		return fmt.Errorf("could not get voice role: %w", err)
-	}
-	roleMembers, err := membersWithRole(ctx, bot, gid, role)
+	ready := newReadiness()
+	mux.Handle("/readyz", ready)
+
+	lock, err := newLeaderLock(cfg.leader.lock, cfg.leader.id, cfg.leader.ttl)
 	if err != nil {
 		return err
 	}
-	slog.Info("got role members", "members", memberList(bot, gid, roleMembers))
-	callMembers := membersInCall(bot, gid)
-	slog.Info("got call members", "members", memberList(bot, gid, callMembers))
-	for uid := range roleMembers.Diff(callMembers) {
-		// Members that are not in the call, but have a role.
-		if err := toggleRole(bot, false, gid, uid, role.ID); err != nil {
-			return fmt.Errorf("could not remove role: %w", err)
+
+	bot = &client{bot}
+	leader := newElector(lock, cfg.leader.ttl, func(leading bool) {
+		if !leading {
+			return
+		}
+		for _, m := range mods {
+			if m, ok := m.module.(leaderModule); ok {
+				m.Lead()
+			}
+		}
+	})
+	for _, m := range mods {
+		err := m.Start(ctx, moduleEnv{
+			bot:     bot,
+			leading: leader.leading,
+			enabled: m.guilds.allows,
+			missing: m.missing,
+			log:     moduleLogger(m.Name()),
+			tracer:  tp.Tracer(tracerName),
+		})
+		if err != nil {
+			return fmt.Errorf("could not start %s module: %w", m.Name(), err)
 		}
 	}
-	for uid := range callMembers.Diff(roleMembers) {
-		// Members that are in the call, but have no role.
-		if err := toggleRole(bot, true, gid, uid, role.ID); err != nil {
-			return fmt.Errorf("could not add role: %w", err)
+	bot.AddEventListeners(
+		disgobot.NewListenerFunc(func(e *events.Ready) {
+			slog.Info("received ready event from gateway",
+				"shard", e.ShardID())
+			ready.connected(e.ShardID())
+		}),
+		disgobot.NewListenerFunc(func(e *events.Resumed) {
+			slog.Info("resumed gateway session", "shard", e.ShardID())
+			if sessions == nil {
+				return
+			}
+			gids := sessions.resumed(e.ShardID())
+			if gids == nil {
+				return
+			}
+			ready.connected(e.ShardID())
+			for _, gid := range gids {
+				ready.guildReady(e.ShardID())
+				for _, m := range mods {
+					r, ok := m.module.(resumeModule)
+					if ok && m.guilds.allows(gid) {
+						r.GuildResumed(e.ShardID(), gid)
+					}
+				}
+			}
+			ready.ready(e.ShardID())
+		}),
+		disgobot.NewListenerFunc(func(e *events.GuildsReady) {
+			slog.Info("all guilds ready", "shard", e.ShardID())
+			ready.ready(e.ShardID())
+		}),
+		disgobot.NewListenerFunc(func(e *events.GuildReady) {
+			ready.guildReady(e.ShardID())
+		}))
+	for _, m := range mods {
+		bot.AddEventListeners(m.Listeners()...)
+	}
+	bot.AddEventListeners(commandListeners(mods)...)
+	if bot.HasHTTPServer() {
+		if err := bot.OpenHTTPServer(); err != nil {
+			return fmt.Errorf("could not serve interactions: %w", err)
 		}
 	}
-	return nil
-}
-
-var testHookMemberList func(
-	disgobot.Client, snowflake.ID, set[snowflake.ID],
-) string
-
-func memberList(
-	bot disgobot.Client, guildID snowflake.ID, m set[snowflake.ID],
-) string {
-	if h := testHookMemberList; t.Testing() && h != nil {
-		return h(bot, guildID, m)
+	elected := make(chan struct{})
+	go func() {
+		defer close(elected)
+		leader.run(ctx)
+	}()
+	if cfg.shards.enabled {
+		if err := bot.OpenShardManager(ctx); err != nil {
+			return fmt.Errorf("could not open shard manager: %w", err)
+		}
+	} else if err := bot.OpenGateway(ctx); err != nil {
+		return fmt.Errorf("could not connect to gateway: %w", err)
 	}
-	var names []string
-	for id := range m {
-		if user, ok := bot.Caches().Member(guildID, id); ok {
-			names = append(names, user.User.Username)
-		} else {
-			names = append(names, "<unknown>")
+	<-ctx.Done()
+	slog.Info("shutting down")
+	for _, m := range mods {
+		m.Stop()
+	}
+	<-elected
+	closeCtx, cancel := context.WithTimeout(
+		context.Background(), 10*time.Second,
+	)
+	defer cancel()
+	if sessions != nil {
+		if err := sessions.close(closeCtx, bot); err != nil {
+			slog.Error("failed to save gateway session", "error", err)
 		}
 	}
-	if len(names) == 0 {
-		return "<none>"
+	bot.Close(closeCtx)
+	select {
+	case code := <-closed:
+		intents, _ := gatewayNeeds(mods)
+		return gatewayClosed(code, intents)
+	default:
+		return nil
 	}
-	return strings.Join(names, ", ")
 }
 
-var testHookMembersWithRole func(
-	context.Context, disgobot.Client, snowflake.ID,
-	discord.Role,
-) (set[snowflake.ID], error)
-
-func membersWithRole(
-	ctx context.Context,
-	bot disgobot.Client, gid snowflake.ID,
-	role discord.Role,
-) (set[snowflake.ID], error) {
-	if h := testHookMembersWithRole; t.Testing() && h != nil {
-		return h(ctx, bot, gid, role)
+// newBot builds the client that run and the operator commands share, with
+// the intents and caches that mods need. Gateway events pass through mw
+// before reaching disgo.
+func newBot(
+	cfg *config, mods []enabledModule, mw []gatewayMiddleware,
+	opts ...disgobot.ConfigOpt,
+) (disgobot.Client, error) {
+	var lean *leanMemberCache
+	if cfg.leanMembers {
+		lean = &leanMemberCache{roles: callRoleNames()}
 	}
-	chunkCtx, cancel := context.WithTimeout(
-		ctx, 30*time.Second,
-	)
-	defer cancel()
-	members, err := bot.MemberChunkingManager().
-		RequestMembersWithFilterCtx(
-			chunkCtx, gid,
-			func(m discord.Member) bool {
-				return slices.Contains(m.RoleIDs, role.ID)
-			},
-		)
+	if cfg.interactions.addr != "" {
+		opts = append([]disgobot.ConfigOpt{
+			interactionsOpt(cfg.interactions),
+		}, opts...)
+	}
+	intents, caches := gatewayNeeds(mods)
+	bot, err := newClient(cfg.token, mw, append([]disgobot.ConfigOpt{
+		gatewayOpts(cfg.shards, gateway.WithIntents(intents)),
+		cacheOpt(caches, lean),
+		disgobot.WithEventManagerConfigOpts(
+			disgobot.WithAsyncEventsEnabled(),
+		),
+	}, opts...)...)
 	if err != nil {
-		return nil, fmt.Errorf("could not get members with role %q: %w",
-			role.Name, err)
+		return nil, fmt.Errorf("could not set up bot: %w", err)
 	}
-	s := newSet[snowflake.ID]()
-	for _, m := range members {
-		s.Add(m.User.ID)
+	if lean != nil {
+		lean.bind(bot)
 	}
-	return s, nil
+	return bot, nil
 }
 
-var testHookMembersInCall func(disgobot.Client, snowflake.ID) set[snowflake.ID]
+// A syncScheduler runs voice role syncs for guilds. Triggers take the
+// context of the span of the event behind them.
+type syncScheduler interface {
+	start(shardID int, gid snowflake.ID)
+	stop(gid snowflake.ID)
+	trigger(ctx context.Context, gid snowflake.ID)
+	triggerMember(ctx context.Context, gid, uid snowflake.ID)
+}
 
-func membersInCall(bot disgobot.Client, gid snowflake.ID) set[snowflake.ID] {
-	if h := testHookMembersInCall; t.Testing() && h != nil {
-		return h(bot, gid)
+// voiceListeners schedules voice role syncs as gateway events arrive, in a
+// span for each event started with tracer.
+func voiceListeners(
+	tracer trace.Tracer, sched syncScheduler, grace *voiceGrace,
+) []disgobot.EventListener {
+	received := func(
+		name string, gid, uid snowflake.ID,
+	) (context.Context, trace.Span) {
+		return tracer.Start(context.Background(), "gateway "+name,
+			trace.WithSpanKind(trace.SpanKindConsumer),
+			trace.WithAttributes(
+				traceID(traceGuild, gid), traceID(traceUser, uid),
+			),
+		)
 	}
-	var voiceMembers []discord.Member
-	bot.Caches().ChannelsForEach(func(channel discord.GuildChannel) {
-		if channel.GuildID() != gid {
-			return
-		}
-		ac, ok := channel.(discord.GuildAudioChannel)
-		if !ok {
-			return
-		}
-		voiceMembers = append(voiceMembers,
-			bot.Caches().AudioChannelMembers(ac)...)
-	})
-	s := newSet[snowflake.ID]()
-	for _, m := range voiceMembers {
-		s.Add(m.User.ID)
+	return []disgobot.EventListener{
+		disgobot.NewListenerFunc(func(e *events.GuildReady) {
+			sched.start(e.ShardID(), e.GuildID)
+		}),
+		disgobot.NewListenerFunc(func(e *events.GuildJoin) {
+			sched.start(e.ShardID(), e.GuildID)
+		}),
+		disgobot.NewListenerFunc(func(e *events.GuildLeave) {
+			sched.stop(e.GuildID)
+		}),
+		disgobot.NewListenerFunc(func(e *events.GuildVoiceJoin) {
+			gid, uid := e.VoiceState.GuildID, e.VoiceState.UserID
+			ctx, span := received("GuildVoiceJoin", gid, uid)
+			defer span.End()
+			grace.joined(gid, uid)
+			sched.trigger(ctx, gid)
+		}),
+		disgobot.NewListenerFunc(func(e *events.GuildVoiceMove) {
+			gid, uid := e.VoiceState.GuildID, e.VoiceState.UserID
+			ctx, span := received("GuildVoiceMove", gid, uid)
+			defer span.End()
+			sched.triggerMember(ctx, gid, uid)
+		}),
+		disgobot.NewListenerFunc(func(e *events.GuildVoiceLeave) {
+			gid, uid := e.VoiceState.GuildID, e.VoiceState.UserID
+			ctx, span := received("GuildVoiceLeave", gid, uid)
+			defer span.End()
+			grace.left(gid, uid)
+			sched.trigger(ctx, gid)
+		}),
+		disgobot.NewListenerFunc(func(e *events.GuildVoiceStateUpdate) {
+			// Streams and cameras turning on and off within a call, and
+			// members invited to speak on a stage or moved back to the
+			// audience.
+			old, vs := e.OldVoiceState, e.VoiceState
+			if old.ChannelID != nil && vs.ChannelID != nil &&
+				(old.SelfStream != vs.SelfStream ||
+					old.SelfVideo != vs.SelfVideo ||
+					old.Suppress != vs.Suppress) {
+				ctx, span := received("GuildVoiceStateUpdate",
+					vs.GuildID, vs.UserID)
+				defer span.End()
+				sched.triggerMember(ctx, vs.GuildID, vs.UserID)
+			}
+		}),
+		disgobot.NewListenerFunc(func(e *events.GuildMemberUpdate) {
+			if !slices.Equal(e.OldMember.RoleIDs, e.Member.RoleIDs) {
+				ctx, span := received("GuildMemberUpdate",
+					e.GuildID, e.Member.User.ID)
+				defer span.End()
+				sched.triggerMember(ctx, e.GuildID, e.Member.User.ID)
+			}
+		}),
+		disgobot.NewListenerFunc(func(e *events.GuildMemberLeave) {
+			// Discord drops the member's roles and voice state with them,
+			// so a sync settles the guild without them.
+			ctx, span := received("GuildMemberLeave", e.GuildID, e.User.ID)
+			defer span.End()
+			grace.forget(e.GuildID, e.User.ID)
+			sched.trigger(ctx, e.GuildID)
+		}),
 	}
-	return s
 }
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"slices"
+
+	disgobot "github.com/disgoorg/disgo/bot"
+	"github.com/disgoorg/disgo/cache"
+	"github.com/disgoorg/disgo/discord"
+	"github.com/disgoorg/disgo/events"
+	"github.com/disgoorg/snowflake/v2"
+)
+
+// leanMemberCache limits the member cache to the members the bot acts on:
+// those in a call and those holding one of roles.
+//
+// disgo only consults the cache policy when it adds a member, leaving the old
+// entry in place when the policy rejects an update, so members that stop
+// qualifying are evicted by listeners.
+type leanMemberCache struct {
+	roles []string
+
+	// Set once the client is built, before the gateway opens.
+	caches cache.Caches
+	self   snowflake.ID
+}
+
+// bind attaches l to bot's caches and events.
+func (l *leanMemberCache) bind(bot disgobot.Client) {
+	// bot.ID is unknown until READY; a bot user shares its application's ID.
+	l.caches, l.self = bot.Caches(), bot.ApplicationID()
+	bot.AddEventListeners(
+		disgobot.NewListenerFunc(func(e *events.GuildMemberUpdate) {
+			l.evict(e.Member)
+		}),
+		disgobot.NewListenerFunc(func(e *events.GuildVoiceLeave) {
+			l.evict(e.Member)
+		}),
+	)
+}
+
+// keep is the member cache policy.
+func (l *leanMemberCache) keep(m discord.Member) bool {
+	if l.caches == nil || m.User.ID == l.self {
+		return true
+	}
+	vs, ok := l.caches.VoiceState(m.GuildID, m.User.ID)
+	if ok && vs.ChannelID != nil {
+		return true
+	}
+	for _, rid := range m.RoleIDs {
+		r, ok := l.caches.Role(m.GuildID, rid)
+		if ok && slices.Contains(l.roles, r.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *leanMemberCache) evict(m discord.Member) {
+	if !l.keep(m) {
+		l.caches.RemoveMember(m.GuildID, m.User.ID)
+	}
+}
+
+// cacheOpt enables the caches in flags. lean may be nil to cache every
+// member.
+func cacheOpt(flags cache.Flags, lean *leanMemberCache) disgobot.ConfigOpt {
+	opts := []cache.ConfigOpt{cache.WithCaches(flags)}
+	if lean != nil {
+		opts = append(opts, cache.WithMemberCachePolicy(lean.keep))
+	}
+	return disgobot.WithCacheConfigOpts(opts...)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/disgoorg/disgo/cache"
+	"github.com/disgoorg/disgo/discord"
+	"github.com/disgoorg/snowflake/v2"
+)
+
+func TestLeanMemberCache(t *testing.T) {
+	const (
+		guildID   snowflake.ID = 1
+		roleID    snowflake.ID = 2
+		channelID snowflake.ID = 3
+		alice     snowflake.ID = 10 // In a call.
+		bob       snowflake.ID = 11 // Holds the voice role.
+		carol     snowflake.ID = 12 // Neither.
+	)
+	f := newFakeDiscord(t, guildID)
+	f.addVoiceChannel(channelID, "General")
+	f.addRole(roleID, voiceRole)
+	f.addMember(alice, "alice")
+	f.addMember(bob, "bob", roleID)
+	f.addMember(carol, "carol")
+	f.setVoice(alice, ptr(channelID))
+
+	bot := f.connect(&leanMemberCache{roles: []string{voiceRole}})
+	backend, caches := discordBackend{bot}, bot.Caches()
+	// The chunked member request adds bob, but not carol.
+	if err := backend.RequestMembers(t.Context(), guildID); err != nil {
+		t.Fatal(err)
+	}
+	wantCached(t, caches, guildID, alice, bob)
+
+	// bob loses the role, alice leaves the call, and carol joins it.
+	if err := backend.SetMemberRole(t.Context(), guildID, bob, roleID, false); err != nil {
+		t.Fatal(err)
+	}
+	f.setVoice(alice, nil)
+	f.setVoice(carol, ptr(channelID))
+	wantCached(t, caches, guildID, carol)
+}
+
+// wantCached waits for the member cache of gid to hold exactly uids.
+func wantCached(
+	t *testing.T, caches cache.Caches, gid snowflake.ID, uids ...snowflake.ID,
+) {
+	t.Helper()
+	want := newSet(uids...)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got := newSet[snowflake.ID]()
+		caches.MembersForEach(gid, func(m discord.Member) {
+			got.Add(m.User.ID)
+		})
+		if len(got) == len(want) && len(got.Diff(want)) == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("cached members = %v, want %v", got, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
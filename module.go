@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+
+	disgobot "github.com/disgoorg/disgo/bot"
+	"github.com/disgoorg/disgo/cache"
+	"github.com/disgoorg/disgo/discord"
+	"github.com/disgoorg/disgo/events"
+	"github.com/disgoorg/disgo/gateway"
+	"github.com/disgoorg/snowflake/v2"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// A module is a feature of the bot. run asks Discord for the union of the
+// intents and caches of the enabled modules, starts them once the client is
+// built, and stops them on shutdown.
+type module interface {
+	Name() string
+	Intents() gateway.Intents
+	Caches() cache.Flags
+	// Commands are the module's slash commands. They are served without
+	// starting the module.
+	Commands() []command
+	// Start prepares the module to handle events. It is called before the
+	// gateway opens; ctx is done when the bot shuts down.
+	Start(ctx context.Context, env moduleEnv) error
+	// Listeners are added to the client once the module has started.
+	Listeners() []disgobot.EventListener
+	// Stop waits for work the module started to finish.
+	Stop()
+}
+
+// Modules may also implement these.
+type (
+	// middlewareModule sees gateway events before disgo does.
+	middlewareModule interface{ Middleware() gatewayMiddleware }
+	// leaderModule is told when this replica becomes the leader.
+	leaderModule interface{ Lead() }
+	// resumeModule is told about guilds restored from a saved session, for
+	// which Discord sends no GUILD_CREATE.
+	resumeModule interface {
+		GuildResumed(shardID int, gid snowflake.ID)
+	}
+)
+
+// moduleEnv is what a started module may use.
+type moduleEnv struct {
+	bot disgobot.Client
+	// leading reports whether this replica should act on events.
+	leading func() bool
+	// enabled reports whether the module is on in a guild.
+	enabled func(gid snowflake.ID) bool
+	// missing are the privileged intents the module runs without.
+	missing gateway.Intents
+	// log logs for the module, at its level.
+	log *slog.Logger
+	// tracer starts the spans of the module.
+	tracer trace.Tracer
+}
+
+// modules constructs every module the bot has, in the order they start.
+var modules = []func(cfg *config) module{
+	newVoiceModule,
+	newCallsModule,
+	newStageModule,
+	newNamesModule,
+	newPresenceModule,
+	newWebhookModule,
+}
+
+// An enabledModule is a module and the guilds it is on in.
+type enabledModule struct {
+	module
+	guilds  guildFilter
+	missing gateway.Intents // Set by grantIntents.
+}
+
+// guildFilter is a set of guilds. The nil filter allows every guild.
+type guildFilter set[snowflake.ID]
+
+func (f guildFilter) allows(gid snowflake.ID) bool {
+	if f == nil {
+		return true
+	}
+	_, ok := f[gid]
+	return ok
+}
+
+// enabledModules constructs the modules enabled by cfg.
+func enabledModules(cfg *config) ([]enabledModule, error) {
+	var (
+		mods  []enabledModule
+		known = newSet[string]()
+	)
+	for _, newModule := range modules {
+		m := newModule(cfg)
+		known.Add(m.Name())
+		if cfg.modules == nil {
+			mods = append(mods, enabledModule{module: m})
+			continue
+		}
+		gids, ok := cfg.modules[m.Name()]
+		if !ok {
+			continue
+		}
+		em := enabledModule{module: m}
+		if gids != nil {
+			em.guilds = guildFilter(newSet(gids...))
+		}
+		mods = append(mods, em)
+	}
+	for name := range cfg.modules {
+		if _, ok := known[name]; !ok {
+			return nil, fmt.Errorf("bad DISCORD_MODULES: unknown module %q",
+				name)
+		}
+	}
+	for name := range cfg.log.modules {
+		if _, ok := known[name]; !ok {
+			return nil, fmt.Errorf(
+				"bad DISCORD_LOG_LEVELS: unknown module %q", name)
+		}
+	}
+	return mods, nil
+}
+
+// gatewayNeeds returns the intents and caches needed by mods, less the
+// intents they run without. Readiness tracking needs guilds whatever is
+// enabled.
+func gatewayNeeds(mods []enabledModule) (gateway.Intents, cache.Flags) {
+	intents, caches := gateway.IntentGuilds, cache.FlagGuilds
+	for _, m := range mods {
+		intents |= m.Intents() &^ m.missing
+		caches |= m.Caches()
+	}
+	return intents, caches
+}
+
+// A command is a slash command and its handlers. Handlers only use the REST
+// API, so they work whether interactions arrive over the gateway or the
+// interactions endpoint.
+type command struct {
+	create discord.SlashCommandCreate
+	// paths handle invocations by command path, like "/voice/check".
+	paths map[string]commandHandler
+	// components handle components by custom ID.
+	components map[string]componentHandler
+}
+
+type (
+	commandHandler   func(*events.ApplicationCommandInteractionCreate) error
+	componentHandler func(*events.ComponentInteractionCreate) error
+)
+
+// A selfRole is a role members give themselves with a command, and take
+// away by running it again.
+type selfRole struct {
+	module      string // Logs failures to change the role.
+	name        string
+	unavailable string // Starts the reply when the role can't be changed.
+	on, off     string // Replies once the role is given or taken away.
+}
+
+// command gives the role to the member who runs it, or takes it away if they
+// have it. Changes are recorded in the audit trail of cfg, if it has one.
+func (r selfRole) command(cfg *config) commandHandler {
+	return func(e *events.ApplicationCommandInteractionCreate) error {
+		return e.CreateMessage(discord.MessageCreate{
+			Content: r.toggle(e.Client(), e.ApplicationCommandInteraction,
+				cfg.auditFile),
+			Flags: discord.MessageFlagEphemeral,
+		})
+	}
+}
+
+func (r selfRole) toggle(
+	bot disgobot.Client, i discord.Interaction, auditFile string,
+) string {
+	gid, member := i.GuildID(), i.Member()
+	if gid == nil || member == nil {
+		return "This command only works in a server."
+	}
+	backend := discordBackend{bot}
+	role, err := backend.FindRole(*gid, r.name)
+	if err != nil {
+		return r.unavailable + err.Error() + "."
+	}
+	uid := member.User.ID
+	on := !slices.Contains(member.RoleIDs, role.ID)
+	err = backend.SetMemberRole(context.Background(), *gid, uid, role.ID, on)
+	log := moduleLogger(r.module)
+	if auditFile != "" {
+		entry := auditEntry{
+			GuildID: *gid,
+			UserID:  uid,
+			RoleID:  role.ID,
+			Role:    role.Name,
+			Add:     on,
+			Trigger: triggerCommand,
+			Run:     i.ID().String(),
+		}
+		if err != nil {
+			entry.Error = err.Error()
+		}
+		if err := appendAudit(systemClock{}, auditFile, entry); err != nil {
+			log.Error("failed to record role change", "error", err)
+		}
+	}
+	if err != nil {
+		log.Error("failed to change role",
+			"role", r.name, "user", uid, "error", err)
+		return r.unavailable + "could not change your roles."
+	}
+	if on {
+		return r.on
+	}
+	return r.off
+}
+
+// commandCreates returns the slash commands of mods, for registration.
+func commandCreates(mods []enabledModule) []discord.ApplicationCommandCreate {
+	creates := []discord.ApplicationCommandCreate{}
+	for _, m := range mods {
+		for _, cmd := range m.Commands() {
+			creates = append(creates, cmd.create)
+		}
+	}
+	return creates
+}
+
+// commandListeners dispatch slash commands and components to the modules
+// that own them, in the guilds where those modules are enabled.
+func commandListeners(mods []enabledModule) []disgobot.EventListener {
+	return []disgobot.EventListener{
+		disgobot.NewListenerFunc(
+			func(e *events.ApplicationCommandInteractionCreate) {
+				d, ok := e.Data.(discord.SlashCommandInteractionData)
+				if !ok {
+					return
+				}
+				for _, m := range mods {
+					for _, cmd := range m.Commands() {
+						h, ok := cmd.paths[d.CommandPath()]
+						if !ok {
+							continue
+						}
+						var err error
+						if m.enabledIn(e.GuildID()) {
+							err = h(e)
+						} else {
+							err = e.CreateMessage(m.disabledMessage())
+						}
+						if err != nil {
+							moduleLogger(m.Name()).Error(
+								"failed to respond to command",
+								"command", d.CommandPath(), "error", err)
+						}
+						return
+					}
+				}
+			},
+		),
+		disgobot.NewListenerFunc(func(e *events.ComponentInteractionCreate) {
+			for _, m := range mods {
+				for _, cmd := range m.Commands() {
+					h, ok := cmd.components[e.Data.CustomID()]
+					if !ok {
+						continue
+					}
+					var err error
+					if m.enabledIn(e.GuildID()) {
+						err = h(e)
+					} else {
+						err = e.CreateMessage(m.disabledMessage())
+					}
+					if err != nil {
+						moduleLogger(m.Name()).Error(
+							"failed to respond to component",
+							"component", e.Data.CustomID(), "error", err)
+					}
+					return
+				}
+			}
+		}),
+	}
+}
+
+// enabledIn reports whether m is enabled in gid, which is nil outside guilds.
+func (m enabledModule) enabledIn(gid *snowflake.ID) bool {
+	return gid != nil && m.guilds.allows(*gid)
+}
+
+func (m enabledModule) disabledMessage() discord.MessageCreate {
+	return discord.MessageCreate{
+		Content: fmt.Sprintf("The %s module is not enabled in this server.",
+			m.Name()),
+		Flags: discord.MessageFlagEphemeral,
+	}
+}
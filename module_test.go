@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/disgoorg/disgo/cache"
+	"github.com/disgoorg/disgo/discord"
+	"github.com/disgoorg/disgo/events"
+	"github.com/disgoorg/disgo/gateway"
+	"github.com/disgoorg/snowflake/v2"
+	"github.com/google/go-cmp/cmp"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+func TestEnabledModules(t *testing.T) {
+	tests := []struct {
+		desc    string
+		modules map[string][]snowflake.ID
+		want    map[string]guildFilter
+		wantErr error
+	}{{
+		desc: "default",
+		want: map[string]guildFilter{
+			"voice": nil, "calls": nil, "stage": nil, "names": nil,
+			"presence": nil, "webhooks": nil,
+		},
+	}, {
+		desc:    "every guild",
+		modules: map[string][]snowflake.ID{"voice": nil},
+		want:    map[string]guildFilter{"voice": nil},
+	}, {
+		desc:    "some guilds",
+		modules: map[string][]snowflake.ID{"voice": {1, 2}},
+		want: map[string]guildFilter{
+			"voice": guildFilter(newSet[snowflake.ID](1, 2)),
+		},
+	}, {
+		desc:    "none",
+		modules: map[string][]snowflake.ID{},
+		want:    map[string]guildFilter{},
+	}, {
+		desc:    "unknown",
+		modules: map[string][]snowflake.ID{"voice": nil, "music": nil},
+		wantErr: fmt.Errorf(`bad DISCORD_MODULES: unknown module "music"`),
+	}}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			mods, err := enabledModules(&config{modules: tt.modules})
+
+			gotErr, wantErr := fmt.Sprintf("%v", err),
+				fmt.Sprintf("%v", tt.wantErr)
+			if gotErr != wantErr {
+				t.Fatalf("%s(%v): %v, want %v",
+					funcname(t, enabledModules), tt.modules, err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			got := make(map[string]guildFilter)
+			for _, m := range mods {
+				got[m.Name()] = m.guilds
+			}
+			if !cmp.Equal(got, tt.want) {
+				t.Errorf("%s(%v) -want +got\n%s",
+					funcname(t, enabledModules), tt.modules,
+					cmp.Diff(tt.want, got))
+			}
+		})
+	}
+}
+
+func TestGuildFilter(t *testing.T) {
+	all, some := guildFilter(nil), guildFilter(newSet[snowflake.ID](1))
+	if !all.allows(1) || !all.allows(2) {
+		t.Errorf("nil filter does not allow every guild")
+	}
+	if !some.allows(1) || some.allows(2) {
+		t.Errorf("{1}.allows(1), {1}.allows(2) = %v, %v; want true, false",
+			some.allows(1), some.allows(2))
+	}
+}
+
+func TestGatewayNeeds(t *testing.T) {
+	intents, caches := gatewayNeeds(nil)
+	if intents != gateway.IntentGuilds || caches != cache.FlagGuilds {
+		t.Errorf("%s(nil) = %v, %v; want guilds only",
+			funcname(t, gatewayNeeds), intents, caches)
+	}
+
+	intents, caches = gatewayNeeds(
+		[]enabledModule{{module: new(voiceModule)}},
+	)
+	wantIntents := gateway.IntentGuilds |
+		gateway.IntentGuildMembers |
+		gateway.IntentGuildVoiceStates
+	if intents != wantIntents {
+		t.Errorf("voice intents = %v, want %v", intents, wantIntents)
+	}
+	if !caches.Has(cache.FlagGuilds, cache.FlagMembers,
+		cache.FlagVoiceStates, cache.FlagRoles) {
+		t.Errorf("voice caches = %v, missing some", caches)
+	}
+}
+
+func TestEnabledSchedulerSkipsDisabledGuilds(t *testing.T) {
+	sched := &fakeScheduler{}
+	s := enabledScheduler{sched, guildFilter(newSet[snowflake.ID](1)).allows}
+	s.start(0, 1)
+	s.start(0, 2)
+	if want := []snowflake.ID{1}; !cmp.Equal(sched.started, want) {
+		t.Errorf("started -want +got\n%s", cmp.Diff(want, sched.started))
+	}
+}
+
+type fakeScheduler struct {
+	syncScheduler
+	started   []snowflake.ID
+	triggered []snowflake.ID
+}
+
+func (s *fakeScheduler) start(_ int, gid snowflake.ID) {
+	s.started = append(s.started, gid)
+}
+
+func (s *fakeScheduler) trigger(_ context.Context, gid snowflake.ID) {
+	s.triggered = append(s.triggered, gid)
+}
+
+func TestVoiceListenersMemberLeave(t *testing.T) {
+	sched := &fakeScheduler{}
+	tracer := noop.NewTracerProvider().Tracer(tracerName)
+	for _, l := range voiceListeners(tracer, sched, nil) {
+		l.OnEvent(&events.GuildMemberLeave{
+			GuildID: 1,
+			User:    discord.User{ID: 7},
+		})
+	}
+	if want := []snowflake.ID{1}; !cmp.Equal(sched.triggered, want) {
+		t.Errorf("triggered -want +got\n%s", cmp.Diff(want, sched.triggered))
+	}
+}
+
+func TestCommandDisabledInGuild(t *testing.T) {
+	const slash = `{"id":"1","application_id":"1000","type":2,"token":"t",` +
+		`"version":1,"guild_id":"1","channel_id":"3",` +
+		`"app_permissions":"268435456",` +
+		`"member":{"user":{"id":"10","username":"mod"},"roles":[],` +
+		`"permissions":"268435456"},` +
+		`"data":{"id":"50","name":"voice","type":1,` +
+		`"options":[{"name":"check","type":1}]}}`
+	f := newFakeDiscord(t, 1)
+	url, key := testInteractions(t, f,
+		map[string]string{"DISCORD_MODULES": "voice:2"})
+
+	status, body := postInteraction(t, url, key, slash)
+	if status != http.StatusOK {
+		t.Fatalf("status %d: %s", status, body)
+	}
+	var resp struct {
+		Data struct {
+			Content string `json:"content"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal([]byte(body), &resp); err != nil {
+		t.Fatalf("%v: %s", err, body)
+	}
+	want := "The voice module is not enabled in this server."
+	if resp.Data.Content != want {
+		t.Errorf("content %q, want %q", resp.Data.Content, want)
+	}
+}
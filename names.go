@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"regexp"
+	"sync"
+	"time"
+
+	disgobot "github.com/disgoorg/disgo/bot"
+	"github.com/disgoorg/disgo/discord"
+	"github.com/disgoorg/snowflake/v2"
+)
+
+// nameSource says what channels are called and what they should be called.
+type nameSource interface {
+	// ChannelName returns the name of cid and the name it should have now.
+	// ok is false if cid is unknown.
+	ChannelName(cid snowflake.ID) (name, want string, ok bool)
+}
+
+// channelRenamer renames channels.
+type channelRenamer interface {
+	RenameChannel(cid snowflake.ID, name string) error
+}
+
+// channelNamer keeps channel names showing live information, like
+// "🔊 General (4)".
+//
+// Discord lets a channel be renamed only twice in ten minutes, so renames are
+// coalesced: a channel is renamed at most once per interval, to whatever it
+// should be called when the rename happens. Changes in between only make
+// sure that a rename is pending.
+type channelNamer struct {
+	clock    clock
+	interval time.Duration
+	names    nameSource
+	renamer  channelRenamer
+	leading  func() bool
+	log      *slog.Logger
+
+	mu       sync.Mutex
+	channels map[snowflake.ID]*namedChannel
+	stopped  bool
+	inflight sync.WaitGroup
+}
+
+type namedChannel struct {
+	renamed time.Time // Zero if never renamed.
+	timer   stopper   // Nil unless a rename is pending.
+}
+
+func newChannelNamer(
+	c clock, interval time.Duration, names nameSource, renamer channelRenamer,
+) *channelNamer {
+	return &channelNamer{
+		clock:    c,
+		interval: interval,
+		names:    names,
+		renamer:  renamer,
+		leading:  func() bool { return true },
+		log:      slog.Default(),
+		channels: make(map[snowflake.ID]*namedChannel),
+	}
+}
+
+// changed notes that cid may need a new name, renaming it as soon as its
+// interval allows.
+func (n *channelNamer) changed(cid snowflake.ID) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.stopped {
+		return
+	}
+	c := n.channels[cid]
+	if c == nil {
+		c = new(namedChannel)
+		n.channels[cid] = c
+	}
+	if c.timer != nil {
+		return
+	}
+	var wait time.Duration
+	if !c.renamed.IsZero() {
+		wait = max(0, c.renamed.Add(n.interval).Sub(n.clock.Now()))
+	}
+	c.timer = n.clock.AfterFunc(wait, func() { n.rename(cid) })
+}
+
+// rename gives cid the name it should have, if it does not have it already.
+func (n *channelNamer) rename(cid snowflake.ID) {
+	n.mu.Lock()
+	c := n.channels[cid]
+	c.timer = nil
+	if n.stopped || !n.leading() {
+		n.mu.Unlock()
+		return
+	}
+	name, want, ok := n.names.ChannelName(cid)
+	if !ok || name == want {
+		n.mu.Unlock()
+		return
+	}
+	c.renamed = n.clock.Now()
+	n.inflight.Add(1)
+	n.mu.Unlock()
+	defer n.inflight.Done()
+	if err := n.renamer.RenameChannel(cid, want); err != nil {
+		n.log.Error("failed to rename channel",
+			"channel", cid, "name", want, "error", err)
+		return
+	}
+	n.log.Info("renamed channel", "channel", cid, "from", name, "to", want)
+}
+
+// stop cancels pending renames and waits for those being made.
+func (n *channelNamer) stop() {
+	n.mu.Lock()
+	n.stopped = true
+	for _, c := range n.channels {
+		if c.timer != nil {
+			c.timer.Stop()
+		}
+	}
+	n.mu.Unlock()
+	n.inflight.Wait()
+}
+
+// occupiedName matches names given by occupancyName, capturing the name the
+// channel had before.
+var occupiedName = regexp.MustCompile(`^🔊 (.*?)(?: \(\d+\))?$`)
+
+// occupancyName returns the name of a channel called name with members in
+// it, like "🔊 General (4)".
+func occupancyName(name string, members int) string {
+	if m := occupiedName.FindStringSubmatch(name); m != nil {
+		name = m[1]
+	}
+	if members == 0 {
+		return "🔊 " + name
+	}
+	return fmt.Sprintf("🔊 %s (%d)", name, members)
+}
+
+// statsName returns the name of a channel showing that members are in a
+// call in its guild.
+func statsName(members int) string {
+	return fmt.Sprintf("🔊 In voice: %d", members)
+}
+
+// discordNames names channels from the channel and voice state caches.
+type discordNames struct {
+	bot   disgobot.Client
+	stats set[snowflake.ID] // Channels showing guild-wide stats.
+}
+
+func (d discordNames) ChannelName(
+	cid snowflake.ID,
+) (name, want string, ok bool) {
+	ch, ok := d.bot.Caches().Channel(cid)
+	if !ok {
+		return "", "", false
+	}
+	_, stats := d.stats[cid]
+	var members int
+	d.bot.Caches().VoiceStatesForEach(ch.GuildID(),
+		func(vs discord.VoiceState) {
+			if vs.ChannelID != nil && (stats || *vs.ChannelID == cid) {
+				members++
+			}
+		},
+	)
+	if stats {
+		return ch.Name(), statsName(members), true
+	}
+	return ch.Name(), occupancyName(ch.Name(), members), true
+}
+
+func (d discordNames) RenameChannel(cid snowflake.ID, name string) error {
+	// Only the name is sent, so the same update renames any kind of
+	// channel.
+	_, err := d.bot.Rest().UpdateChannel(cid,
+		discord.GuildVoiceChannelUpdate{Name: &name})
+	if err != nil {
+		return fmt.Errorf("could not rename channel: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/disgoorg/snowflake/v2"
+	"github.com/google/go-cmp/cmp"
+)
+
+// fakeNames names channels from a map of names and wanted names, renaming
+// them in the map.
+type fakeNames struct {
+	names, want map[snowflake.ID]string
+	renamed     []string
+	err         error
+}
+
+func (f *fakeNames) ChannelName(
+	cid snowflake.ID,
+) (name, want string, ok bool) {
+	name, ok = f.names[cid]
+	return name, f.want[cid], ok
+}
+
+func (f *fakeNames) RenameChannel(cid snowflake.ID, name string) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.names[cid] = name
+	f.renamed = append(f.renamed, fmt.Sprintf("%d: %s", cid, name))
+	return nil
+}
+
+func fakeNamer() (*channelNamer, *fakeClock, *fakeNames) {
+	clk := &fakeClock{now: time.Date(2026, 1, 1, 20, 0, 0, 0, time.UTC)}
+	f := &fakeNames{
+		names: map[snowflake.ID]string{5: "General"},
+		want:  map[snowflake.ID]string{5: "🔊 General (1)"},
+	}
+	return newChannelNamer(clk, 5*time.Minute, f, f), clk, f
+}
+
+func TestChannelNamerCoalesces(t *testing.T) {
+	n, clk, f := fakeNamer()
+
+	n.changed(5)
+	if got := clk.timers[0].d; got != 0 {
+		t.Errorf("first rename after %v, want 0", got)
+	}
+	fire(clk)
+
+	// Changes within the interval are made in a single rename at its end.
+	clk.now = clk.now.Add(time.Minute)
+	f.want[5] = "🔊 General (2)"
+	n.changed(5)
+	f.want[5] = "🔊 General (3)"
+	n.changed(5)
+	if len(clk.timers) != 2 {
+		t.Fatalf("%d timers, want 2", len(clk.timers))
+	}
+	if got, want := clk.timers[1].d, 4*time.Minute; got != want {
+		t.Errorf("second rename after %v, want %v", got, want)
+	}
+	clk.now = clk.now.Add(4 * time.Minute)
+	fire(clk)
+
+	want := []string{"5: 🔊 General (1)", "5: 🔊 General (3)"}
+	if !cmp.Equal(f.renamed, want) {
+		t.Errorf("renames -want +got\n%s", cmp.Diff(want, f.renamed))
+	}
+}
+
+func TestChannelNamerSkips(t *testing.T) {
+	tests := []struct {
+		desc  string
+		setup func(*channelNamer, *fakeNames)
+	}{{
+		desc: "standby",
+		setup: func(n *channelNamer, _ *fakeNames) {
+			n.leading = func() bool { return false }
+		},
+	}, {
+		desc:  "stopped",
+		setup: func(n *channelNamer, _ *fakeNames) { n.stop() },
+	}, {
+		desc:  "unchanged",
+		setup: func(_ *channelNamer, f *fakeNames) { f.names[5] = f.want[5] },
+	}, {
+		desc:  "unknown channel",
+		setup: func(_ *channelNamer, f *fakeNames) { delete(f.names, 5) },
+	}}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			n, clk, f := fakeNamer()
+			n.changed(5)
+			tt.setup(n, f)
+			fire(clk)
+			if len(f.renamed) != 0 {
+				t.Errorf("renames: %v", f.renamed)
+			}
+		})
+	}
+}
+
+func TestChannelNamerError(t *testing.T) {
+	n, clk, f := fakeNamer()
+	f.err = errors.New("rate limited")
+	n.changed(5)
+	fire(clk)
+
+	// A failed rename still counts against the interval.
+	f.err = nil
+	n.changed(5)
+	if got, want := clk.timers[1].d, 5*time.Minute; got != want {
+		t.Errorf("retry after %v, want %v", got, want)
+	}
+}
+
+func TestOccupancyName(t *testing.T) {
+	tests := []struct {
+		name    string
+		members int
+		want    string
+	}{
+		{"General", 0, "🔊 General"},
+		{"General", 4, "🔊 General (4)"},
+		{"🔊 General (4)", 5, "🔊 General (5)"},
+		{"🔊 General (4)", 0, "🔊 General"},
+		{"🔊 General", 1, "🔊 General (1)"},
+		{"Room (2)", 1, "🔊 Room (2) (1)"},
+	}
+	for _, tt := range tests {
+		if got := occupancyName(tt.name, tt.members); got != tt.want {
+			t.Errorf("%s(%q, %d) = %q, want %q", funcname(t, occupancyName),
+				tt.name, tt.members, got, tt.want)
+		}
+	}
+}
+
+func TestRunChannelNames(t *testing.T) {
+	const (
+		guildID   snowflake.ID = 1
+		roleID    snowflake.ID = 2
+		channelID snowflake.ID = 3
+		statsID   snowflake.ID = 4
+		alice     snowflake.ID = 10
+	)
+	f := newFakeDiscord(t, guildID)
+	f.addVoiceChannel(channelID, "General")
+	f.addVoiceChannel(statsID, "Stats")
+	f.addRole(roleID, "voice")
+	f.addMember(alice, "alice")
+	f.setVoice(alice, ptr(channelID))
+	runFakeConfig(t, f, &config{
+		token:         fakeToken,
+		leader:        leaderConfig{ttl: 15 * time.Second},
+		modules:       map[string][]snowflake.ID{"names": nil},
+		namesChannels: []snowflake.ID{channelID},
+		namesStats:    []snowflake.ID{statsID},
+	})
+
+	want := []fakeRename{
+		{channelID, "🔊 General (1)"},
+		{statsID, "🔊 In voice: 1"},
+	}
+	if got := f.waitRenames(2); !cmp.Equal(got, want, anyRenameOrder) {
+		t.Fatalf("renames -want +got\n%s",
+			cmp.Diff(want, got, anyRenameOrder))
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"slices"
+
+	disgobot "github.com/disgoorg/disgo/bot"
+	"github.com/disgoorg/disgo/cache"
+	"github.com/disgoorg/disgo/events"
+	"github.com/disgoorg/disgo/gateway"
+	"github.com/disgoorg/snowflake/v2"
+)
+
+// namesModule renames voice channels to show how many members are in them,
+// and stats channels to show how many are in a call in the guild.
+type namesModule struct {
+	cfg *config
+
+	// Set by Start.
+	bot     disgobot.Client
+	namer   *channelNamer
+	enabled func(gid snowflake.ID) bool
+}
+
+func newNamesModule(cfg *config) module {
+	return &namesModule{cfg: cfg}
+}
+
+func (*namesModule) Name() string { return "names" }
+
+func (*namesModule) Intents() gateway.Intents {
+	return gateway.IntentGuildVoiceStates
+}
+
+func (*namesModule) Caches() cache.Flags {
+	return cache.FlagChannels | cache.FlagVoiceStates
+}
+
+func (*namesModule) Commands() []command { return nil }
+
+// channels returns the channels the module names.
+func (m *namesModule) channels() []snowflake.ID {
+	return slices.Concat(m.cfg.namesChannels, m.cfg.namesStats)
+}
+
+func (m *namesModule) Start(_ context.Context, env moduleEnv) error {
+	if len(m.channels()) == 0 {
+		return nil
+	}
+	names := discordNames{env.bot, newSet(m.cfg.namesStats...)}
+	m.bot, m.enabled = env.bot, env.enabled
+	m.namer = newChannelNamer(systemClock{},
+		m.cfg.namesInterval, names, names)
+	m.namer.leading, m.namer.log = env.leading, env.log
+	return nil
+}
+
+func (m *namesModule) Listeners() []disgobot.EventListener {
+	if m.namer == nil {
+		return nil
+	}
+	return []disgobot.EventListener{
+		disgobot.NewListenerFunc(func(e *events.GuildReady) {
+			m.guildChanged(e.GuildID)
+		}),
+		disgobot.NewListenerFunc(func(e *events.GuildVoiceStateUpdate) {
+			m.guildChanged(e.VoiceState.GuildID)
+		}),
+		disgobot.NewListenerFunc(func(e *events.GuildChannelUpdate) {
+			// Someone else renamed it.
+			m.guildChanged(e.GuildID)
+		}),
+	}
+}
+
+// guildChanged renames the channels of gid that need it.
+func (m *namesModule) guildChanged(gid snowflake.ID) {
+	if !m.enabled(gid) {
+		return
+	}
+	for _, cid := range m.channels() {
+		if ch, ok := m.bot.Caches().Channel(cid); ok && ch.GuildID() == gid {
+			m.namer.changed(cid)
+		}
+	}
+}
+
+// Lead catches up on renames skipped while another replica led.
+func (m *namesModule) Lead() {
+	if m.namer == nil {
+		return
+	}
+	for _, cid := range m.channels() {
+		m.namer.changed(cid)
+	}
+}
+
+func (m *namesModule) Stop() {
+	if m.namer != nil {
+		m.namer.stop()
+	}
+}
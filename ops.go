@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	disgobot "github.com/disgoorg/disgo/bot"
+	"github.com/disgoorg/disgo/discord"
+	"github.com/disgoorg/disgo/webhook"
+	"github.com/disgoorg/snowflake/v2"
+)
+
+// opsPoster posts log records to an ops channel.
+type opsPoster interface {
+	PostOps(content string) error
+}
+
+const (
+	opsRateLimit   = 5 // Messages per opsRateWindow.
+	opsRateWindow  = time.Minute
+	opsDedupWindow = 10 * time.Minute
+	opsMaxLength   = 2000 // Of a Discord message.
+)
+
+// opsHandler is a slog.Handler that passes records on, and mirrors those at
+// or above a level to an ops channel.
+type opsHandler struct {
+	next   slog.Handler
+	level  slog.Leveler
+	mirror *opsMirror
+	group  string   // Prefix of attribute keys, like "sync.".
+	attrs  []string // Formatted by WithAttrs.
+}
+
+func newOpsHandler(
+	next slog.Handler, level slog.Leveler, mirror *opsMirror,
+) *opsHandler {
+	return &opsHandler{next: next, level: level, mirror: mirror}
+}
+
+func (h *opsHandler) Enabled(ctx context.Context, l slog.Level) bool {
+	return l >= h.level.Level() || h.next.Enabled(ctx, l)
+}
+
+func (h *opsHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= h.level.Level() {
+		attrs := h.attrs
+		r.Attrs(func(a slog.Attr) bool {
+			attrs = appendOpsAttr(attrs, h.group, a)
+			return true
+		})
+		h.mirror.mirror(r.Level, r.Message, attrs)
+	}
+	if !h.next.Enabled(ctx, r.Level) {
+		return nil
+	}
+	return h.next.Handle(ctx, r)
+}
+
+func (h *opsHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	c := *h
+	c.next = h.next.WithAttrs(attrs)
+	c.attrs = h.attrs[:len(h.attrs):len(h.attrs)]
+	for _, a := range attrs {
+		c.attrs = appendOpsAttr(c.attrs, h.group, a)
+	}
+	return &c
+}
+
+func (h *opsHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	c := *h
+	c.next = h.next.WithGroup(name)
+	c.group = h.group + name + "."
+	return &c
+}
+
+// appendOpsAttr appends a as "key=value" lines, one per attribute in groups.
+func appendOpsAttr(lines []string, prefix string, a slog.Attr) []string {
+	v := a.Value.Resolve()
+	if v.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+		for _, ga := range v.Group() {
+			lines = appendOpsAttr(lines, prefix, ga)
+		}
+		return lines
+	}
+	if a.Equal(slog.Attr{}) {
+		return lines
+	}
+	return append(lines, prefix+a.Key+"="+v.String())
+}
+
+// opsMirror posts records to an ops channel, at most opsRateLimit per
+// opsRateWindow. A record repeating one posted in the last opsDedupWindow is
+// only counted, and the count is posted with it once the window has passed.
+// Posts are made from timers, so that logging never waits on Discord.
+type opsMirror struct {
+	clock clock
+	log   *slog.Logger // For the mirror's own errors, which are not mirrored.
+
+	mu       sync.Mutex
+	poster   opsPoster // Nil drops records until one is set.
+	sent     []time.Time
+	dropped  int // Records dropped by the rate limit since the last post.
+	repeats  map[string]*opsRepeat
+	stopped  bool
+	inflight sync.WaitGroup
+}
+
+type opsRepeat struct {
+	posted     time.Time
+	suppressed int
+}
+
+func newOpsMirror(c clock, log slog.Handler) *opsMirror {
+	return &opsMirror{
+		clock:   c,
+		log:     slog.New(log),
+		repeats: make(map[string]*opsRepeat),
+	}
+}
+
+// setPoster starts posting records to p.
+func (m *opsMirror) setPoster(p opsPoster) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.poster = p
+}
+
+func (m *opsMirror) mirror(level slog.Level, msg string, attrs []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.stopped || m.poster == nil {
+		return
+	}
+	now := m.clock.Now()
+	key := level.String() + " " + msg
+	var suppressed int
+	if rep := m.repeats[key]; rep != nil {
+		if now.Sub(rep.posted) < opsDedupWindow {
+			rep.suppressed++
+			return
+		}
+		suppressed = rep.suppressed
+	}
+	for len(m.sent) > 0 && now.Sub(m.sent[0]) >= opsRateWindow {
+		m.sent = m.sent[1:]
+	}
+	if len(m.sent) >= opsRateLimit {
+		m.dropped++
+		return
+	}
+	content := formatOps(level, msg, attrs, suppressed, m.dropped)
+	for k, rep := range m.repeats {
+		if now.Sub(rep.posted) >= opsDedupWindow && rep.suppressed == 0 {
+			delete(m.repeats, k)
+		}
+	}
+	m.repeats[key] = &opsRepeat{posted: now}
+	m.sent = append(m.sent, now)
+	m.dropped = 0
+	poster := m.poster
+	m.clock.AfterFunc(0, func() { m.post(poster, content) })
+}
+
+func (m *opsMirror) post(p opsPoster, content string) {
+	m.mu.Lock()
+	if m.stopped {
+		m.mu.Unlock()
+		return
+	}
+	m.inflight.Add(1)
+	m.mu.Unlock()
+	defer m.inflight.Done()
+	if err := p.PostOps(content); err != nil {
+		m.log.Error("failed to post log record to ops channel",
+			"error", err)
+	}
+}
+
+// stop drops records not yet posted and waits for those being posted.
+func (m *opsMirror) stop() {
+	m.mu.Lock()
+	m.stopped = true
+	m.mu.Unlock()
+	m.inflight.Wait()
+}
+
+var opsLevelEmoji = map[slog.Level]string{
+	slog.LevelDebug: "🐛",
+	slog.LevelInfo:  "ℹ️",
+	slog.LevelWarn:  "⚠️",
+	slog.LevelError: "🚨",
+}
+
+// formatOps formats a record as a message, with its attributes in a code
+// block.
+func formatOps(
+	level slog.Level, msg string, attrs []string, suppressed, dropped int,
+) string {
+	var head, foot strings.Builder
+	emoji, ok := opsLevelEmoji[level]
+	if !ok {
+		emoji = "📝"
+	}
+	fmt.Fprintf(&head, "%s **%s** %s", emoji, level, msg)
+	if suppressed > 0 {
+		fmt.Fprintf(&foot, "\n-# Repeated %d more %s since last posted.",
+			suppressed, plural(suppressed, "time", "times"))
+	}
+	if dropped > 0 {
+		fmt.Fprintf(&foot, "\n-# %d other %s dropped by the rate limit.",
+			dropped, plural(dropped, "record was", "records were"))
+	}
+	if len(attrs) == 0 {
+		return truncateOps(head.String()+foot.String(), opsMaxLength)
+	}
+	// Keep values from closing the code block early.
+	block := strings.ReplaceAll(strings.Join(attrs, "\n"),
+		"```", "`\u200b``")
+	room := opsMaxLength - len(head.String()) - len(foot.String()) -
+		len("\n```\n\n```")
+	return head.String() + "\n```\n" + truncateOps(block, room) + "\n```" +
+		foot.String()
+}
+
+// truncateOps shortens s to at most n bytes, marking that it was cut.
+func truncateOps(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	const mark = "…"
+	n = max(0, n-len(mark))
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n] + mark
+}
+
+func plural(n int, one, many string) string {
+	if n == 1 {
+		return one
+	}
+	return many
+}
+
+// setDefaultHandler makes h the handler of the default logger until restore
+// is called.
+//
+// slog.SetDefault sends the log package's output to h. The log package is
+// left writing where it did instead: the default slog handler writes
+// through it, so h wrapping that handler would otherwise deadlock.
+func setDefaultHandler(h slog.Handler) (restore func()) {
+	prev, w, flags := slog.Default(), log.Writer(), log.Flags()
+	slog.SetDefault(slog.New(h))
+	log.SetOutput(w)
+	log.SetFlags(flags)
+	return func() {
+		slog.SetDefault(prev)
+		log.SetOutput(w)
+		log.SetFlags(flags)
+	}
+}
+
+// opsChannelPoster posts to a channel with the bot.
+type opsChannelPoster struct {
+	bot       disgobot.Client
+	channelID snowflake.ID
+}
+
+func (p opsChannelPoster) PostOps(content string) error {
+	_, err := p.bot.Rest().CreateMessage(p.channelID, discord.MessageCreate{
+		Content:         content,
+		AllowedMentions: &discord.AllowedMentions{},
+	})
+	if err != nil {
+		return fmt.Errorf("could not post message: %w", err)
+	}
+	return nil
+}
+
+// opsWebhookPoster posts to a channel through a Discord webhook.
+type opsWebhookPoster struct{ client webhook.Client }
+
+func (p opsWebhookPoster) PostOps(content string) error {
+	_, err := p.client.CreateMessage(discord.WebhookMessageCreate{
+		Content:         content,
+		AllowedMentions: &discord.AllowedMentions{},
+	})
+	if err != nil {
+		return fmt.Errorf("could not post message: %w", err)
+	}
+	return nil
+}
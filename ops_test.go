@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+type fakeOpsPoster struct {
+	got []string
+	err error
+}
+
+func (p *fakeOpsPoster) PostOps(content string) error {
+	p.got = append(p.got, content)
+	return p.err
+}
+
+// fakeOps returns a logger that mirrors warnings and above to a fake poster,
+// and drops everything else.
+func fakeOps() (*slog.Logger, *fakeClock, *fakeOpsPoster) {
+	clk := &fakeClock{now: time.Date(2026, 1, 1, 20, 0, 0, 0, time.UTC)}
+	p := new(fakeOpsPoster)
+	m := newOpsMirror(clk, slog.DiscardHandler)
+	m.setPoster(p)
+	return slog.New(newOpsHandler(slog.DiscardHandler, slog.LevelWarn, m)),
+		clk, p
+}
+
+func TestOpsHandler(t *testing.T) {
+	logger, clk, p := fakeOps()
+	logger = logger.With("guild", 1).WithGroup("sync")
+	logger.Info("synced voice roles", "took", time.Second)
+	logger.Error("failed to sync voice roles",
+		"error", errors.New("could not get roles"),
+		slog.Group("role", "name", "voice"))
+	fire(clk)
+
+	want := []string{"🚨 **ERROR** failed to sync voice roles\n```\n" +
+		"guild=1\nsync.error=could not get roles\nsync.role.name=voice\n```"}
+	if !cmp.Equal(p.got, want) {
+		t.Errorf("posts -want +got\n%s", cmp.Diff(want, p.got))
+	}
+}
+
+func TestOpsMirrorDedup(t *testing.T) {
+	logger, clk, p := fakeOps()
+	for range 3 {
+		logger.Error("failed to sync voice roles", "guild", 1)
+	}
+	fire(clk)
+	clk.now = clk.now.Add(opsDedupWindow)
+	logger.Error("failed to sync voice roles", "guild", 2)
+	fire(clk)
+
+	want := []string{
+		"🚨 **ERROR** failed to sync voice roles\n```\nguild=1\n```",
+		"🚨 **ERROR** failed to sync voice roles\n```\nguild=2\n```\n" +
+			"-# Repeated 2 more times since last posted.",
+	}
+	if !cmp.Equal(p.got, want) {
+		t.Errorf("posts -want +got\n%s", cmp.Diff(want, p.got))
+	}
+}
+
+func TestOpsMirrorRateLimit(t *testing.T) {
+	logger, clk, p := fakeOps()
+	for i := range opsRateLimit + 2 {
+		logger.Warn(fmt.Sprintf("warning %d", i))
+	}
+	fire(clk)
+	if len(p.got) != opsRateLimit {
+		t.Fatalf("%d posts, want %d", len(p.got), opsRateLimit)
+	}
+	clk.now = clk.now.Add(opsRateWindow)
+	logger.Warn("later")
+	fire(clk)
+
+	want := "⚠️ **WARN** later\n" +
+		"-# 2 other records were dropped by the rate limit."
+	if got := p.got[len(p.got)-1]; got != want {
+		t.Errorf("last post %q, want %q", got, want)
+	}
+}
+
+func TestOpsMirrorPostError(t *testing.T) {
+	logger, clk, p := fakeOps()
+	p.err = errors.New("missing access")
+	logger.Warn("something")
+	fire(clk)
+	fire(clk)
+
+	// The failure is logged, but not mirrored in turn.
+	if len(p.got) != 1 {
+		t.Errorf("%d posts, want 1", len(p.got))
+	}
+}
+
+func TestFormatOps(t *testing.T) {
+	tests := []struct {
+		desc  string
+		attrs []string
+		want  string
+	}{{
+		desc: "no attributes",
+		want: "⚠️ **WARN** msg",
+	}, {
+		desc:  "code fence in value",
+		attrs: []string{"error=bad ```json"},
+		want:  "⚠️ **WARN** msg\n```\nerror=bad `\u200b``json\n```",
+	}, {
+		desc:  "too long",
+		attrs: []string{"body=" + strings.Repeat("é", 2000)},
+		want: "⚠️ **WARN** msg\n```\nbody=" +
+			strings.Repeat("é", (opsMaxLength-len("⚠️ **WARN** msg")-
+				len("\n```\n\n```")-len("body=")-len("…"))/2) +
+			"…\n```",
+	}}
+	for _, tt := range tests {
+		got := formatOps(slog.LevelWarn, "msg", tt.attrs, 0, 0)
+		if got != tt.want {
+			t.Errorf("%s: %s() = %q, want %q",
+				tt.desc, funcname(t, formatOps), got, tt.want)
+		}
+		if len(got) > opsMaxLength {
+			t.Errorf("%s: %d bytes, want at most %d",
+				tt.desc, len(got), opsMaxLength)
+		}
+	}
+}
+
+func TestSetDefaultHandler(t *testing.T) {
+	var buf bytes.Buffer
+	w, flags := log.Writer(), log.Flags()
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	t.Cleanup(func() {
+		log.SetOutput(w)
+		log.SetFlags(flags)
+	})
+
+	// Wrapping the default handler must not deadlock.
+	m := newOpsMirror(new(fakeClock), slog.DiscardHandler)
+	restore := setDefaultHandler(
+		newOpsHandler(slog.Default().Handler(), slog.LevelWarn, m),
+	)
+	slog.Warn("wrapped")
+	log.Print("printed")
+	restore()
+	slog.Info("restored")
+
+	want := "WARN wrapped\nprinted\nINFO restored\n"
+	if got := buf.String(); got != want {
+		t.Errorf("logged %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	disgobot "github.com/disgoorg/disgo/bot"
+	"github.com/disgoorg/disgo/discord"
+	"github.com/disgoorg/snowflake/v2"
+)
+
+// voicePresence is who is in voice in a guild, as the presence API shows it.
+type voicePresence struct {
+	GuildID  snowflake.ID      `json:"guild_id"`
+	Members  int               `json:"members"`
+	Channels []presenceChannel `json:"channels"`
+}
+
+type presenceChannel struct {
+	ID      snowflake.ID   `json:"id"`
+	Name    string         `json:"name"`
+	Members int            `json:"members"`
+	Users   []presenceUser `json:"users"` // Only members who opted in.
+}
+
+type presenceUser struct {
+	ID        snowflake.ID `json:"id"`
+	Name      string       `json:"name"`
+	AvatarURL string       `json:"avatar_url"`
+}
+
+// presenceSource says who is in voice.
+type presenceSource interface {
+	// VoicePresence returns who is in voice in gid. ok is false if gid is
+	// unknown.
+	VoicePresence(gid snowflake.ID) (p voicePresence, ok bool)
+}
+
+// presenceHeartbeat is how often an idle event stream is written to, so
+// that proxies do not close it.
+const presenceHeartbeat = 30 * time.Second
+
+// presenceServer serves the presence API: the voice presence of a guild as
+// JSON at /guilds/{gid}/voice, and as a stream of server-sent events at
+// /guilds/{gid}/voice/events that sends it again whenever it changes.
+type presenceServer struct {
+	source    presenceSource
+	origins   set[string] // Nil allows any origin.
+	enabled   func(gid snowflake.ID) bool
+	heartbeat time.Duration
+
+	mu       sync.Mutex
+	watchers map[snowflake.ID]set[chan struct{}] // Event streams, by guild.
+}
+
+func newPresenceServer(
+	source presenceSource, origins []string,
+) *presenceServer {
+	s := &presenceServer{
+		source:    source,
+		enabled:   func(snowflake.ID) bool { return true },
+		heartbeat: presenceHeartbeat,
+		watchers:  make(map[snowflake.ID]set[chan struct{}]),
+	}
+	if origins != nil {
+		s.origins = newSet(origins...)
+	}
+	return s
+}
+
+func (s *presenceServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /guilds/{gid}/voice", s.serveVoice)
+	mux.HandleFunc("GET /guilds/{gid}/voice/events", s.serveEvents)
+	return s.cors(mux)
+}
+
+// cors lets the allowed origins read the API from a browser.
+func (s *presenceServer) cors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Origin")
+		origin := r.Header.Get("Origin")
+		switch _, ok := s.origins[origin]; {
+		case s.origins == nil:
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		case ok:
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		if r.Method == http.MethodOptions {
+			w.Header().Set("Access-Control-Allow-Methods", "GET")
+			w.Header().Set("Access-Control-Allow-Headers", "If-None-Match")
+			w.Header().Set("Access-Control-Max-Age", "86400")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Access-Control-Expose-Headers", "ETag")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// render returns the voice presence of gid as JSON and its ETag.
+func (s *presenceServer) render(
+	gid snowflake.ID,
+) (body []byte, etag string, ok bool) {
+	if !s.enabled(gid) {
+		return nil, "", false
+	}
+	p, ok := s.source.VoicePresence(gid)
+	if !ok {
+		return nil, "", false
+	}
+	body, _ = json.Marshal(p) // Plain structs always marshal.
+	sum := sha256.Sum256(body)
+	return body, `"` + hex.EncodeToString(sum[:8]) + `"`, true
+}
+
+func (s *presenceServer) serveVoice(w http.ResponseWriter, r *http.Request) {
+	gid, err := snowflake.Parse(r.PathValue("gid"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	body, etag, ok := s.render(gid)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(body)
+}
+
+func (s *presenceServer) serveEvents(w http.ResponseWriter, r *http.Request) {
+	gid, err := snowflake.Parse(r.PathValue("gid"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	body, etag, ok := s.render(gid)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	rc := http.NewResponseController(w)
+	changed := s.watch(gid)
+	defer s.unwatch(gid, changed)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	heartbeat := time.NewTicker(s.heartbeat)
+	defer heartbeat.Stop()
+	for {
+		if body != nil {
+			fmt.Fprintf(w, "id: %s\ndata: %s\n\n", etag, body)
+			body = nil
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+		case <-changed:
+			b, tag, ok := s.render(gid)
+			if !ok {
+				return // The guild is gone.
+			}
+			if tag != etag {
+				body, etag = b, tag
+			}
+		}
+	}
+}
+
+func (s *presenceServer) watch(gid snowflake.ID) chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := make(chan struct{}, 1)
+	if s.watchers[gid] == nil {
+		s.watchers[gid] = newSet[chan struct{}]()
+	}
+	s.watchers[gid].Add(c)
+	return c
+}
+
+func (s *presenceServer) unwatch(gid snowflake.ID, c chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.watchers[gid], c)
+	if len(s.watchers[gid]) == 0 {
+		delete(s.watchers, gid)
+	}
+}
+
+// changed tells the event streams of gid that its voice presence may have
+// changed.
+func (s *presenceServer) changed(gid snowflake.ID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.watchers[gid] {
+		select {
+		case c <- struct{}{}:
+		default: // A change is already pending.
+		}
+	}
+}
+
+// presenceRole is the role of members who opted in to being shown by name
+// in the presence API.
+const presenceRole = "presence"
+
+// discordPresence takes voice presence from the caches. Only voice channels
+// that everyone can see are shown, and only members in them are counted.
+type discordPresence struct{ bot disgobot.Client }
+
+func (d discordPresence) VoicePresence(
+	gid snowflake.ID,
+) (voicePresence, bool) {
+	caches := d.bot.Caches()
+	if _, ok := caches.Guild(gid); !ok {
+		return voicePresence{}, false
+	}
+	var optIn snowflake.ID
+	caches.RolesForEach(gid, func(r discord.Role) {
+		if r.Name == presenceRole {
+			optIn = r.ID
+		}
+	})
+	// Only @everyone counts: channels that other roles or members are let
+	// into are not public. If @everyone is not cached, only channels its
+	// overwrite lets everyone see are.
+	everyone, _ := caches.Role(gid, gid)
+	var chs []discord.GuildChannel
+	caches.ChannelsForEach(func(ch discord.GuildChannel) {
+		if _, audio := ch.(discord.GuildAudioChannel); audio &&
+			ch.GuildID() == gid && public(everyone, ch) {
+			chs = append(chs, ch)
+		}
+	})
+	slices.SortFunc(chs, func(a, b discord.GuildChannel) int {
+		return cmp.Or(cmp.Compare(a.Position(), b.Position()),
+			cmp.Compare(a.ID(), b.ID()))
+	})
+	p := voicePresence{GuildID: gid, Channels: []presenceChannel{}}
+	index := make(map[snowflake.ID]int)
+	for i, ch := range chs {
+		index[ch.ID()] = i
+		p.Channels = append(p.Channels, presenceChannel{
+			ID:    ch.ID(),
+			Name:  ch.Name(),
+			Users: []presenceUser{},
+		})
+	}
+	caches.VoiceStatesForEach(gid, func(vs discord.VoiceState) {
+		if vs.ChannelID == nil {
+			return
+		}
+		i, ok := index[*vs.ChannelID]
+		if !ok {
+			return
+		}
+		ch := &p.Channels[i]
+		ch.Members++
+		p.Members++
+		m, ok := caches.Member(gid, vs.UserID)
+		if !ok || optIn == 0 || !slices.Contains(m.RoleIDs, optIn) {
+			return
+		}
+		ch.Users = append(ch.Users, presenceUser{
+			ID:        m.User.ID,
+			Name:      m.EffectiveName(),
+			AvatarURL: m.EffectiveAvatarURL(),
+		})
+	})
+	for _, ch := range p.Channels {
+		slices.SortFunc(ch.Users, func(a, b presenceUser) int {
+			return cmp.Or(cmp.Compare(a.Name, b.Name), cmp.Compare(a.ID, b.ID))
+		})
+	}
+	return p, true
+}
+
+// public reports whether everyone in the guild of ch can see it, given the
+// guild's @everyone role. Its permissions apply first, then its overwrite in
+// ch, denies before allows.
+func public(everyone discord.Role, ch discord.GuildChannel) bool {
+	perms := everyone.Permissions
+	if perms.Has(discord.PermissionAdministrator) {
+		return true
+	}
+	if o, ok := ch.PermissionOverwrites().Role(ch.GuildID()); ok {
+		perms = perms&^o.Deny | o.Allow
+	}
+	return perms.Has(discord.PermissionViewChannel)
+}
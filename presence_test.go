@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/disgoorg/disgo/discord"
+	"github.com/disgoorg/snowflake/v2"
+	"github.com/google/go-cmp/cmp"
+)
+
+type fakePresence struct {
+	mu       sync.Mutex
+	presence map[snowflake.ID]voicePresence
+}
+
+func (f *fakePresence) VoicePresence(
+	gid snowflake.ID,
+) (voicePresence, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p, ok := f.presence[gid]
+	return p, ok
+}
+
+func (f *fakePresence) set(p voicePresence) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.presence[p.GuildID] = p
+}
+
+func fakePresenceServer(
+	t *testing.T, origins []string,
+) (*presenceServer, *fakePresence, string) {
+	f := &fakePresence{presence: map[snowflake.ID]voicePresence{
+		1: {GuildID: 1, Members: 1, Channels: []presenceChannel{{
+			ID: 3, Name: "General", Members: 1, Users: []presenceUser{},
+		}}},
+		2: {GuildID: 2, Channels: []presenceChannel{}},
+	}}
+	s := newPresenceServer(f, origins)
+	s.enabled = func(gid snowflake.ID) bool { return gid != 2 }
+	srv := httptest.NewServer(s.handler())
+	t.Cleanup(srv.Close)
+	return s, f, srv.URL
+}
+
+func getPresence(
+	t *testing.T, url string, header http.Header,
+) *http.Response {
+	t.Helper()
+	req, err := http.NewRequestWithContext(t.Context(), "GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header = header
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestPresenceServerVoice(t *testing.T) {
+	_, _, url := fakePresenceServer(t, nil)
+
+	resp := getPresence(t, url+"/guilds/1/voice", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	var got map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{
+		"guild_id": "1",
+		"members":  1.0,
+		"channels": []any{map[string]any{
+			"id": "3", "name": "General", "members": 1.0, "users": []any{},
+		}},
+	}
+	if !cmp.Equal(got, want) {
+		t.Errorf("presence -want +got\n%s", cmp.Diff(want, got))
+	}
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		t.Fatal("no ETag")
+	}
+
+	resp = getPresence(t, url+"/guilds/1/voice",
+		http.Header{"If-None-Match": {etag}})
+	if resp.StatusCode != http.StatusNotModified {
+		t.Errorf("status with matching ETag %d, want %d",
+			resp.StatusCode, http.StatusNotModified)
+	}
+
+	for _, path := range []string{
+		"/guilds/2/voice", // Disabled.
+		"/guilds/4/voice", // Unknown.
+		"/guilds/general/voice",
+	} {
+		resp := getPresence(t, url+path, nil)
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("GET %s: status %d, want %d",
+				path, resp.StatusCode, http.StatusNotFound)
+		}
+	}
+}
+
+func TestPresenceServerCORS(t *testing.T) {
+	tests := []struct {
+		desc    string
+		origins []string
+		origin  string
+		want    string
+	}{{
+		desc:   "any origin",
+		origin: "https://example.com",
+		want:   "*",
+	}, {
+		desc:    "allowed origin",
+		origins: []string{"https://lesiw.chat"},
+		origin:  "https://lesiw.chat",
+		want:    "https://lesiw.chat",
+	}, {
+		desc:    "other origin",
+		origins: []string{"https://lesiw.chat"},
+		origin:  "https://example.com",
+	}}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			_, _, url := fakePresenceServer(t, tt.origins)
+			for _, method := range []string{"GET", "OPTIONS"} {
+				req, err := http.NewRequestWithContext(t.Context(),
+					method, url+"/guilds/1/voice", nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				req.Header.Set("Origin", tt.origin)
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+				got := resp.Header.Get("Access-Control-Allow-Origin")
+				if got != tt.want {
+					t.Errorf("%s: Access-Control-Allow-Origin %q, want %q",
+						method, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestPresenceServerEvents(t *testing.T) {
+	s, f, url := fakePresenceServer(t, nil)
+	resp := getPresence(t, url+"/guilds/1/voice/events", nil)
+	if got := resp.Header.Get("Content-Type"); got != "text/event-stream" {
+		t.Fatalf("Content-Type %q, want text/event-stream", got)
+	}
+	events := bufio.NewScanner(resp.Body)
+	next := func() voicePresence {
+		t.Helper()
+		for events.Scan() {
+			data, ok := strings.CutPrefix(events.Text(), "data: ")
+			if !ok {
+				continue
+			}
+			var p voicePresence
+			if err := json.Unmarshal([]byte(data), &p); err != nil {
+				t.Fatalf("%v: %s", err, data)
+			}
+			return p
+		}
+		t.Fatalf("stream ended: %v", events.Err())
+		return voicePresence{}
+	}
+
+	if got := next(); got.Members != 1 {
+		t.Errorf("first event has %d members, want 1", got.Members)
+	}
+	s.changed(1) // Unchanged, so not sent.
+	f.set(voicePresence{GuildID: 1, Members: 2, Channels: []presenceChannel{{
+		ID: 3, Name: "General", Members: 2, Users: []presenceUser{
+			{ID: 10, Name: "alice", AvatarURL: "https://cdn/a.png"},
+		},
+	}}})
+	s.changed(1)
+	if got := next(); got.Members != 2 || len(got.Channels[0].Users) != 1 {
+		t.Errorf("second event = %+v, want 2 members and alice", got)
+	}
+}
+
+func TestDiscordPresence(t *testing.T) {
+	const (
+		guildID   snowflake.ID = 1
+		roleID    snowflake.ID = 2
+		generalID snowflake.ID = 3
+		privateID snowflake.ID = 4
+		gamingID  snowflake.ID = 5
+		alice     snowflake.ID = 10
+		bob       snowflake.ID = 11
+		carol     snowflake.ID = 12
+	)
+	f := newFakeDiscord(t, guildID)
+	f.addVoiceChannel(generalID, "General")
+	f.addVoiceChannel(gamingID, "Gaming")
+	f.channels = append(f.channels, json.RawMessage(fmt.Sprintf(
+		`{"id":"%d","type":%d,"guild_id":"%d","name":"Mods",`+
+			`"permission_overwrites":[{"id":"%d","type":0,"deny":"%d"}]}`,
+		privateID, discord.ChannelTypeGuildVoice, guildID,
+		guildID, discord.PermissionViewChannel,
+	)))
+	f.addTextChannel(6, "chat")
+	f.roles = append(f.roles, discord.Role{
+		ID: guildID, GuildID: guildID, Name: "@everyone",
+		Permissions: discord.PermissionViewChannel,
+	})
+	f.addRole(roleID, presenceRole)
+	f.addMember(alice, "alice", roleID)
+	f.addMember(bob, "bob")
+	f.addMember(carol, "carol", roleID)
+	f.setVoice(alice, ptr(generalID))
+	f.setVoice(bob, ptr(generalID))
+	f.setVoice(carol, ptr(privateID))
+	bot := f.connect(nil)
+
+	got, ok := discordPresence{bot}.VoicePresence(guildID)
+	if !ok {
+		t.Fatalf("guild %d unknown", guildID)
+	}
+	want := voicePresence{
+		GuildID: guildID,
+		Members: 2, // Carol is in a private channel.
+		Channels: []presenceChannel{{
+			ID: generalID, Name: "General", Members: 2,
+			Users: []presenceUser{{
+				ID:        alice,
+				Name:      "alice",
+				AvatarURL: discord.User{ID: alice}.EffectiveAvatarURL(),
+			}},
+		}, {
+			ID: gamingID, Name: "Gaming", Users: []presenceUser{},
+		}},
+	}
+	if !cmp.Equal(got, want) {
+		t.Errorf("presence -want +got\n%s", cmp.Diff(want, got))
+	}
+	if _, ok := (discordPresence{bot}).VoicePresence(7); ok {
+		t.Errorf("unknown guild has presence")
+	}
+}
+
+func TestPublic(t *testing.T) {
+	const (
+		view  = discord.PermissionViewChannel
+		admin = discord.PermissionAdministrator
+		// roleView lets role 2 see the channel.
+		roleView = `{"id":"2","type":0,"allow":"1024","deny":"0"}`
+	)
+	tests := []struct {
+		desc        string
+		everyone    discord.Permissions
+		allow, deny discord.Permissions
+		others      string // Overwrites for other roles and members.
+		want        bool
+	}{{
+		desc:     "no overwrite",
+		everyone: view,
+		want:     true,
+	}, {
+		desc:     "denied in channel",
+		everyone: view,
+		deny:     view,
+	}, {
+		desc: "hidden in guild",
+	}, {
+		desc:  "hidden in guild, allowed in channel",
+		allow: view,
+		want:  true,
+	}, {
+		desc:     "administrator",
+		everyone: admin,
+		deny:     view,
+		want:     true,
+	}, {
+		desc:   "hidden in guild, allowed for a role",
+		others: roleView,
+	}, {
+		desc:   "hidden in guild, allowed for a member",
+		others: `{"id":"10","type":1,"allow":"1024","deny":"0"}`,
+	}, {
+		desc:     "denied in channel, allowed for a role",
+		everyone: view,
+		deny:     view,
+		others:   roleView,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			everyone := discord.Role{ID: 1, Permissions: tt.everyone}
+			var overwrites []string
+			if tt.allow != 0 || tt.deny != 0 {
+				overwrites = append(overwrites, fmt.Sprintf(
+					`{"id":"1","type":0,"allow":"%d","deny":"%d"}`,
+					tt.allow, tt.deny))
+			}
+			if tt.others != "" {
+				overwrites = append(overwrites, tt.others)
+			}
+			var ch discord.GuildVoiceChannel
+			err := json.Unmarshal([]byte(fmt.Sprintf(
+				`{"id":"3","type":%d,"guild_id":"1",`+
+					`"permission_overwrites":%s}`,
+				discord.ChannelTypeGuildVoice,
+				"["+strings.Join(overwrites, ",")+"]",
+			)), &ch)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := public(everyone, ch); got != tt.want {
+				t.Errorf("public() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInteractionsPresenceShow(t *testing.T) {
+	const slash = `{"id":"1","application_id":"1000","type":2,"token":"t",` +
+		`"version":1,"guild_id":"1","channel_id":"3",` +
+		`"member":{"user":{"id":"10","username":"alice"},"roles":[%s],` +
+		`"permissions":"0"},` +
+		`"data":{"id":"53","name":"presence","type":1,` +
+		`"options":[{"name":"show","type":1}]}}`
+	tests := []struct {
+		desc     string
+		roles    string
+		want     string
+		wantMuts []roleMutation
+	}{{
+		desc: "show",
+		want: "👀 Your name is shown on the website when you are in voice.",
+		wantMuts: []roleMutation{
+			{Add: true, GuildID: 1, UserID: 10, RoleID: 7},
+		},
+	}, {
+		desc:  "hide",
+		roles: `"7"`,
+		want:  "🙈 Your name is no longer shown on the website.",
+		wantMuts: []roleMutation{
+			{Add: false, GuildID: 1, UserID: 10, RoleID: 7},
+		},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			f := newFakeDiscord(t, 1)
+			f.addRole(7, presenceRole)
+			f.addMember(10, "alice")
+			url, key := testInteractions(t, f, nil)
+
+			status, body := postInteraction(t, url, key,
+				fmt.Sprintf(slash, tt.roles))
+			if status != http.StatusOK {
+				t.Fatalf("status %d: %s", status, body)
+			}
+			var resp struct {
+				Data struct {
+					Content string `json:"content"`
+				} `json:"data"`
+			}
+			if err := json.Unmarshal([]byte(body), &resp); err != nil {
+				t.Fatalf("%v: %s", err, body)
+			}
+			if resp.Data.Content != tt.want {
+				t.Errorf("content %q, want %q", resp.Data.Content, tt.want)
+			}
+			f.mu.Lock()
+			muts := f.mutations
+			f.mu.Unlock()
+			if !cmp.Equal(muts, tt.wantMuts) {
+				t.Errorf("mutations -want +got\n%s",
+					cmp.Diff(tt.wantMuts, muts))
+			}
+		})
+	}
+}
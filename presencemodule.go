@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	disgobot "github.com/disgoorg/disgo/bot"
+	"github.com/disgoorg/disgo/cache"
+	"github.com/disgoorg/disgo/discord"
+	"github.com/disgoorg/disgo/events"
+	"github.com/disgoorg/disgo/gateway"
+)
+
+// presenceModule serves who is in voice over a public HTTP API, for
+// websites to show.
+type presenceModule struct {
+	cfg *config
+
+	// Set by Start.
+	server *presenceServer
+	http   *http.Server
+	cancel context.CancelFunc // Ends event streams.
+	served chan struct{}
+	log    *slog.Logger
+}
+
+func newPresenceModule(cfg *config) module {
+	return &presenceModule{cfg: cfg}
+}
+
+func (*presenceModule) Name() string { return "presence" }
+
+func (*presenceModule) Intents() gateway.Intents {
+	return gateway.IntentGuildMembers | gateway.IntentGuildVoiceStates
+}
+
+func (*presenceModule) Caches() cache.Flags {
+	return cache.FlagChannels |
+		cache.FlagMembers |
+		cache.FlagVoiceStates |
+		cache.FlagRoles
+}
+
+func (*presenceModule) Degraded(missing gateway.Intents) string {
+	if missing.Has(gateway.IntentGuildMembers) {
+		return "opting in to the presence API takes effect on joining a call"
+	}
+	return ""
+}
+
+func (m *presenceModule) Start(ctx context.Context, env moduleEnv) error {
+	if m.cfg.presence.addr == "" {
+		return nil
+	}
+	ln, err := net.Listen("tcp", m.cfg.presence.addr)
+	if err != nil {
+		return fmt.Errorf("could not serve presence API: %w", err)
+	}
+	m.server = newPresenceServer(discordPresence{env.bot},
+		m.cfg.presence.origins)
+	m.server.enabled, m.log = env.enabled, env.log
+	base, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	m.cancel = cancel
+	m.http = &http.Server{
+		Handler:           m.server.handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+		BaseContext:       func(net.Listener) context.Context { return base },
+	}
+	m.served = make(chan struct{})
+	go func() {
+		defer close(m.served)
+		err := m.http.Serve(ln)
+		if !errors.Is(err, http.ErrServerClosed) {
+			m.log.Error("presence API stopped", "error", err)
+		}
+	}()
+	m.log.Info("serving presence API", "addr", ln.Addr())
+	return nil
+}
+
+func (m *presenceModule) Listeners() []disgobot.EventListener {
+	if m.server == nil {
+		return nil
+	}
+	return []disgobot.EventListener{
+		disgobot.NewListenerFunc(func(e *events.GuildReady) {
+			m.server.changed(e.GuildID)
+		}),
+		disgobot.NewListenerFunc(func(e *events.GuildVoiceStateUpdate) {
+			m.server.changed(e.VoiceState.GuildID)
+		}),
+		disgobot.NewListenerFunc(func(e *events.GuildChannelCreate) {
+			m.server.changed(e.GuildID)
+		}),
+		disgobot.NewListenerFunc(func(e *events.GuildChannelUpdate) {
+			m.server.changed(e.GuildID)
+		}),
+		disgobot.NewListenerFunc(func(e *events.GuildChannelDelete) {
+			m.server.changed(e.GuildID)
+		}),
+		disgobot.NewListenerFunc(func(e *events.GuildMemberUpdate) {
+			m.server.changed(e.GuildID)
+		}),
+	}
+}
+
+func (m *presenceModule) Stop() {
+	if m.http == nil {
+		return
+	}
+	m.cancel()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := m.http.Shutdown(ctx); err != nil {
+		m.log.Error("failed to stop presence API", "error", err)
+	}
+	<-m.served
+}
+
+func (m *presenceModule) Commands() []command {
+	return []command{{
+		create: discord.SlashCommandCreate{
+			Name:        "presence",
+			Description: "Voice presence on the website",
+			Contexts: []discord.InteractionContextType{
+				discord.InteractionContextTypeGuild,
+			},
+			Options: []discord.ApplicationCommandOption{
+				discord.ApplicationCommandOptionSubCommand{
+					Name:        "show",
+					Description: "Show or hide your name when you are in voice",
+				},
+			},
+		},
+		paths: map[string]commandHandler{
+			"/presence/show": presenceShow.command(m.cfg),
+		},
+	}}
+}
+
+// presenceShow toggles the presence role, so that members choose whether
+// the website shows their name.
+var presenceShow = selfRole{
+	module:      "presence",
+	name:        presenceRole,
+	unavailable: "❌ Showing your name is not available: ",
+	on:          "👀 Your name is shown on the website when you are in voice.",
+	off:         "🙈 Your name is no longer shown on the website.",
+}
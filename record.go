@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	disgobot "github.com/disgoorg/disgo/bot"
+	"github.com/disgoorg/disgo/discord"
+	"github.com/disgoorg/disgo/gateway"
+	"github.com/disgoorg/snowflake/v2"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// A recordedEvent is one line of a gateway recording.
+type recordedEvent struct {
+	Time  time.Time         `json:"time"`
+	Shard int               `json:"shard"`
+	Seq   int               `json:"seq"`
+	Type  gateway.EventType `json:"t"`
+	Data  json.RawMessage   `json:"d"`
+}
+
+// recorder appends every dispatched gateway event to a JSONL file.
+type recorder struct {
+	clock clock
+
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+func newRecorder(path string, c clock) (*recorder, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("could not open record file: %w", err)
+	}
+	return &recorder{clock: c, f: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (r *recorder) middleware() gatewayMiddleware {
+	return func(
+		_ disgobot.Client, next gateway.EventHandlerFunc,
+	) gateway.EventHandlerFunc {
+		return func(
+			t gateway.EventType, seq int, shardID int, e gateway.EventData,
+		) {
+			if err := r.record(t, seq, shardID, e); err != nil {
+				slog.Error("failed to record gateway event",
+					"type", t, "error", err)
+			}
+			next(t, seq, shardID, e)
+		}
+	}
+}
+
+func (r *recorder) record(
+	t gateway.EventType, seq int, shardID int, e gateway.EventData,
+) error {
+	d, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("could not encode event: %w", err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.enc.Encode(recordedEvent{
+		Time:  r.clock.Now(),
+		Shard: shardID,
+		Seq:   seq,
+		Type:  t,
+		Data:  d,
+	})
+}
+
+func (r *recorder) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.f.Close(); err != nil {
+		slog.Error("failed to close record file", "error", err)
+	}
+}
+
+// A roleChange is a role change reported instead of made.
+type roleChange struct {
+	Time    time.Time    `json:"time"`
+	GuildID snowflake.ID `json:"guild_id"`
+	UserID  snowflake.ID `json:"user_id"`
+	RoleID  snowflake.ID `json:"role_id"`
+	Add     bool         `json:"add"`
+}
+
+// replayToken lets replay build a client without credentials. It never
+// reaches Discord.
+var replayToken = base64.RawStdEncoding.EncodeToString([]byte("0")) +
+	".replay.replay"
+
+// replayFile replays the recording at path to w. Grace periods are configured
+// from getenv as they are for run; no token is needed.
+func replayFile(
+	ctx context.Context, getenv func(string) string, path string, w io.Writer,
+) error {
+	cfg, err := loadConfig(func(k string) string {
+		if k == "DISCORD_TOKEN" {
+			return replayToken
+		}
+		return getenv(k)
+	})
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("could not open recording: %w", err)
+	}
+	defer f.Close()
+	return replay(ctx, cfg, f, w)
+}
+
+// replay feeds a recording through the voice role listeners and writes the
+// role changes they make to w as JSONL. Time follows the recording, so grace
+// periods expire as they did when it was made. Nothing is sent to Discord.
+func replay(ctx context.Context, cfg *config, r io.Reader, w io.Writer) error {
+	_, caches := gatewayNeeds([]enabledModule{{module: newVoiceModule(cfg)}})
+	bot, err := newClient(replayToken, nil, cacheOpt(caches, nil))
+	if err != nil {
+		return fmt.Errorf("could not set up bot: %w", err)
+	}
+	clk := new(replayClock)
+	backend := replayBackend{discordBackend{bot}}
+	sched := &replayScheduler{
+		ctx:    ctx,
+		guilds: newSet[snowflake.ID](),
+	}
+	grace := newVoiceGrace(clk,
+		cfg.voiceLeaveGrace, cfg.voiceMinInCall,
+		func(gid snowflake.ID) { sched.syncGuild(gid, triggerGrace) })
+	sched.voice = newCallSyncs(voiceSync{
+		roles:   backend,
+		mutator: changeLog{clk, json.NewEncoder(w)},
+		holders: backend,
+		members: backend,
+		clock:   clk,
+		grace:   grace,
+	})
+	tracer := noop.NewTracerProvider().Tracer(tracerName)
+	bot.AddEventListeners(voiceListeners(tracer, sched, grace)...)
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 64<<20) // GUILD_CREATE can be large.
+	for line := 1; sc.Scan(); line++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var rec recordedEvent
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			return fmt.Errorf("bad event on line %d: %w", line, err)
+		}
+		e, err := gateway.UnmarshalEventData(rec.Data, rec.Type)
+		if err != nil {
+			return fmt.Errorf("bad %s event on line %d: %w",
+				rec.Type, line, err)
+		}
+		clk.advance(rec.Time)
+		bot.EventManager().HandleGatewayEvent(rec.Type, rec.Seq, rec.Shard, e)
+	}
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("could not read recording: %w", err)
+	}
+	return nil
+}
+
+// replayBackend serves voiceSync from the replayed caches.
+type replayBackend struct{ discordBackend }
+
+func (b replayBackend) FindRole(
+	gid snowflake.ID, name string,
+) (discord.Role, error) {
+	roles, _ := b.GuildRoles(gid)
+	return roleNamed(roles, name)
+}
+
+func (b replayBackend) GuildRoles(gid snowflake.ID) ([]discord.Role, error) {
+	var roles []discord.Role
+	b.bot.Caches().RolesForEach(gid, func(r discord.Role) {
+		roles = append(roles, r)
+	})
+	return roles, nil
+}
+
+func (b replayBackend) RoleMembers(
+	_ context.Context, gid snowflake.ID, role discord.Role,
+) (set[snowflake.ID], error) {
+	s := newSet[snowflake.ID]()
+	b.bot.Caches().MembersForEach(gid, func(m discord.Member) {
+		if slices.Contains(m.RoleIDs, role.ID) {
+			s.Add(m.User.ID)
+		}
+	})
+	return s, nil
+}
+
+// changeLog writes role changes to enc as JSONL instead of making them. In a
+// replay, the recording already holds the member updates that followed the
+// original changes.
+type changeLog struct {
+	clock clock
+	enc   *json.Encoder
+}
+
+func (l changeLog) SetMemberRole(
+	_ context.Context, gid, uid, rid snowflake.ID, enable bool,
+) error {
+	return l.enc.Encode(roleChange{
+		Time:    l.clock.Now(),
+		GuildID: gid,
+		UserID:  uid,
+		RoleID:  rid,
+		Add:     enable,
+	})
+}
+
+// replayScheduler syncs as soon as a sync is scheduled, so that replays are
+// deterministic.
+type replayScheduler struct {
+	ctx    context.Context
+	voice  callSyncs
+	guilds set[snowflake.ID]
+}
+
+func (s *replayScheduler) start(_ int, gid snowflake.ID) {
+	s.guilds.Add(gid)
+	s.syncGuild(gid, triggerStart)
+}
+
+func (s *replayScheduler) stop(gid snowflake.ID) {
+	delete(s.guilds, gid)
+}
+
+func (s *replayScheduler) trigger(_ context.Context, gid snowflake.ID) {
+	s.syncGuild(gid, triggerEvent)
+}
+
+func (s *replayScheduler) syncGuild(gid snowflake.ID, reason string) {
+	if _, ok := s.guilds[gid]; !ok {
+		return
+	}
+	run := newSyncRun(slog.Default(), gid, reason)
+	if err := s.voice.syncGuild(s.ctx, run, gid); err != nil {
+		run.log.Error("failed to sync voice roles", "error", err)
+	}
+}
+
+func (s *replayScheduler) triggerMember(
+	_ context.Context, gid, uid snowflake.ID,
+) {
+	if _, ok := s.guilds[gid]; !ok {
+		return
+	}
+	run := newSyncRun(slog.Default(), gid, triggerEvent)
+	if err := s.voice.syncMember(s.ctx, run, gid, uid); err != nil {
+		run.log.Error("failed to sync member voice role",
+			"user", uid, "error", err)
+	}
+}
+
+// replayClock is a clock that only moves when the recording does.
+type replayClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*replayTimer
+}
+
+type replayTimer struct {
+	at      time.Time
+	f       func()
+	stopped bool
+}
+
+func (t *replayTimer) Stop() bool {
+	stopped := t.stopped
+	t.stopped = true
+	return !stopped
+}
+
+func (c *replayClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *replayClock) AfterFunc(d time.Duration, f func()) stopper {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &replayTimer{at: c.now.Add(d), f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// advance moves the clock to now, firing due timers in order.
+func (c *replayClock) advance(now time.Time) {
+	for {
+		c.mu.Lock()
+		c.timers = slices.DeleteFunc(c.timers,
+			func(t *replayTimer) bool { return t.stopped })
+		i := -1
+		for j, t := range c.timers {
+			if !t.at.After(now) && (i < 0 || t.at.Before(c.timers[i].at)) {
+				i = j
+			}
+		}
+		if i < 0 {
+			if now.After(c.now) {
+				c.now = now
+			}
+			c.mu.Unlock()
+			return
+		}
+		t := c.timers[i]
+		c.timers = slices.Delete(c.timers, i, i+1)
+		if t.at.After(c.now) {
+			c.now = t.at
+		}
+		t.stopped = true
+		c.mu.Unlock()
+		t.f()
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/disgoorg/disgo/discord"
+	"github.com/disgoorg/disgo/gateway"
+	"github.com/disgoorg/snowflake/v2"
+	"github.com/google/go-cmp/cmp"
+)
+
+// testRecording builds a gateway recording for guild 1.
+type testRecording struct {
+	t     *testing.T
+	start time.Time
+	buf   bytes.Buffer
+	seq   int
+}
+
+func (r *testRecording) add(
+	at time.Duration, typ gateway.EventType, d any,
+) {
+	r.t.Helper()
+	data, err := json.Marshal(d)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	r.seq++
+	err = json.NewEncoder(&r.buf).Encode(recordedEvent{
+		Time: r.start.Add(at), Seq: r.seq, Type: typ, Data: data,
+	})
+	if err != nil {
+		r.t.Fatal(err)
+	}
+}
+
+// voice records uid joining the voice channel, or leaving it if in is false.
+func (r *testRecording) voice(at time.Duration, uid snowflake.ID, in bool) {
+	r.t.Helper()
+	var channel *snowflake.ID
+	if in {
+		channel = ptr[snowflake.ID](3)
+	}
+	r.add(at, gateway.EventTypeVoiceStateUpdate, discord.VoiceState{
+		GuildID: 1, UserID: uid, ChannelID: channel,
+	})
+}
+
+func TestReplayLeaveGrace(t *testing.T) {
+	const (
+		alice snowflake.ID = 10
+		bob   snowflake.ID = 11
+	)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	r := &testRecording{t: t, start: start}
+	r.add(0, gateway.EventTypeReady, map[string]any{
+		"v":          gateway.Version,
+		"user":       map[string]any{"id": "1000", "username": "bot"},
+		"guilds":     []map[string]any{{"id": "1", "unavailable": true}},
+		"session_id": "recorded",
+	})
+	r.add(0, gateway.EventTypeGuildCreate, map[string]any{
+		"id":   "1",
+		"name": "lesiw",
+		"channels": []map[string]any{{
+			"id": "3", "type": discord.ChannelTypeGuildVoice,
+			"guild_id": "1", "name": "General",
+		}},
+		"roles": []discord.Role{{ID: 2, GuildID: 1, Name: "voice"}},
+		"members": []discord.Member{{
+			User:    discord.User{ID: alice, Username: "alice"},
+			RoleIDs: []snowflake.ID{2},
+		}, {
+			User: discord.User{ID: bob, Username: "bob"},
+		}},
+		"voice_states": []discord.VoiceState{{
+			GuildID: 1, UserID: alice, ChannelID: ptr[snowflake.ID](3),
+		}},
+	})
+	r.voice(10*time.Second, alice, false)
+	r.voice(20*time.Second, alice, true) // Back within the grace period.
+	r.voice(30*time.Second, alice, false)
+	// Discord confirms the removal made when the grace period ran out.
+	r.add(60*time.Second, gateway.EventTypeGuildMemberUpdate, discord.Member{
+		GuildID: 1, User: discord.User{ID: alice, Username: "alice"},
+	})
+	r.voice(70*time.Second, bob, true)
+
+	var out bytes.Buffer
+	cfg := &config{voiceLeaveGrace: 30 * time.Second}
+	if err := replay(t.Context(), cfg, &r.buf, &out); err != nil {
+		t.Fatalf("replay(): %v", err)
+	}
+
+	want := []roleChange{{
+		Time: start.Add(60 * time.Second), GuildID: 1, UserID: alice,
+		RoleID: 2, Add: false,
+	}, {
+		Time: start.Add(70 * time.Second), GuildID: 1, UserID: bob,
+		RoleID: 2, Add: true,
+	}}
+	var got []roleChange
+	for dec := json.NewDecoder(&out); dec.More(); {
+		var m roleChange
+		if err := dec.Decode(&m); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, m)
+	}
+	if !cmp.Equal(got, want) {
+		t.Errorf("replay -want +got\n%s", cmp.Diff(want, got))
+	}
+}
+
+func TestReplayBadEvent(t *testing.T) {
+	rec := strings.NewReader(
+		`{"time":"2024-01-01T00:00:00Z","t":"READY","d":{}}` + "\n" +
+			"not json\n",
+	)
+	err := replay(t.Context(), new(config), rec, new(bytes.Buffer))
+	if got, want := err, "bad event on line 2"; got == nil ||
+		!strings.HasPrefix(got.Error(), want) {
+		t.Errorf("replay(): %v, want %q", got, want)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	disgobot "github.com/disgoorg/disgo/bot"
+	"github.com/disgoorg/disgo/discord"
+	"github.com/disgoorg/disgo/gateway"
+	"github.com/disgoorg/snowflake/v2"
+)
+
+// roleIndex tracks which members hold which roles from gateway events, so
+// that syncs read role holders from memory instead of requesting every
+// member of the guild.
+//
+// A guild is indexed by requesting its members once; member events keep the
+// index current from then on. The guild is requested again when the index is
+// suspected stale: after a new gateway session, during an outage, after a
+// failed sync, or once maxAge has passed.
+//
+// The index is fed by gateway middleware rather than listeners, so that it
+// sees member events in gateway order even with async listeners.
+type roleIndex struct {
+	clock  clock
+	maxAge time.Duration // Zero never expires an index.
+	// request asks the gateway for every member of gid, returning once all
+	// chunks have been received.
+	request func(ctx context.Context, gid snowflake.ID) error
+
+	mu     sync.Mutex
+	guilds map[snowflake.ID]*guildRoles
+}
+
+type guildRoles struct {
+	// indexedAt is zero until the guild is fully indexed.
+	indexedAt time.Time
+	holders   map[snowflake.ID]set[snowflake.ID] // By role.
+	roles     map[snowflake.ID][]snowflake.ID    // By member, if any.
+}
+
+func newGuildRoles() *guildRoles {
+	return &guildRoles{
+		holders: make(map[snowflake.ID]set[snowflake.ID]),
+		roles:   make(map[snowflake.ID][]snowflake.ID),
+	}
+}
+
+func newRoleIndex(c clock, maxAge time.Duration) *roleIndex {
+	return &roleIndex{
+		clock:  c,
+		maxAge: maxAge,
+		guilds: make(map[snowflake.ID]*guildRoles),
+	}
+}
+
+func (x *roleIndex) middleware() gatewayMiddleware {
+	return func(
+		_ disgobot.Client, next gateway.EventHandlerFunc,
+	) gateway.EventHandlerFunc {
+		return func(
+			t gateway.EventType, seq int, shardID int, e gateway.EventData,
+		) {
+			x.handle(e)
+			next(t, seq, shardID, e)
+		}
+	}
+}
+
+func (x *roleIndex) handle(e gateway.EventData) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	switch e := e.(type) {
+	case gateway.EventReady:
+		// Events may have been missed since the last session.
+		for _, g := range e.Guilds {
+			x.invalidateLocked(g.ID)
+		}
+	case gateway.EventGuildCreate:
+		for _, m := range e.Members {
+			x.set(e.ID, m.User.ID, m.RoleIDs)
+		}
+	case gateway.EventGuildDelete:
+		if e.Unavailable {
+			x.invalidateLocked(e.ID)
+		} else {
+			delete(x.guilds, e.ID)
+		}
+	case gateway.EventGuildMembersChunk:
+		for _, m := range e.Members {
+			x.set(e.GuildID, m.User.ID, m.RoleIDs)
+		}
+	case gateway.EventGuildMemberAdd:
+		x.set(e.GuildID, e.User.ID, e.RoleIDs)
+	case gateway.EventGuildMemberUpdate:
+		x.set(e.GuildID, e.User.ID, e.RoleIDs)
+	case gateway.EventGuildMemberRemove:
+		x.set(e.GuildID, e.User.ID, nil)
+	case gateway.EventGuildRoleDelete:
+		if g, ok := x.guilds[e.GuildID]; ok {
+			delete(g.holders, e.RoleID)
+		}
+	}
+}
+
+// set records that uid holds exactly roles in gid.
+func (x *roleIndex) set(gid, uid snowflake.ID, roles []snowflake.ID) {
+	g := x.guild(gid)
+	for _, rid := range g.roles[uid] {
+		if !slices.Contains(roles, rid) {
+			delete(g.holders[rid], uid)
+		}
+	}
+	if len(roles) == 0 {
+		delete(g.roles, uid)
+	} else {
+		g.roles[uid] = slices.Clone(roles)
+	}
+	for _, rid := range roles {
+		s, ok := g.holders[rid]
+		if !ok {
+			s = newSet[snowflake.ID]()
+			g.holders[rid] = s
+		}
+		s.Add(uid)
+	}
+}
+
+func (x *roleIndex) guild(gid snowflake.ID) *guildRoles {
+	g, ok := x.guilds[gid]
+	if !ok {
+		g = newGuildRoles()
+		x.guilds[gid] = g
+	}
+	return g
+}
+
+// invalidate marks the index of gid as stale.
+func (x *roleIndex) invalidate(gid snowflake.ID) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.invalidateLocked(gid)
+}
+
+func (x *roleIndex) invalidateLocked(gid snowflake.ID) {
+	if g, ok := x.guilds[gid]; ok {
+		// Replacing g also keeps an index in progress from completing.
+		x.guilds[gid] = &guildRoles{holders: g.holders, roles: g.roles}
+	}
+}
+
+// RoleMembers returns the members of gid holding role, indexing the guild
+// first if its index is missing or stale.
+func (x *roleIndex) RoleMembers(
+	ctx context.Context, gid snowflake.ID, role discord.Role,
+) (_ set[snowflake.ID], err error) {
+	if s, ok := x.lookup(gid, role.ID); ok {
+		return s, nil
+	}
+	ctx, span := startSpan(ctx, "request members", traceID(traceGuild, gid),
+		traceRole.String(role.Name))
+	defer func() { endSpan(span, err) }()
+	g := newGuildRoles()
+	x.mu.Lock()
+	x.guilds[gid] = g
+	x.mu.Unlock()
+	if err := x.request(ctx, gid); err != nil {
+		return nil, fmt.Errorf("could not index members with role %q: %w",
+			role.Name, err)
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.guilds[gid] == g {
+		g.indexedAt = x.clock.Now()
+	}
+	s := newSet[snowflake.ID]()
+	s.Union(g.holders[role.ID])
+	span.SetAttributes(traceRoleMembers.Int(len(s)))
+	return s, nil
+}
+
+func (x *roleIndex) lookup(gid, rid snowflake.ID) (set[snowflake.ID], bool) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	g, ok := x.guilds[gid]
+	if !ok || g.indexedAt.IsZero() {
+		return nil, false
+	}
+	if x.maxAge > 0 && x.clock.Now().Sub(g.indexedAt) >= x.maxAge {
+		return nil, false
+	}
+	s := newSet[snowflake.ID]()
+	s.Union(g.holders[rid])
+	return s, true
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/disgoorg/disgo/discord"
+	"github.com/disgoorg/disgo/gateway"
+	"github.com/disgoorg/snowflake/v2"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+// testRoleIndex returns a roleIndex for guild 1 whose member requests answer
+// with members and are counted in requests.
+func testRoleIndex(
+	members ...discord.Member,
+) (x *roleIndex, clk *fakeClock, requests *int) {
+	clk, requests = &fakeClock{now: time.Unix(0, 0)}, new(int)
+	x = newRoleIndex(clk, time.Hour)
+	x.request = func(context.Context, snowflake.ID) error {
+		*requests++
+		x.handle(gateway.EventGuildMembersChunk{GuildID: 1, Members: members})
+		return nil
+	}
+	return x, clk, requests
+}
+
+func roleMember(uid snowflake.ID, roles ...snowflake.ID) discord.Member {
+	return discord.Member{
+		GuildID: 1, User: discord.User{ID: uid}, RoleIDs: roles,
+	}
+}
+
+var voiceRoleTwo = discord.Role{ID: 2, Name: voiceRole}
+
+func wantHolders(
+	t *testing.T, x *roleIndex, requests *int,
+	wantRequests int, uids ...snowflake.ID,
+) {
+	t.Helper()
+	got, err := x.RoleMembers(t.Context(), 1, voiceRoleTwo)
+	if err != nil {
+		t.Fatalf("RoleMembers(): %v", err)
+	}
+	if want := newSet(uids...); !cmp.Equal(got, want, cmpopts.EquateEmpty()) {
+		t.Errorf("RoleMembers() -want +got\n%s", cmp.Diff(want, got))
+	}
+	if *requests != wantRequests {
+		t.Errorf("member requests = %d, want %d", *requests, wantRequests)
+	}
+}
+
+func TestRoleIndexEvents(t *testing.T) {
+	x, _, requests := testRoleIndex(
+		roleMember(10, 2), roleMember(11, 2, 3), roleMember(12, 3),
+	)
+	wantHolders(t, x, requests, 1, 10, 11)
+	wantHolders(t, x, requests, 1, 10, 11)
+
+	x.handle(gateway.EventGuildMemberUpdate{Member: roleMember(10, 3)})
+	x.handle(gateway.EventGuildMemberUpdate{Member: roleMember(12, 2, 3)})
+	x.handle(gateway.EventGuildMemberAdd{Member: roleMember(13, 2)})
+	x.handle(gateway.EventGuildMemberRemove{
+		GuildID: 1, User: discord.User{ID: 11},
+	})
+	wantHolders(t, x, requests, 1, 12, 13)
+
+	x.handle(gateway.EventGuildRoleDelete{GuildID: 1, RoleID: 2})
+	wantHolders(t, x, requests, 1)
+}
+
+func TestRoleIndexStale(t *testing.T) {
+	tests := []struct {
+		desc  string
+		stale func(x *roleIndex, clk *fakeClock)
+	}{{
+		desc: "new session",
+		stale: func(x *roleIndex, _ *fakeClock) {
+			x.handle(gateway.EventReady{
+				Guilds: []discord.UnavailableGuild{{ID: 1}},
+			})
+		},
+	}, {
+		desc: "outage",
+		stale: func(x *roleIndex, _ *fakeClock) {
+			x.handle(gateway.EventGuildDelete{
+				UnavailableGuild: discord.UnavailableGuild{
+					ID: 1, Unavailable: true,
+				},
+			})
+		},
+	}, {
+		desc: "failed sync",
+		stale: func(x *roleIndex, _ *fakeClock) {
+			x.invalidate(1)
+		},
+	}, {
+		desc: "max age",
+		stale: func(_ *roleIndex, clk *fakeClock) {
+			clk.now = clk.now.Add(time.Hour)
+		},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			t.Parallel()
+			x, clk, requests := testRoleIndex(roleMember(10, 2))
+			wantHolders(t, x, requests, 1, 10)
+			clk.now = clk.now.Add(time.Minute)
+			wantHolders(t, x, requests, 1, 10)
+
+			tt.stale(x, clk)
+			wantHolders(t, x, requests, 2, 10)
+		})
+	}
+}
+
+func TestRoleIndexStaleWhileIndexing(t *testing.T) {
+	x, _, requests := testRoleIndex(roleMember(10, 2))
+	request := x.request
+	x.request = func(ctx context.Context, gid snowflake.ID) error {
+		err := request(ctx, gid)
+		if *requests == 1 {
+			x.handle(gateway.EventReady{
+				Guilds: []discord.UnavailableGuild{{ID: 1}},
+			})
+		}
+		return err
+	}
+	wantHolders(t, x, requests, 1, 10)
+	wantHolders(t, x, requests, 2, 10)
+	wantHolders(t, x, requests, 2, 10)
+}
+
+func TestRoleIndexRequestError(t *testing.T) {
+	x, _, requests := testRoleIndex(roleMember(10, 2))
+	request := x.request
+	x.request = func(context.Context, snowflake.ID) error {
+		return errors.New("timed out")
+	}
+	_, err := x.RoleMembers(t.Context(), 1, voiceRoleTwo)
+	if got, want := err, `could not index members with role "voice": `+
+		"timed out"; got == nil || got.Error() != want {
+		t.Errorf("RoleMembers(): %v, want %v", got, want)
+	}
+	x.request = request
+	wantHolders(t, x, requests, 1, 10)
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	disgobot "github.com/disgoorg/disgo/bot"
+	"github.com/disgoorg/disgo/cache"
+	"github.com/disgoorg/disgo/discord"
+	"github.com/disgoorg/disgo/gateway"
+	"github.com/disgoorg/disgo/sharding"
+	"github.com/disgoorg/snowflake/v2"
+	"github.com/gorilla/websocket"
+)
+
+// sessionStore persists gateway sessions across restarts, so that a short
+// restart can RESUME instead of IDENTIFY.
+//
+// A resumed session only replays the events missed while the bot was down,
+// so the caches it needs are saved alongside the session. If Discord rejects
+// the resume, disgo falls back to IDENTIFY and the restored guilds are
+// evicted before their fresh GUILD_CREATE arrives.
+type sessionStore struct {
+	path   string
+	maxAge time.Duration
+
+	mu         sync.Mutex
+	saved      *savedSession
+	resumeURLs map[int]string
+	restored   map[int][]snowflake.ID // Guilds awaiting RESUMED, by shard.
+}
+
+type savedSession struct {
+	SavedAt time.Time            `json:"saved_at"`
+	Shards  map[int]shardSession `json:"shards"`
+	Cache   cacheSnapshot        `json:"cache"`
+}
+
+type shardSession struct {
+	ShardCount int            `json:"shard_count"`
+	SessionID  string         `json:"session_id"`
+	ResumeURL  string         `json:"resume_url"`
+	Sequence   int            `json:"sequence"`
+	Guilds     []snowflake.ID `json:"guilds"`
+}
+
+type cacheSnapshot struct {
+	SelfUser    *discord.OAuth2User  `json:"self_user,omitempty"`
+	Guilds      []discord.Guild      `json:"guilds"`
+	Channels    []json.RawMessage    `json:"channels"`
+	Roles       []discord.Role       `json:"roles"`
+	Members     []discord.Member     `json:"members"`
+	VoiceStates []discord.VoiceState `json:"voice_states"`
+}
+
+func newSessionStore(path string, maxAge time.Duration) *sessionStore {
+	return &sessionStore{
+		path:       path,
+		maxAge:     maxAge,
+		resumeURLs: make(map[int]string),
+		restored:   make(map[int][]snowflake.ID),
+	}
+}
+
+// load reads the saved session, if there is one that is fresh enough.
+// The file is removed either way: once the bot runs, its sequence is stale.
+func (s *sessionStore) load() error {
+	buf, err := os.ReadFile(s.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("could not read session file: %w", err)
+	}
+	if err := os.Remove(s.path); err != nil {
+		return fmt.Errorf("could not remove session file: %w", err)
+	}
+	saved := new(savedSession)
+	if err := json.Unmarshal(buf, saved); err != nil {
+		return fmt.Errorf("could not parse session file: %w", err)
+	}
+	if age := time.Since(saved.SavedAt); age > s.maxAge {
+		slog.Info("ignoring stale gateway session", "age", age)
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.saved = saved
+	return nil
+}
+
+// restore fills c with the cached state saved with the session.
+func (s *sessionStore) restore(c cache.Caches) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.saved == nil {
+		return nil
+	}
+	snap := s.saved.Cache
+	if snap.SelfUser != nil {
+		c.SetSelfUser(*snap.SelfUser)
+	}
+	for _, g := range snap.Guilds {
+		c.AddGuild(g)
+	}
+	for _, raw := range snap.Channels {
+		var ch discord.UnmarshalChannel
+		if err := json.Unmarshal(raw, &ch); err != nil {
+			return fmt.Errorf("could not restore channel: %w", err)
+		}
+		if gc, ok := ch.Channel.(discord.GuildChannel); ok {
+			c.AddChannel(gc)
+		}
+	}
+	for _, r := range snap.Roles {
+		c.AddRole(r)
+	}
+	// Voice states first, as the member cache policy may depend on them.
+	for _, vs := range snap.VoiceStates {
+		c.AddVoiceState(vs)
+	}
+	for _, m := range snap.Members {
+		c.AddMember(m)
+	}
+	for id, sh := range s.saved.Shards {
+		s.restored[id] = sh.Guilds
+	}
+	slog.Info("restored gateway session",
+		"shards", len(s.saved.Shards),
+		"guilds", len(snap.Guilds),
+		"age", time.Since(s.saved.SavedAt),
+	)
+	return nil
+}
+
+// gatewayOpt resumes the saved session for the gateway being configured.
+// It must be applied after the shard ID and count are set.
+func (s *sessionStore) gatewayOpt() gateway.ConfigOpt {
+	return func(c *gateway.Config) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.saved == nil {
+			return
+		}
+		sh, ok := s.saved.Shards[c.ShardID]
+		if !ok || sh.ShardCount != c.ShardCount {
+			return
+		}
+		gateway.WithSessionID(sh.SessionID)(c)
+		gateway.WithSequence(sh.Sequence)(c)
+		if sh.ResumeURL != "" {
+			c.ResumeURL = &sh.ResumeURL
+		}
+	}
+}
+
+// middleware tracks resume URLs and evicts restored guilds when a shard
+// has to IDENTIFY after all.
+func (s *sessionStore) middleware() gatewayMiddleware {
+	return func(
+		c disgobot.Client, next gateway.EventHandlerFunc,
+	) gateway.EventHandlerFunc {
+		return func(
+			t gateway.EventType, seq int, shardID int, e gateway.EventData,
+		) {
+			if ready, ok := e.(gateway.EventReady); ok {
+				s.mu.Lock()
+				s.resumeURLs[shardID] = ready.ResumeGatewayURL
+				stale := s.restored[shardID]
+				delete(s.restored, shardID)
+				s.mu.Unlock()
+				for _, gid := range stale {
+					evictGuild(c.Caches(), gid)
+				}
+			}
+			next(t, seq, shardID, e)
+		}
+	}
+}
+
+// resumed returns the restored guilds of a shard whose saved session was
+// successfully resumed.
+func (s *sessionStore) resumed(shardID int) []snowflake.ID {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	gids := s.restored[shardID]
+	delete(s.restored, shardID)
+	return gids
+}
+
+// close disconnects every gateway without invalidating its session,
+// then saves the sessions and caches.
+func (s *sessionStore) close(ctx context.Context, bot disgobot.Client) error {
+	gws := gateways(bot)
+	for _, gw := range gws {
+		gw.CloseWithCode(ctx, websocket.CloseServiceRestart, "restarting")
+	}
+	saved := &savedSession{
+		SavedAt: time.Now(),
+		Shards:  make(map[int]shardSession),
+	}
+	s.mu.Lock()
+	for _, gw := range gws {
+		sid, seq := gw.SessionID(), gw.LastSequenceReceived()
+		if sid == nil || seq == nil {
+			continue
+		}
+		saved.Shards[gw.ShardID()] = shardSession{
+			ShardCount: gw.ShardCount(),
+			SessionID:  *sid,
+			ResumeURL:  s.resumeURLs[gw.ShardID()],
+			Sequence:   *seq,
+		}
+	}
+	s.mu.Unlock()
+	if len(saved.Shards) == 0 {
+		return nil
+	}
+	if err := snapshotCaches(bot.Caches(), saved); err != nil {
+		return err
+	}
+	buf, err := json.Marshal(saved)
+	if err != nil {
+		return fmt.Errorf("could not encode session: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".session-*")
+	if err != nil {
+		return fmt.Errorf("could not save session: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(buf)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("could not save session: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("could not save session: %w", err)
+	}
+	slog.Info("saved gateway session", "shards", len(saved.Shards))
+	return nil
+}
+
+func snapshotCaches(c cache.Caches, saved *savedSession) error {
+	snap := &saved.Cache
+	if u, ok := c.SelfUser(); ok {
+		snap.SelfUser = &u
+	}
+	guilds := newSet[snowflake.ID]()
+	c.GuildsForEach(func(g discord.Guild) {
+		shardID := 0
+		var sh shardSession
+		for id, s := range saved.Shards {
+			if sharding.ShardIDByGuild(g.ID, s.ShardCount) == id {
+				shardID, sh = id, s
+				break
+			}
+		}
+		if sh.SessionID == "" {
+			return
+		}
+		sh.Guilds = append(sh.Guilds, g.ID)
+		saved.Shards[shardID] = sh
+		guilds.Add(g.ID)
+		snap.Guilds = append(snap.Guilds, g)
+		c.RolesForEach(g.ID, func(r discord.Role) {
+			snap.Roles = append(snap.Roles, r)
+		})
+		c.MembersForEach(g.ID, func(m discord.Member) {
+			snap.Members = append(snap.Members, m)
+		})
+		c.VoiceStatesForEach(g.ID, func(vs discord.VoiceState) {
+			snap.VoiceStates = append(snap.VoiceStates, vs)
+		})
+	})
+	var err error
+	c.ChannelsForEach(func(ch discord.GuildChannel) {
+		if err != nil {
+			return
+		}
+		if _, ok := guilds[ch.GuildID()]; !ok {
+			return
+		}
+		var raw []byte
+		if raw, err = json.Marshal(ch); err == nil {
+			snap.Channels = append(snap.Channels, raw)
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("could not snapshot channels: %w", err)
+	}
+	return nil
+}
+
+func evictGuild(c cache.Caches, gid snowflake.ID) {
+	c.RemoveVoiceStatesByGuildID(gid)
+	c.RemoveMembersByGuildID(gid)
+	c.RemoveRolesByGuildID(gid)
+	c.RemoveChannelsByGuildID(gid)
+	c.RemoveGuild(gid)
+}
+
+func gateways(bot disgobot.Client) []gateway.Gateway {
+	if bot.HasShardManager() {
+		var gws []gateway.Gateway
+		for _, gw := range bot.ShardManager().Shards() {
+			gws = append(gws, gw)
+		}
+		return gws
+	}
+	if bot.HasGateway() {
+		return []gateway.Gateway{bot.Gateway()}
+	}
+	return nil
+}
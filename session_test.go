@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/disgoorg/disgo/cache"
+	"github.com/disgoorg/disgo/discord"
+	"github.com/disgoorg/disgo/gateway"
+	"github.com/disgoorg/snowflake/v2"
+)
+
+func testCaches(t *testing.T) cache.Caches {
+	t.Helper()
+	c := cache.New(cache.WithCaches(cache.FlagsAll))
+	c.AddGuild(discord.Guild{ID: 1, Name: "lesiw"})
+	var ch discord.UnmarshalChannel
+	err := json.Unmarshal([]byte(
+		`{"id":"10","type":2,"guild_id":"1","name":"General"}`,
+	), &ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.AddChannel(ch.Channel.(discord.GuildChannel))
+	c.AddRole(discord.Role{ID: 20, GuildID: 1, Name: "voice"})
+	c.AddMember(discord.Member{
+		GuildID: 1,
+		User:    discord.User{ID: 30, Username: "alice"},
+		RoleIDs: []snowflake.ID{20},
+	})
+	c.AddVoiceState(discord.VoiceState{
+		GuildID:   1,
+		UserID:    30,
+		ChannelID: ptr(snowflake.ID(10)),
+	})
+	return c
+}
+
+func saveTestSession(t *testing.T, path string, c cache.Caches) {
+	t.Helper()
+	saved := &savedSession{
+		SavedAt: time.Now(),
+		Shards: map[int]shardSession{0: {
+			ShardCount: 1,
+			SessionID:  "abc",
+			ResumeURL:  "wss://resume.example",
+			Sequence:   42,
+		}},
+	}
+	if err := snapshotCaches(c, saved); err != nil {
+		t.Fatalf("snapshotCaches(): %v", err)
+	}
+	buf, err := json.Marshal(saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, buf, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSessionRestore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session.json")
+	saveTestSession(t, path, testCaches(t))
+
+	s := newSessionStore(path, time.Minute)
+	if err := s.load(); err != nil {
+		t.Fatalf("load(): %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("session file still exists after load()")
+	}
+	c := cache.New(cache.WithCaches(cache.FlagsAll))
+	if err := s.restore(c); err != nil {
+		t.Fatalf("restore(): %v", err)
+	}
+
+	if _, ok := c.GuildVoiceChannel(10); !ok {
+		t.Errorf("voice channel not restored")
+	}
+	if _, ok := c.Role(1, 20); !ok {
+		t.Errorf("role not restored")
+	}
+	if _, ok := c.Member(1, 30); !ok {
+		t.Errorf("member not restored")
+	}
+	if _, ok := c.VoiceState(1, 30); !ok {
+		t.Errorf("voice state not restored")
+	}
+
+	gc := gateway.DefaultConfig()
+	s.gatewayOpt()(gc)
+	if gc.SessionID == nil || *gc.SessionID != "abc" {
+		t.Errorf("SessionID = %v, want abc", gc.SessionID)
+	}
+	if gc.LastSequenceReceived == nil || *gc.LastSequenceReceived != 42 {
+		t.Errorf("LastSequenceReceived = %v, want 42",
+			gc.LastSequenceReceived)
+	}
+	if gc.ResumeURL == nil || *gc.ResumeURL != "wss://resume.example" {
+		t.Errorf("ResumeURL = %v, want wss://resume.example", gc.ResumeURL)
+	}
+
+	gc = gateway.DefaultConfig()
+	gateway.WithShardCount(2)(gc)
+	s.gatewayOpt()(gc)
+	if gc.SessionID != nil {
+		t.Errorf("resumed session with a different shard count")
+	}
+
+	if got := s.resumed(0); len(got) != 1 || got[0] != 1 {
+		t.Errorf("resumed(0) = %v, want [1]", got)
+	}
+	if got := s.resumed(0); got != nil {
+		t.Errorf("second resumed(0) = %v, want nil", got)
+	}
+}
+
+func TestSessionStale(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session.json")
+	saveTestSession(t, path, testCaches(t))
+	old := time.Now().Add(-time.Hour)
+	buf, _ := os.ReadFile(path)
+	var saved savedSession
+	if err := json.Unmarshal(buf, &saved); err != nil {
+		t.Fatal(err)
+	}
+	saved.SavedAt = old
+	buf, _ = json.Marshal(saved)
+	if err := os.WriteFile(path, buf, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newSessionStore(path, time.Minute)
+	if err := s.load(); err != nil {
+		t.Fatalf("load(): %v", err)
+	}
+	gc := gateway.DefaultConfig()
+	s.gatewayOpt()(gc)
+	if gc.SessionID != nil {
+		t.Errorf("resumed a stale session")
+	}
+}
+
+func TestSessionIdentifyEvicts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session.json")
+	saveTestSession(t, path, testCaches(t))
+	s := newSessionStore(path, time.Minute)
+	if err := s.load(); err != nil {
+		t.Fatalf("load(): %v", err)
+	}
+	c := mockClient(t)
+	caches := cache.New(cache.WithCaches(cache.FlagsAll))
+	c._Caches_Return(caches)
+	if err := s.restore(caches); err != nil {
+		t.Fatalf("restore(): %v", err)
+	}
+
+	var called bool
+	h := s.middleware()(c, func(gateway.EventType, int, int, gateway.EventData) {
+		called = true
+	})
+	h(gateway.EventTypeReady, 1, 0, gateway.EventReady{
+		ResumeGatewayURL: "wss://new.example",
+	})
+
+	if !called {
+		t.Errorf("middleware did not call next handler")
+	}
+	if _, ok := caches.VoiceState(1, 30); ok {
+		t.Errorf("restored voice state survived IDENTIFY")
+	}
+	if _, ok := caches.Guild(1); ok {
+		t.Errorf("restored guild survived IDENTIFY")
+	}
+	if got := s.resumed(0); got != nil {
+		t.Errorf("resumed(0) = %v after IDENTIFY, want nil", got)
+	}
+}
+
+// TestRunShardedResume runs sharded with a saved session, whose shard must
+// resume while close codes are still watched.
+func TestRunShardedResume(t *testing.T) {
+	f := newFakeDiscord(t, 1)
+	path := filepath.Join(t.TempDir(), "session.json")
+	saved := &savedSession{
+		SavedAt: time.Now(),
+		Shards: map[int]shardSession{0: {
+			ShardCount: 1,
+			SessionID:  "abc",
+			ResumeURL:  "ws" + strings.TrimPrefix(f.srv.URL, "http") + "/ws",
+			Sequence:   42,
+			Guilds:     []snowflake.ID{1},
+		}},
+	}
+	if err := snapshotCaches(testCaches(t), saved); err != nil {
+		t.Fatalf("snapshotCaches(): %v", err)
+	}
+	buf, err := json.Marshal(saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, buf, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	runFakeConfig(t, f, &config{
+		token:         fakeToken,
+		shards:        shardConfig{enabled: true, count: 1},
+		sessionFile:   path,
+		sessionMaxAge: time.Minute,
+		leader:        leaderConfig{ttl: 15 * time.Second},
+	})
+
+	select {
+	case sid := <-f.resumed:
+		if sid != "abc" {
+			t.Errorf("resumed session %q, want abc", sid)
+		}
+	case <-f.identified:
+		t.Fatal("shard identified instead of resuming")
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for resume")
+	}
+}
+
+func ptr[T any](v T) *T { return &v }
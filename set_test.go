@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// bytesSets splits b into two sets at the first zero byte.
+func bytesSets(b []byte) (s, o set[byte]) {
+	left, right, _ := bytes.Cut(b, []byte{0})
+	return newSet(left...), newSet(right...)
+}
+
+func FuzzSetAlgebra(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{1, 2, 3, 0, 2, 3, 4})
+	f.Add([]byte{1, 1, 0, 1})
+	f.Add([]byte{0, 5, 6})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		s, o := bytesSets(b)
+
+		diff := s.Diff(o)
+		for e := range diff {
+			if !has(s, e) || has(o, e) {
+				t.Errorf("%v.Diff(%v) has %v", s, o, e)
+			}
+		}
+		for e := range s {
+			if !has(o, e) && !has(diff, e) {
+				t.Errorf("%v.Diff(%v) lacks %v", s, o, e)
+			}
+		}
+		if len(s.Diff(s)) != 0 {
+			t.Errorf("%v.Diff(itself) is not empty", s)
+		}
+
+		u := newSet[byte]()
+		u.Union(s)
+		u.Union(o)
+		for e := range u {
+			if !has(s, e) && !has(o, e) {
+				t.Errorf("%v ∪ %v has %v", s, o, e)
+			}
+		}
+		if len(u.Diff(s).Diff(o)) != 0 || len(s.Diff(u)) != 0 ||
+			len(o.Diff(u)) != 0 {
+			t.Errorf("%v ∪ %v = %v", s, o, u)
+		}
+
+		// (s \ o) ∪ (s ∩ o) = s, where s ∩ o = s \ (s \ o).
+		back := s.Diff(diff)
+		back.Union(diff)
+		if len(back) != len(s) || len(back.Diff(s)) != 0 {
+			t.Errorf("(%v \\ %v) ∪ (%v ∩ %v) = %v", s, o, s, o, back)
+		}
+		if len(diff)+len(o.Diff(s))+len(s.Diff(diff)) != len(u) {
+			t.Errorf("%v and %v do not partition %v", s, o, u)
+		}
+	})
+}
+
+func has[E comparable](s set[E], e E) bool {
+	_, ok := s[e]
+	return ok
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"sync"
+
+	disgobot "github.com/disgoorg/disgo/bot"
+	"github.com/disgoorg/disgo/gateway"
+	"github.com/disgoorg/disgo/sharding"
+)
+
+// gatewayOpts connects through a single gateway or the shard manager,
+// depending on sc.
+func gatewayOpts(sc shardConfig, opts ...gateway.ConfigOpt) disgobot.ConfigOpt {
+	if !sc.enabled {
+		return func(c *disgobot.Config) {
+			disgobot.WithDefaultGateway()(c)
+			disgobot.WithGatewayConfigOpts(opts...)(c)
+		}
+	}
+	shardOpts := []sharding.ConfigOpt{sharding.WithGatewayConfigOpts(opts...)}
+	if sc.count > 0 {
+		shardOpts = append(shardOpts, sharding.WithShardCount(sc.count))
+	}
+	if sc.ids != nil || sc.count > 0 {
+		ids := sc.ids
+		if ids == nil {
+			for id := range sc.count {
+				ids = append(ids, id)
+			}
+		}
+		// disgo pre-populates ShardIDs with every shard it was told about,
+		// and WithShardIDs only adds to that set.
+		shardOpts = append(shardOpts, func(c *sharding.Config) {
+			c.ShardIDs = make(map[int]struct{}, len(ids))
+			for _, id := range ids {
+				c.ShardIDs[id] = struct{}{}
+			}
+		})
+	}
+	return disgobot.WithShardManagerConfigOpts(shardOpts...)
+}
+
+// readiness tracks which shards have finished loading their guilds.
+type readiness struct {
+	mu     sync.Mutex
+	shards map[int]shardState
+}
+
+type shardState struct {
+	Ready  bool `json:"ready"`
+	Guilds int  `json:"guilds"`
+}
+
+func newReadiness() *readiness {
+	return &readiness{shards: make(map[int]shardState)}
+}
+
+func (r *readiness) connected(shardID int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.shards[shardID] = shardState{}
+}
+
+func (r *readiness) guildReady(shardID int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.shards[shardID]
+	s.Guilds++
+	r.shards[shardID] = s
+}
+
+func (r *readiness) ready(shardID int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.shards[shardID]
+	s.Ready = true
+	r.shards[shardID] = s
+}
+
+func (r *readiness) snapshot() map[int]shardState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return maps.Clone(r.shards)
+}
+
+// ServeHTTP reports per-shard readiness. It responds with 503 until every
+// connected shard is ready.
+func (r *readiness) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	shards := r.snapshot()
+	status := http.StatusOK
+	if len(shards) == 0 {
+		status = http.StatusServiceUnavailable
+	}
+	for _, s := range shards {
+		if !s.Ready {
+			status = http.StatusServiceUnavailable
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(shards)
+}
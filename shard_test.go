@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+
+	disgobot "github.com/disgoorg/disgo/bot"
+	"github.com/disgoorg/disgo/sharding"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestGatewayOptsShardIDs(t *testing.T) {
+	var cfg disgobot.Config
+	gatewayOpts(shardConfig{enabled: true, count: 4, ids: []int{1, 3}})(&cfg)
+	if len(cfg.GatewayConfigOpts) > 0 {
+		t.Errorf("sharded gatewayOpts() set single gateway options")
+	}
+
+	// Simulate disgo's defaults, which list every shard.
+	sc := sharding.DefaultConfig()
+	sc.Apply(append([]sharding.ConfigOpt{
+		sharding.WithShardIDs(0, 1, 2, 3, 4, 5),
+	}, cfg.ShardManagerConfigOpts...))
+
+	want := map[int]struct{}{1: {}, 3: {}}
+	if !cmp.Equal(sc.ShardIDs, want) {
+		t.Errorf("ShardIDs -want +got\n%s", cmp.Diff(want, sc.ShardIDs))
+	}
+	if got, want := sc.ShardCount, 4; got != want {
+		t.Errorf("ShardCount = %d, want %d", got, want)
+	}
+}
+
+func TestGatewayOptsUnsharded(t *testing.T) {
+	var cfg disgobot.Config
+	gatewayOpts(shardConfig{})(&cfg)
+	if len(cfg.ShardManagerConfigOpts) > 0 {
+		t.Errorf("unsharded gatewayOpts() set shard manager options")
+	}
+	if len(cfg.GatewayConfigOpts) == 0 {
+		t.Errorf("unsharded gatewayOpts() set no gateway options")
+	}
+}
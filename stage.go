@@ -0,0 +1,360 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	disgobot "github.com/disgoorg/disgo/bot"
+	"github.com/disgoorg/disgo/discord"
+	"github.com/disgoorg/disgo/gateway"
+	"github.com/disgoorg/snowflake/v2"
+)
+
+// stagePoster posts stage summaries.
+type stagePoster interface {
+	// PostStageSummary posts summary in the chat of stage channel cid.
+	PostStageSummary(cid snowflake.ID, summary string) error
+}
+
+// stageTracker follows stages from when they go live until they end, and
+// then posts a summary of each in its channel: how long it lasted, who spoke
+// and how large the audience grew.
+//
+// Like callNotifier, it is fed by gateway middleware so that it sees events
+// in gateway order, and only calls Discord from timers.
+type stageTracker struct {
+	clock clock
+
+	// Set before the gateway opens. Without a poster, stages are tracked
+	// but never summarized.
+	poster  stagePoster
+	enabled func(gid snowflake.ID) bool
+	leading func() bool
+	log     *slog.Logger
+
+	mu       sync.Mutex
+	voice    map[guildMember]discord.VoiceState // Members in a call.
+	stages   map[snowflake.ID]*stage            // Live stages, by channel.
+	stopped  bool
+	inflight sync.WaitGroup
+}
+
+type stage struct {
+	guildID, channelID snowflake.ID
+	topic              string
+	start, end         time.Time
+	speakers           []snowflake.ID // In the order they first spoke.
+	audience           set[snowflake.ID]
+	peakAudience       int
+}
+
+func newStageTracker(c clock) *stageTracker {
+	return &stageTracker{
+		clock:   c,
+		enabled: func(snowflake.ID) bool { return true },
+		leading: func() bool { return true },
+		log:     slog.Default(),
+		voice:   make(map[guildMember]discord.VoiceState),
+		stages:  make(map[snowflake.ID]*stage),
+	}
+}
+
+func (t *stageTracker) middleware() gatewayMiddleware {
+	return func(
+		_ disgobot.Client, next gateway.EventHandlerFunc,
+	) gateway.EventHandlerFunc {
+		return func(
+			et gateway.EventType, seq int, shardID int, e gateway.EventData,
+		) {
+			t.handle(e)
+			next(et, seq, shardID, e)
+		}
+	}
+}
+
+func (t *stageTracker) handle(e gateway.EventData) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch e := e.(type) {
+	case gateway.EventGuildCreate:
+		t.resetLocked(e.ID, e.VoiceStates, e.StageInstances)
+	case gateway.EventGuildDelete:
+		if !e.Unavailable {
+			t.forgetLocked(e.ID)
+		}
+	case gateway.EventStageInstanceCreate:
+		t.startLocked(e.StageInstance)
+	case gateway.EventStageInstanceUpdate:
+		if s := t.stages[e.ChannelID]; s != nil {
+			s.topic = e.Topic
+		}
+	case gateway.EventStageInstanceDelete:
+		if s := t.stages[e.ChannelID]; s != nil {
+			t.endLocked(s)
+		}
+	case gateway.EventVoiceStateUpdate:
+		t.updateLocked(e.VoiceState)
+	}
+}
+
+// resetLocked replaces what is known about gid, as after a reconnect.
+// Stages that ended in the meantime end now.
+func (t *stageTracker) resetLocked(
+	gid snowflake.ID,
+	states []discord.VoiceState, instances []discord.StageInstance,
+) {
+	for k := range t.voice {
+		if k.guildID == gid {
+			delete(t.voice, k)
+		}
+	}
+	for _, vs := range states {
+		vs.GuildID = gid
+		t.voice[guildMember{gid, vs.UserID}] = vs
+	}
+	for _, s := range t.stages {
+		live := slices.ContainsFunc(instances,
+			func(i discord.StageInstance) bool {
+				return i.ChannelID == s.channelID
+			})
+		if s.guildID == gid && !live {
+			t.endLocked(s)
+		}
+	}
+	for _, i := range instances {
+		i.GuildID = gid
+		if s := t.stages[i.ChannelID]; s != nil {
+			s.topic = i.Topic
+			t.recountLocked(s)
+			continue
+		}
+		t.startLocked(i)
+	}
+}
+
+// forgetLocked drops gid without summarizing its stages.
+func (t *stageTracker) forgetLocked(gid snowflake.ID) {
+	for k := range t.voice {
+		if k.guildID == gid {
+			delete(t.voice, k)
+		}
+	}
+	for cid, s := range t.stages {
+		if s.guildID == gid {
+			delete(t.stages, cid)
+		}
+	}
+}
+
+// startLocked starts tracking the stage of i, counting the members already
+// on it.
+func (t *stageTracker) startLocked(i discord.StageInstance) {
+	s := &stage{
+		guildID:   i.GuildID,
+		channelID: i.ChannelID,
+		topic:     i.Topic,
+		start:     i.CreatedAt(),
+		audience:  newSet[snowflake.ID](),
+	}
+	t.stages[i.ChannelID] = s
+	t.recountLocked(s)
+}
+
+// recountLocked counts the members on s from their voice states.
+func (t *stageTracker) recountLocked(s *stage) {
+	s.audience = newSet[snowflake.ID]()
+	for k, vs := range t.voice {
+		if k.guildID == s.guildID && vs.ChannelID != nil &&
+			*vs.ChannelID == s.channelID {
+			s.join(vs)
+		}
+	}
+}
+
+// updateLocked records a new voice state.
+func (t *stageTracker) updateLocked(vs discord.VoiceState) {
+	k := guildMember{vs.GuildID, vs.UserID}
+	if old, ok := t.voice[k]; ok && old.ChannelID != nil {
+		if s := t.stages[*old.ChannelID]; s != nil {
+			delete(s.audience, vs.UserID)
+		}
+	}
+	if vs.ChannelID == nil {
+		delete(t.voice, k)
+		return
+	}
+	t.voice[k] = vs
+	if s := t.stages[*vs.ChannelID]; s != nil {
+		s.join(vs)
+	}
+}
+
+// join counts a member on s as a speaker or in the audience.
+func (s *stage) join(vs discord.VoiceState) {
+	if vs.Suppress {
+		s.audience.Add(vs.UserID)
+		s.peakAudience = max(s.peakAudience, len(s.audience))
+	} else if !slices.Contains(s.speakers, vs.UserID) {
+		s.speakers = append(s.speakers, vs.UserID)
+	}
+}
+
+// endLocked ends s and summarizes it.
+func (t *stageTracker) endLocked(s *stage) {
+	delete(t.stages, s.channelID)
+	s.end = t.clock.Now()
+	if t.poster == nil || !t.enabled(s.guildID) {
+		return
+	}
+	t.clock.AfterFunc(0, func() { t.summarize(s) })
+}
+
+// summarize posts the summary of s.
+func (t *stageTracker) summarize(s *stage) {
+	t.mu.Lock()
+	if t.stopped {
+		t.mu.Unlock()
+		return
+	}
+	t.inflight.Add(1)
+	t.mu.Unlock()
+	defer t.inflight.Done()
+	if !t.leading() {
+		return
+	}
+	if err := t.poster.PostStageSummary(s.channelID, s.summary()); err != nil {
+		t.log.Error("failed to post stage summary",
+			"channel", s.channelID, "error", err)
+	}
+}
+
+// stop drops pending summaries and waits for those being posted.
+func (t *stageTracker) stop() {
+	t.mu.Lock()
+	t.stopped = true
+	t.mu.Unlock()
+	t.inflight.Wait()
+}
+
+// summary describes s once it has ended.
+func (s *stage) summary() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "🎙️ The stage %q ended after %s.",
+		s.topic, formatCallDuration(s.end.Sub(s.start)))
+	if len(s.speakers) > 0 {
+		var mentions []string
+		for _, uid := range s.speakers {
+			mentions = append(mentions, discord.UserMention(uid))
+		}
+		fmt.Fprintf(&b, "\nSpeakers: %s", strings.Join(mentions, ", "))
+	}
+	fmt.Fprintf(&b, "\nLargest audience: %d", s.peakAudience)
+	return b.String()
+}
+
+// discordStagePoster posts the summaries of stages in channels without
+// pinging anyone. Other stages are not summarized.
+type discordStagePoster struct {
+	bot      disgobot.Client
+	channels set[snowflake.ID]
+}
+
+func (p discordStagePoster) PostStageSummary(
+	cid snowflake.ID, summary string,
+) error {
+	if _, ok := p.channels[cid]; !ok {
+		return nil
+	}
+	_, err := p.bot.Rest().CreateMessage(cid, discord.MessageCreate{
+		Content:         summary,
+		AllowedMentions: &discord.AllowedMentions{},
+	})
+	if err != nil {
+		return fmt.Errorf("could not post message: %w", err)
+	}
+	return nil
+}
+
+// The raise-hand queue is shown in a message. Each line after the header is
+// a member waiting to speak.
+const stageQueueHeader = "✋ **Raise your hand to speak.**"
+
+var stageQueueLine = regexp.MustCompile(`^\d+\. <@(\d+)>$`)
+
+// parseStageQueue returns the members waiting in the queue shown by content,
+// first come first.
+func parseStageQueue(content string) []snowflake.ID {
+	var queue []snowflake.ID
+	for line := range strings.Lines(content) {
+		m := stageQueueLine.FindStringSubmatch(strings.TrimSpace(line))
+		if m == nil {
+			continue
+		}
+		if uid, err := snowflake.Parse(m[1]); err == nil {
+			queue = append(queue, uid)
+		}
+	}
+	return queue
+}
+
+// formatStageQueue shows queue in a message.
+func formatStageQueue(queue []snowflake.ID) string {
+	var b strings.Builder
+	b.WriteString(stageQueueHeader)
+	if len(queue) == 0 {
+		b.WriteString("\nNo hands raised.")
+	}
+	for i, uid := range queue {
+		fmt.Fprintf(&b, "\n%d. %s", i+1, discord.UserMention(uid))
+	}
+	return b.String()
+}
+
+// stageQueues holds the raise-hand queues being shown, by the ID of the
+// message showing each. A queue it does not hold yet, as after a restart, is
+// read from its message. Queues are small and only made by moderators, so
+// they are kept until the bot stops.
+type stageQueues struct {
+	mu     sync.Mutex
+	queues map[snowflake.ID]*stageQueue
+}
+
+type stageQueue struct {
+	mu      sync.Mutex // Held from reading the queue to showing it.
+	members []snowflake.ID
+}
+
+func newStageQueues() *stageQueues {
+	return &stageQueues{queues: make(map[snowflake.ID]*stageQueue)}
+}
+
+// update calls fn with the queue shown by msg, and keeps the queue it
+// returns unless it also returns an error. fn should show the queue it
+// returns. Updates to a queue run one at a time, so that members pressing
+// its buttons together are all counted.
+func (q *stageQueues) update(
+	msg discord.Message,
+	fn func(queue []snowflake.ID) ([]snowflake.ID, error),
+) error {
+	q.mu.Lock()
+	sq, ok := q.queues[msg.ID]
+	if !ok {
+		sq = &stageQueue{members: parseStageQueue(msg.Content)}
+		q.queues[msg.ID] = sq
+	}
+	q.mu.Unlock()
+
+	sq.mu.Lock()
+	defer sq.mu.Unlock()
+	members, err := fn(slices.Clone(sq.members))
+	if err != nil {
+		return err
+	}
+	sq.members = members
+	return nil
+}
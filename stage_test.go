@@ -0,0 +1,365 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/disgoorg/disgo/discord"
+	"github.com/disgoorg/disgo/gateway"
+	"github.com/disgoorg/snowflake/v2"
+	"github.com/google/go-cmp/cmp"
+)
+
+type fakeStagePoster struct{ got []string }
+
+func (p *fakeStagePoster) PostStageSummary(
+	cid snowflake.ID, summary string,
+) error {
+	p.got = append(p.got, fmt.Sprintf("%d: %s", cid, summary))
+	return nil
+}
+
+func fakeStages() (*stageTracker, *fakeClock, *fakeStagePoster) {
+	clk := &fakeClock{now: time.Date(2026, 1, 1, 20, 0, 0, 0, time.UTC)}
+	p := new(fakeStagePoster)
+	t := newStageTracker(clk)
+	t.poster = p
+	return t, clk, p
+}
+
+func stageInstance(clk *fakeClock, cid snowflake.ID) discord.StageInstance {
+	return discord.StageInstance{
+		ID:        snowflake.New(clk.now),
+		GuildID:   1,
+		ChannelID: cid,
+		Topic:     "AMA",
+	}
+}
+
+func stageVoice(
+	uid snowflake.ID, cid *snowflake.ID, suppress bool,
+) gateway.EventData {
+	return gateway.EventVoiceStateUpdate{VoiceState: discord.VoiceState{
+		GuildID: 1, UserID: uid, ChannelID: cid, Suppress: suppress,
+	}}
+}
+
+func TestStageTrackerSummary(t *testing.T) {
+	s, clk, p := fakeStages()
+	stage := ptr[snowflake.ID](5)
+
+	s.handle(stageVoice(10, stage, false)) // On stage before it starts.
+	s.handle(gateway.EventStageInstanceCreate{
+		StageInstance: stageInstance(clk, 5),
+	})
+	s.handle(stageVoice(11, stage, true))
+	s.handle(stageVoice(12, stage, true))
+	s.handle(stageVoice(20, ptr[snowflake.ID](6), true)) // Elsewhere.
+	s.handle(stageVoice(12, nil, false))
+	s.handle(stageVoice(11, stage, false)) // Invited to speak.
+	s.handle(stageVoice(13, stage, true))
+	clk.now = clk.now.Add(45 * time.Minute)
+	s.handle(gateway.EventStageInstanceDelete{
+		StageInstance: stageInstance(clk, 5),
+	})
+	fire(clk)
+
+	want := []string{"5: 🎙️ The stage \"AMA\" ended after 45m.\n" +
+		"Speakers: <@10>, <@11>\nLargest audience: 2"}
+	if !cmp.Equal(p.got, want) {
+		t.Errorf("summaries -want +got\n%s", cmp.Diff(want, p.got))
+	}
+}
+
+func TestStageTrackerReconnect(t *testing.T) {
+	s, clk, p := fakeStages()
+	i := stageInstance(clk, 5)
+	var e gateway.EventGuildCreate
+	e.ID = 1
+	e.StageInstances = []discord.StageInstance{i}
+	e.VoiceStates = []discord.VoiceState{
+		{UserID: 10, ChannelID: ptr[snowflake.ID](5)},
+	}
+	s.handle(e)
+
+	// Still live after a reconnect: the stage keeps its start.
+	clk.now = clk.now.Add(time.Hour)
+	s.handle(e)
+	fire(clk)
+	if len(p.got) != 0 {
+		t.Fatalf("summaries while live: %v", p.got)
+	}
+
+	// Ended while disconnected.
+	clk.now = clk.now.Add(12 * time.Minute)
+	e.StageInstances, e.VoiceStates = nil, nil
+	s.handle(e)
+	fire(clk)
+	want := []string{"5: 🎙️ The stage \"AMA\" ended after 1h12m.\n" +
+		"Speakers: <@10>\nLargest audience: 0"}
+	if !cmp.Equal(p.got, want) {
+		t.Errorf("summaries -want +got\n%s", cmp.Diff(want, p.got))
+	}
+}
+
+func TestStageTrackerSkips(t *testing.T) {
+	tests := []struct {
+		desc  string
+		setup func(*stageTracker)
+	}{{
+		desc: "disabled",
+		setup: func(s *stageTracker) {
+			s.enabled = func(snowflake.ID) bool { return false }
+		},
+	}, {
+		desc:  "standby",
+		setup: func(s *stageTracker) { s.leading = func() bool { return false } },
+	}, {
+		desc:  "stopped",
+		setup: func(s *stageTracker) { s.stop() },
+	}, {
+		desc:  "no poster",
+		setup: func(s *stageTracker) { s.poster = nil },
+	}}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			s, clk, p := fakeStages()
+			i := stageInstance(clk, 5)
+			s.handle(gateway.EventStageInstanceCreate{StageInstance: i})
+			tt.setup(s)
+			s.handle(gateway.EventStageInstanceDelete{StageInstance: i})
+			fire(clk)
+			if len(p.got) != 0 {
+				t.Errorf("summaries: %v", p.got)
+			}
+		})
+	}
+}
+
+func TestStageQueue(t *testing.T) {
+	tests := []struct {
+		queue []snowflake.ID
+		want  string
+	}{{
+		want: stageQueueHeader + "\nNo hands raised.",
+	}, {
+		queue: []snowflake.ID{11, 10},
+		want:  stageQueueHeader + "\n1. <@11>\n2. <@10>",
+	}}
+	for _, tt := range tests {
+		got := formatStageQueue(tt.queue)
+		if got != tt.want {
+			t.Errorf("%s(%v) = %q, want %q",
+				funcname(t, formatStageQueue), tt.queue, got, tt.want)
+		}
+		if q := parseStageQueue(got); !cmp.Equal(q, tt.queue) {
+			t.Errorf("%s(%q) = %v, want %v",
+				funcname(t, parseStageQueue), got, q, tt.queue)
+		}
+	}
+}
+
+func TestStageQueuesConcurrent(t *testing.T) {
+	q := newStageQueues()
+	msg := discord.Message{
+		ID:      60,
+		Content: formatStageQueue([]snowflake.ID{1}),
+	}
+	var wg sync.WaitGroup
+	for uid := snowflake.ID(2); uid <= 50; uid++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := q.update(msg,
+				func(queue []snowflake.ID) ([]snowflake.ID, error) {
+					return append(queue, uid), nil
+				})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	var got []snowflake.ID
+	err := q.update(msg, func(queue []snowflake.ID) ([]snowflake.ID, error) {
+		got = queue
+		return nil, errors.New("not shown")
+	})
+	if err == nil {
+		t.Error("update() = nil, want the error of fn")
+	}
+	if len(got) != 50 || got[0] != 1 {
+		t.Errorf("queue after 49 presses = %v, want 1 and all of 2-50", got)
+	}
+	err = q.update(msg, func(queue []snowflake.ID) ([]snowflake.ID, error) {
+		if len(queue) != 50 {
+			t.Errorf("queue after failed update = %v, want it kept", queue)
+		}
+		return queue, nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestInteractionsStageQueue(t *testing.T) {
+	const (
+		slash = `{"id":"1","application_id":"1000","type":2,"token":"t",` +
+			`"version":1,"guild_id":"1","channel_id":"%[1]d",` +
+			`"channel":{"id":"%[1]d","type":%[2]d,"guild_id":"1"},` +
+			`"member":{"user":{"id":"10","username":"mod"},"roles":[],` +
+			`"permissions":"4194304"},` +
+			`"data":{"id":"52","name":"stage","type":1,` +
+			`"options":[{"name":"queue","type":1}]}}`
+		button = `{"id":"2","application_id":"1000","type":3,"token":"t",` +
+			`"version":1,"guild_id":"1","channel_id":"5",` +
+			`"channel":{"id":"5","type":13,"guild_id":"1"},` +
+			`"member":{"user":{"id":"%d","username":"user"},"roles":[],` +
+			`"permissions":"%d"},` +
+			`"message":{"id":"%d","channel_id":"5","content":%q,` +
+			`"timestamp":"2024-01-01T00:00:00Z"},` +
+			`"data":{"custom_id":%q,"component_type":2}}`
+		mod = discord.PermissionMuteMembers
+	)
+	f := newFakeDiscord(t, 1)
+	f.addStageChannel(5, "Stage")
+	f.addMember(11, "alice")
+	f.addMember(12, "bob")
+	f.setVoice(12, ptr[snowflake.ID](5))
+	url, key := testInteractions(t, f,
+		map[string]string{"DISCORD_STAGE_CHANNELS": "5"})
+
+	tests := []struct {
+		desc      string
+		body      string
+		wantType  discord.InteractionResponseType
+		want      string
+		wantVoice bool // Whether bob was invited to speak.
+	}{{
+		desc:     "queue outside a stage",
+		body:     fmt.Sprintf(slash, 3, discord.ChannelTypeGuildText),
+		wantType: discord.InteractionResponseTypeCreateMessage,
+		want:     "This command only works in a stage.",
+	}, {
+		desc:     "queue in another stage",
+		body:     fmt.Sprintf(slash, 6, discord.ChannelTypeGuildStageVoice),
+		wantType: discord.InteractionResponseTypeCreateMessage,
+		want:     "The raise-hand queue is not on in this stage.",
+	}, {
+		desc:     "queue",
+		body:     fmt.Sprintf(slash, 5, discord.ChannelTypeGuildStageVoice),
+		wantType: discord.InteractionResponseTypeCreateMessage,
+		want:     formatStageQueue(nil),
+	}, {
+		desc: "raise hand",
+		body: fmt.Sprintf(button, 12, 0, 60,
+			formatStageQueue([]snowflake.ID{11}), stageHandID),
+		wantType: discord.InteractionResponseTypeUpdateMessage,
+		want:     formatStageQueue([]snowflake.ID{11, 12}),
+	}, {
+		desc: "lower hand",
+		body: fmt.Sprintf(button, 11, 0, 60,
+			formatStageQueue([]snowflake.ID{11, 12}), stageHandID),
+		wantType: discord.InteractionResponseTypeUpdateMessage,
+		want:     formatStageQueue([]snowflake.ID{12}),
+	}, {
+		// The message went out before alice lowered her hand.
+		desc: "raise hand on a stale message",
+		body: fmt.Sprintf(button, 13, 0, 60,
+			formatStageQueue([]snowflake.ID{11}), stageHandID),
+		wantType: discord.InteractionResponseTypeUpdateMessage,
+		want:     formatStageQueue([]snowflake.ID{12, 13}),
+	}, {
+		desc: "invite without permission",
+		body: fmt.Sprintf(button, 11, 0, 60,
+			formatStageQueue([]snowflake.ID{12}), stageNextID),
+		wantType: discord.InteractionResponseTypeCreateMessage,
+		want:     "Only moderators can invite members to speak.",
+	}, {
+		// Alice is not on the stage, so bob is next.
+		desc: "invite next",
+		body: fmt.Sprintf(button, 10, mod, 61,
+			formatStageQueue([]snowflake.ID{11, 12, 13}), stageNextID),
+		wantType:  discord.InteractionResponseTypeUpdateMessage,
+		want:      formatStageQueue([]snowflake.ID{13}),
+		wantVoice: true,
+	}}
+	for _, tt := range tests {
+		status, body := postInteraction(t, url, key, tt.body)
+		if status != http.StatusOK {
+			t.Errorf("%s: status %d: %s", tt.desc, status, body)
+			continue
+		}
+		var resp struct {
+			Type discord.InteractionResponseType `json:"type"`
+			Data struct {
+				Content string `json:"content"`
+			} `json:"data"`
+		}
+		if err := json.Unmarshal([]byte(body), &resp); err != nil {
+			t.Fatalf("%s: %v: %s", tt.desc, err, body)
+		}
+		if resp.Type != tt.wantType {
+			t.Errorf("%s: response type %d, want %d",
+				tt.desc, resp.Type, tt.wantType)
+		}
+		if resp.Data.Content != tt.want {
+			t.Errorf("%s: content %q, want %q",
+				tt.desc, resp.Data.Content, tt.want)
+		}
+		f.mu.Lock()
+		speaking := !f.voiceStates[12].Suppress
+		f.mu.Unlock()
+		if speaking != tt.wantVoice {
+			t.Errorf("%s: bob speaking = %v, want %v",
+				tt.desc, speaking, tt.wantVoice)
+		}
+	}
+}
+
+func TestRunStageRoles(t *testing.T) {
+	const (
+		guildID    snowflake.ID = 1
+		voiceID    snowflake.ID = 2
+		stageID    snowflake.ID = 3
+		speakerID  snowflake.ID = 4
+		audienceID snowflake.ID = 5
+		alice      snowflake.ID = 10
+	)
+	f := newFakeDiscord(t, guildID)
+	f.addStageChannel(stageID, "Stage")
+	f.addRole(voiceID, "voice")
+	f.addRole(speakerID, "speaker")
+	f.addRole(audienceID, "audience")
+	f.addMember(alice, "alice")
+	f.setVoice(alice, ptr(stageID))
+	runFake(t, f)
+
+	want := []roleMutation{
+		{Add: true, GuildID: guildID, UserID: alice, RoleID: voiceID},
+		{Add: true, GuildID: guildID, UserID: alice, RoleID: audienceID},
+	}
+	if got := f.waitMutations(2); !cmp.Equal(got, want) {
+		t.Fatalf("initial sync -want +got\n%s", cmp.Diff(want, got))
+	}
+
+	f.updateVoice(alice, func(vs *discord.VoiceState) bool {
+		vs.Suppress = false
+		return true
+	})
+	got := f.waitMutations(4)[2:]
+	want = []roleMutation{
+		{Add: true, GuildID: guildID, UserID: alice, RoleID: speakerID},
+		{Add: false, GuildID: guildID, UserID: alice, RoleID: audienceID},
+	}
+	if !cmp.Equal(got, want, anyMutationOrder) {
+		t.Fatalf("after invite -want +got\n%s",
+			cmp.Diff(want, got, anyMutationOrder))
+	}
+}
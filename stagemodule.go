@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+
+	disgobot "github.com/disgoorg/disgo/bot"
+	"github.com/disgoorg/disgo/cache"
+	"github.com/disgoorg/disgo/discord"
+	"github.com/disgoorg/disgo/events"
+	"github.com/disgoorg/disgo/gateway"
+	"github.com/disgoorg/disgo/rest"
+	"github.com/disgoorg/json"
+	"github.com/disgoorg/snowflake/v2"
+)
+
+// stageModule summarizes the stages in DISCORD_STAGE_CHANNELS when they end,
+// and offers moderators a raise-hand queue there to invite listeners to
+// speak.
+type stageModule struct {
+	cfg     *config
+	tracker *stageTracker
+	queues  *stageQueues
+}
+
+func newStageModule(cfg *config) module {
+	return &stageModule{
+		cfg:     cfg,
+		tracker: newStageTracker(systemClock{}),
+		queues:  newStageQueues(),
+	}
+}
+
+func (*stageModule) Name() string { return "stage" }
+
+func (*stageModule) Intents() gateway.Intents {
+	return gateway.IntentGuildVoiceStates
+}
+
+func (*stageModule) Caches() cache.Flags { return 0 }
+
+func (m *stageModule) Middleware() gatewayMiddleware {
+	return m.tracker.middleware()
+}
+
+func (m *stageModule) Start(_ context.Context, env moduleEnv) error {
+	if len(m.cfg.stageChannels) == 0 {
+		return nil
+	}
+	m.tracker.poster = discordStagePoster{
+		env.bot, newSet(m.cfg.stageChannels...),
+	}
+	m.tracker.enabled = env.enabled
+	m.tracker.leading = env.leading
+	m.tracker.log = env.log
+	return nil
+}
+
+func (*stageModule) Listeners() []disgobot.EventListener { return nil }
+
+func (m *stageModule) Stop() { m.tracker.stop() }
+
+const (
+	stageHandID = "stage/hand"
+	stageNextID = "stage/next"
+)
+
+func (m *stageModule) Commands() []command {
+	return []command{{
+		create: discord.SlashCommandCreate{
+			Name:        "stage",
+			Description: "Manage stages",
+			DefaultMemberPermissions: json.NewNullablePtr(
+				discord.PermissionMuteMembers,
+			),
+			Contexts: []discord.InteractionContextType{
+				discord.InteractionContextTypeGuild,
+			},
+			Options: []discord.ApplicationCommandOption{
+				discord.ApplicationCommandOptionSubCommand{
+					Name:        "queue",
+					Description: "Post a raise-hand queue in this stage",
+				},
+			},
+		},
+		paths: map[string]commandHandler{
+			"/stage/queue": m.queueCommand,
+		},
+		components: map[string]componentHandler{
+			stageHandID: m.hand,
+			stageNextID: m.next,
+		},
+	}}
+}
+
+// queueCommand posts an empty raise-hand queue in the stage it is run in.
+func (m *stageModule) queueCommand(
+	e *events.ApplicationCommandInteractionCreate,
+) error {
+	ch := e.Channel()
+	if ch.MessageChannel == nil ||
+		ch.Type() != discord.ChannelTypeGuildStageVoice {
+		return e.CreateMessage(discord.MessageCreate{
+			Content: "This command only works in a stage.",
+			Flags:   discord.MessageFlagEphemeral,
+		})
+	}
+	if !slices.Contains(m.cfg.stageChannels, ch.ID()) {
+		return e.CreateMessage(discord.MessageCreate{
+			Content: "The raise-hand queue is not on in this stage.",
+			Flags:   discord.MessageFlagEphemeral,
+		})
+	}
+	return e.CreateMessage(discord.MessageCreate{
+		Content:         formatStageQueue(nil),
+		AllowedMentions: &discord.AllowedMentions{},
+		Components: []discord.ContainerComponent{
+			discord.NewActionRow(
+				discord.NewPrimaryButton("Raise hand", stageHandID).
+					WithEmoji(discord.ComponentEmoji{Name: "✋"}),
+				discord.NewSecondaryButton("Invite next", stageNextID),
+			),
+		},
+	})
+}
+
+// hand adds the member who pressed it to the queue, or takes them out if
+// they are in it.
+func (m *stageModule) hand(e *events.ComponentInteractionCreate) error {
+	uid := e.User().ID
+	return m.queues.update(e.Message,
+		func(queue []snowflake.ID) ([]snowflake.ID, error) {
+			if i := slices.Index(queue, uid); i >= 0 {
+				queue = slices.Delete(queue, i, i+1)
+			} else {
+				queue = append(queue, uid)
+			}
+			return queue, updateStageQueue(e, queue)
+		})
+}
+
+// unknownVoiceState is the JSON error code for a member not in a call.
+const unknownVoiceState rest.JSONErrorCode = 10065
+
+// next invites the first member in the queue to speak. Members who have left
+// the stage since raising their hand are skipped.
+func (m *stageModule) next(e *events.ComponentInteractionCreate) error {
+	member := e.Member()
+	if member == nil ||
+		!member.Permissions.Has(discord.PermissionMuteMembers) {
+		return e.CreateMessage(discord.MessageCreate{
+			Content: "Only moderators can invite members to speak.",
+			Flags:   discord.MessageFlagEphemeral,
+		})
+	}
+	gid, cid := *e.GuildID(), e.Channel().ID()
+	return m.queues.update(e.Message,
+		func(queue []snowflake.ID) ([]snowflake.ID, error) {
+			shown := queue
+			for len(queue) > 0 {
+				uid, suppress := queue[0], false
+				err := e.Client().Rest().UpdateUserVoiceState(gid, uid,
+					discord.UserVoiceStateUpdate{
+						ChannelID: &cid, Suppress: &suppress,
+					},
+				)
+				var restErr rest.Error
+				if err != nil && (!errors.As(err, &restErr) ||
+					restErr.Code != unknownVoiceState) {
+					moduleLogger("stage").Error(
+						"failed to invite member to speak",
+						"user", uid, "error", err)
+					return shown, e.CreateMessage(discord.MessageCreate{
+						Content: "❌ Could not invite " +
+							discord.UserMention(uid) + " to speak.",
+						Flags: discord.MessageFlagEphemeral,
+					})
+				}
+				queue = queue[1:]
+				if err == nil {
+					break
+				}
+			}
+			return queue, updateStageQueue(e, queue)
+		})
+}
+
+func updateStageQueue(
+	e *events.ComponentInteractionCreate, queue []snowflake.ID,
+) error {
+	content := formatStageQueue(queue)
+	return e.UpdateMessage(discord.MessageUpdate{
+		Content:         &content,
+		AllowedMentions: &discord.AllowedMentions{},
+	})
+}
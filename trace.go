@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/disgoorg/snowflake/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// tracerName names the tracer spans are made with.
+const tracerName = "labs.lesiw.io/discord"
+
+// Span attributes.
+const (
+	traceGuild       = attribute.Key("discord.guild_id")
+	traceUser        = attribute.Key("discord.user_id")
+	traceRole        = attribute.Key("discord.role")
+	traceTrigger     = attribute.Key("discord.trigger")
+	traceMembers     = attribute.Key("discord.members")
+	traceRoleMembers = attribute.Key("discord.role_members")
+	traceCallMembers = attribute.Key("discord.call_members")
+)
+
+func traceID(k attribute.Key, id snowflake.ID) attribute.KeyValue {
+	return k.String(id.String())
+}
+
+// newTracerProvider returns the provider spans are exported with, and a
+// function that flushes and stops it. Spans are dropped unless tc sets an
+// endpoint or an exporter.
+func newTracerProvider(
+	ctx context.Context, tc traceConfig,
+) (trace.TracerProvider, func(context.Context) error, error) {
+	exp, batch := tc.exporter, false
+	if exp == nil && tc.endpoint == "" {
+		return noop.NewTracerProvider(),
+			func(context.Context) error { return nil }, nil
+	}
+	if exp == nil {
+		var err error
+		exp, err = otlptracehttp.New(ctx,
+			otlptracehttp.WithEndpointURL(tc.endpoint))
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not set up trace exporter: %w",
+				err)
+		}
+		batch = true
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		attribute.String("service.name", "discord"),
+	))
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not describe traces: %w", err)
+	}
+	opts := []sdktrace.TracerProviderOption{sdktrace.WithResource(res)}
+	if batch {
+		opts = append(opts, sdktrace.WithBatcher(exp))
+	} else {
+		// Exporters set in config are for tests, which want spans as they
+		// end.
+		opts = append(opts, sdktrace.WithSyncer(exp))
+	}
+	tp := sdktrace.NewTracerProvider(opts...)
+	return tp, tp.Shutdown, nil
+}
+
+// startSpan starts a span in ctx, with the tracer of the span ctx is in.
+// Outside spans, or without a tracer provider, the span records nothing.
+func startSpan(
+	ctx context.Context, name string, attrs ...attribute.KeyValue,
+) (context.Context, trace.Span) {
+	return trace.SpanFromContext(ctx).TracerProvider().Tracer(tracerName).
+		Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan ends span, recording err if it is not nil.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/disgoorg/snowflake/v2"
+	"github.com/google/go-cmp/cmp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// waitSpan waits until exp holds a span that match accepts, and returns it
+// with every span exported so far.
+func waitSpan(
+	t *testing.T, exp *tracetest.InMemoryExporter,
+	match func(tracetest.SpanStub) bool,
+) (tracetest.SpanStub, tracetest.SpanStubs) {
+	t.Helper()
+	timeout := time.After(10 * time.Second)
+	for {
+		spans := exp.GetSpans()
+		if i := slices.IndexFunc(spans, match); i >= 0 {
+			return spans[i], spans
+		}
+		select {
+		case <-time.After(10 * time.Millisecond):
+		case <-timeout:
+			t.Fatalf("timed out waiting for span, got %d spans", len(spans))
+		}
+	}
+}
+
+func hasAttr(s tracetest.SpanStub, kv attribute.KeyValue) bool {
+	return slices.Contains(s.Attributes, kv)
+}
+
+func TestRunTraces(t *testing.T) {
+	const (
+		guildID   snowflake.ID = 1
+		roleID    snowflake.ID = 2
+		channelID snowflake.ID = 3
+		alice     snowflake.ID = 10
+	)
+	exp := tracetest.NewInMemoryExporter()
+	f := newFakeDiscord(t, guildID)
+	f.addVoiceChannel(channelID, "General")
+	f.addRole(roleID, "voice")
+	f.addMember(alice, "alice")
+	runFakeConfig(t, f, &config{
+		token:  fakeToken,
+		leader: leaderConfig{ttl: 15 * time.Second},
+		trace:  traceConfig{exporter: exp},
+	})
+	f.waitIdentified()
+	// Let the first sync finish, so that the join starts a sync of its own.
+	waitSpan(t, exp, func(s tracetest.SpanStub) bool {
+		return s.Name == "sync voice roles" &&
+			hasAttr(s, traceTrigger.String(triggerStart))
+	})
+	f.setVoice(alice, ptr(channelID))
+
+	sync, spans := waitSpan(t, exp, func(s tracetest.SpanStub) bool {
+		return s.Name == "sync voice roles" &&
+			hasAttr(s, traceTrigger.String(triggerEvent))
+	})
+	byID := make(map[string]tracetest.SpanStub)
+	for _, s := range spans {
+		byID[s.SpanContext.SpanID().String()] = s
+	}
+	i := slices.IndexFunc(spans, func(s tracetest.SpanStub) bool {
+		return s.Name == "AddMemberRole" &&
+			s.SpanContext.TraceID() == sync.SpanContext.TraceID()
+	})
+	if i < 0 {
+		t.Fatalf("no AddMemberRole span in the trace of the sync")
+	}
+	add := spans[i]
+	for _, kv := range []attribute.KeyValue{
+		traceID(traceGuild, guildID),
+		traceID(traceUser, alice),
+		traceRole.String(voiceRole),
+	} {
+		if !hasAttr(add, kv) {
+			t.Errorf("AddMemberRole span has no %s=%s", kv.Key, kv.Value.Emit())
+		}
+	}
+
+	var names []string
+	for s, ok := add, true; ok; s, ok = byID[s.Parent.SpanID().String()] {
+		names = append(names, s.Name)
+	}
+	want := []string{
+		"AddMemberRole", "sync role", "sync voice roles",
+		"gateway GuildVoiceJoin",
+	}
+	if !cmp.Equal(names, want) {
+		t.Errorf("span ancestry -want +got\n%s", cmp.Diff(want, names))
+	}
+}
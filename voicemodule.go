@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	disgobot "github.com/disgoorg/disgo/bot"
+	"github.com/disgoorg/disgo/cache"
+	"github.com/disgoorg/disgo/discord"
+	"github.com/disgoorg/disgo/events"
+	"github.com/disgoorg/disgo/gateway"
+	"github.com/disgoorg/json"
+	"github.com/disgoorg/snowflake/v2"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// voiceModule gives the voice role to members in a call, the live and camera
+// roles to those streaming and on camera, and the speaker and audience roles
+// to those on a stage. These are the callRoles.
+type voiceModule struct {
+	cfg   *config
+	index *roleIndex
+
+	// Set by Start.
+	workers *guildWorkers
+	grace   *voiceGrace
+	enabled func(gid snowflake.ID) bool
+	tracer  trace.Tracer
+	audit   *auditTrail // Nil without DISCORD_AUDIT_FILE.
+}
+
+func newVoiceModule(cfg *config) module {
+	return &voiceModule{
+		cfg:   cfg,
+		index: newRoleIndex(systemClock{}, cfg.roleIndexMaxAge),
+	}
+}
+
+func (*voiceModule) Name() string { return "voice" }
+
+func (*voiceModule) Intents() gateway.Intents {
+	return gateway.IntentGuildMembers | gateway.IntentGuildVoiceStates
+}
+
+func (*voiceModule) Caches() cache.Flags {
+	return cache.FlagChannels |
+		cache.FlagMembers |
+		cache.FlagVoiceStates |
+		cache.FlagRoles
+}
+
+func (m *voiceModule) Middleware() gatewayMiddleware {
+	return m.index.middleware()
+}
+
+func (*voiceModule) Degraded(missing gateway.Intents) string {
+	if missing.Has(gateway.IntentGuildMembers) {
+		return "voice roles are only taken from members seen in a call"
+	}
+	return ""
+}
+
+func (m *voiceModule) Start(ctx context.Context, env moduleEnv) error {
+	backend := discordBackend{env.bot}
+	m.index.request = backend.RequestMembers
+	voice := voiceSync{
+		roles:   backend,
+		mutator: backend,
+		holders: m.index,
+		members: backend,
+		clock:   systemClock{},
+	}
+	if m.cfg.auditFile != "" {
+		var err error
+		m.audit, err = newAuditTrail(systemClock{},
+			m.cfg.auditFile, m.cfg.auditRetention)
+		if err != nil {
+			return err
+		}
+		voice.audit = m.audit
+	}
+	if env.missing.Has(gateway.IntentGuildMembers) {
+		// Members can't be requested, and Discord only sends the ones in a
+		// call, so the cache is all there is.
+		voice.holders = backend
+		voice.mutator = cacheMutator{backend}
+	}
+	// Set below, before any worker runs.
+	var syncs callSyncs
+	m.workers = newGuildWorkers(ctx,
+		func(
+			ctx context.Context, gid snowflake.ID, members set[snowflake.ID],
+			trigger string,
+		) {
+			if !env.leading() {
+				return
+			}
+			run := newSyncRun(env.log, gid, trigger)
+			ctx, span := env.tracer.Start(ctx, "sync voice roles",
+				trace.WithAttributes(
+					traceID(traceGuild, gid),
+					traceTrigger.String(trigger),
+					traceMembers.Int(len(members)),
+				),
+			)
+			if members == nil {
+				err := syncs.syncGuild(ctx, run, gid)
+				if err != nil {
+					run.log.Error("failed to sync voice roles", "error", err)
+					m.index.invalidate(gid)
+				}
+				endSpan(span, err)
+				return
+			}
+			var failed error
+			for uid := range members {
+				if err := syncs.syncMember(ctx, run, gid, uid); err != nil {
+					run.log.Error("failed to sync member voice role",
+						"user", uid, "error", err)
+					failed = err
+				}
+			}
+			endSpan(span, failed)
+		},
+	)
+	m.grace = newVoiceGrace(systemClock{},
+		m.cfg.voiceLeaveGrace, m.cfg.voiceMinInCall,
+		func(gid snowflake.ID) { m.workers.triggerFor(gid, triggerGrace) })
+	voice.grace = m.grace
+	syncs = newCallSyncs(voice)
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				m.workers.triggerAll(triggerTicker)
+			}
+		}
+	}()
+	m.enabled, m.tracer = env.enabled, env.tracer
+	return nil
+}
+
+func (m *voiceModule) Listeners() []disgobot.EventListener {
+	return voiceListeners(m.tracer,
+		enabledScheduler{m.workers, m.enabled}, m.grace)
+}
+
+func (m *voiceModule) Lead() { m.workers.triggerAll(triggerLeader) }
+
+func (m *voiceModule) GuildResumed(shardID int, gid snowflake.ID) {
+	m.workers.start(shardID, gid)
+}
+
+func (m *voiceModule) Stop() {
+	m.workers.wait()
+	m.audit.close()
+}
+
+// enabledScheduler only starts syncing guilds where the module is enabled.
+// Triggers for other guilds are no-ops, as they have no worker.
+type enabledScheduler struct {
+	syncScheduler
+	enabled func(gid snowflake.ID) bool
+}
+
+func (s enabledScheduler) start(shardID int, gid snowflake.ID) {
+	if s.enabled(gid) {
+		s.syncScheduler.start(shardID, gid)
+	}
+}
+
+const voiceCheckID = "voice/check"
+
+func (m *voiceModule) Commands() []command {
+	return []command{{
+		create: discord.SlashCommandCreate{
+			Name:        "voice",
+			Description: "Manage the voice role",
+			DefaultMemberPermissions: json.NewNullablePtr(
+				discord.PermissionManageRoles,
+			),
+			Contexts: []discord.InteractionContextType{
+				discord.InteractionContextTypeGuild,
+			},
+			Options: []discord.ApplicationCommandOption{
+				discord.ApplicationCommandOptionSubCommand{
+					Name:        "check",
+					Description: "Check that the bot can assign the voice role",
+				},
+				discord.ApplicationCommandOptionSubCommand{
+					Name:        "why",
+					Description: "Show the bot's changes to a member's role",
+					Options: []discord.ApplicationCommandOption{
+						discord.ApplicationCommandOptionUser{
+							Name:        "user",
+							Description: "The member",
+							Required:    true,
+						},
+						discord.ApplicationCommandOptionRole{
+							Name:        "role",
+							Description: "The role",
+							Required:    true,
+						},
+					},
+				},
+			},
+		},
+		paths: map[string]commandHandler{
+			"/voice/check": voiceCheckCommand,
+			"/voice/why":   m.whyCommand,
+		},
+		components: map[string]componentHandler{
+			voiceCheckID: voiceCheckAgain,
+		},
+	}}
+}
+
+func voiceCheckCommand(e *events.ApplicationCommandInteractionCreate) error {
+	return e.CreateMessage(discord.MessageCreate{
+		Content: voiceCheck(e.Client(), e.ApplicationCommandInteraction),
+		Components: []discord.ContainerComponent{
+			discord.NewActionRow(
+				discord.NewSecondaryButton("Check again", voiceCheckID),
+			),
+		},
+		Flags: discord.MessageFlagEphemeral,
+	})
+}
+
+func voiceCheckAgain(e *events.ComponentInteractionCreate) error {
+	content := voiceCheck(e.Client(), e.ComponentInteraction)
+	return e.UpdateMessage(discord.MessageUpdate{Content: &content})
+}
+
+// voiceCheck reports whether the bot can assign the voice role in the guild
+// of i.
+func voiceCheck(bot disgobot.Client, i discord.Interaction) string {
+	gid, perms := i.GuildID(), i.AppPermissions()
+	if gid == nil || perms == nil {
+		return "This command only works in a server."
+	}
+	detail, err := checkGuild(bot, *gid, *perms)
+	if err != nil {
+		return "❌ Voice roles are not working: " + err.Error() + "."
+	}
+	return "✅ Voice roles are working: the bot " + detail + "."
+}
+
+// voiceWhyLimit is the most role changes /voice why shows.
+const voiceWhyLimit = 5
+
+// whyCommand shows whether a member holds a role and the last changes the
+// bot made to it, from the audit trail. It reads the file rather than m.audit
+// so that it also works from discord interactions. Each run scans the whole
+// file, keeping only the latest matching entries; that is as much as the bot
+// changed roles in DISCORD_AUDIT_RETENTION, at most maxAuditRetention.
+func (m *voiceModule) whyCommand(
+	e *events.ApplicationCommandInteractionCreate,
+) error {
+	content, err := m.why(e)
+	if err != nil {
+		moduleLogger("voice").Error("failed to read audit trail",
+			"error", err)
+		content = "Could not read the audit trail."
+	}
+	return e.CreateMessage(discord.MessageCreate{
+		Content:         content,
+		AllowedMentions: &discord.AllowedMentions{},
+		Flags:           discord.MessageFlagEphemeral,
+	})
+}
+
+func (m *voiceModule) why(
+	e *events.ApplicationCommandInteractionCreate,
+) (string, error) {
+	gid := e.GuildID()
+	if gid == nil {
+		return "This command only works in a server.", nil
+	}
+	if m.cfg.auditFile == "" {
+		return "The bot keeps no audit trail. " +
+			"Set DISCORD_AUDIT_FILE to keep one.", nil
+	}
+	d := e.SlashCommandInteractionData()
+	uid, role := d.User("user").ID, d.Role("role")
+	var entries []auditEntry
+	err := scanAudit(m.cfg.auditFile, func(e auditEntry) {
+		if e.GuildID != *gid || e.UserID != uid || e.RoleID != role.ID {
+			return
+		}
+		if len(entries) == voiceWhyLimit {
+			entries = slices.Delete(entries, 0, 1)
+		}
+		entries = append(entries, e)
+	})
+	if err != nil {
+		return "", err
+	}
+	member, ok := d.OptMember("user")
+	return formatWhy(uid, role.ID,
+		ok && slices.Contains(member.RoleIDs, role.ID), entries), nil
+}
+
+// formatWhy describes whether uid has rid and the latest of the changes the
+// bot made to it, given oldest first.
+func formatWhy(
+	uid, rid snowflake.ID, has bool, entries []auditEntry,
+) string {
+	var b strings.Builder
+	verb := "has"
+	if !has {
+		verb = "does not have"
+	}
+	fmt.Fprintf(&b, "<@%s> %s <@&%s>.", uid, verb, rid)
+	if len(entries) == 0 {
+		b.WriteString(" The bot has no changes to it on record.")
+		return b.String()
+	}
+	b.WriteString(" Latest changes by the bot:")
+	for i := len(entries) - 1; i >= max(0, len(entries)-voiceWhyLimit); i-- {
+		e := entries[i]
+		action := "removed"
+		if e.Add {
+			action = "added"
+		}
+		why := e.Trigger + " sync"
+		if e.Trigger == triggerCommand {
+			why = "their own command"
+		}
+		fmt.Fprintf(&b, "\n- <t:%d:R> %s (%s)", e.Time.Unix(), action, why)
+		if e.Error != "" {
+			fmt.Fprintf(&b, ", failed: %s", e.Error)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/disgoorg/disgo/discord"
+	"github.com/disgoorg/snowflake/v2"
+)
+
+// roleFinder looks up guild roles.
+type roleFinder interface {
+	FindRole(gid snowflake.ID, name string) (discord.Role, error)
+}
+
+// roleLister lists guild roles. The roles of a roleFinder that is also a
+// roleLister are listed once per syncRun, rather than once per call role.
+type roleLister interface {
+	GuildRoles(gid snowflake.ID) ([]discord.Role, error)
+}
+
+// roleNamed returns the role called name from roles.
+func roleNamed(roles []discord.Role, name string) (discord.Role, error) {
+	for _, r := range roles {
+		if r.Name == name {
+			return r, nil
+		}
+	}
+	return discord.Role{}, fmt.Errorf("%w %q", errNoRole, name)
+}
+
+// roleMutator grants and revokes member roles.
+type roleMutator interface {
+	SetMemberRole(
+		ctx context.Context, gid, uid, rid snowflake.ID, enable bool,
+	) error
+}
+
+// roleHolders lists the members of a guild holding a role.
+type roleHolders interface {
+	RoleMembers(
+		ctx context.Context, gid snowflake.ID, role discord.Role,
+	) (set[snowflake.ID], error)
+}
+
+// A callState is the voice state of a member in a call.
+type callState struct {
+	discord.VoiceState
+	stage bool // Whether the call is on a stage.
+}
+
+// memberSource reports the voice state of guild members. A nil match matches
+// every member in a call.
+type memberSource interface {
+	// CallMembers returns the members of gid connected to a voice channel
+	// whose call state matches.
+	CallMembers(
+		gid snowflake.ID, match func(callState) bool,
+	) set[snowflake.ID]
+	// MemberVoiceState reports whether a member is in a call with a state
+	// that matches and whether they hold role. ok is false if the member is
+	// unknown.
+	MemberVoiceState(
+		gid, uid snowflake.ID, match func(callState) bool, role discord.Role,
+	) (inCall, hasRole, ok bool)
+	// MemberName returns a display name for logging.
+	MemberName(gid, uid snowflake.ID) string
+}
+
+// voiceRole is the name of the role given to members in a call.
+const voiceRole = "voice"
+
+// errNoRole is returned by a roleFinder for a role the guild does not have.
+var errNoRole = errors.New("could not find role")
+
+// A callRole is a role given to the members in a call whose voice state
+// matches, and taken from everyone else.
+type callRole struct {
+	name  string
+	match func(callState) bool // Nil matches every member in a call.
+	// optional roles are left alone in guilds that don't have them.
+	optional bool
+	// graced roles wait out the voiceGrace periods, which follow joins and
+	// leaves rather than voice state flags.
+	graced bool
+}
+
+var voiceCallRole = callRole{name: voiceRole, graced: true}
+
+// callRoles are the roles synced from voice states: the voice role, roles
+// for members streaming their screen and with their camera on, and roles
+// for the speakers and audience of stages. Discord suppresses the audience.
+var callRoles = []callRole{voiceCallRole, {
+	name:     "live",
+	match:    func(cs callState) bool { return cs.SelfStream },
+	optional: true,
+}, {
+	name:     "camera",
+	match:    func(cs callState) bool { return cs.SelfVideo },
+	optional: true,
+}, {
+	name:     "speaker",
+	match:    func(cs callState) bool { return cs.stage && !cs.Suppress },
+	optional: true,
+}, {
+	name:     "audience",
+	match:    func(cs callState) bool { return cs.stage && cs.Suppress },
+	optional: true,
+}}
+
+// callRoleNames returns the names of callRoles.
+func callRoleNames() []string {
+	var names []string
+	for _, r := range callRoles {
+		names = append(names, r.name)
+	}
+	return names
+}
+
+// voiceSync gives role to the members in a call whose voice state matches
+// and takes it from everyone else. Every field except grace and audit is
+// required.
+type voiceSync struct {
+	role    callRole
+	roles   roleFinder
+	mutator roleMutator
+	holders roleHolders
+	members memberSource
+	clock   clock
+	grace   *voiceGrace
+	audit   *auditTrail
+}
+
+// syncGuild reconciles the role of every member of gid in run.
+func (s *voiceSync) syncGuild(
+	ctx context.Context, run *syncRun, gid snowflake.ID,
+) (err error) {
+	ctx, span := startSpan(ctx, "sync role", traceRole.String(s.role.name))
+	defer func() { endSpan(span, err) }()
+	start := s.clock.Now()
+	role, ok, err := s.findRole(run, gid)
+	if !ok {
+		return err
+	}
+	roleMembers, err := s.holders.RoleMembers(ctx, gid, role)
+	if err != nil {
+		return err
+	}
+	run.log.Info("got role members",
+		"members", s.memberList(gid, roleMembers))
+	callMembers := s.members.CallMembers(gid, s.role.match)
+	run.log.Info("got call members",
+		"members", s.memberList(gid, callMembers))
+	span.SetAttributes(
+		traceRoleMembers.Int(len(roleMembers)),
+		traceCallMembers.Int(len(callMembers)),
+	)
+	grace := s.roleGrace()
+	for uid := range roleMembers.Diff(callMembers) {
+		// Members that are not in the call, but have a role.
+		if !grace.canRemove(gid, uid) {
+			run.log.Info("deferring role removal", "user", uid)
+			continue
+		}
+		if err := s.setRole(ctx, run, gid, uid, role, false); err != nil {
+			return fmt.Errorf("could not remove role: %w", err)
+		}
+	}
+	for uid := range callMembers.Diff(roleMembers) {
+		// Members that are in the call, but have no role.
+		if !grace.canAdd(gid, uid) {
+			run.log.Info("deferring role grant", "user", uid)
+			continue
+		}
+		if err := s.setRole(ctx, run, gid, uid, role, true); err != nil {
+			return fmt.Errorf("could not add role: %w", err)
+		}
+	}
+	run.log.Info("synced voice roles", "role", role.Name,
+		"took", s.clock.Now().Sub(start))
+	return nil
+}
+
+// syncMember reconciles the role of a single member in run.
+func (s *voiceSync) syncMember(
+	ctx context.Context, run *syncRun, gid, uid snowflake.ID,
+) error {
+	role, ok, err := s.findRole(run, gid)
+	if !ok {
+		return err
+	}
+	grace := s.roleGrace()
+	inCall, hasRole, ok := s.members.MemberVoiceState(
+		gid, uid, s.role.match, role,
+	)
+	switch {
+	case !ok:
+		return nil
+	case inCall && !hasRole && grace.canAdd(gid, uid):
+		if err := s.setRole(ctx, run, gid, uid, role, true); err != nil {
+			return fmt.Errorf("could not add role: %w", err)
+		}
+	case !inCall && hasRole && grace.canRemove(gid, uid):
+		if err := s.setRole(ctx, run, gid, uid, role, false); err != nil {
+			return fmt.Errorf("could not remove role: %w", err)
+		}
+	}
+	return nil
+}
+
+// findRole gets the role of s in gid. ok is false if there is nothing to
+// sync, either because of err or because an optional role is missing.
+func (s *voiceSync) findRole(
+	run *syncRun, gid snowflake.ID,
+) (role discord.Role, ok bool, err error) {
+	role, err = run.findRole(s.roles, gid, s.role.name)
+	if s.role.optional && errors.Is(err, errNoRole) {
+		return role, false, nil
+	}
+	if err != nil {
+		return role, false,
+			fmt.Errorf("could not get %s role: %w", s.role.name, err)
+	}
+	return role, true, nil
+}
+
+// roleGrace returns the grace periods that apply to the role of s.
+func (s *voiceSync) roleGrace() *voiceGrace {
+	if !s.role.graced {
+		return nil
+	}
+	return s.grace
+}
+
+func (s *voiceSync) setRole(
+	ctx context.Context, run *syncRun,
+	gid, uid snowflake.ID, role discord.Role, enable bool,
+) (err error) {
+	name := "RemoveMemberRole"
+	if enable {
+		name = "AddMemberRole"
+	}
+	ctx, span := startSpan(ctx, name, traceID(traceGuild, gid),
+		traceID(traceUser, uid), traceRole.String(role.Name))
+	defer func() { endSpan(span, err) }()
+	err = s.mutator.SetMemberRole(ctx, gid, uid, role.ID, enable)
+	entry := auditEntry{
+		GuildID: gid,
+		UserID:  uid,
+		RoleID:  role.ID,
+		Role:    role.Name,
+		Add:     enable,
+		Trigger: run.trigger,
+		Run:     run.id,
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	s.audit.record(entry)
+	if err != nil {
+		return fmt.Errorf("failed to toggle role %q (enable=%t): %w",
+			role.Name, enable, err)
+	}
+	run.log.Info("role toggle",
+		"role", role.Name,
+		"user", s.members.MemberName(gid, uid),
+		"enable", enable,
+	)
+	return nil
+}
+
+func (s *voiceSync) memberList(gid snowflake.ID, m set[snowflake.ID]) string {
+	var names []string
+	for uid := range m {
+		names = append(names, s.members.MemberName(gid, uid))
+	}
+	if len(names) == 0 {
+		return "<none>"
+	}
+	return strings.Join(names, ", ")
+}
+
+// callSyncs syncs each of callRoles in turn.
+type callSyncs []*voiceSync
+
+// newCallSyncs returns a voiceSync like s for each of callRoles.
+func newCallSyncs(s voiceSync) callSyncs {
+	var syncs callSyncs
+	for _, r := range callRoles {
+		rs := s
+		rs.role = r
+		syncs = append(syncs, &rs)
+	}
+	return syncs
+}
+
+// syncGuild reconciles the roles of every member of gid, stopping at the
+// first error.
+func (c callSyncs) syncGuild(
+	ctx context.Context, run *syncRun, gid snowflake.ID,
+) error {
+	for _, s := range c {
+		if err := s.syncGuild(ctx, run, gid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncMember reconciles the roles of a single member, stopping at the first
+// error.
+func (c callSyncs) syncMember(
+	ctx context.Context, run *syncRun, gid, uid snowflake.ID,
+) error {
+	for _, s := range c {
+		if err := s.syncMember(ctx, run, gid, uid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
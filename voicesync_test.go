@@ -0,0 +1,532 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/disgoorg/disgo/discord"
+	"github.com/disgoorg/snowflake/v2"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+// testRun is the run of syncs in tests.
+var testRun = newSyncRun(slog.Default(), 0, triggerManual)
+
+// fakeVoice is a guild whose members hold the voice role if they are in
+// roleMembers and are in a call if they are in callMembers. Members in
+// neither set are unknown.
+type fakeVoice struct {
+	findRoleErr error
+	toggleErr   error
+	roleMembers set[snowflake.ID]
+	callMembers set[snowflake.ID]
+
+	mu        sync.Mutex
+	toggleOn  set[snowflake.ID]
+	toggleOff set[snowflake.ID]
+}
+
+func newFakeVoice(roleMembers, callMembers set[snowflake.ID]) *fakeVoice {
+	return &fakeVoice{
+		roleMembers: roleMembers,
+		callMembers: callMembers,
+		toggleOn:    newSet[snowflake.ID](),
+		toggleOff:   newSet[snowflake.ID](),
+	}
+}
+
+// voiceSync returns a voiceSync served entirely by f.
+func (f *fakeVoice) voiceSync(grace *voiceGrace) *voiceSync {
+	return &voiceSync{
+		role:    voiceCallRole,
+		roles:   f,
+		mutator: f,
+		holders: f,
+		members: f,
+		clock:   new(fakeClock),
+		grace:   grace,
+	}
+}
+
+func (f *fakeVoice) FindRole(
+	_ snowflake.ID, name string,
+) (discord.Role, error) {
+	return discord.Role{ID: 1, Name: name}, f.findRoleErr
+}
+
+func (f *fakeVoice) SetMemberRole(
+	_ context.Context, _, uid, _ snowflake.ID, enable bool,
+) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if enable {
+		f.toggleOn.Add(uid)
+	} else {
+		f.toggleOff.Add(uid)
+	}
+	return f.toggleErr
+}
+
+func (f *fakeVoice) RoleMembers(
+	context.Context, snowflake.ID, discord.Role,
+) (set[snowflake.ID], error) {
+	return f.roleMembers, nil
+}
+
+func (f *fakeVoice) CallMembers(
+	snowflake.ID, func(callState) bool,
+) set[snowflake.ID] {
+	return f.callMembers
+}
+
+func (f *fakeVoice) MemberVoiceState(
+	_, uid snowflake.ID, _ func(callState) bool, _ discord.Role,
+) (inCall, hasRole, ok bool) {
+	_, inCall = f.callMembers[uid]
+	_, hasRole = f.roleMembers[uid]
+	return inCall, hasRole, inCall || hasRole
+}
+
+func (f *fakeVoice) MemberName(_, uid snowflake.ID) string {
+	return uid.String()
+}
+
+type syncGuildTest struct {
+	desc        string
+	role        callRole // The voice role if unset.
+	findRoleErr error
+	roleMembers set[snowflake.ID]
+	callMembers set[snowflake.ID]
+	toggleOn    set[snowflake.ID]
+	toggleOff   set[snowflake.ID]
+	toggleErr   error
+	grace       func() *voiceGrace
+	wantErr     error
+}
+
+var syncGuildTests = []syncGuildTest{{
+	desc: "no members",
+}, {
+	desc:        "all members have roles",
+	roleMembers: newSet[snowflake.ID](1, 2, 3),
+	callMembers: newSet[snowflake.ID](1, 2, 3),
+	toggleOn:    newSet[snowflake.ID](),
+	toggleOff:   newSet[snowflake.ID](),
+}, {
+	desc:        "one member missing role",
+	roleMembers: newSet[snowflake.ID](1, 3),
+	callMembers: newSet[snowflake.ID](1, 2, 3),
+	toggleOn:    newSet[snowflake.ID](2),
+	toggleOff:   newSet[snowflake.ID](),
+}, {
+	desc:        "one role too many",
+	roleMembers: newSet[snowflake.ID](1, 2, 3),
+	callMembers: newSet[snowflake.ID](1, 2),
+	toggleOn:    newSet[snowflake.ID](),
+	toggleOff:   newSet[snowflake.ID](3),
+}, {
+	desc:        "mixed state",
+	roleMembers: newSet[snowflake.ID](1, 3),
+	callMembers: newSet[snowflake.ID](1, 2, 4),
+	toggleOn:    newSet[snowflake.ID](2, 4),
+	toggleOff:   newSet[snowflake.ID](3),
+}, {
+	desc:        "leave within grace period",
+	roleMembers: newSet[snowflake.ID](1, 2, 3),
+	callMembers: newSet[snowflake.ID](1),
+	grace: func() *voiceGrace {
+		return pendingGrace(nil, []snowflake.ID{3})
+	},
+	toggleOn:  newSet[snowflake.ID](),
+	toggleOff: newSet[snowflake.ID](2),
+}, {
+	desc:        "join before minimum time in call",
+	roleMembers: newSet[snowflake.ID](1),
+	callMembers: newSet[snowflake.ID](1, 2, 3),
+	grace: func() *voiceGrace {
+		return pendingGrace([]snowflake.ID{2}, nil)
+	},
+	toggleOn:  newSet[snowflake.ID](3),
+	toggleOff: newSet[snowflake.ID](),
+}, {
+	desc:        "role lookup error",
+	findRoleErr: errors.New("boom"),
+	callMembers: newSet[snowflake.ID](1),
+	wantErr:     errors.New("could not get voice role: boom"),
+}, {
+	desc:        "optional role missing",
+	role:        callRoles[1],
+	findRoleErr: fmt.Errorf("%w %q", errNoRole, "live"),
+	roleMembers: newSet[snowflake.ID](2),
+	callMembers: newSet[snowflake.ID](1),
+}, {
+	desc:        "optional role lookup error",
+	role:        callRoles[1],
+	findRoleErr: errors.New("boom"),
+	callMembers: newSet[snowflake.ID](1),
+	wantErr:     errors.New("could not get live role: boom"),
+}, {
+	desc:        "role without grace period",
+	role:        callRoles[1],
+	roleMembers: newSet[snowflake.ID](1, 2),
+	callMembers: newSet[snowflake.ID](1, 3),
+	grace: func() *voiceGrace {
+		return pendingGrace([]snowflake.ID{3}, []snowflake.ID{2})
+	},
+	toggleOn:  newSet[snowflake.ID](3),
+	toggleOff: newSet[snowflake.ID](2),
+}, {
+	desc:        "toggle error",
+	callMembers: newSet[snowflake.ID](1),
+	toggleOn:    newSet[snowflake.ID](1),
+	toggleErr:   errors.New("boom"),
+	wantErr: errors.New(
+		`could not add role: failed to toggle role "voice" ` +
+			"(enable=true): boom"),
+}}
+
+func TestVoiceSyncGuild(t *testing.T) {
+	opts := []cmp.Option{
+		cmpopts.SortMaps(func(x, y snowflake.ID) bool { return x < y }),
+		cmpopts.EquateEmpty(),
+	}
+	for _, tt := range syncGuildTests {
+		t.Run(tt.desc, func(t *testing.T) {
+			t.Parallel()
+			f := newFakeVoice(tt.roleMembers, tt.callMembers)
+			f.findRoleErr, f.toggleErr = tt.findRoleErr, tt.toggleErr
+			var grace *voiceGrace
+			if tt.grace != nil {
+				grace = tt.grace()
+			}
+
+			s := f.voiceSync(grace)
+			if tt.role.name != "" {
+				s.role = tt.role
+			}
+
+			err := s.syncGuild(t.Context(), testRun, 0)
+
+			gotErr := fmt.Sprintf("%v", err)
+			wantErr := fmt.Sprintf("%v", tt.wantErr)
+			if gotErr != wantErr {
+				t.Errorf("%s(): %v, want %v",
+					funcname(t, (*voiceSync).syncGuild), gotErr, wantErr)
+			}
+			if !cmp.Equal(f.toggleOn, tt.toggleOn, opts...) {
+				t.Errorf("%s(): toggleOn -want +got\n%s",
+					funcname(t, (*voiceSync).syncGuild),
+					cmp.Diff(tt.toggleOn, f.toggleOn))
+			}
+			if !cmp.Equal(f.toggleOff, tt.toggleOff, opts...) {
+				t.Errorf("%s(): toggleOff -want +got\n%s",
+					funcname(t, (*voiceSync).syncGuild),
+					cmp.Diff(tt.toggleOff, f.toggleOff))
+			}
+		})
+	}
+}
+
+type syncMemberTest struct {
+	desc       string
+	inCall     bool
+	hasRole    bool
+	grace      func() *voiceGrace
+	wantToggle *bool
+}
+
+var syncMemberTests = []syncMemberTest{{
+	desc:    "in call with role",
+	inCall:  true,
+	hasRole: true,
+}, {
+	desc:       "role removed by moderator while in call",
+	inCall:     true,
+	hasRole:    false,
+	wantToggle: ptr(true),
+}, {
+	desc:       "role added by moderator outside call",
+	hasRole:    true,
+	wantToggle: ptr(false),
+}, {
+	desc:    "outside call within leave grace",
+	hasRole: true,
+	grace: func() *voiceGrace {
+		return pendingGrace(nil, []snowflake.ID{7})
+	},
+}, {
+	desc: "member not cached",
+}}
+
+func TestVoiceSyncMember(t *testing.T) {
+	for _, tt := range syncMemberTests {
+		t.Run(tt.desc, func(t *testing.T) {
+			t.Parallel()
+			roleMembers, callMembers :=
+				newSet[snowflake.ID](), newSet[snowflake.ID]()
+			if tt.hasRole {
+				roleMembers.Add(7)
+			}
+			if tt.inCall {
+				callMembers.Add(7)
+			}
+			f := newFakeVoice(roleMembers, callMembers)
+			var grace *voiceGrace
+			if tt.grace != nil {
+				grace = tt.grace()
+			}
+
+			err := f.voiceSync(grace).syncMember(t.Context(), testRun, 0, 7)
+
+			if err != nil {
+				t.Errorf("%s(): %v", funcname(t, (*voiceSync).syncMember), err)
+			}
+			var toggled *bool
+			if _, ok := f.toggleOn[7]; ok {
+				toggled = ptr(true)
+			} else if _, ok := f.toggleOff[7]; ok {
+				toggled = ptr(false)
+			}
+			if !cmp.Equal(toggled, tt.wantToggle) {
+				t.Errorf("%s(): toggle -want +got\n%s",
+					funcname(t, (*voiceSync).syncMember),
+					cmp.Diff(tt.wantToggle, toggled))
+			}
+		})
+	}
+}
+
+// listingVoice is a fakeVoice that lists the roles of its guild, and counts
+// how many times it does.
+type listingVoice struct {
+	*fakeVoice
+	lists int
+}
+
+func (f *listingVoice) GuildRoles(snowflake.ID) ([]discord.Role, error) {
+	f.lists++
+	var roles []discord.Role
+	for _, r := range callRoles {
+		roles = append(roles, discord.Role{ID: 1, Name: r.name})
+	}
+	return roles, nil
+}
+
+func TestCallSyncsListRolesOnce(t *testing.T) {
+	f := &listingVoice{fakeVoice: newFakeVoice(
+		newSet[snowflake.ID](), newSet[snowflake.ID](),
+	)}
+	s := f.voiceSync(nil)
+	s.roles = f
+	syncs := newCallSyncs(*s)
+	run := newSyncRun(slog.Default(), 0, triggerManual)
+
+	if err := syncs.syncGuild(t.Context(), run, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := syncs.syncMember(t.Context(), run, 0, 7); err != nil {
+		t.Fatal(err)
+	}
+	if f.lists != 1 {
+		t.Errorf("listed roles %d times in one run, want 1", f.lists)
+	}
+}
+
+// modelGuild is a guild with a single voice role whose state the voice sync
+// under test actually changes, for checking properties over random histories.
+type modelGuild struct {
+	t       *testing.T
+	inCall  set[snowflake.ID]
+	hasRole set[snowflake.ID]
+	failing bool
+
+	clock *fakeClock
+	grace *voiceGrace
+	sync  *voiceSync
+	runs  map[snowflake.ID]int // Toggles per member in the current run.
+}
+
+func newModelGuild(t *testing.T) *modelGuild {
+	m := &modelGuild{
+		t:       t,
+		inCall:  newSet[snowflake.ID](),
+		hasRole: newSet[snowflake.ID](),
+	}
+	m.restart()
+	return m
+}
+
+// restart drops the grace periods and pending timers, as a new process would.
+func (m *modelGuild) restart() {
+	m.clock = new(fakeClock)
+	m.grace = newVoiceGrace(m.clock, time.Minute, 10*time.Second,
+		func(snowflake.ID) { m.syncGuild() })
+	m.sync = &voiceSync{
+		role:    voiceCallRole,
+		roles:   m,
+		mutator: m,
+		holders: m,
+		members: m,
+		clock:   m.clock,
+		grace:   m.grace,
+	}
+}
+
+func (m *modelGuild) FindRole(
+	_ snowflake.ID, name string,
+) (discord.Role, error) {
+	return discord.Role{ID: 1, Name: name}, nil
+}
+
+func (m *modelGuild) SetMemberRole(
+	_ context.Context, _, uid, _ snowflake.ID, enable bool,
+) error {
+	if m.failing {
+		return errors.New("500 Internal Server Error")
+	}
+	m.runs[uid]++
+	if m.runs[uid] > 1 {
+		m.t.Errorf("member %v toggled %d times in one run", uid, m.runs[uid])
+	}
+	if enable {
+		m.hasRole.Add(uid)
+	} else {
+		delete(m.hasRole, uid)
+	}
+	return nil
+}
+
+func (m *modelGuild) RoleMembers(
+	context.Context, snowflake.ID, discord.Role,
+) (set[snowflake.ID], error) {
+	return m.hasRole.Diff(nil), nil
+}
+
+func (m *modelGuild) CallMembers(
+	snowflake.ID, func(callState) bool,
+) set[snowflake.ID] {
+	return m.inCall.Diff(nil)
+}
+
+func (m *modelGuild) MemberVoiceState(
+	_, uid snowflake.ID, _ func(callState) bool, _ discord.Role,
+) (inCall, hasRole, ok bool) {
+	return has(m.inCall, uid), has(m.hasRole, uid), true
+}
+
+func (m *modelGuild) MemberName(_, uid snowflake.ID) string {
+	return uid.String()
+}
+
+func (m *modelGuild) syncGuild() {
+	m.runs = make(map[snowflake.ID]int)
+	// REST failures are expected; the next run retries.
+	_ = m.sync.syncGuild(m.t.Context(), testRun, 0)
+}
+
+func (m *modelGuild) syncMember(uid snowflake.ID) {
+	m.runs = make(map[snowflake.ID]int)
+	_ = m.sync.syncMember(m.t.Context(), testRun, 0, uid)
+}
+
+// fire runs every timer that has not been stopped.
+func (m *modelGuild) fire() {
+	timers := m.clock.timers
+	m.clock.timers = nil
+	for _, t := range timers {
+		if !t.stopped {
+			t.f()
+		}
+	}
+}
+
+// play applies a history encoded as pairs of operation and member bytes,
+// mirroring what the gateway listeners do for each event.
+func (m *modelGuild) play(ops []byte) {
+	for len(ops) >= 2 {
+		op, uid := ops[0]%9, snowflake.ID(ops[1]%8+1)
+		ops = ops[2:]
+		switch op {
+		case 0: // Join.
+			if !has(m.inCall, uid) {
+				m.inCall.Add(uid)
+				m.grace.joined(0, uid)
+				m.syncGuild()
+			}
+		case 1: // Leave.
+			if has(m.inCall, uid) {
+				delete(m.inCall, uid)
+				m.grace.left(0, uid)
+				m.syncGuild()
+			}
+		case 2: // Move between channels.
+			if has(m.inCall, uid) {
+				m.syncMember(uid)
+			}
+		case 3: // A moderator toggles the role.
+			if has(m.hasRole, uid) {
+				delete(m.hasRole, uid)
+			} else {
+				m.hasRole.Add(uid)
+			}
+			m.syncMember(uid)
+		case 4:
+			m.failing = !m.failing
+		case 5:
+			m.restart()
+			m.syncGuild()
+		case 6: // Periodic resync.
+			m.syncGuild()
+		case 7:
+			m.fire()
+		case 8: // The member leaves the guild.
+			delete(m.inCall, uid)
+			delete(m.hasRole, uid)
+			m.grace.forget(0, uid)
+		}
+	}
+}
+
+// checkConverges plays ops, then lets grace periods run out and REST recover,
+// and checks that a final reconciliation gives the role to exactly the
+// members in a call.
+func checkConverges(t *testing.T, ops []byte) {
+	t.Helper()
+	m := newModelGuild(t)
+	m.play(ops)
+	m.failing = false
+	m.fire()
+	m.syncGuild()
+	if !cmp.Equal(m.hasRole, m.inCall, cmpopts.EquateEmpty()) {
+		t.Errorf("after %v: -call members +role holders\n%s",
+			ops, cmp.Diff(m.inCall, m.hasRole, cmpopts.EquateEmpty()))
+	}
+}
+
+func FuzzVoiceSync(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{0, 1, 1, 1})                   // Join, leave.
+	f.Add([]byte{0, 1, 7, 0, 1, 1, 0, 1, 7, 0}) // Leave and return.
+	f.Add([]byte{4, 0, 0, 1, 0, 2, 4, 0, 6, 0}) // REST outage.
+	f.Add([]byte{0, 1, 1, 1, 5, 0, 3, 2})       // Restart, moderator.
+	f.Fuzz(checkConverges)
+}
+
+func TestVoiceSyncModel(t *testing.T) {
+	t.Parallel()
+	for seed := range uint64(500) {
+		r := rand.New(rand.NewPCG(seed, 0))
+		ops := make([]byte, 2*r.IntN(40))
+		for i := range ops {
+			ops[i] = byte(r.Uint32())
+		}
+		checkConverges(t, ops)
+	}
+}
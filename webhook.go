@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/disgoorg/snowflake/v2"
+)
+
+// webhookEvent is the body of a webhook delivery.
+type webhookEvent struct {
+	ID           string        `json:"id"` // The same for every attempt.
+	Type         string        `json:"type"`
+	Time         time.Time     `json:"time"`
+	GuildID      snowflake.ID  `json:"guild_id"`
+	UserID       snowflake.ID  `json:"user_id"`
+	ChannelID    *snowflake.ID `json:"channel_id,omitempty"`
+	OldChannelID *snowflake.ID `json:"old_channel_id,omitempty"`
+	RoleID       *snowflake.ID `json:"role_id,omitempty"`
+}
+
+// Webhook event types.
+const (
+	webhookVoiceJoin  = "voice.join"
+	webhookVoiceMove  = "voice.move"
+	webhookVoiceLeave = "voice.leave"
+	webhookRoleAdd    = "role.add"
+	webhookRoleRemove = "role.remove"
+)
+
+// webhookDelivery is an event on its way to a URL.
+type webhookDelivery struct {
+	ID       string          `json:"id"`
+	URL      string          `json:"url"`
+	Type     string          `json:"type"`
+	Body     json.RawMessage `json:"body"`
+	Attempts int             `json:"attempts"`
+	Next     time.Time       `json:"next"` // When to attempt it next.
+}
+
+// webhookResult is how a delivery ended.
+type webhookResult struct {
+	webhookDelivery
+	Done   time.Time `json:"done"`
+	Status int       `json:"status,omitempty"` // Of the last attempt.
+	Error  string    `json:"error,omitempty"`  // Empty if delivered.
+}
+
+const (
+	webhookMaxAttempts = 8
+	webhookLogSize     = 100
+	webhookTimeout     = 10 * time.Second
+)
+
+// webhookBackoff returns how long to wait after a delivery has failed
+// attempts times: 10s, doubling up to an hour.
+func webhookBackoff(attempts int) time.Duration {
+	return min(10*time.Second<<min(attempts-1, 9), time.Hour)
+}
+
+// webhookSignature signs body with secret. Receivers compare it to the
+// X-Webhook-Signature header.
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookSender posts signed deliveries.
+type webhookSender struct {
+	client *http.Client
+	secret string
+}
+
+// send attempts d once. A response other than 2xx is an error.
+func (s webhookSender) send(d *webhookDelivery) (status int, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.URL,
+		bytes.NewReader(d.Body))
+	if err != nil {
+		return 0, fmt.Errorf("could not build request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "labs.lesiw.io/discord")
+	req.Header.Set("X-Webhook-ID", d.ID)
+	req.Header.Set("X-Webhook-Event", d.Type)
+	req.Header.Set("X-Webhook-Signature", webhookSignature(s.secret, d.Body))
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("could not post: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode/100 != 2 {
+		return resp.StatusCode, fmt.Errorf("got status %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// webhookQueue delivers events to every webhook URL, retrying failed
+// deliveries with backoff until they succeed or run out of attempts.
+//
+// Pending deliveries and a log of finished ones are saved to a file after
+// every change, when one is set, so that deliveries survive restarts.
+// Deliveries are made one at a time, from timers.
+type webhookQueue struct {
+	clock  clock
+	sender webhookSender
+	urls   []string
+	path   string // Empty keeps the queue in memory.
+	logger *slog.Logger
+
+	mu       sync.Mutex
+	pending  []*webhookDelivery
+	log      []webhookResult // Oldest first.
+	timer    stopper
+	sending  bool
+	stopped  bool
+	inflight sync.WaitGroup
+}
+
+// webhookState is what webhookQueue saves.
+type webhookState struct {
+	Pending []*webhookDelivery `json:"pending"`
+	Log     []webhookResult    `json:"log"`
+}
+
+// newWebhookQueue returns a queue delivering to urls, restoring the
+// deliveries saved at path, and logging to log.
+func newWebhookQueue(
+	c clock, sender webhookSender, urls []string, path string,
+	log *slog.Logger,
+) (*webhookQueue, error) {
+	q := &webhookQueue{
+		clock:  c,
+		sender: sender,
+		urls:   urls,
+		path:   path,
+		logger: log,
+	}
+	if path == "" {
+		return q, nil
+	}
+	st, err := loadWebhookState(path)
+	if err != nil {
+		return nil, err
+	}
+	q.pending, q.log = st.Pending, st.Log
+	if len(q.pending) > 0 {
+		q.logger.Info("restored webhook deliveries", "pending", len(q.pending))
+	}
+	q.mu.Lock()
+	q.scheduleLocked()
+	q.mu.Unlock()
+	return q, nil
+}
+
+// loadWebhookState reads the deliveries saved at path. A missing file holds
+// none.
+func loadWebhookState(path string) (webhookState, error) {
+	var st webhookState
+	buf, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return st, nil
+	} else if err != nil {
+		return st, fmt.Errorf("could not read webhook queue: %w", err)
+	}
+	if err := json.Unmarshal(buf, &st); err != nil {
+		return st, fmt.Errorf("could not decode webhook queue: %w", err)
+	}
+	return st, nil
+}
+
+// send queues e for every URL.
+func (q *webhookQueue) send(e webhookEvent) {
+	e.ID = rand.Text()
+	e.Time = q.clock.Now().UTC()
+	body, _ := json.Marshal(e) // Plain structs always marshal.
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.stopped {
+		return
+	}
+	for _, url := range q.urls {
+		q.pending = append(q.pending, &webhookDelivery{
+			ID:   e.ID,
+			URL:  url,
+			Type: e.Type,
+			Body: body,
+			Next: e.Time,
+		})
+	}
+	q.saveLocked()
+	q.scheduleLocked()
+}
+
+// scheduleLocked sets the timer for the next delivery due.
+func (q *webhookQueue) scheduleLocked() {
+	if q.timer != nil {
+		q.timer.Stop()
+		q.timer = nil
+	}
+	if q.stopped || q.sending || len(q.pending) == 0 {
+		return
+	}
+	next := q.pending[0].Next
+	for _, d := range q.pending[1:] {
+		if d.Next.Before(next) {
+			next = d.Next
+		}
+	}
+	q.timer = q.clock.AfterFunc(max(0, next.Sub(q.clock.Now())), q.deliver)
+}
+
+// deliver attempts the deliveries that are due.
+func (q *webhookQueue) deliver() {
+	q.mu.Lock()
+	if q.stopped || q.sending {
+		q.mu.Unlock()
+		return
+	}
+	q.timer, q.sending = nil, true
+	var due []*webhookDelivery
+	now := q.clock.Now()
+	for _, d := range q.pending {
+		if !d.Next.After(now) {
+			due = append(due, d)
+		}
+	}
+	q.inflight.Add(1)
+	q.mu.Unlock()
+	defer q.inflight.Done()
+
+	for _, d := range due {
+		status, err := q.sender.send(d)
+		q.mu.Lock()
+		q.attemptedLocked(d, status, err)
+		stopped := q.stopped
+		q.mu.Unlock()
+		if stopped {
+			break
+		}
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.sending = false
+	q.saveLocked()
+	q.scheduleLocked()
+}
+
+// attemptedLocked records an attempt at d.
+func (q *webhookQueue) attemptedLocked(
+	d *webhookDelivery, status int, err error,
+) {
+	d.Attempts++
+	log := q.logger.With("id", d.ID, "url", d.URL, "type", d.Type,
+		"attempt", d.Attempts)
+	now := q.clock.Now()
+	if err != nil && d.Attempts < webhookMaxAttempts {
+		d.Next = now.Add(webhookBackoff(d.Attempts))
+		log.Warn("failed to deliver webhook, will retry",
+			"status", status, "error", err, "retry", d.Next)
+		return
+	}
+	r := webhookResult{webhookDelivery: *d, Done: now, Status: status}
+	if err != nil {
+		r.Error = err.Error()
+		log.Error("gave up delivering webhook", "status", status, "error", err)
+	} else {
+		log.Info("delivered webhook", "status", status)
+	}
+	for i, p := range q.pending {
+		if p == d {
+			q.pending = append(q.pending[:i], q.pending[i+1:]...)
+			break
+		}
+	}
+	q.log = append(q.log, r)
+	if n := len(q.log) - webhookLogSize; n > 0 {
+		q.log = q.log[n:]
+	}
+}
+
+// saveLocked writes the queue to its file, if it has one.
+func (q *webhookQueue) saveLocked() {
+	if q.path == "" {
+		return
+	}
+	st := webhookState{Pending: q.pending, Log: q.log}
+	if err := saveWebhookState(q.path, st); err != nil {
+		q.logger.Error("failed to save webhook queue", "error", err)
+	}
+}
+
+func saveWebhookState(path string, st webhookState) error {
+	buf, err := json.Marshal(st)
+	if err != nil {
+		return fmt.Errorf("could not encode webhook queue: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".webhooks-*")
+	if err != nil {
+		return fmt.Errorf("could not save webhook queue: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(buf)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("could not save webhook queue: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("could not save webhook queue: %w", err)
+	}
+	return nil
+}
+
+// stop cancels pending attempts and waits for the one being made. Pending
+// deliveries stay saved for the next start.
+func (q *webhookQueue) stop() {
+	q.mu.Lock()
+	q.stopped = true
+	if q.timer != nil {
+		q.timer.Stop()
+		q.timer = nil
+	}
+	q.mu.Unlock()
+	q.inflight.Wait()
+	q.mu.Lock()
+	q.saveLocked()
+	q.mu.Unlock()
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/disgoorg/snowflake/v2"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+const testWebhookSecret = "s3cret"
+
+// webhookReceiver is an HTTP server that checks the signature of webhook
+// deliveries and records their events.
+type webhookReceiver struct {
+	t   testing.TB
+	url string
+
+	mu      sync.Mutex
+	status  []int // Answered in turn; 200 once used up.
+	events  []webhookEvent
+	changed chan struct{}
+}
+
+func newWebhookReceiver(t testing.TB, status ...int) *webhookReceiver {
+	r := &webhookReceiver{t: t, status: status,
+		changed: make(chan struct{}, 1)}
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+	r.url = srv.URL
+	return r
+}
+
+func (r *webhookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sig := req.Header.Get("X-Webhook-Signature")
+	if want := webhookSignature(testWebhookSecret, body); sig != want {
+		r.t.Errorf("signature %q, want %q", sig, want)
+		http.Error(w, "bad signature", http.StatusUnauthorized)
+		return
+	}
+	var e webhookEvent
+	if err := json.Unmarshal(body, &e); err != nil {
+		r.t.Errorf("%v: %s", err, body)
+		return
+	}
+	if id := req.Header.Get("X-Webhook-ID"); id != e.ID {
+		r.t.Errorf("X-Webhook-ID %q, want %q", id, e.ID)
+	}
+	r.mu.Lock()
+	status := http.StatusOK
+	if len(r.status) > 0 {
+		status, r.status = r.status[0], r.status[1:]
+	}
+	if status == http.StatusOK {
+		r.events = append(r.events, e)
+	}
+	r.mu.Unlock()
+	select {
+	case r.changed <- struct{}{}:
+	default:
+	}
+	w.WriteHeader(status)
+}
+
+// types returns the types of the events received.
+func (r *webhookReceiver) types() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var types []string
+	for _, e := range r.events {
+		types = append(types, e.Type)
+	}
+	return types
+}
+
+// wait waits until at least n events have been received and returns them.
+func (r *webhookReceiver) wait(n int) []webhookEvent {
+	r.t.Helper()
+	timeout := time.After(10 * time.Second)
+	for {
+		r.mu.Lock()
+		got := slices.Clone(r.events)
+		r.mu.Unlock()
+		if len(got) >= n {
+			return got
+		}
+		select {
+		case <-r.changed:
+		case <-timeout:
+			r.t.Fatalf("timed out waiting for %d webhooks, got %v", n, got)
+		}
+	}
+}
+
+// fireDue runs the timers of clk that are set, but not those they set: a
+// queue reschedules itself after every attempt.
+func fireDue(clk *fakeClock) {
+	for _, t := range slices.Clone(clk.timers) {
+		if !t.stopped {
+			t.stopped = true
+			t.f()
+		}
+	}
+}
+
+func fakeWebhooks(
+	t *testing.T, path string, urls ...string,
+) (*webhookQueue, *fakeClock) {
+	clk := &fakeClock{now: time.Date(2026, 1, 1, 20, 0, 0, 0, time.UTC)}
+	q, err := newWebhookQueue(clk,
+		webhookSender{http.DefaultClient, testWebhookSecret}, urls, path,
+		slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q, clk
+}
+
+func TestWebhookQueueDelivers(t *testing.T) {
+	a, b := newWebhookReceiver(t), newWebhookReceiver(t)
+	q, clk := fakeWebhooks(t, "", a.url, b.url+"/hook")
+	q.send(webhookEvent{
+		Type: webhookVoiceJoin, GuildID: 1, UserID: 10,
+		ChannelID: ptr[snowflake.ID](3),
+	})
+	fireDue(clk)
+
+	want := []webhookEvent{{
+		Type: webhookVoiceJoin, Time: clk.now, GuildID: 1, UserID: 10,
+		ChannelID: ptr[snowflake.ID](3),
+	}}
+	ignoreID := cmpopts.IgnoreFields(webhookEvent{}, "ID")
+	for _, r := range []*webhookReceiver{a, b} {
+		if got := r.wait(1); !cmp.Equal(got, want, ignoreID) {
+			t.Errorf("%s got -want +got\n%s",
+				r.url, cmp.Diff(want, got, ignoreID))
+		}
+	}
+	if a.events[0].ID != b.events[0].ID {
+		t.Errorf("event IDs differ by URL: %q, %q",
+			a.events[0].ID, b.events[0].ID)
+	}
+	if len(q.pending) != 0 || len(q.log) != 2 {
+		t.Errorf("%d pending and %d logged, want 0 and 2",
+			len(q.pending), len(q.log))
+	}
+}
+
+func TestWebhookQueueRetries(t *testing.T) {
+	r := newWebhookReceiver(t, http.StatusInternalServerError,
+		http.StatusBadGateway)
+	q, clk := fakeWebhooks(t, "", r.url)
+	q.send(webhookEvent{Type: webhookVoiceLeave, GuildID: 1, UserID: 10})
+	for range 3 {
+		fireDue(clk)
+		clk.now = clk.now.Add(time.Hour)
+	}
+
+	var waits []time.Duration
+	for _, timer := range clk.timers {
+		waits = append(waits, timer.d)
+	}
+	want := []time.Duration{0, 10 * time.Second, 20 * time.Second}
+	if !cmp.Equal(waits, want) {
+		t.Errorf("waits %v, want %v", waits, want)
+	}
+	if got := r.types(); !cmp.Equal(got, []string{webhookVoiceLeave}) {
+		t.Errorf("received %v, want one %s", got, webhookVoiceLeave)
+	}
+	if len(q.log) != 1 || q.log[0].Attempts != 3 || q.log[0].Error != "" {
+		t.Errorf("log = %+v, want a delivery after 3 attempts", q.log)
+	}
+}
+
+func TestWebhookQueueGivesUp(t *testing.T) {
+	status := slices.Repeat([]int{http.StatusInternalServerError},
+		webhookMaxAttempts)
+	r := newWebhookReceiver(t, status...)
+	q, clk := fakeWebhooks(t, "", r.url)
+	q.send(webhookEvent{Type: webhookVoiceLeave, GuildID: 1, UserID: 10})
+	for range webhookMaxAttempts + 1 {
+		fireDue(clk)
+		clk.now = clk.now.Add(time.Hour)
+	}
+
+	if len(q.pending) != 0 {
+		t.Errorf("%d deliveries still pending", len(q.pending))
+	}
+	if len(q.log) != 1 || q.log[0].Status != http.StatusInternalServerError ||
+		!strings.Contains(q.log[0].Error, "500") {
+		t.Errorf("log = %+v, want a failure with status 500", q.log)
+	}
+}
+
+func TestWebhookQueueRestores(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "webhooks.json")
+	r := newWebhookReceiver(t, http.StatusServiceUnavailable)
+	q, clk := fakeWebhooks(t, path, r.url)
+	q.send(webhookEvent{Type: webhookRoleAdd, GuildID: 1, UserID: 10})
+	fireDue(clk)
+	q.stop()
+
+	q, clk = fakeWebhooks(t, path, r.url)
+	if len(q.pending) != 1 {
+		t.Fatalf("%d deliveries restored, want 1", len(q.pending))
+	}
+	clk.now = clk.now.Add(time.Minute)
+	fireDue(clk)
+	if got := r.types(); !cmp.Equal(got, []string{webhookRoleAdd}) {
+		t.Errorf("received %v, want one %s", got, webhookRoleAdd)
+	}
+	q.stop()
+	st, err := loadWebhookState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(st.Pending) != 0 || len(st.Log) != 1 {
+		t.Errorf("saved %d pending and %d logged, want 0 and 1",
+			len(st.Pending), len(st.Log))
+	}
+}
+
+func TestCLIWebhooks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "webhooks.json")
+	r := newWebhookReceiver(t)
+	q, clk := fakeWebhooks(t, path, r.url)
+	q.send(webhookEvent{Type: webhookVoiceJoin, GuildID: 1, UserID: 10})
+	fireDue(clk)
+	q.stop()
+	id := r.wait(1)[0].ID
+	env := map[string]string{
+		"DISCORD_WEBHOOK_URLS":   r.url,
+		"DISCORD_WEBHOOK_SECRET": testWebhookSecret,
+		"DISCORD_WEBHOOK_FILE":   path,
+	}
+
+	c, out := testCLI(nil, env)
+	if err := c.run(t.Context(), []string{"webhooks", "log"}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), id+"  voice.join") ||
+		!strings.Contains(out.String(), "delivered") {
+		t.Errorf("webhooks log printed %q, want %s delivered", out, id)
+	}
+
+	c, out = testCLI(nil, env)
+	err := c.run(t.Context(), []string{"webhooks", "replay", id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "replayed " + id + " to " + r.url + ": 200\n"
+	if out.String() != want {
+		t.Errorf("webhooks replay printed %q, want %q", out, want)
+	}
+	if got := r.wait(2); got[1].ID != id {
+		t.Errorf("replayed event %q, want %q", got[1].ID, id)
+	}
+
+	c, _ = testCLI(nil, env)
+	err = c.run(t.Context(), []string{"webhooks", "replay", "nope"})
+	if want := `no webhook delivery "nope"`; err == nil || err.Error() != want {
+		t.Errorf("replay of unknown delivery: %v, want %s", err, want)
+	}
+}
+
+func TestRunWebhooks(t *testing.T) {
+	const (
+		guildID   snowflake.ID = 1
+		roleID    snowflake.ID = 2
+		channelID snowflake.ID = 3
+		alice     snowflake.ID = 10
+	)
+	r := newWebhookReceiver(t)
+	f := newFakeDiscord(t, guildID)
+	f.addVoiceChannel(channelID, "General")
+	f.addRole(roleID, "voice")
+	f.addMember(alice, "alice")
+	runFakeConfig(t, f, &config{
+		token:   fakeToken,
+		leader:  leaderConfig{ttl: 15 * time.Second},
+		modules: map[string][]snowflake.ID{"voice": nil, "webhooks": nil},
+		webhooks: webhookConfig{
+			urls: []string{r.url}, secret: testWebhookSecret,
+		},
+	})
+	f.waitIdentified()
+	f.setVoice(alice, ptr(channelID))
+
+	// The voice role follows the join.
+	got := r.wait(2)
+	want := []webhookEvent{{
+		Type: webhookVoiceJoin, GuildID: guildID, UserID: alice,
+		ChannelID: ptr(channelID),
+	}, {
+		Type: webhookRoleAdd, GuildID: guildID, UserID: alice,
+		RoleID: ptr(roleID),
+	}}
+	ignore := cmpopts.IgnoreFields(webhookEvent{}, "ID", "Time")
+	if !cmp.Equal(got, want, ignore) {
+		t.Errorf("webhooks -want +got\n%s", cmp.Diff(want, got, ignore))
+	}
+}
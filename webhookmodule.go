@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	disgobot "github.com/disgoorg/disgo/bot"
+	"github.com/disgoorg/disgo/cache"
+	"github.com/disgoorg/disgo/events"
+	"github.com/disgoorg/disgo/gateway"
+	"github.com/disgoorg/snowflake/v2"
+)
+
+// webhookModule sends voice and role changes to webhooks.
+type webhookModule struct {
+	cfg *config
+
+	// Set by Start.
+	queue   *webhookQueue
+	enabled func(gid snowflake.ID) bool
+	leading func() bool
+}
+
+func newWebhookModule(cfg *config) module {
+	return &webhookModule{cfg: cfg}
+}
+
+func (*webhookModule) Name() string { return "webhooks" }
+
+func (*webhookModule) Intents() gateway.Intents {
+	return gateway.IntentGuildMembers | gateway.IntentGuildVoiceStates
+}
+
+// Caches keeps members and voice states, which hold the roles and channels
+// changes are told apart from.
+func (*webhookModule) Caches() cache.Flags {
+	return cache.FlagMembers | cache.FlagVoiceStates
+}
+
+func (*webhookModule) Degraded(missing gateway.Intents) string {
+	if missing.Has(gateway.IntentGuildMembers) {
+		return "role changes are not sent to webhooks"
+	}
+	return ""
+}
+
+func (*webhookModule) Commands() []command { return nil }
+
+func (m *webhookModule) Start(_ context.Context, env moduleEnv) error {
+	wc := m.cfg.webhooks
+	if len(wc.urls) == 0 {
+		return nil
+	}
+	q, err := newWebhookQueue(systemClock{},
+		webhookSender{http.DefaultClient, wc.secret}, wc.urls, wc.file,
+		env.log)
+	if err != nil {
+		return err
+	}
+	m.queue, m.enabled, m.leading = q, env.enabled, env.leading
+	return nil
+}
+
+func (m *webhookModule) Listeners() []disgobot.EventListener {
+	if m.queue == nil {
+		return nil
+	}
+	return []disgobot.EventListener{
+		disgobot.NewListenerFunc(func(e *events.GuildVoiceJoin) {
+			m.send(webhookEvent{
+				Type:      webhookVoiceJoin,
+				GuildID:   e.VoiceState.GuildID,
+				UserID:    e.VoiceState.UserID,
+				ChannelID: e.VoiceState.ChannelID,
+			})
+		}),
+		disgobot.NewListenerFunc(func(e *events.GuildVoiceMove) {
+			m.send(webhookEvent{
+				Type:         webhookVoiceMove,
+				GuildID:      e.VoiceState.GuildID,
+				UserID:       e.VoiceState.UserID,
+				ChannelID:    e.VoiceState.ChannelID,
+				OldChannelID: e.OldVoiceState.ChannelID,
+			})
+		}),
+		disgobot.NewListenerFunc(func(e *events.GuildVoiceLeave) {
+			m.send(webhookEvent{
+				Type:         webhookVoiceLeave,
+				GuildID:      e.VoiceState.GuildID,
+				UserID:       e.VoiceState.UserID,
+				OldChannelID: e.OldVoiceState.ChannelID,
+			})
+		}),
+		disgobot.NewListenerFunc(func(e *events.GuildMemberUpdate) {
+			// Without the member as it was, there is nothing to compare.
+			if e.OldMember.User.ID == 0 {
+				return
+			}
+			old := newSet(e.OldMember.RoleIDs...)
+			roles := newSet(e.Member.RoleIDs...)
+			for _, diff := range []struct {
+				typ string
+				ids set[snowflake.ID]
+			}{
+				{webhookRoleAdd, roles.Diff(old)},
+				{webhookRoleRemove, old.Diff(roles)},
+			} {
+				for rid := range diff.ids {
+					m.send(webhookEvent{
+						Type:    diff.typ,
+						GuildID: e.GuildID,
+						UserID:  e.Member.User.ID,
+						RoleID:  &rid,
+					})
+				}
+			}
+		}),
+	}
+}
+
+// send queues e if this replica leads and the module is on in its guild.
+func (m *webhookModule) send(e webhookEvent) {
+	if m.enabled(e.GuildID) && m.leading() {
+		m.queue.send(e)
+	}
+}
+
+func (m *webhookModule) Stop() {
+	if m.queue != nil {
+		m.queue.stop()
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+
+	"github.com/disgoorg/snowflake/v2"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// guildWorkers runs one sync loop per guild. Triggers are coalesced: a guild
+// that is already due for a sync does not queue another, and members queued
+// for a targeted sync are folded into a pending full sync.
+type guildWorkers struct {
+	ctx context.Context
+	// sync reconciles members of gid, or the whole guild if members is nil.
+	// trigger is why, like triggerEvent.
+	sync func(
+		ctx context.Context, gid snowflake.ID, members set[snowflake.ID],
+		trigger string,
+	)
+
+	mu      sync.Mutex
+	workers map[snowflake.ID]*guildWorker
+	wg      sync.WaitGroup
+}
+
+type guildWorker struct {
+	shardID int
+	trigger chan struct{}
+	cancel  context.CancelFunc
+
+	mu      sync.Mutex
+	full    bool
+	members set[snowflake.ID]
+	cause   syncCause // Of the pending sync.
+}
+
+// syncCause is why a sync runs.
+type syncCause struct {
+	reason string            // Like triggerEvent.
+	parent trace.SpanContext // Of the event behind the sync, if any.
+}
+
+func newGuildWorkers(
+	ctx context.Context,
+	sync func(context.Context, snowflake.ID, set[snowflake.ID], string),
+) *guildWorkers {
+	return &guildWorkers{
+		ctx:     ctx,
+		sync:    sync,
+		workers: make(map[snowflake.ID]*guildWorker),
+	}
+}
+
+// start launches the worker for gid on shardID, if it is not already running.
+func (w *guildWorkers) start(shardID int, gid snowflake.ID) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.workers[gid]; ok {
+		return
+	}
+	ctx, cancel := context.WithCancel(w.ctx)
+	gw := &guildWorker{
+		shardID: shardID,
+		trigger: make(chan struct{}, 1),
+		cancel:  cancel,
+		full:    true,
+		members: newSet[snowflake.ID](),
+		cause:   syncCause{reason: triggerStart},
+	}
+	w.workers[gid] = gw
+	slog.Info("starting guild worker", "guild", gid, "shard", shardID)
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-gw.trigger:
+				full, members, cause := gw.take()
+				sctx := ctx
+				if cause.parent.IsValid() {
+					sctx = trace.ContextWithSpanContext(ctx, cause.parent)
+				}
+				if full {
+					w.sync(sctx, gid, nil, cause.reason)
+				} else if len(members) > 0 {
+					w.sync(sctx, gid, members, cause.reason)
+				}
+			}
+		}
+	}()
+	gw.trigger <- struct{}{}
+}
+
+// stop halts the worker for gid.
+func (w *guildWorkers) stop(gid snowflake.ID) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if gw, ok := w.workers[gid]; ok {
+		gw.cancel()
+		delete(w.workers, gid)
+		slog.Info("stopped guild worker", "guild", gid, "shard", gw.shardID)
+	}
+}
+
+// wait blocks until every worker has stopped, letting in-flight syncs finish.
+// Workers stop when the context passed to newGuildWorkers is done.
+func (w *guildWorkers) wait() {
+	w.wg.Wait()
+}
+
+// trigger schedules a sync for gid after the event whose span is in ctx. It
+// is a no-op for unknown guilds.
+func (w *guildWorkers) trigger(ctx context.Context, gid snowflake.ID) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if gw, ok := w.workers[gid]; ok {
+		gw.poke(nil, eventCause(ctx))
+	}
+}
+
+// triggerFor schedules a sync for gid, for the reason given.
+func (w *guildWorkers) triggerFor(gid snowflake.ID, reason string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if gw, ok := w.workers[gid]; ok {
+		gw.poke(nil, syncCause{reason: reason})
+	}
+}
+
+// triggerMember schedules a sync of a single member of gid after the event
+// whose span is in ctx.
+func (w *guildWorkers) triggerMember(
+	ctx context.Context, gid, uid snowflake.ID,
+) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if gw, ok := w.workers[gid]; ok {
+		gw.poke(&uid, eventCause(ctx))
+	}
+}
+
+// triggerAll schedules a sync for every guild, for the reason given.
+func (w *guildWorkers) triggerAll(reason string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, gw := range w.workers {
+		gw.poke(nil, syncCause{reason: reason})
+	}
+}
+
+func eventCause(ctx context.Context) syncCause {
+	return syncCause{
+		reason: triggerEvent,
+		parent: trace.SpanContextFromContext(ctx),
+	}
+}
+
+// poke queues a sync of uid, or of the whole guild if uid is nil. A full
+// sync keeps the cause it was first queued for; member syncs keep the cause
+// of the first member.
+func (gw *guildWorker) poke(uid *snowflake.ID, cause syncCause) {
+	gw.mu.Lock()
+	if uid == nil {
+		if !gw.full {
+			gw.cause = cause
+		}
+		gw.full = true
+	} else {
+		gw.members.Add(*uid)
+		if gw.cause.reason == "" {
+			gw.cause = cause
+		}
+	}
+	gw.mu.Unlock()
+	select {
+	case gw.trigger <- struct{}{}:
+	default:
+	}
+}
+
+func (gw *guildWorker) take() (
+	full bool, members set[snowflake.ID], cause syncCause,
+) {
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+	full, members, cause = gw.full, gw.members, gw.cause
+	gw.full, gw.members, gw.cause = false, newSet[snowflake.ID](), syncCause{}
+	return full, members, cause
+}
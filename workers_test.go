@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/disgoorg/snowflake/v2"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+type workerSync struct {
+	gid     snowflake.ID
+	members set[snowflake.ID]
+	trigger string
+}
+
+func TestGuildWorkers(t *testing.T) {
+	syncs := make(chan workerSync)
+	release := make(chan struct{})
+	w := newGuildWorkers(t.Context(),
+		func(
+			_ context.Context, gid snowflake.ID, m set[snowflake.ID],
+			trigger string,
+		) {
+			syncs <- workerSync{gid, m, trigger}
+			<-release
+		},
+	)
+	next := func() workerSync {
+		t.Helper()
+		select {
+		case s := <-syncs:
+			return s
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for sync")
+			return workerSync{}
+		}
+	}
+	opts := []cmp.Option{
+		cmp.AllowUnexported(workerSync{}),
+		cmpopts.SortMaps(func(x, y snowflake.ID) bool { return x < y }),
+	}
+
+	w.trigger(t.Context(), 1) // Unknown guild.
+	w.start(0, 1)
+	want := workerSync{gid: 1, trigger: triggerStart}
+	if got := next(); !cmp.Equal(got, want, opts...) {
+		t.Errorf("initial sync -want +got\n%s", cmp.Diff(want, got, opts...))
+	}
+
+	// While the first sync runs, targeted syncs are coalesced.
+	w.triggerMember(t.Context(), 1, 10)
+	w.triggerMember(t.Context(), 1, 11)
+	w.triggerMember(t.Context(), 1, 10)
+	release <- struct{}{}
+	want = workerSync{
+		gid:     1,
+		members: newSet[snowflake.ID](10, 11),
+		trigger: triggerEvent,
+	}
+	if got := next(); !cmp.Equal(got, want, opts...) {
+		t.Errorf("member sync -want +got\n%s", cmp.Diff(want, got, opts...))
+	}
+
+	// A full sync absorbs pending member syncs.
+	w.triggerMember(t.Context(), 1, 12)
+	w.triggerAll(triggerTicker)
+	release <- struct{}{}
+	want = workerSync{gid: 1, trigger: triggerTicker}
+	if got := next(); !cmp.Equal(got, want, opts...) {
+		t.Errorf("full sync -want +got\n%s", cmp.Diff(want, got, opts...))
+	}
+	w.stop(1)
+	close(release)
+}